@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/nochzato/hush/internal/agent"
+	"github.com/nochzato/hush/internal/hushcore"
+	"github.com/urfave/cli/v2"
+)
+
+// agentStartTimeout is how long "hush agent" waits for the agent it started
+// in the background to answer.
+const agentStartTimeout = 5 * time.Second
+
+func agentCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "agent",
+		Usage: "Start the agent that keeps unlocked vaults unlocked for a while",
+		Description: "The agent listens on a Unix socket, $HUSH_AGENT_SOCK by default. Every command that unlocks a vault " +
+			"with the master password hands its key to the agent, and later commands use it instead of prompting. " +
+			"Keys are forgotten after the idle timeout, after the maximum lifetime or on 'hush lock'.",
+		Flags: []cli.Flag{
+			&cli.DurationFlag{
+				Name:  "idle-timeout",
+				Value: agent.DefaultIdleTimeout,
+				Usage: "Forget a vault key that has not been used for this long",
+			},
+			&cli.DurationFlag{
+				Name:  "max-lifetime",
+				Value: agent.DefaultMaxLifetime,
+				Usage: "Forget a vault key this long after it was unlocked, even if it is in use",
+			},
+			&cli.BoolFlag{
+				Name:  "foreground",
+				Usage: "Run the agent in the foreground instead of in the background",
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			idleTimeout, maxLifetime := ctx.Duration("idle-timeout"), ctx.Duration("max-lifetime")
+			if idleTimeout <= 0 || maxLifetime <= 0 {
+				return fmt.Errorf("timeouts must be positive")
+			}
+
+			path := agent.SocketPath()
+			if ctx.Bool("foreground") {
+				return runAgent(path, idleTimeout, maxLifetime)
+			}
+
+			if _, err := agent.Status(path); err == nil {
+				return fmt.Errorf("%w on %s", agent.ErrAlreadyRunning, path)
+			}
+
+			pid, err := startAgent(idleTimeout, maxLifetime)
+			if err != nil {
+				return fmt.Errorf("failed to start agent: %w", err)
+			}
+
+			fmt.Printf("hush agent started (pid %d), listening on %s\n", pid, path)
+			return nil
+		},
+		Subcommands: []*cli.Command{
+			{
+				Name:  "status",
+				Usage: "Show whether the agent runs and which vaults it holds unlocked",
+				Action: func(ctx *cli.Context) error {
+					path := agent.SocketPath()
+					vaults, err := agent.Status(path)
+					if errors.Is(err, agent.ErrNotRunning) {
+						fmt.Println("hush agent is not running.")
+						return nil
+					}
+					if err != nil {
+						return err
+					}
+
+					fmt.Printf("hush agent is running on %s\n", path)
+					if len(vaults) == 0 {
+						fmt.Println("No vaults are unlocked.")
+						return nil
+					}
+
+					current, _ := hushcore.VaultID()
+					for _, v := range vaults {
+						marker := ""
+						if v.Vault == current {
+							marker = " (current vault)"
+						}
+						fmt.Printf("  %s%s: unlocked until %s\n", v.Vault, marker, v.Expires.Local().Format(time.DateTime))
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "stop",
+				Usage: "Stop the agent, forgetting every key",
+				Action: func(ctx *cli.Context) error {
+					err := agent.Stop(agent.SocketPath())
+					if errors.Is(err, agent.ErrNotRunning) {
+						fmt.Println("hush agent is not running.")
+						return nil
+					}
+					if err != nil {
+						return fmt.Errorf("failed to stop agent: %w", err)
+					}
+
+					fmt.Println("hush agent stopped.")
+					return nil
+				},
+			},
+		},
+	}
+}
+
+func lockCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "lock",
+		Usage: "Make the agent forget every vault key",
+		Action: func(ctx *cli.Context) error {
+			err := agent.Lock(agent.SocketPath(), "")
+			if errors.Is(err, agent.ErrNotRunning) {
+				fmt.Println("hush agent is not running; nothing to lock.")
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("failed to lock vaults: %w", err)
+			}
+
+			fmt.Println("All vaults locked.")
+			return nil
+		},
+	}
+}
+
+func runAgent(path string, idleTimeout, maxLifetime time.Duration) error {
+	l, err := agent.Listen(path)
+	if err != nil {
+		return err
+	}
+
+	server := agent.NewServer(idleTimeout, maxLifetime)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		server.Stop()
+	}()
+
+	fmt.Printf("hush agent listening on %s\n", path)
+	return server.Serve(l)
+}
+
+// startAgent runs the agent in a background process of its own and waits
+// until it answers.
+func startAgent(idleTimeout, maxLifetime time.Duration) (int, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	cmd := exec.Command(executable, "agent", "--foreground",
+		"--idle-timeout", idleTimeout.String(), "--max-lifetime", maxLifetime.String())
+	if err := detach(cmd); err != nil {
+		return 0, fmt.Errorf("%w; use --foreground", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	pid := cmd.Process.Pid
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	deadline := time.Now().Add(agentStartTimeout)
+	for time.Now().Before(deadline) {
+		if _, err := agent.Status(agent.SocketPath()); err == nil {
+			return pid, nil
+		}
+
+		select {
+		case err := <-exited:
+			return 0, fmt.Errorf("agent exited: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	return 0, fmt.Errorf("agent did not answer within %s", agentStartTimeout)
+}
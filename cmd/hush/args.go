@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// flagsFirst moves the flags of the invoked command in front of its
+// positional arguments. urfave/cli stops parsing flags at the first
+// positional argument, which would otherwise break "hush get <name> -d".
+// Everything after "--" is left alone.
+func flagsFirst(app *cli.App, args []string) []string {
+	if len(args) < 2 {
+		return args
+	}
+
+	// Global flags come before the command.
+	i := 1
+	for ; i < len(args) && strings.HasPrefix(args[i], "-") && args[i] != "--"; i++ {
+		if takesValue(app.Flags, args[i]) {
+			i++
+		}
+	}
+
+	commands := app.Commands
+	var command *cli.Command
+	for ; i < len(args); i++ {
+		next := findCommand(commands, args[i])
+		if next == nil {
+			break
+		}
+		command = next
+		commands = command.Subcommands
+	}
+	if command == nil || command.SkipFlagParsing {
+		return args
+	}
+
+	reordered := append([]string{}, args[:i]...)
+	var positional []string
+	for ; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			positional = append(positional, args[i:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			positional = append(positional, arg)
+			continue
+		}
+
+		reordered = append(reordered, arg)
+		if takesValue(command.Flags, arg) && i+1 < len(args) {
+			i++
+			reordered = append(reordered, args[i])
+		}
+	}
+
+	return append(reordered, positional...)
+}
+
+func findCommand(commands []*cli.Command, name string) *cli.Command {
+	for _, command := range commands {
+		if command.HasName(name) {
+			return command
+		}
+	}
+	return nil
+}
+
+// takesValue reports whether arg is one of flags and is followed by a
+// separate value argument.
+func takesValue(flags []cli.Flag, arg string) bool {
+	name := strings.TrimLeft(arg, "-")
+	if strings.Contains(name, "=") {
+		return false
+	}
+
+	for _, flag := range flags {
+		for _, flagName := range flag.Names() {
+			if flagName != name {
+				continue
+			}
+			if docFlag, ok := flag.(cli.DocGenerationFlag); ok {
+				return docFlag.TakesValue()
+			}
+			return true
+		}
+	}
+	return false
+}
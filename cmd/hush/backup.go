@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/nochzato/hush/internal/hushcore"
+	"github.com/nochzato/hush/internal/passutils"
+	"github.com/urfave/cli/v2"
+)
+
+func backupCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "backup",
+		Usage:     "Write the whole vault to an encrypted backup file",
+		ArgsUsage: "<file>",
+		Description: "The backup holds every file of the vault, entry history included, with a manifest of checksums. " +
+			"It is encrypted with the master password, which also unlocks the vault once it is restored with 'hush restore <file>'.",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "force",
+				Usage: "Overwrite the file if it exists",
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			if ctx.NArg() < 1 {
+				return fmt.Errorf("missing backup file")
+			}
+			path := ctx.Args().First()
+			if _, err := os.Stat(path); err == nil && !ctx.Bool("force") {
+				return fmt.Errorf("%s already exists; use --force to overwrite it", path)
+			}
+
+			masterPassword, err := promptMasterPassword()
+			if err != nil {
+				return err
+			}
+
+			var info *hushcore.BackupInfo
+			err = writeExport(path, func(w io.Writer) error {
+				info, err = hushcore.Backup(w, masterPassword)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("failed to back up vault: %w", err)
+			}
+
+			fmt.Printf("Backed up %d entries (%d files) to %s.\n", info.Entries, len(info.Files), path)
+			return nil
+		},
+	}
+}
+
+// restoreBackupFlags are the flags of 'hush restore' for restoring a backup
+// rather than a revision of an entry.
+func restoreBackupFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "verify",
+			Usage: "Only check that the backup is complete and intact",
+		},
+		&cli.BoolFlag{
+			Name:  "merge",
+			Usage: "Add the entries of the backup to the vault instead of replacing it",
+		},
+		&cli.StringFlag{
+			Name:  "conflict",
+			Value: string(hushcore.ConflictSkip),
+			Usage: "With --merge, what to do with entries whose name is taken: skip, overwrite or rename",
+		},
+	}
+}
+
+func restoreBackup(ctx *cli.Context, path string) error {
+	conflict, err := hushcore.ParseConflictPolicy(ctx.String("conflict"))
+	if err != nil {
+		return err
+	}
+	if ctx.IsSet("conflict") && !ctx.Bool("merge") {
+		return fmt.Errorf("--conflict only applies with --merge")
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("backup file %s does not exist (to restore a revision of an entry, pass --rev)", path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open backup file: %w", err)
+	}
+	defer f.Close()
+
+	if ctx.Bool("verify") {
+		backupPassword, err := readBackupPassword()
+		if err != nil {
+			return err
+		}
+
+		info, err := hushcore.VerifyBackup(bufio.NewReader(f), backupPassword)
+		if err != nil {
+			return fmt.Errorf("failed to verify backup: %w", err)
+		}
+		printBackupInfo(info)
+		fmt.Println("Backup is complete and intact.")
+		return nil
+	}
+
+	mode := hushcore.RestoreReplace
+	if ctx.Bool("merge") {
+		mode = hushcore.RestoreMerge
+	}
+
+	_, err = hushcore.VaultID()
+	initialized := !errors.Is(err, hushcore.ErrNotInitialized)
+	if mode == hushcore.RestoreMerge && !initialized {
+		return fmt.Errorf("there is no vault to merge into; restore without --merge")
+	}
+	if mode == hushcore.RestoreReplace && initialized {
+		dir, err := hushcore.CurrentVaultDir()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("This replaces the vault in %s, entry history included, with the backup.\n", dir)
+		fmt.Print("Are you sure you want to continue? (y/N): ")
+		response, err := stdin.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("failed to read user input: %w", err)
+		}
+		if strings.TrimSpace(strings.ToLower(response)) != "y" {
+			fmt.Println("Operation cancelled.")
+			return nil
+		}
+	}
+
+	backupPassword, err := readBackupPassword()
+	if err != nil {
+		return err
+	}
+	masterPassword := ""
+	if initialized {
+		masterPassword, err = getMasterPassword()
+		if err != nil {
+			return err
+		}
+	}
+
+	info, result, err := hushcore.RestoreBackup(bufio.NewReader(f), backupPassword, mode, conflict, masterPassword)
+	if err != nil {
+		return fmt.Errorf("failed to restore backup: %w", err)
+	}
+
+	printBackupInfo(info)
+	if result != nil {
+		printImportResult(result, false)
+		return nil
+	}
+	fmt.Println("Vault restored. It now opens with the master password of the backup.")
+	return nil
+}
+
+func readBackupPassword() (string, error) {
+	fmt.Print("Enter the master password of the backup: ")
+	password, err := passutils.ReadPassword(passwordReader())
+	if err != nil {
+		return "", fmt.Errorf("failed to read master password: %w", err)
+	}
+	fmt.Println()
+	return password, nil
+}
+
+func printBackupInfo(info *hushcore.BackupInfo) {
+	fmt.Printf("Backup of %d entries (%d files) taken %s, at vault revision %d.\n",
+		info.Entries, len(info.Files), info.Created.Local().Format("2006-01-02 15:04:05"), info.Revision)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/atotto/clipboard"
+	"github.com/nochzato/hush/internal/agent"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	defaultClipTimeout = 45 * time.Second
+	clipHelperName     = "clip-helper"
+	clipDirName        = "clip"
+	// clipGuardGrace is how long a guard file outlives its timeout before
+	// it is considered left behind by a helper that never finished.
+	clipGuardGrace = time.Minute
+)
+
+// clipGuard identifies a secret in the clipboard without holding it: the
+// clipboard still holds the secret if it hashes to Hash with Salt.
+type clipGuard struct {
+	Salt    []byte    `json:"salt"`
+	Hash    []byte    `json:"hash"`
+	Expires time.Time `json:"expires"`
+}
+
+func newClipGuard(secret string, timeout time.Duration) (*clipGuard, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	g := &clipGuard{Salt: salt, Expires: time.Now().Add(timeout + clipGuardGrace)}
+	g.Hash = g.hash(secret)
+	return g, nil
+}
+
+func (g *clipGuard) hash(value string) []byte {
+	h := sha256.New()
+	h.Write(g.Salt)
+	h.Write([]byte(value))
+	return h.Sum(nil)
+}
+
+func (g *clipGuard) matches(value string) bool {
+	return subtle.ConstantTimeCompare(g.hash(value), g.Hash) == 1
+}
+
+// clipJob is what a clipboard helper is told on its standard input. While
+// the helper waits, its guard is also kept in GuardFile so that later
+// copies can recognize the secret.
+type clipJob struct {
+	Guard     clipGuard `json:"guard"`
+	GuardFile string    `json:"guard_file"`
+	Previous  string    `json:"previous"`
+}
+
+func clipTimeoutFlag() cli.Flag {
+	return &cli.DurationFlag{
+		Name:    "clip-timeout",
+		Value:   defaultClipTimeout,
+		Usage:   "Clear the clipboard after this long, unless it has changed since (0 keeps it)",
+		EnvVars: []string{"HUSH_CLIP_TIMEOUT"},
+	}
+}
+
+// copyToClipboard puts secret in the clipboard and, unless timeout is zero,
+// starts a helper that restores what was there before once timeout passes,
+// provided the clipboard still holds secret by then.
+func copyToClipboard(secret string, timeout time.Duration) error {
+	// A secret copied earlier whose helper is still waiting is not worth
+	// restoring; the clipboard is cleared instead.
+	previous, err := clipboard.ReadAll()
+	if err != nil || isGuardedSecret(previous) {
+		previous = ""
+	}
+
+	if err := clipboard.WriteAll(secret); err != nil {
+		return err
+	}
+	if timeout <= 0 {
+		return nil
+	}
+
+	guard, err := newClipGuard(secret, timeout)
+	if err != nil {
+		return fmt.Errorf("failed to start clipboard helper: %w", err)
+	}
+	if err := startClipHelper(&clipJob{Guard: *guard, Previous: previous}, timeout); err != nil {
+		return fmt.Errorf("failed to start clipboard helper: %w", err)
+	}
+	return nil
+}
+
+// copiedMessage describes where something was copied to, and for how long.
+func copiedMessage(what string, timeout time.Duration) string {
+	if timeout <= 0 {
+		return what + " copied to clipboard."
+	}
+	return fmt.Sprintf("%s copied to clipboard; it will be cleared in %s.", what, timeout)
+}
+
+func clipDir() string {
+	return filepath.Join(agent.RuntimeDir(), clipDirName)
+}
+
+// privateClipDir creates the directory for guard files, and the runtime
+// directory it is in, for the current user only.
+func privateClipDir() error {
+	if err := agent.PrivateDir(agent.RuntimeDir()); err != nil {
+		return err
+	}
+	return agent.PrivateDir(clipDir())
+}
+
+// isGuardedSecret reports whether value is a secret that a clipboard helper
+// is still waiting to clear. Guard files of helpers that never finished are
+// removed.
+func isGuardedSecret(value string) bool {
+	// Guard files are only trusted from directories nobody else controls.
+	if agent.CheckPrivateDir(agent.RuntimeDir()) != nil || agent.CheckPrivateDir(clipDir()) != nil {
+		return false
+	}
+
+	files, err := filepath.Glob(filepath.Join(clipDir(), "*.json"))
+	if err != nil {
+		return false
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var guard clipGuard
+		if err := json.Unmarshal(data, &guard); err != nil || time.Now().After(guard.Expires) {
+			os.Remove(file)
+			continue
+		}
+		if guard.matches(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func startClipHelper(job *clipJob, timeout time.Duration) error {
+	if err := privateClipDir(); err != nil {
+		return err
+	}
+
+	guard, err := json.Marshal(job.Guard)
+	if err != nil {
+		return err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	job.GuardFile = filepath.Join(clipDir(), hex.EncodeToString(id)+".json")
+	if err := os.WriteFile(job.GuardFile, guard, 0600); err != nil {
+		return err
+	}
+
+	input, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(executable, clipHelperName, "--timeout", timeout.String())
+	if err := detach(cmd); err != nil {
+		os.Remove(job.GuardFile)
+		return err
+	}
+	// The job is written before hush exits, rather than by a goroutine of
+	// exec that might not get to it.
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		os.Remove(job.GuardFile)
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		os.Remove(job.GuardFile)
+		return err
+	}
+
+	_, err = stdin.Write(input)
+	if closeErr := stdin.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		os.Remove(job.GuardFile)
+		return err
+	}
+
+	return cmd.Process.Release()
+}
+
+func clipHelperCommand() *cli.Command {
+	return &cli.Command{
+		Name:   clipHelperName,
+		Hidden: true,
+		Usage:  "Restore the clipboard after a timeout if it still holds a copied secret",
+		Flags: []cli.Flag{
+			&cli.DurationFlag{
+				Name:  "timeout",
+				Value: defaultClipTimeout,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			var job clipJob
+			if err := json.NewDecoder(os.Stdin).Decode(&job); err != nil {
+				return fmt.Errorf("failed to read clipboard job: %w", err)
+			}
+			defer os.Remove(job.GuardFile)
+
+			time.Sleep(ctx.Duration("timeout"))
+
+			current, err := clipboard.ReadAll()
+			if err != nil || !job.Guard.matches(current) {
+				return nil
+			}
+			return clipboard.WriteAll(job.Previous)
+		},
+	}
+}
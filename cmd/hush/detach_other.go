@@ -0,0 +1,12 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows)
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+func detach(cmd *exec.Cmd) error {
+	return errors.New("starting a background process is not supported on this platform")
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nochzato/hush/internal/exporter"
+	"github.com/nochzato/hush/internal/hushcore"
+	"github.com/nochzato/hush/internal/passutils"
+	"github.com/urfave/cli/v2"
+)
+
+func exportCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "export",
+		Usage:     "Export every entry to a file",
+		ArgsUsage: "<file>",
+		Description: "JSON and CSV exports hold every field and the revision and modification time of every entry. " +
+			"They are encrypted with an export passphrase unless --unsafe-plaintext is given; decrypt them with hush decrypt-export. " +
+			"KeePass databases (KDBX 4) are protected with a password of their own; folders become groups.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "format",
+				Usage:    "Format of the file: json, csv or kdbx",
+				Required: true,
+			},
+			&cli.BoolFlag{
+				Name:  "unsafe-plaintext",
+				Usage: "Write a JSON or CSV export without encrypting it",
+			},
+			&cli.BoolFlag{
+				Name:  "force",
+				Usage: "Overwrite the file if it exists",
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			if ctx.NArg() < 1 {
+				return fmt.Errorf("missing file to export to")
+			}
+			path := ctx.Args().First()
+
+			format := ctx.String("format")
+			plaintext := ctx.Bool("unsafe-plaintext")
+			switch format {
+			case "json", "csv":
+			case "kdbx":
+				if plaintext {
+					return fmt.Errorf("--unsafe-plaintext does not apply to KeePass databases")
+				}
+			default:
+				return fmt.Errorf("unsupported export format %q", format)
+			}
+			if _, err := os.Stat(path); err == nil && !ctx.Bool("force") {
+				return fmt.Errorf("%s already exists; use --force to overwrite it", path)
+			}
+
+			if plaintext {
+				fmt.Printf("This writes every password and secret in the vault unencrypted to %s.\n", path)
+				fmt.Print("Are you sure you want to continue? (y/N): ")
+				response, err := stdin.ReadString('\n')
+				if err != nil {
+					return fmt.Errorf("failed to read user input: %w", err)
+				}
+				if strings.TrimSpace(strings.ToLower(response)) != "y" {
+					fmt.Println("Operation cancelled.")
+					return nil
+				}
+			}
+
+			masterPassword, err := getMasterPassword()
+			if err != nil {
+				return err
+			}
+
+			password := ""
+			switch {
+			case format == "kdbx":
+				password, err = readNewPassword("a password for the KeePass database", "database password")
+			case !plaintext:
+				password, err = readNewPassword("an export passphrase", "export passphrase")
+			}
+			if err != nil {
+				return err
+			}
+
+			count := 0
+			err = writeExport(path, func(w io.Writer) error {
+				var encrypted io.WriteCloser
+				if format != "kdbx" && !plaintext {
+					encrypted, err = passutils.NewEncryptWriter(w, password, passutils.DefaultKDFParams())
+					if err != nil {
+						return fmt.Errorf("failed to encrypt export: %w", err)
+					}
+					w = encrypted
+				}
+
+				var ew exporter.Writer
+				switch format {
+				case "json":
+					ew = exporter.NewJSON(w)
+				case "csv":
+					ew = exporter.NewCSV(w)
+				case "kdbx":
+					ew = exporter.NewKDBX(w, password)
+				}
+
+				err := hushcore.WalkRecords(masterPassword, func(info hushcore.EntryInfo, record *hushcore.Record) error {
+					count++
+					return ew.Add(info, record)
+				})
+				if err != nil {
+					return err
+				}
+				if err := ew.Close(); err != nil {
+					return err
+				}
+				if encrypted != nil {
+					return encrypted.Close()
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("failed to export: %w", err)
+			}
+
+			fmt.Printf("Exported %d entries to %s.\n", count, path)
+			return nil
+		},
+	}
+}
+
+func decryptExportCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "decrypt-export",
+		Usage:     "Decrypt an encrypted JSON or CSV export",
+		ArgsUsage: "<file> <output>",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "force",
+				Usage: "Overwrite the output file if it exists",
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			if ctx.NArg() < 2 {
+				return fmt.Errorf("missing export file or output file")
+			}
+			path, output := ctx.Args().Get(0), ctx.Args().Get(1)
+			if _, err := os.Stat(output); err == nil && !ctx.Bool("force") {
+				return fmt.Errorf("%s already exists; use --force to overwrite it", output)
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				return fmt.Errorf("failed to open export file: %w", err)
+			}
+			defer f.Close()
+
+			fmt.Print("Enter the export passphrase: ")
+			passphrase, err := passutils.ReadPassword(passwordReader())
+			if err != nil {
+				return fmt.Errorf("failed to read export passphrase: %w", err)
+			}
+			fmt.Println()
+
+			r, err := passutils.NewDecryptReader(bufio.NewReader(f), passphrase)
+			if err != nil {
+				return fmt.Errorf("failed to decrypt export: %w", err)
+			}
+			err = writeExport(output, func(w io.Writer) error {
+				_, err := io.Copy(w, r)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("failed to decrypt export: %w", err)
+			}
+
+			fmt.Printf("Decrypted %s to %s.\n", path, output)
+			return nil
+		},
+	}
+}
+
+// readNewPassword prompts for a password twice. what is how the prompt
+// names it, such as "an export passphrase", and name how errors do.
+func readNewPassword(what, name string) (string, error) {
+	fmt.Printf("Enter %s: ", what)
+	password, err := passutils.ReadPassword(passwordReader())
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	fmt.Println()
+
+	fmt.Printf("Confirm the %s: ", name)
+	confirmation, err := passutils.ReadPassword(passwordReader())
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	fmt.Println()
+
+	if password == "" {
+		return "", fmt.Errorf("%s must not be empty", name)
+	}
+	if password != confirmation {
+		return "", fmt.Errorf("%ss do not match", name)
+	}
+	return password, nil
+}
+
+// writeExport writes to a temporary file next to path, which CreateTemp
+// makes readable by the user only, and moves it into place once write
+// succeeds. A failed export leaves nothing behind.
+func writeExport(path string, write func(w io.Writer) error) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), ".hush-export-*")
+	if err != nil {
+		return fmt.Errorf("failed to create export file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	bw := bufio.NewWriter(f)
+	if err := write(bw); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write export file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to write export file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write export file: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("failed to write export file: %w", err)
+	}
+	return nil
+}
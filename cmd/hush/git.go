@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/nochzato/hush/internal/hushcore"
+	"github.com/urfave/cli/v2"
+)
+
+func gitCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "git",
+		Usage: "Keep the vault in a git repository and sync it with a remote",
+		Description: "Once the vault is a git repository, every change to it is committed. " +
+			"Commit messages name the entries that changed, or only count them if names are encrypted, and never hold secrets.",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "init",
+				Usage: "Make the vault directory a git repository",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "remote",
+						Usage: "URL of a repository to add as the origin remote",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					if err := hushcore.GitInit(ctx.String("remote")); err != nil {
+						return fmt.Errorf("failed to set up git: %w", err)
+					}
+
+					dir, err := hushcore.CurrentVaultDir()
+					if err != nil {
+						return err
+					}
+					fmt.Printf("Vault in %s is now a git repository.\n", dir)
+					return nil
+				},
+			},
+			{
+				Name:            "push",
+				Usage:           "Push the vault to its remote",
+				ArgsUsage:       "[git push arguments]",
+				Description:     "Without arguments, pushes the current branch to origin and sets it as the upstream branch.",
+				SkipFlagParsing: true,
+				Action: func(ctx *cli.Context) error {
+					if err := hushcore.GitPush(ctx.Args().Slice(), os.Stderr); err != nil {
+						return fmt.Errorf("failed to push vault: %w", err)
+					}
+					return nil
+				},
+			},
+			{
+				Name:            "pull",
+				Usage:           "Fast-forward the vault to its upstream branch",
+				ArgsUsage:       "[git pull arguments]",
+				SkipFlagParsing: true,
+				Action: func(ctx *cli.Context) error {
+					err := hushcore.GitPull(ctx.Args().Slice(), os.Stderr)
+					if errors.Is(err, hushcore.ErrGitDiverged) {
+						return fmt.Errorf("failed to pull vault: %w; git cannot merge encrypted entries, so keep one side and make the changes of the other again", err)
+					}
+					if err != nil {
+						return fmt.Errorf("failed to pull vault: %w", err)
+					}
+					return nil
+				},
+			},
+		},
+	}
+}
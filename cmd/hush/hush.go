@@ -2,22 +2,52 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"maps"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/atotto/clipboard"
+	"github.com/nochzato/hush/internal/agent"
+	"github.com/nochzato/hush/internal/fuzzy"
 	"github.com/nochzato/hush/internal/hushcore"
 	"github.com/nochzato/hush/internal/passutils"
 	"github.com/urfave/cli/v2"
+	"golang.org/x/term"
 )
 
 const version = "1.0.0"
 
+// stdin is shared by every prompt so that buffered input is not lost between
+// them when hush is driven through a pipe.
+var stdin = bufio.NewReader(os.Stdin)
+
+func passwordReader() io.Reader {
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		return os.Stdin
+	}
+	return stdin
+}
+
+// getMasterPassword prompts for the master password, unless the agent holds
+// the key of the vault; the empty password then tells hushcore to use it.
 func getMasterPassword() (string, error) {
+	if hushcore.AgentUnlocked() {
+		return "", nil
+	}
+	return promptMasterPassword()
+}
+
+// promptMasterPassword always prompts, for commands that must not rely on
+// the agent.
+func promptMasterPassword() (string, error) {
 	fmt.Print("Enter your master password: ")
-	masterPassword, err := passutils.ReadPassword(os.Stdin)
+	masterPassword, err := passutils.ReadPassword(passwordReader())
 	if err != nil {
 		return "", fmt.Errorf("failed to read master password: %w", err)
 	}
@@ -25,10 +55,171 @@ func getMasterPassword() (string, error) {
 	return masterPassword, nil
 }
 
+// parseFields turns k=v arguments into custom record fields.
+func parseFields(args []string, sensitive bool) ([]hushcore.Field, error) {
+	fields := make([]hushcore.Field, 0, len(args))
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid field %q (expected key=value)", arg)
+		}
+		fields = append(fields, hushcore.Field{Key: key, Value: value, Sensitive: sensitive})
+	}
+	return fields, nil
+}
+
+// setField sets a custom field, replacing any field with the same key.
+func setField(record *hushcore.Record, field hushcore.Field) {
+	for i, f := range record.Fields {
+		if strings.EqualFold(f.Key, field.Key) {
+			record.Fields[i] = field
+			return
+		}
+	}
+	record.Fields = append(record.Fields, field)
+}
+
+// removeField removes a custom field or clears a built-in one. The password
+// cannot be removed.
+func removeField(record *hushcore.Record, key string) error {
+	switch strings.ToLower(key) {
+	case hushcore.FieldPassword:
+		return fmt.Errorf("the password cannot be removed")
+	case hushcore.FieldUsername:
+		record.Username = ""
+	case hushcore.FieldURL:
+		record.URLs = nil
+	case hushcore.FieldNotes:
+		record.Notes = ""
+	case hushcore.FieldTags:
+		record.Tags = nil
+	case hushcore.FieldOTP:
+		record.OTP = ""
+	default:
+		i := slices.IndexFunc(record.Fields, func(f hushcore.Field) bool {
+			return strings.EqualFold(f.Key, key)
+		})
+		if i < 0 {
+			return fmt.Errorf("%w: %q", hushcore.ErrFieldNotFound, key)
+		}
+		record.Fields = slices.Delete(record.Fields, i, i+1)
+	}
+	return nil
+}
+
+// targetName resolves the destination of mv and cp; a destination ending in
+// a slash is a folder to put src in under its own base name.
+func targetName(src, dst string) string {
+	if !strings.HasSuffix(dst, "/") {
+		return dst
+	}
+	base := strings.TrimSuffix(src, "/")
+	if i := strings.LastIndex(base, "/"); i >= 0 {
+		base = base[i+1:]
+	}
+	return dst + base
+}
+
+func retrieveFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.BoolFlag{
+			Name:    "display",
+			Aliases: []string{"d"},
+			Usage:   "Display the password instead of copying to clipboard",
+		},
+		&cli.StringFlag{
+			Name:    "field",
+			Aliases: []string{"f"},
+			Value:   hushcore.FieldPassword,
+			Usage:   "Field to retrieve (password, username, url, notes, tags, otp or a custom field)",
+		},
+		clipTimeoutFlag(),
+	}
+}
+
+// retrieveEntry prints a field of an entry, or copies it to the clipboard
+// if it is sensitive.
+func retrieveEntry(name, masterPassword, field string, display bool, clipTimeout time.Duration) error {
+	record, err := hushcore.GetRecord(name, masterPassword)
+	if errors.Is(err, hushcore.ErrEntryTampered) {
+		fmt.Fprintf(os.Stderr, "WARNING: the password file for %q has been moved, swapped or modified outside of hush.\n", name)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get password: %w", err)
+	}
+
+	value, sensitive, err := record.Get(field)
+	if err != nil {
+		return fmt.Errorf("failed to get field: %w", err)
+	}
+
+	// Only secrets go to the clipboard by default; there is no point in
+	// hiding a username or a URL.
+	if display || !sensitive {
+		fmt.Println(value)
+		return nil
+	}
+
+	err = copyToClipboard(value, clipTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to copy %s to clipboard: %w", field, err)
+	}
+	if field == hushcore.FieldPassword {
+		fmt.Println(copiedMessage(fmt.Sprintf("Password for '%s'", name), clipTimeout))
+	} else {
+		fmt.Println(copiedMessage(fmt.Sprintf("Field %q of '%s'", field, name), clipTimeout))
+	}
+	return nil
+}
+
+// pickAndRetrieve lets the user pick an entry in the fuzzy finder, ranked by
+// how well it matches and how recently it was used, and retrieves it.
+func pickAndRetrieve(ctx *cli.Context, query string) error {
+	masterPassword, err := getMasterPassword()
+	if err != nil {
+		return err
+	}
+
+	lastUsed, err := hushcore.EntryUsage(masterPassword)
+	if err != nil {
+		return fmt.Errorf("failed to list passwords: %w", err)
+	}
+	if len(lastUsed) == 0 {
+		return fmt.Errorf("there are no entries yet; add one with 'hush add <name>'")
+	}
+
+	name, err := pickEntry(slices.Sorted(maps.Keys(lastUsed)), lastUsed, query)
+	if err != nil {
+		return err
+	}
+
+	return retrieveEntry(name, masterPassword, ctx.String("field"), ctx.Bool("display"), ctx.Duration("clip-timeout"))
+}
+
 func main() {
 	app := &cli.App{
 		Name:  "hush",
 		Usage: "A CLI tool for password management",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "vault",
+				Usage: "Vault profile name or path to a hush directory (default: $HUSH_DIR or ~/.hush)",
+			},
+			&cli.BoolFlag{
+				Name:    "no-agent",
+				Usage:   "Neither use nor update the hush agent",
+				EnvVars: []string{"HUSH_NO_AGENT"},
+			},
+		},
+		Before: func(ctx *cli.Context) error {
+			if !ctx.Bool("no-agent") {
+				hushcore.UseAgent(agent.SocketPath(), promptMasterPassword)
+			}
+			if !ctx.IsSet("vault") {
+				return nil
+			}
+			return hushcore.SelectVault(ctx.String("vault"))
+		},
 		Commands: []*cli.Command{
 			{
 				Name:  "version",
@@ -41,12 +232,177 @@ func main() {
 			{
 				Name:  "init",
 				Usage: "Initialize hush and set the master password",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "encrypt-names",
+						Usage: "Store entries under random file names so the vault directory does not reveal them",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					masterPassword, err := promptMasterPassword()
+					if err != nil {
+						return err
+					}
+					if err := hushcore.InitHush(masterPassword); err != nil {
+						return err
+					}
+					if ctx.Bool("encrypt-names") {
+						return hushcore.SetNameEncryption(masterPassword, true)
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "migrate",
+				Usage: "Migrate the vault between plain and encrypted entry names",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "encrypt-names",
+						Usage: "Move entries to random file names and keep their names only in the encrypted manifest",
+					},
+					&cli.BoolFlag{
+						Name:  "decrypt-names",
+						Usage: "Move entries back to files named after them",
+					},
+				},
 				Action: func(ctx *cli.Context) error {
+					encrypt, decrypt := ctx.Bool("encrypt-names"), ctx.Bool("decrypt-names")
+					if encrypt == decrypt {
+						return fmt.Errorf("specify exactly one of --encrypt-names or --decrypt-names")
+					}
+
 					masterPassword, err := getMasterPassword()
 					if err != nil {
 						return err
 					}
-					return hushcore.InitHush(masterPassword)
+
+					if err := hushcore.SetNameEncryption(masterPassword, encrypt); err != nil {
+						return fmt.Errorf("failed to migrate vault: %w", err)
+					}
+
+					if encrypt {
+						fmt.Println("Entry names are now encrypted.")
+					} else {
+						fmt.Println("Entry names are now stored in plain text.")
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "passwd",
+				Usage: "Change the master password",
+				Action: func(ctx *cli.Context) error {
+					masterPassword, err := promptMasterPassword()
+					if err != nil {
+						return err
+					}
+
+					fmt.Print("Enter your new master password: ")
+					newMasterPassword, err := passutils.ReadPassword(passwordReader())
+					if err != nil {
+						return fmt.Errorf("failed to read new master password: %w", err)
+					}
+					fmt.Println()
+
+					fmt.Print("Confirm your new master password: ")
+					confirmation, err := passutils.ReadPassword(passwordReader())
+					if err != nil {
+						return fmt.Errorf("failed to read new master password: %w", err)
+					}
+					fmt.Println()
+
+					if newMasterPassword != confirmation {
+						return fmt.Errorf("new master passwords do not match")
+					}
+
+					err = hushcore.ChangeMasterPassword(masterPassword, newMasterPassword)
+					if err != nil {
+						return fmt.Errorf("failed to change master password: %w", err)
+					}
+
+					fmt.Println("Master password changed successfully.")
+					return nil
+				},
+			},
+			{
+				Name:  "kdf",
+				Usage: "Manage key derivation parameters",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "tune",
+						Usage: "Calibrate Argon2id on this machine and upgrade the vault to the suggested costs",
+						Flags: []cli.Flag{
+							&cli.DurationFlag{
+								Name:    "target",
+								Aliases: []string{"t"},
+								Value:   500 * time.Millisecond,
+								Usage:   "Target unlock latency",
+							},
+							&cli.UintFlag{
+								Name:  "max-memory",
+								Value: 1024,
+								Usage: "Upper bound for the memory cost in MiB",
+							},
+							&cli.BoolFlag{
+								Name:  "dry-run",
+								Usage: "Only print the suggested parameters",
+							},
+						},
+						Action: func(ctx *cli.Context) error {
+							maxMemory := ctx.Uint("max-memory")
+							if maxMemory > passutils.MaxKDFMemory/1024 {
+								return fmt.Errorf("--max-memory must be at most %d MiB", passutils.MaxKDFMemory/1024)
+							}
+
+							current, err := hushcore.VaultKDFParams()
+							if err != nil {
+								return fmt.Errorf("failed to read vault parameters: %w", err)
+							}
+
+							target := ctx.Duration("target")
+							fmt.Printf("Calibrating Argon2id for a %s unlock...\n", target)
+
+							params, elapsed, err := passutils.CalibrateKDF(target, uint32(maxMemory)*1024)
+							if err != nil {
+								return fmt.Errorf("failed to calibrate kdf: %w", err)
+							}
+
+							fmt.Printf("Current:   %s\n", current)
+							fmt.Printf("Suggested: %s (%s on this machine)\n", params, elapsed.Round(time.Millisecond))
+
+							if ctx.Bool("dry-run") {
+								return nil
+							}
+							if params == current {
+								fmt.Println("The vault already uses these parameters.")
+								return nil
+							}
+
+							fmt.Print("Upgrade the vault to the suggested parameters? (y/N): ")
+							response, err := stdin.ReadString('\n')
+							if err != nil {
+								return fmt.Errorf("failed to read user input: %w", err)
+							}
+
+							response = strings.TrimSpace(strings.ToLower(response))
+							if response != "y" {
+								fmt.Println("Operation cancelled.")
+								return nil
+							}
+
+							masterPassword, err := promptMasterPassword()
+							if err != nil {
+								return err
+							}
+
+							if err := hushcore.UpgradeKDF(masterPassword, params); err != nil {
+								return fmt.Errorf("failed to upgrade kdf parameters: %w", err)
+							}
+
+							fmt.Printf("KDF parameters upgraded from %s to %s.\n", current, params)
+							return nil
+						},
+					},
 				},
 			},
 			{
@@ -54,24 +410,93 @@ func main() {
 				Aliases:   []string{"a"},
 				Usage:     "Add a new password entry",
 				ArgsUsage: "<name>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "username",
+						Aliases: []string{"u"},
+						Usage:   "Username for the account",
+					},
+					&cli.StringSliceFlag{
+						Name:  "url",
+						Usage: "URL of the site (can be repeated)",
+					},
+					&cli.StringFlag{
+						Name:  "notes",
+						Usage: "Free-form notes",
+					},
+					&cli.StringSliceFlag{
+						Name:  "field",
+						Usage: "Custom field as key=value (can be repeated)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "sensitive-field",
+						Usage: "Custom field as key=value that is copied to the clipboard instead of displayed (can be repeated)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "tag",
+						Usage: "Tag for the entry (can be repeated)",
+					},
+					&cli.BoolFlag{
+						Name:  "otp",
+						Usage: "Prompt for an OTP secret or otpauth:// URI for 'hush otp'",
+					},
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "Replace an existing entry with the same name",
+					},
+				},
 				Action: func(ctx *cli.Context) error {
 					if ctx.NArg() < 1 {
 						return fmt.Errorf("missing account name")
 					}
 					name := ctx.Args().First()
 
+					fields, err := parseFields(ctx.StringSlice("field"), false)
+					if err != nil {
+						return err
+					}
+					sensitiveFields, err := parseFields(ctx.StringSlice("sensitive-field"), true)
+					if err != nil {
+						return err
+					}
+
 					fmt.Print("Enter the password: ")
-					password, err := passutils.ReadPassword(os.Stdin)
+					password, err := passutils.ReadPassword(passwordReader())
 					if err != nil {
 						return fmt.Errorf("failed to read password: %w", err)
 					}
 					fmt.Println()
 
+					var otp string
+					if ctx.Bool("otp") {
+						otp, err = readOTPSecret()
+						if err != nil {
+							return err
+						}
+					}
+
 					masterPassword, err := getMasterPassword()
 					if err != nil {
 						return err
 					}
-					err = hushcore.AddPassword(name, password, masterPassword)
+
+					record := &hushcore.Record{
+						Password: password,
+						Username: ctx.String("username"),
+						URLs:     ctx.StringSlice("url"),
+						Notes:    ctx.String("notes"),
+						Fields:   append(fields, sensitiveFields...),
+						Tags:     ctx.StringSlice("tag"),
+						OTP:      otp,
+					}
+					if ctx.Bool("force") {
+						err = hushcore.SetRecord(name, record, masterPassword)
+					} else {
+						err = hushcore.AddRecord(name, record, masterPassword)
+					}
+					if errors.Is(err, hushcore.ErrEntryExists) {
+						return fmt.Errorf("%q already exists; use 'hush edit' to change it or --force to replace it", name)
+					}
 					if err != nil {
 						if _, ok := err.(*passutils.PasswordStrengthError); ok {
 							fmt.Println("Error: ", err)
@@ -83,32 +508,189 @@ func main() {
 				},
 			},
 			{
-				Name:    "list",
-				Aliases: []string{"ls"},
-				Usage:   "List all password names",
+				Name:      "list",
+				Aliases:   []string{"ls"},
+				Usage:     "List all password names, or one folder as a tree",
+				ArgsUsage: "[folder]",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "tree",
+						Aliases: []string{"t"},
+						Usage:   "Show all entries as a tree of folders",
+					},
+					&cli.StringSliceFlag{
+						Name:  "tag",
+						Usage: "Only list entries matching a tag query such as 'prod and not legacy' (can be repeated)",
+					},
+				},
 				Action: func(ctx *cli.Context) error {
-					passwordNames, err := hushcore.ListPasswordNames()
+					folder := strings.TrimSuffix(ctx.Args().First(), "/")
+
+					var query hushcore.TagQuery
+					if tags := ctx.StringSlice("tag"); len(tags) > 0 {
+						var err error
+						query, err = hushcore.ParseTagQuery("(" + strings.Join(tags, ") and (") + ")")
+						if err != nil {
+							return fmt.Errorf("invalid tag query: %w", err)
+						}
+					}
+
+					namesEncrypted, err := hushcore.NamesEncrypted()
+					if err != nil {
+						return fmt.Errorf("failed to list passwords: %w", err)
+					}
+
+					// Tags are encrypted along with the entry.
+					var masterPassword string
+					if namesEncrypted || query != nil {
+						masterPassword, err = getMasterPassword()
+						if err != nil {
+							return err
+						}
+					}
+
+					var passwordNames []string
+					if query != nil {
+						passwordNames, err = hushcore.FindTagged(query, masterPassword)
+					} else {
+						passwordNames, err = hushcore.ListPasswordNames(masterPassword)
+					}
 					if err != nil {
 						return fmt.Errorf("failed to list passwords: %w", err)
 					}
 
+					if folder == "" && !ctx.Bool("tree") {
+						for _, name := range passwordNames {
+							fmt.Println(name)
+						}
+						return nil
+					}
+
+					var inFolder []string
 					for _, name := range passwordNames {
-						fmt.Println(name)
+						if hushcore.InFolder(name, folder) {
+							inFolder = append(inFolder, name)
+						}
+					}
+					if folder != "" && len(inFolder) == 0 && query == nil {
+						return fmt.Errorf("folder %q is empty or does not exist", folder)
 					}
 
+					printTree(os.Stdout, inFolder, folder)
 					return nil
 				},
 			},
 			{
 				Name:      "get",
 				Aliases:   []string{"g"},
-				Usage:     "Retrieve a password",
-				ArgsUsage: "<name>",
+				Usage:     "Retrieve a password, or pick the entry from a fuzzy finder when no name is given",
+				ArgsUsage: "[name]",
+				Flags:     retrieveFlags(),
+				Action: func(ctx *cli.Context) error {
+					if ctx.NArg() < 1 {
+						if !isInteractive() {
+							return fmt.Errorf("missing password name")
+						}
+						return pickAndRetrieve(ctx, "")
+					}
+					name := ctx.Args().First()
+
+					masterPassword, err := getMasterPassword()
+					if err != nil {
+						return err
+					}
+
+					return retrieveEntry(name, masterPassword, ctx.String("field"), ctx.Bool("display"), ctx.Duration("clip-timeout"))
+				},
+			},
+			{
+				Name:      "find",
+				Usage:     "Pick an entry with a fuzzy finder and retrieve it; prints the names containing the query when not run in a terminal",
+				ArgsUsage: "[query]",
+				Flags:     retrieveFlags(),
+				Action: func(ctx *cli.Context) error {
+					query := strings.Join(ctx.Args().Slice(), " ")
+					if isInteractive() {
+						return pickAndRetrieve(ctx, query)
+					}
+
+					namesEncrypted, err := hushcore.NamesEncrypted()
+					if err != nil {
+						return fmt.Errorf("failed to list passwords: %w", err)
+					}
+
+					var masterPassword string
+					if namesEncrypted {
+						masterPassword, err = getMasterPassword()
+						if err != nil {
+							return err
+						}
+					}
+
+					passwordNames, err := hushcore.ListPasswordNames(masterPassword)
+					if err != nil {
+						return fmt.Errorf("failed to list passwords: %w", err)
+					}
+
+					matches := fuzzy.Substring(passwordNames, query)
+					if len(matches) == 0 {
+						return fmt.Errorf("no entries match %q", query)
+					}
+					for _, name := range matches {
+						fmt.Println(name)
+					}
+					return nil
+				},
+			},
+			otpCommand(),
+			{
+				Name:        "edit",
+				Aliases:     []string{"e"},
+				Usage:       "Change the password or other fields of an entry",
+				ArgsUsage:   "<name>",
+				Description: "Without flags, prompts for a new password. The previous version is kept in the entry history.",
 				Flags: []cli.Flag{
 					&cli.BoolFlag{
-						Name:    "display",
-						Aliases: []string{"d"},
-						Usage:   "Display the password instead of copying to clipboard",
+						Name:    "password",
+						Aliases: []string{"p"},
+						Usage:   "Prompt for a new password",
+					},
+					&cli.StringFlag{
+						Name:    "username",
+						Aliases: []string{"u"},
+						Usage:   "New username for the account",
+					},
+					&cli.StringSliceFlag{
+						Name:  "url",
+						Usage: "New URL of the site, replacing all current ones (can be repeated)",
+					},
+					&cli.StringFlag{
+						Name:  "notes",
+						Usage: "New free-form notes",
+					},
+					&cli.StringSliceFlag{
+						Name:  "field",
+						Usage: "Set a custom field as key=value (can be repeated)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "sensitive-field",
+						Usage: "Set a sensitive custom field as key=value (can be repeated)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "remove-field",
+						Usage: "Remove a custom field, or clear username, url, notes, tags or otp (can be repeated)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "tag",
+						Usage: "Add a tag (can be repeated)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "untag",
+						Usage: "Remove a tag (can be repeated)",
+					},
+					&cli.BoolFlag{
+						Name:  "otp",
+						Usage: "Prompt for a new OTP secret or otpauth:// URI",
 					},
 				},
 				Action: func(ctx *cli.Context) error {
@@ -116,36 +698,171 @@ func main() {
 						return fmt.Errorf("missing password name")
 					}
 					name := ctx.Args().First()
-					displayPassword := ctx.Bool("display")
 
-					masterPassword, err := getMasterPassword()
+					fields, err := parseFields(ctx.StringSlice("field"), false)
 					if err != nil {
 						return err
 					}
-
-					password, err := hushcore.GetPassword(name, masterPassword)
+					sensitiveFields, err := parseFields(ctx.StringSlice("sensitive-field"), true)
 					if err != nil {
-						return fmt.Errorf("failed to get password: %w", err)
+						return err
 					}
 
-					if displayPassword {
-						fmt.Println(password)
-					} else {
-						err = clipboard.WriteAll(password)
+					changesPassword := ctx.Bool("password") || ctx.NumFlags() == 0
+					var password string
+					if changesPassword {
+						fmt.Print("Enter the new password: ")
+						password, err = passutils.ReadPassword(passwordReader())
 						if err != nil {
-							return fmt.Errorf("failed to copy password to clipboard: %w", err)
+							return fmt.Errorf("failed to read password: %w", err)
 						}
-						fmt.Println("Password copied to clipboard.")
+						fmt.Println()
 					}
 
+					var otp string
+					if ctx.Bool("otp") {
+						otp, err = readOTPSecret()
+						if err != nil {
+							return err
+						}
+					}
+
+					masterPassword, err := getMasterPassword()
+					if err != nil {
+						return err
+					}
+
+					err = hushcore.EditRecord(name, func(record *hushcore.Record) error {
+						if changesPassword {
+							record.Password = password
+						}
+						for _, key := range ctx.StringSlice("remove-field") {
+							if err := removeField(record, key); err != nil {
+								return err
+							}
+						}
+						if ctx.IsSet("username") {
+							record.Username = ctx.String("username")
+						}
+						if ctx.IsSet("url") {
+							record.URLs = ctx.StringSlice("url")
+						}
+						if ctx.IsSet("notes") {
+							record.Notes = ctx.String("notes")
+						}
+						if otp != "" {
+							record.OTP = otp
+						}
+						for _, field := range append(fields, sensitiveFields...) {
+							setField(record, field)
+						}
+						for _, tag := range ctx.StringSlice("untag") {
+							record.Tags = slices.DeleteFunc(record.Tags, func(t string) bool {
+								return strings.EqualFold(t, tag)
+							})
+						}
+						for _, tag := range ctx.StringSlice("tag") {
+							if !slices.ContainsFunc(record.Tags, func(t string) bool { return strings.EqualFold(t, tag) }) {
+								record.Tags = append(record.Tags, tag)
+							}
+						}
+						return nil
+					}, masterPassword)
+					if err != nil {
+						if _, ok := err.(*passutils.PasswordStrengthError); ok {
+							fmt.Println("Error: ", err)
+						}
+						return fmt.Errorf("failed to edit entry: %w", err)
+					}
+
+					fmt.Printf("Entry '%s' updated successfully.\n", name)
+					return nil
+				},
+			},
+			{
+				Name:        "mv",
+				Aliases:     []string{"move", "rename"},
+				Usage:       "Rename an entry or move it to another folder",
+				ArgsUsage:   "<old> <new>",
+				Description: "A new name ending in / moves the entry into that folder under its current name. The entry keeps its history.",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "force",
+						Aliases: []string{"f"},
+						Usage:   "Replace an existing entry with the same name",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					if ctx.NArg() < 2 {
+						return fmt.Errorf("missing old or new name")
+					}
+					src, dst := ctx.Args().Get(0), targetName(ctx.Args().Get(0), ctx.Args().Get(1))
+
+					masterPassword, err := getMasterPassword()
+					if err != nil {
+						return err
+					}
+
+					err = hushcore.MoveEntry(src, dst, ctx.Bool("force"), masterPassword)
+					if errors.Is(err, hushcore.ErrEntryExists) {
+						return fmt.Errorf("%q already exists; use --force to replace it", dst)
+					}
+					if err != nil {
+						return fmt.Errorf("failed to move entry: %w", err)
+					}
+
+					fmt.Printf("Moved '%s' to '%s'.\n", src, dst)
+					return nil
+				},
+			},
+			{
+				Name:        "cp",
+				Aliases:     []string{"copy"},
+				Usage:       "Copy an entry",
+				ArgsUsage:   "<src> <dst>",
+				Description: "A destination ending in / copies the entry into that folder under its current name.",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "force",
+						Aliases: []string{"f"},
+						Usage:   "Replace an existing entry with the same name",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					if ctx.NArg() < 2 {
+						return fmt.Errorf("missing source or destination name")
+					}
+					src, dst := ctx.Args().Get(0), targetName(ctx.Args().Get(0), ctx.Args().Get(1))
+
+					masterPassword, err := getMasterPassword()
+					if err != nil {
+						return err
+					}
+
+					err = hushcore.CopyEntry(src, dst, ctx.Bool("force"), masterPassword)
+					if errors.Is(err, hushcore.ErrEntryExists) {
+						return fmt.Errorf("%q already exists; use --force to replace it", dst)
+					}
+					if err != nil {
+						return fmt.Errorf("failed to copy entry: %w", err)
+					}
+
+					fmt.Printf("Copied '%s' to '%s'.\n", src, dst)
 					return nil
 				},
 			},
 			{
 				Name:      "remove",
 				Aliases:   []string{"rm"},
-				Usage:     "Remove a password",
+				Usage:     "Remove a password, or a whole folder with -r",
 				ArgsUsage: "<name>",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "recursive",
+						Aliases: []string{"r"},
+						Usage:   "Remove a folder and every entry in it",
+					},
+				},
 				Action: func(ctx *cli.Context) error {
 					if ctx.NArg() < 1 {
 						return fmt.Errorf("missing password name")
@@ -157,11 +874,168 @@ func main() {
 						return err
 					}
 
-					err = hushcore.RemovePassword(name, masterPassword)
+					if !ctx.Bool("recursive") {
+						err = hushcore.RemovePassword(name, masterPassword)
+						if errors.Is(err, hushcore.ErrEntryNotFound) {
+							names, listErr := hushcore.ListPasswordNames(masterPassword)
+							if listErr == nil && slices.ContainsFunc(names, func(n string) bool { return hushcore.InFolder(n, name) }) {
+								return fmt.Errorf("%q is a folder; use 'hush rm -r %s' to remove it with everything in it", name, name)
+							}
+						}
+						if err != nil {
+							return fmt.Errorf("failed to remove password: %w", err)
+						}
+						return nil
+					}
+
+					folder := strings.TrimSuffix(name, "/")
+					names, err := hushcore.ListPasswordNames(masterPassword)
+					if err != nil {
+						return fmt.Errorf("failed to list passwords: %w", err)
+					}
+
+					var inFolder []string
+					for _, n := range names {
+						if hushcore.InFolder(n, folder) {
+							inFolder = append(inFolder, n)
+						}
+					}
+					if len(inFolder) == 0 {
+						return fmt.Errorf("folder %q is empty or does not exist", folder)
+					}
+
+					fmt.Printf("This will remove %d entries in %q:\n", len(inFolder), folder)
+					for _, n := range inFolder {
+						fmt.Printf("  %s\n", n)
+					}
+					fmt.Print("Are you sure you want to continue? (y/N): ")
+
+					response, err := stdin.ReadString('\n')
+					if err != nil {
+						return fmt.Errorf("failed to read user input: %w", err)
+					}
+
+					response = strings.TrimSpace(strings.ToLower(response))
+					if response != "y" {
+						fmt.Println("Operation cancelled.")
+						return nil
+					}
+
+					removed, err := hushcore.RemoveFolder(folder, masterPassword)
 					if err != nil {
-						return fmt.Errorf("failed to remove password: %w", err)
+						return fmt.Errorf("failed to remove folder: %w", err)
 					}
 
+					fmt.Printf("Removed %d entries from %q.\n", len(removed), folder)
+					return nil
+				},
+			},
+			{
+				Name:      "history",
+				Usage:     "List the revisions of a password entry",
+				ArgsUsage: "<name>",
+				Action: func(ctx *cli.Context) error {
+					if ctx.NArg() < 1 {
+						return fmt.Errorf("missing password name")
+					}
+					name := ctx.Args().First()
+
+					masterPassword, err := getMasterPassword()
+					if err != nil {
+						return err
+					}
+
+					revisions, err := hushcore.EntryHistory(name, masterPassword)
+					if err != nil {
+						return fmt.Errorf("failed to get history: %w", err)
+					}
+
+					for _, rev := range revisions {
+						modified := "unknown"
+						if !rev.Modified.IsZero() {
+							modified = rev.Modified.Local().Format("2006-01-02 15:04:05")
+						}
+
+						current := ""
+						if rev.Current {
+							current = " (current)"
+						}
+
+						fmt.Printf("%4d  %s%s\n", rev.Revision, modified, current)
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:      "restore",
+				Usage:     "Restore a previous revision of a password entry, or the vault from a backup",
+				ArgsUsage: "<name> --rev <revision> | <backup file>",
+				Flags: append([]cli.Flag{
+					&cli.IntFlag{
+						Name:    "rev",
+						Aliases: []string{"r"},
+						Usage:   "Revision to restore, as listed by 'hush history'",
+					},
+				}, restoreBackupFlags()...),
+				Action: func(ctx *cli.Context) error {
+					if ctx.NArg() < 1 {
+						return fmt.Errorf("missing password name or backup file")
+					}
+					name := ctx.Args().First()
+
+					if !ctx.IsSet("rev") {
+						return restoreBackup(ctx, name)
+					}
+					for _, flag := range []string{"verify", "merge", "conflict"} {
+						if ctx.IsSet(flag) {
+							return fmt.Errorf("--%s only applies to restoring a backup", flag)
+						}
+					}
+					revision := ctx.Int("rev")
+
+					masterPassword, err := getMasterPassword()
+					if err != nil {
+						return err
+					}
+
+					if err := hushcore.RestoreRevision(name, revision, masterPassword); err != nil {
+						return fmt.Errorf("failed to restore revision: %w", err)
+					}
+
+					fmt.Printf("Revision %d of '%s' restored.\n", revision, name)
+					return nil
+				},
+			},
+			{
+				Name:      "retention",
+				Usage:     "Show or set how many previous revisions are kept per entry",
+				ArgsUsage: "[revisions]",
+				Action: func(ctx *cli.Context) error {
+					masterPassword, err := getMasterPassword()
+					if err != nil {
+						return err
+					}
+
+					if ctx.NArg() < 1 {
+						keep, err := hushcore.HistoryRetention(masterPassword)
+						if err != nil {
+							return fmt.Errorf("failed to get history retention: %w", err)
+						}
+						fmt.Printf("Keeping %d previous revisions per entry.\n", keep)
+						return nil
+					}
+
+					keep, err := strconv.Atoi(ctx.Args().First())
+					if err != nil {
+						return fmt.Errorf("invalid number of revisions %q", ctx.Args().First())
+					}
+
+					if err := hushcore.SetHistoryRetention(masterPassword, keep); err != nil {
+						return fmt.Errorf("failed to set history retention: %w", err)
+					}
+
+					fmt.Printf("Now keeping %d previous revisions per entry.\n", keep)
 					return nil
 				},
 			},
@@ -181,6 +1055,7 @@ func main() {
 						Aliases: []string{"d"},
 						Usage:   "Display password instead of copying to clipboard",
 					},
+					clipTimeoutFlag(),
 				},
 				Action: func(ctx *cli.Context) error {
 					length := ctx.Int("length")
@@ -194,28 +1069,48 @@ func main() {
 					if display {
 						fmt.Printf("Generated password: %s\n", password)
 					} else {
-						if err = clipboard.WriteAll(password); err != nil {
+						clipTimeout := ctx.Duration("clip-timeout")
+						if err = copyToClipboard(password, clipTimeout); err != nil {
 							return fmt.Errorf("failed to copy password to clipboard: %w", err)
 						}
-						fmt.Println("Password copied to clipboard.")
+						fmt.Println(copiedMessage("Password", clipTimeout))
 					}
 
 					fmt.Print("Do you want to save this password? (y/N): ")
 					var response string
-					fmt.Scanln(&response)
+					fmt.Fscanln(stdin, &response)
 
 					if response == "y" || response == "Y" {
 						fmt.Print("Enter a name for this password: ")
-						var name string
-						fmt.Scanln(&name)
+						name, err := stdin.ReadString('\n')
+						if err != nil {
+							return fmt.Errorf("failed to read user input: %w", err)
+						}
+						name = strings.TrimSpace(name)
 
 						masterPassword, err := getMasterPassword()
 						if err != nil {
 							return err
 						}
 
-						if err = hushcore.AddPassword(name, password, masterPassword); err != nil {
-							fmt.Errorf("failed to save password: %w", err)
+						err = hushcore.AddPassword(name, password, masterPassword)
+						if errors.Is(err, hushcore.ErrEntryExists) {
+							fmt.Printf("%q already exists. Replace its password? (y/N): ", name)
+							response, readErr := stdin.ReadString('\n')
+							if readErr != nil {
+								return fmt.Errorf("failed to read user input: %w", readErr)
+							}
+							if strings.TrimSpace(strings.ToLower(response)) != "y" {
+								fmt.Println("Operation cancelled.")
+								return nil
+							}
+							err = hushcore.EditRecord(name, func(record *hushcore.Record) error {
+								record.Password = password
+								return nil
+							}, masterPassword)
+						}
+						if err != nil {
+							return fmt.Errorf("failed to save password: %w", err)
 						}
 						fmt.Printf("Password saved as %q.\n", name)
 					}
@@ -223,16 +1118,100 @@ func main() {
 					return nil
 				},
 			},
+			{
+				Name:  "verify",
+				Usage: "Check the vault against its authenticated manifest",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "repair",
+						Usage: "Accept the current state of the vault and write a new manifest",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					masterPassword, err := getMasterPassword()
+					if err != nil {
+						return err
+					}
+
+					if ctx.Bool("repair") {
+						rejected, err := hushcore.RepairManifest(masterPassword)
+						if err != nil {
+							return fmt.Errorf("failed to repair manifest: %w", err)
+						}
+
+						for _, name := range rejected {
+							fmt.Printf("Left out %q: it does not authenticate under this vault.\n", name)
+						}
+						fmt.Println("Manifest rewritten for the current state of the vault.")
+						return nil
+					}
+
+					issues, err := hushcore.VerifyVault(masterPassword)
+					if err != nil {
+						return fmt.Errorf("failed to verify vault: %w", err)
+					}
+
+					if len(issues) == 0 {
+						fmt.Println("Vault matches its manifest.")
+						return nil
+					}
+
+					for _, issue := range issues {
+						fmt.Printf("%s: %s\n", issue.Kind, issue)
+					}
+					return fmt.Errorf("vault verification found %d issue(s)", len(issues))
+				},
+			},
+			{
+				Name:  "vaults",
+				Usage: "List the default vault and all named vault profiles",
+				Action: func(ctx *cli.Context) error {
+					vaults, err := hushcore.ListVaults()
+					if err != nil {
+						return fmt.Errorf("failed to list vaults: %w", err)
+					}
+
+					current, err := hushcore.CurrentVaultDir()
+					if err != nil {
+						return fmt.Errorf("failed to list vaults: %w", err)
+					}
+
+					listed := false
+					for _, vault := range vaults {
+						marker := " "
+						if vault.Dir == current {
+							marker = "*"
+							listed = true
+						}
+
+						status := ""
+						if !vault.Initialized {
+							status = " (not initialized)"
+						}
+
+						fmt.Printf("%s %-12s %s%s\n", marker, vault.Name, vault.Dir, status)
+					}
+					if !listed {
+						fmt.Printf("* %-12s %s\n", "(path)", current)
+					}
+
+					return nil
+				},
+			},
 			{
 				Name:  "implode",
-				Usage: "Delete all data and remove the .hush directory",
+				Usage: "Delete all data and remove the vault directory",
 				Action: func(ctx *cli.Context) error {
-					fmt.Println("WARNING: This will delete all your stored passwords and remove the .hush directory.")
+					hushDir, err := hushcore.CurrentVaultDir()
+					if err != nil {
+						return err
+					}
+
+					fmt.Printf("WARNING: This will delete all your stored passwords and remove %s.\n", hushDir)
 					fmt.Println("This action is non-reversible and all data will be lost.")
 					fmt.Print("Are you sure you want to continue? (y/N): ")
 
-					reader := bufio.NewReader(os.Stdin)
-					response, err := reader.ReadString('\n')
+					response, err := stdin.ReadString('\n')
 					if err != nil {
 						return fmt.Errorf("failed to read user input: %w", err)
 					}
@@ -243,7 +1222,7 @@ func main() {
 						return nil
 					}
 
-					masterPassword, err := getMasterPassword()
+					masterPassword, err := promptMasterPassword()
 					if err != nil {
 						return err
 					}
@@ -256,10 +1235,18 @@ func main() {
 					return nil
 				},
 			},
+			importCommand(),
+			exportCommand(),
+			decryptExportCommand(),
+			backupCommand(),
+			gitCommand(),
+			agentCommand(),
+			lockCommand(),
+			clipHelperCommand(),
 		},
 	}
 
-	if err := app.Run(os.Args); err != nil {
+	if err := app.Run(flagsFirst(app, os.Args)); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/nochzato/hush/internal/hushcore"
+	"github.com/nochzato/hush/internal/importer"
+	"github.com/nochzato/hush/internal/passutils"
+	"github.com/urfave/cli/v2"
+)
+
+func importCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "import",
+		Usage:     "Import entries from another password manager",
+		ArgsUsage: "<file|directory>",
+		Description: "CSV exports of Chrome, Firefox, Bitwarden, 1Password and hush are recognized by their header; " +
+			"other CSV files need --map. KeePass databases (KDBX 4) are read with their password, and their groups become folders. " +
+			"A pass store is a directory whose files are decrypted with gpg. Entries whose passwords are too weak, or that cannot be read, are listed and left out.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "format",
+				Usage:    "Format of the file: csv, kdbx or pass",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "preset",
+				Usage: "CSV column mapping: " + strings.Join(importer.CSVPresets(), ", ") + " (default: detected from the header)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "map",
+				Usage: "Map a column to a CSV header as column=header, on top of the preset; columns are name, folder, url, username, password, notes, tags and otp, anything else becomes a custom field (can be repeated)",
+			},
+			&cli.StringFlag{
+				Name:  "gpg-command",
+				Value: importer.DefaultGPGCommand,
+				Usage: "Command that decrypts a pass file to standard output, given the file as its last argument",
+			},
+			&cli.StringFlag{
+				Name:  "conflict",
+				Value: string(hushcore.ConflictSkip),
+				Usage: "What to do with entries whose name is taken: skip, overwrite or rename",
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Only show what would be imported",
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			if ctx.NArg() < 1 {
+				return fmt.Errorf("missing file to import")
+			}
+			path := ctx.Args().First()
+
+			conflict, err := hushcore.ParseConflictPolicy(ctx.String("conflict"))
+			if err != nil {
+				return err
+			}
+
+			read, err := readImport(ctx, path)
+			if err != nil {
+				return err
+			}
+
+			masterPassword, err := getMasterPassword()
+			if err != nil {
+				return err
+			}
+
+			dryRun := ctx.Bool("dry-run")
+			result, err := hushcore.ImportEntries(read.Entries, conflict, dryRun, masterPassword)
+			if err != nil {
+				return fmt.Errorf("failed to import: %w", err)
+			}
+			result.Rejected = append(read.Rejected, result.Rejected...)
+
+			printImportResult(result, dryRun)
+			return nil
+		},
+	}
+}
+
+func readImport(ctx *cli.Context, path string) (*importer.Result, error) {
+	format := ctx.String("format")
+	if format != "csv" && (ctx.IsSet("preset") || ctx.IsSet("map")) {
+		return nil, fmt.Errorf("--preset and --map only apply to CSV files")
+	}
+	if format != "pass" && ctx.IsSet("gpg-command") {
+		return nil, fmt.Errorf("--gpg-command only applies to pass stores")
+	}
+
+	switch format {
+	case "csv":
+		columns, err := importer.ParseColumnMap(ctx.StringSlice("map"))
+		if err != nil {
+			return nil, err
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open import file: %w", err)
+		}
+		defer f.Close()
+
+		result, err := importer.ReadCSV(f, ctx.String("preset"), columns)
+		if err != nil {
+			return nil, err
+		}
+		if !ctx.IsSet("preset") && len(columns) == 0 {
+			fmt.Printf("Reading %s as a %s export.\n", path, result.Format)
+		}
+		return result, nil
+	case "kdbx":
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open import file: %w", err)
+		}
+		defer f.Close()
+
+		fmt.Print("Enter the password of the KeePass database: ")
+		password, err := passutils.ReadPassword(passwordReader())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read database password: %w", err)
+		}
+		fmt.Println()
+
+		result, err := importer.ReadKDBX(f, password)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read KeePass database: %w", err)
+		}
+		return result, nil
+	case "pass":
+		decrypt, err := importer.CommandDecrypter(ctx.String("gpg-command"))
+		if err != nil {
+			return nil, err
+		}
+		return importer.ReadPass(path, decrypt)
+	default:
+		return nil, fmt.Errorf("unsupported import format %q", format)
+	}
+}
+
+func printImportResult(result *hushcore.ImportResult, dryRun bool) {
+	if dryRun {
+		for _, name := range result.Added {
+			fmt.Printf("add      %s\n", name)
+		}
+		for _, name := range result.Replaced {
+			fmt.Printf("replace  %s\n", name)
+		}
+		for _, r := range result.Renamed {
+			fmt.Printf("rename   %s -> %s\n", r.From, r.To)
+		}
+		for _, name := range result.Skipped {
+			fmt.Printf("skip     %s\n", name)
+		}
+	}
+
+	verb := "Imported"
+	if dryRun {
+		verb = "Would import"
+	}
+	imported := len(result.Added) + len(result.Replaced) + len(result.Renamed)
+	total := imported + len(result.Skipped) + len(result.Rejected)
+	fmt.Printf("%s %d of %d entries: %d added, %d replaced, %d renamed, %d skipped, %d rejected.\n",
+		verb, imported, total, len(result.Added), len(result.Replaced), len(result.Renamed), len(result.Skipped), len(result.Rejected))
+
+	if len(result.Rejected) == 0 {
+		return
+	}
+	fmt.Println("Rejected entries:")
+	for _, r := range result.Rejected {
+		name := r.Name
+		if name == "" {
+			name = "(unnamed)"
+		}
+		fmt.Printf("  %s: %s: %s\n", r.Source, name, r.Reason)
+	}
+}
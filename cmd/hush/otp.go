@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nochzato/hush/internal/hushcore"
+	"github.com/nochzato/hush/internal/passutils"
+	"github.com/urfave/cli/v2"
+)
+
+func otpCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "otp",
+		Usage:     "Copy or display the current one-time code of an entry",
+		ArgsUsage: "<name>",
+		Description: "The entry needs an OTP secret, set with 'hush add --otp' or 'hush edit --otp'. " +
+			"TOTP codes are shown with the seconds they remain valid; HOTP codes advance the stored counter every time.",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:    "display",
+				Aliases: []string{"d"},
+				Usage:   "Display the code instead of copying to clipboard",
+			},
+			clipTimeoutFlag(),
+		},
+		Action: func(ctx *cli.Context) error {
+			if ctx.NArg() < 1 {
+				return fmt.Errorf("missing password name")
+			}
+			name := ctx.Args().First()
+
+			masterPassword, err := getMasterPassword()
+			if err != nil {
+				return err
+			}
+
+			code, err := hushcore.OTPCode(name, masterPassword)
+			if errors.Is(err, hushcore.ErrEntryTampered) {
+				fmt.Fprintf(os.Stderr, "WARNING: the password file for %q has been moved, swapped or modified outside of hush.\n", name)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to get one-time code: %w", err)
+			}
+
+			validity := ""
+			if !code.HOTP {
+				validity = fmt.Sprintf("Valid for %s.", code.Remaining.Round(time.Second))
+			}
+
+			if ctx.Bool("display") {
+				fmt.Println(code.Code)
+				// The validity goes to stderr so that the code can be
+				// captured on its own.
+				if validity != "" {
+					fmt.Fprintln(os.Stderr, validity)
+				}
+				return nil
+			}
+
+			clipTimeout := ctx.Duration("clip-timeout")
+			if err := copyToClipboard(code.Code, clipTimeout); err != nil {
+				return fmt.Errorf("failed to copy one-time code to clipboard: %w", err)
+			}
+			fmt.Println(copiedMessage(fmt.Sprintf("One-time code for '%s'", name), clipTimeout))
+			if validity != "" {
+				fmt.Println(validity)
+			}
+			return nil
+		},
+	}
+}
+
+// readOTPSecret prompts for an OTP secret and returns it as an otpauth://
+// URI, which is how records store it.
+func readOTPSecret() (string, error) {
+	fmt.Print("Enter the OTP secret or otpauth:// URI: ")
+	secret, err := passutils.ReadPassword(passwordReader())
+	if err != nil {
+		return "", fmt.Errorf("failed to read OTP secret: %w", err)
+	}
+	fmt.Println()
+
+	key, err := passutils.ParseOTP(secret)
+	if err != nil {
+		return "", fmt.Errorf("invalid OTP secret: %w", err)
+	}
+	return key.URI(), nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/nochzato/hush/internal/fuzzy"
+	"golang.org/x/term"
+)
+
+const (
+	pickerPrompt  = "> "
+	pickerMaxRows = 10
+)
+
+var errPickCancelled = errors.New("no entry picked")
+
+// isInteractive reports whether hush talks to a person at a terminal, who
+// can use the picker, rather than to a script.
+func isInteractive() bool {
+	return term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+type picker struct {
+	names    []string
+	lastUsed map[string]time.Time
+	query    []rune
+	matches  []fuzzy.Match
+	selected int
+	top      int
+	rows     int
+	width    int
+}
+
+// pickEntry lets the user narrow down names by typing and pick one with the
+// arrow keys and Enter. It draws below the cursor and clears up after
+// itself.
+func pickEntry(names []string, lastUsed map[string]time.Time, query string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	oldState, err := term.MakeRaw(fd)
+	if err != nil {
+		return "", fmt.Errorf("failed to set up terminal: %w", err)
+	}
+	defer term.Restore(fd, oldState)
+
+	p := &picker{names: names, lastUsed: lastUsed, query: []rune(query), rows: pickerMaxRows, width: 80}
+	if width, height, err := term.GetSize(int(os.Stdout.Fd())); err == nil && width > 0 && height > 0 {
+		p.rows = max(min(pickerMaxRows, height-2), 1)
+		p.width = width
+	}
+	p.update()
+	defer fmt.Print("\r\x1b[J")
+
+	buf := make([]byte, 64)
+	for {
+		p.draw()
+
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return "", fmt.Errorf("failed to read input: %w", err)
+		}
+
+		name, done, err := p.handle(buf[:n])
+		if done {
+			return name, err
+		}
+	}
+}
+
+// handle processes one read of key presses. It reports done once an entry
+// was picked or the picker was cancelled.
+func (p *picker) handle(keys []byte) (string, bool, error) {
+	if keys[0] == 0x1b {
+		switch {
+		case len(keys) == 1:
+			return "", true, errPickCancelled
+		case len(keys) >= 3 && (keys[1] == '[' || keys[1] == 'O') && keys[2] == 'A':
+			p.move(-1)
+		case len(keys) >= 3 && (keys[1] == '[' || keys[1] == 'O') && keys[2] == 'B':
+			p.move(1)
+		}
+		return "", false, nil
+	}
+
+	for len(keys) > 0 {
+		r, size := utf8.DecodeRune(keys)
+		keys = keys[size:]
+
+		switch r {
+		case 0x03, 0x07: // Ctrl-C, Ctrl-G
+			return "", true, errPickCancelled
+		case 0x04: // Ctrl-D
+			if len(p.query) == 0 {
+				return "", true, errPickCancelled
+			}
+		case '\r', '\n':
+			if len(p.matches) == 0 {
+				continue
+			}
+			return p.matches[p.selected].Name, true, nil
+		case 0x7f, 0x08: // Backspace
+			if len(p.query) > 0 {
+				p.query = p.query[:len(p.query)-1]
+				p.update()
+			}
+		case 0x15: // Ctrl-U
+			p.query = nil
+			p.update()
+		case 0x10, 0x0b: // Ctrl-P, Ctrl-K
+			p.move(-1)
+		case 0x0e, '\t': // Ctrl-N, Tab
+			p.move(1)
+		default:
+			if unicode.IsPrint(r) {
+				p.query = append(p.query, r)
+				p.update()
+			}
+		}
+	}
+
+	return "", false, nil
+}
+
+func (p *picker) update() {
+	p.matches = fuzzy.Rank(p.names, string(p.query), p.lastUsed, time.Now())
+	p.selected, p.top = 0, 0
+}
+
+func (p *picker) move(delta int) {
+	if len(p.matches) == 0 {
+		return
+	}
+
+	p.selected = min(max(p.selected+delta, 0), len(p.matches)-1)
+	if p.selected < p.top {
+		p.top = p.selected
+	}
+	if p.selected >= p.top+p.rows {
+		p.top = p.selected - p.rows + 1
+	}
+}
+
+// draw renders the prompt and the visible matches, then puts the cursor back
+// at the end of the query.
+func (p *picker) draw() {
+	var b strings.Builder
+	b.WriteString("\r\x1b[J" + pickerPrompt + string(p.query))
+
+	lines := 1
+	visible := p.matches[p.top:min(p.top+p.rows, len(p.matches))]
+	for i, m := range visible {
+		b.WriteString("\r\n")
+		p.drawMatch(&b, m, p.top+i == p.selected)
+	}
+	lines += len(visible)
+
+	b.WriteString("\r\n")
+	fmt.Fprintf(&b, "\x1b[2m  %d/%d\x1b[0m", len(p.matches), len(p.names))
+	lines++
+
+	fmt.Fprintf(&b, "\x1b[%dA\r\x1b[%dC", lines-1, len(pickerPrompt)+len(p.query))
+	fmt.Print(b.String())
+}
+
+func (p *picker) drawMatch(b *strings.Builder, m fuzzy.Match, selected bool) {
+	if selected {
+		b.WriteString("\x1b[7m> ")
+	} else {
+		b.WriteString("  ")
+	}
+
+	runes := []rune(m.Name)
+	maxRunes := max(p.width-3, 1)
+	truncated := len(runes) > maxRunes
+	if truncated {
+		runes = runes[:maxRunes-1]
+	}
+
+	matched := map[int]bool{}
+	for _, pos := range m.Positions {
+		matched[pos] = true
+	}
+	for i, r := range runes {
+		if matched[i] {
+			b.WriteString("\x1b[1m" + string(r) + "\x1b[22m")
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	if truncated {
+		b.WriteString("…")
+	}
+
+	b.WriteString("\x1b[0m")
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+)
+
+type treeNode struct {
+	children map[string]*treeNode
+}
+
+// printTree prints names as a tree of folders, relative to folder.
+func printTree(w io.Writer, names []string, folder string) {
+	root := &treeNode{children: map[string]*treeNode{}}
+	for _, name := range names {
+		name = strings.TrimPrefix(name, folder+"/")
+
+		node := root
+		for _, segment := range strings.Split(name, "/") {
+			child, ok := node.children[segment]
+			if !ok {
+				child = &treeNode{children: map[string]*treeNode{}}
+				node.children[segment] = child
+			}
+			node = child
+		}
+	}
+
+	if folder != "" {
+		fmt.Fprintln(w, folder)
+	}
+	root.print(w, "")
+}
+
+func (n *treeNode) print(w io.Writer, indent string) {
+	segments := slices.Sorted(maps.Keys(n.children))
+	for i, segment := range segments {
+		branch, nextIndent := "├── ", indent+"│   "
+		if i == len(segments)-1 {
+			branch, nextIndent = "└── ", indent+"    "
+		}
+
+		fmt.Fprintf(w, "%s%s%s\n", indent, branch, segment)
+		n.children[segment].print(w, nextIndent)
+	}
+}
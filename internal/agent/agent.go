@@ -0,0 +1,447 @@
+// Package agent implements the hush agent, which keeps unlocked vault keys
+// in memory so that hush does not need the master password for every
+// command, and a client for it.
+//
+// The agent listens on a Unix socket in a directory only its user can
+// access, and agent and clients check that the other end of a connection
+// runs as the same user where the platform can tell. A client sends one
+// request per connection as a single line of JSON and the agent answers
+// with a single line of JSON:
+//
+//	{"op": "get", "vault": "<vault id>"}
+//	{"ok": true, "key": "<base64 data key>"}
+//
+// The operations are:
+//
+//   - get: return the key of a vault, resetting its idle timer. Fails with
+//     the error "locked" when the agent holds no key for the vault.
+//   - put: remember "key" for "vault".
+//   - lock: forget the key of "vault", or of every vault if it is empty.
+//   - status: list the unlocked vaults in "vaults", each with "vault",
+//     "unlocked", "last_used" and "expires" times.
+//   - stop: forget every key and exit.
+//
+// Failed requests are answered with {"ok": false, "error": "<message>"}.
+// Keys are forgotten once unused for the idle timeout or once they were
+// held for the maximum lifetime, whichever comes first.
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// SocketEnv overrides where the agent socket is.
+	SocketEnv      = "HUSH_AGENT_SOCK"
+	runtimeDirName = "hush"
+	socketFileName = "agent.sock"
+
+	DefaultIdleTimeout = 15 * time.Minute
+	DefaultMaxLifetime = 4 * time.Hour
+
+	requestTimeout = 5 * time.Second
+	sweepInterval  = time.Second
+	maxRequestSize = 64 * 1024
+
+	lockedError = "locked"
+)
+
+var (
+	ErrNotRunning     = errors.New("hush agent is not running")
+	ErrAlreadyRunning = errors.New("hush agent is already running")
+	ErrLocked         = errors.New("vault is locked")
+)
+
+type Request struct {
+	Op    string `json:"op"`
+	Vault string `json:"vault,omitempty"`
+	Key   []byte `json:"key,omitempty"`
+}
+
+type Response struct {
+	OK     bool          `json:"ok"`
+	Error  string        `json:"error,omitempty"`
+	Key    []byte        `json:"key,omitempty"`
+	Vaults []VaultStatus `json:"vaults,omitempty"`
+}
+
+// VaultStatus describes a vault whose key the agent holds.
+type VaultStatus struct {
+	Vault    string    `json:"vault"`
+	Unlocked time.Time `json:"unlocked"`
+	LastUsed time.Time `json:"last_used"`
+	Expires  time.Time `json:"expires"`
+}
+
+// RuntimeDir returns the directory for files that only live as long as the
+// user's session: a hush directory under $XDG_RUNTIME_DIR or, failing that,
+// a per-user directory in the system temp directory.
+func RuntimeDir() string {
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		return filepath.Join(runtimeDir, runtimeDirName)
+	}
+	return filepath.Join(os.TempDir(), runtimeDirName+"-"+strconv.Itoa(os.Getuid()))
+}
+
+// SocketPath returns where the agent listens: $HUSH_AGENT_SOCK, or
+// agent.sock in RuntimeDir.
+func SocketPath() string {
+	if path := os.Getenv(SocketEnv); path != "" {
+		return path
+	}
+	return filepath.Join(RuntimeDir(), socketFileName)
+}
+
+// PrivateDir creates dir for the current user only, and refuses it if it
+// already exists and does not pass CheckPrivateDir.
+func PrivateDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	return CheckPrivateDir(dir)
+}
+
+// CheckPrivateDir makes sure that dir is a directory of the current user,
+// not a symbolic link, that nobody else can access. Another local user
+// could otherwise create it first, in the system temp directory, and have
+// keys and guard files handed to them.
+func CheckPrivateDir(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return fmt.Errorf("failed to check directory: %w", err)
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("directory %s must not be a symbolic link", dir)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if err := checkOwner(dir, info); err != nil {
+		return err
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("directory %s must only be accessible by its owner (mode %o)", dir, info.Mode().Perm())
+	}
+	return nil
+}
+
+// checkPeerUID refuses a peer on the agent socket that runs as another
+// user than the current one.
+func checkPeerUID(uid int) error {
+	if uid != os.Getuid() {
+		return fmt.Errorf("peer on the agent socket runs as user %d, not %d", uid, os.Getuid())
+	}
+	return nil
+}
+
+// Listen creates the agent socket at path, in a PrivateDir.
+func Listen(path string) (net.Listener, error) {
+	if err := PrivateDir(filepath.Dir(path)); err != nil {
+		return nil, fmt.Errorf("unsafe socket directory: %w", err)
+	}
+
+	if _, err := Status(path); err == nil {
+		return nil, ErrAlreadyRunning
+	}
+	// Whatever is left is a socket of an agent that is gone.
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to protect socket: %w", err)
+	}
+
+	return l, nil
+}
+
+type cachedKey struct {
+	key      []byte
+	unlocked time.Time
+	lastUsed time.Time
+}
+
+// Server holds vault keys and answers requests for them.
+type Server struct {
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+	now         func() time.Time
+
+	mu       sync.Mutex
+	keys     map[string]*cachedKey
+	listener net.Listener
+	stopped  bool
+}
+
+func NewServer(idleTimeout, maxLifetime time.Duration) *Server {
+	return &Server{
+		idleTimeout: idleTimeout,
+		maxLifetime: maxLifetime,
+		now:         time.Now,
+		keys:        map[string]*cachedKey{},
+	}
+}
+
+// Serve answers requests on l until the server is stopped, then closes l.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	s.listener = l
+	stopped := s.stopped
+	s.mu.Unlock()
+	if stopped {
+		l.Close()
+		return nil
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.sweep(done)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			stopped := s.stopped
+			s.mu.Unlock()
+			if stopped {
+				return nil
+			}
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+		go s.handle(conn)
+	}
+}
+
+// Stop forgets every key and makes Serve return.
+func (s *Server) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopped = true
+	s.lockVault("")
+	if s.listener != nil {
+		s.listener.Close()
+	}
+}
+
+func (s *Server) sweep(done <-chan struct{}) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			s.expire()
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *Server) expiry(k *cachedKey) time.Time {
+	idle, lifetime := k.lastUsed.Add(s.idleTimeout), k.unlocked.Add(s.maxLifetime)
+	if idle.Before(lifetime) {
+		return idle
+	}
+	return lifetime
+}
+
+// expire forgets every key past its idle timeout or maximum lifetime.
+func (s *Server) expire() {
+	now := s.now()
+	for vault, k := range s.keys {
+		if !now.Before(s.expiry(k)) {
+			s.forget(vault)
+		}
+	}
+}
+
+func (s *Server) forget(vault string) {
+	clear(s.keys[vault].key)
+	delete(s.keys, vault)
+}
+
+func (s *Server) lockVault(vault string) {
+	for v := range s.keys {
+		if vault == "" || v == vault {
+			s.forget(v)
+		}
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	if err := checkPeer(conn); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+
+	line, err := bufio.NewReader(io.LimitReader(conn, maxRequestSize)).ReadBytes('\n')
+	if err != nil {
+		return
+	}
+
+	var req Request
+	var resp *Response
+	if err := json.Unmarshal(line, &req); err != nil {
+		resp = &Response{Error: "invalid request"}
+	} else {
+		resp = s.Handle(&req)
+	}
+	clear(req.Key)
+
+	data, err := json.Marshal(resp)
+	clear(resp.Key)
+	if err != nil {
+		return
+	}
+	conn.Write(append(data, '\n'))
+
+	if req.Op == "stop" && resp.OK {
+		s.Stop()
+	}
+}
+
+// Handle answers a single request.
+func (s *Server) Handle(req *Request) *Response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+
+	switch req.Op {
+	case "get":
+		k, ok := s.keys[req.Vault]
+		if !ok {
+			return &Response{Error: lockedError}
+		}
+		k.lastUsed = s.now()
+		return &Response{OK: true, Key: append([]byte(nil), k.key...)}
+	case "put":
+		if req.Vault == "" || len(req.Key) == 0 {
+			return &Response{Error: "put needs a vault and a key"}
+		}
+		if _, ok := s.keys[req.Vault]; ok {
+			s.forget(req.Vault)
+		}
+		now := s.now()
+		s.keys[req.Vault] = &cachedKey{key: append([]byte(nil), req.Key...), unlocked: now, lastUsed: now}
+		return &Response{OK: true}
+	case "lock":
+		s.lockVault(req.Vault)
+		return &Response{OK: true}
+	case "status":
+		resp := &Response{OK: true}
+		for vault, k := range s.keys {
+			resp.Vaults = append(resp.Vaults, VaultStatus{
+				Vault:    vault,
+				Unlocked: k.unlocked,
+				LastUsed: k.lastUsed,
+				Expires:  s.expiry(k),
+			})
+		}
+		return resp
+	case "stop":
+		return &Response{OK: true}
+	default:
+		return &Response{Error: fmt.Sprintf("unknown operation %q", req.Op)}
+	}
+}
+
+// call sends req to the agent at path and returns its answer. Only an agent
+// of the current user, listening in a private directory, is talked to.
+func call(path string, req *Request) (*Response, error) {
+	if err := CheckPrivateDir(filepath.Dir(path)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w: %w", ErrNotRunning, err)
+		}
+		return nil, fmt.Errorf("unsafe socket directory: %w", err)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNotRunning, err)
+	}
+	defer conn.Close()
+	if err := checkPeer(conn); err != nil {
+		return nil, fmt.Errorf("refusing agent: %w", err)
+	}
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %w", err)
+	}
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		return nil, fmt.Errorf("failed to send request to agent: %w", err)
+	}
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read answer from agent: %w", err)
+	}
+
+	var resp Response
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return nil, fmt.Errorf("failed to decode answer from agent: %w", err)
+	}
+	if !resp.OK {
+		if resp.Error == lockedError {
+			return nil, ErrLocked
+		}
+		return nil, fmt.Errorf("agent: %s", resp.Error)
+	}
+
+	return &resp, nil
+}
+
+// GetKey returns the key the agent holds for vault, or ErrLocked.
+func GetKey(path, vault string) ([]byte, error) {
+	resp, err := call(path, &Request{Op: "get", Vault: vault})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Key, nil
+}
+
+func PutKey(path, vault string, key []byte) error {
+	_, err := call(path, &Request{Op: "put", Vault: vault, Key: key})
+	return err
+}
+
+// Lock makes the agent forget the key of vault, or every key if vault is
+// empty.
+func Lock(path, vault string) error {
+	_, err := call(path, &Request{Op: "lock", Vault: vault})
+	return err
+}
+
+func Status(path string) ([]VaultStatus, error) {
+	resp, err := call(path, &Request{Op: "status"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Vaults, nil
+}
+
+func Stop(path string) error {
+	_, err := call(path, &Request{Op: "stop"})
+	return err
+}
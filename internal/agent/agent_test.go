@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerExpiry(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	s := NewServer(10*time.Minute, time.Hour)
+	s.now = func() time.Time { return now }
+
+	get := func(vault string) *Response {
+		return s.Handle(&Request{Op: "get", Vault: vault})
+	}
+
+	require.Equal(t, lockedError, get("a").Error)
+	require.True(t, s.Handle(&Request{Op: "put", Vault: "a", Key: []byte("key-a")}).OK)
+	require.True(t, s.Handle(&Request{Op: "put", Vault: "b", Key: []byte("key-b")}).OK)
+	require.False(t, s.Handle(&Request{Op: "put", Vault: "c"}).OK)
+
+	resp := get("a")
+	require.True(t, resp.OK)
+	require.Equal(t, []byte("key-a"), resp.Key)
+
+	// Using a key keeps it alive past the idle timeout...
+	for range 5 {
+		now = now.Add(9 * time.Minute)
+		require.True(t, get("a").OK)
+	}
+	require.Equal(t, lockedError, get("b").Error)
+
+	// ...but not past the maximum lifetime.
+	now = now.Add(9 * time.Minute)
+	require.True(t, get("a").OK)
+	now = now.Add(9 * time.Minute)
+	require.Equal(t, lockedError, get("a").Error)
+
+	require.True(t, s.Handle(&Request{Op: "put", Vault: "a", Key: []byte("key-a")}).OK)
+	require.True(t, s.Handle(&Request{Op: "put", Vault: "b", Key: []byte("key-b")}).OK)
+	status := s.Handle(&Request{Op: "status"})
+	require.Len(t, status.Vaults, 2)
+	require.Equal(t, now.Add(10*time.Minute), status.Vaults[0].Expires)
+
+	require.True(t, s.Handle(&Request{Op: "lock", Vault: "a"}).OK)
+	require.Equal(t, lockedError, get("a").Error)
+	require.True(t, get("b").OK)
+	require.True(t, s.Handle(&Request{Op: "lock"}).OK)
+	require.Equal(t, lockedError, get("b").Error)
+
+	require.False(t, s.Handle(&Request{Op: "bogus"}).OK)
+}
+
+func TestAgentSocket(t *testing.T) {
+	dir, err := os.MkdirTemp("", "hush-agent")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hush", "agent.sock")
+
+	_, err = Status(path)
+	require.ErrorIs(t, err, ErrNotRunning)
+
+	l, err := Listen(path)
+	require.NoError(t, err)
+	s := NewServer(time.Minute, time.Hour)
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(l) }()
+
+	info, err := os.Stat(filepath.Dir(path))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	_, err = Listen(path)
+	require.ErrorIs(t, err, ErrAlreadyRunning)
+
+	_, err = GetKey(path, "vault")
+	require.ErrorIs(t, err, ErrLocked)
+	require.NoError(t, PutKey(path, "vault", []byte("secret key")))
+	key, err := GetKey(path, "vault")
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret key"), key)
+
+	vaults, err := Status(path)
+	require.NoError(t, err)
+	require.Len(t, vaults, 1)
+	require.Equal(t, "vault", vaults[0].Vault)
+
+	require.NoError(t, Lock(path, ""))
+	_, err = GetKey(path, "vault")
+	require.ErrorIs(t, err, ErrLocked)
+
+	require.NoError(t, Stop(path))
+	require.NoError(t, <-served)
+	_, err = Status(path)
+	require.ErrorIs(t, err, ErrNotRunning)
+
+	// Neither the agent nor a client uses a directory others can get at.
+	require.NoError(t, os.Chmod(filepath.Dir(path), 0755))
+	_, err = Listen(path)
+	require.Error(t, err)
+	_, err = Status(path)
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrNotRunning)
+	require.NoError(t, os.Chmod(filepath.Dir(path), 0700))
+
+	// A socket left behind by an agent that died is replaced.
+	require.NoError(t, os.WriteFile(path, nil, 0600))
+	l, err = Listen(path)
+	require.NoError(t, err)
+	l.Close()
+}
+
+func TestPrivateDir(t *testing.T) {
+	dir := t.TempDir()
+	private := filepath.Join(dir, "private")
+	require.NoError(t, PrivateDir(private))
+	require.NoError(t, CheckPrivateDir(private))
+
+	link := filepath.Join(dir, "link")
+	require.NoError(t, os.Symlink(private, link))
+	require.Error(t, PrivateDir(link))
+	_, err := Listen(filepath.Join(link, "agent.sock"))
+	require.Error(t, err)
+
+	file := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(file, nil, 0600))
+	require.Error(t, CheckPrivateDir(file))
+
+	// Only root can hand a directory to another user.
+	if os.Getuid() == 0 {
+		foreign := filepath.Join(dir, "foreign")
+		require.NoError(t, os.Mkdir(foreign, 0700))
+		require.NoError(t, os.Chown(foreign, 12345, 12345))
+		require.Error(t, PrivateDir(foreign))
+		_, err := Status(filepath.Join(foreign, "agent.sock"))
+		require.NotErrorIs(t, err, ErrNotRunning)
+	}
+
+	require.NoError(t, checkPeerUID(os.Getuid()))
+	require.Error(t, checkPeerUID(os.Getuid()+1))
+}
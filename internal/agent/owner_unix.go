@@ -0,0 +1,20 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package agent
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+func checkOwner(dir string, info os.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("failed to read owner of %s", dir)
+	}
+	if int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("directory %s belongs to user %d, not %d", dir, stat.Uid, os.Getuid())
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+//go:build darwin || freebsd || linux
+
+package agent
+
+import (
+	"fmt"
+	"net"
+)
+
+// checkPeer refuses conn unless the process at its other end runs as the
+// current user.
+func checkPeer(conn net.Conn) error {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return fmt.Errorf("not a unix socket connection")
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("failed to read peer credentials: %w", err)
+	}
+
+	var uid int
+	var uidErr error
+	if err := raw.Control(func(fd uintptr) {
+		uid, uidErr = peerUID(int(fd))
+	}); err != nil {
+		return fmt.Errorf("failed to read peer credentials: %w", err)
+	}
+	if uidErr != nil {
+		return fmt.Errorf("failed to read peer credentials: %w", uidErr)
+	}
+
+	return checkPeerUID(uid)
+}
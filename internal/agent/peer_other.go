@@ -0,0 +1,11 @@
+//go:build !(darwin || freebsd || linux)
+
+package agent
+
+import "net"
+
+// checkPeer accepts every connection on platforms where hush cannot ask
+// for the credentials of the peer; the private socket directory has to do.
+func checkPeer(conn net.Conn) error {
+	return nil
+}
@@ -0,0 +1,72 @@
+package exporter
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nochzato/hush/internal/hushcore"
+)
+
+// csvHeader uses the column names hush imports, so that the export can be
+// imported again with the hush preset.
+var csvHeader = []string{"name", "url", "username", "password", "notes", "tags", "otp", "fields", "revision", "modified"}
+
+type csvWriter struct {
+	w       *csv.Writer
+	started bool
+}
+
+// NewCSV returns a Writer for a CSV file with one row per entry. URLs are
+// separated by newlines, and custom fields are "key: value" lines like in
+// Bitwarden exports, so whether they are sensitive is lost.
+func NewCSV(w io.Writer) Writer {
+	return &csvWriter{w: csv.NewWriter(w)}
+}
+
+func (c *csvWriter) Add(info hushcore.EntryInfo, record *hushcore.Record) error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+
+	fields := make([]string, 0, len(record.Fields))
+	for _, f := range record.Fields {
+		fields = append(fields, f.Key+": "+f.Value)
+	}
+
+	modified := ""
+	if !info.Modified.IsZero() {
+		modified = info.Modified.UTC().Format(time.RFC3339)
+	}
+
+	return c.w.Write([]string{
+		info.Name,
+		strings.Join(record.URLs, "\n"),
+		record.Username,
+		record.Password,
+		record.Notes,
+		strings.Join(record.Tags, ","),
+		record.OTP,
+		strings.Join(fields, "\n"),
+		strconv.Itoa(info.Revision),
+		modified,
+	})
+}
+
+func (c *csvWriter) Close() error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvWriter) writeHeader() error {
+	if c.started {
+		return nil
+	}
+	c.started = true
+	return c.w.Write(csvHeader)
+}
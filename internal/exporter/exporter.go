@@ -0,0 +1,12 @@
+// Package exporter writes vault entries, as walked by hushcore.WalkRecords,
+// in the formats of other password managers.
+package exporter
+
+import "github.com/nochzato/hush/internal/hushcore"
+
+// Writer writes one entry at a time. Close finishes the export; nothing
+// may be complete before it returns.
+type Writer interface {
+	Add(info hushcore.EntryInfo, record *hushcore.Record) error
+	Close() error
+}
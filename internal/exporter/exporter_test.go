@@ -0,0 +1,155 @@
+package exporter
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nochzato/hush/internal/hushcore"
+	"github.com/nochzato/hush/internal/importer"
+	"github.com/nochzato/hush/internal/kdbx"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKDBX(t *testing.T) {
+	modified := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	w := NewKDBX(&buf, "export password")
+
+	require.NoError(t, w.Add(hushcore.EntryInfo{Name: "mail", Revision: 1, Modified: modified}, &hushcore.Record{
+		Password: "Secret123!",
+		Username: "alice",
+		URLs:     []string{"https://mail.example.com", "https://webmail.example.com"},
+		Notes:    "first",
+		Fields:   []hushcore.Field{{Key: "PIN", Value: "1234", Sensitive: true}, {Key: "Title", Value: "Dr"}},
+		Tags:     []string{"work"},
+		OTP:      "otpauth://totp/?algorithm=SHA1&digits=6&period=30&secret=GEZDGNBVGY3TQOJQ",
+	}))
+	require.NoError(t, w.Add(hushcore.EntryInfo{Name: "servers/prod/db", Modified: modified}, &hushcore.Record{Password: "Pr0d!Pass"}))
+	require.NoError(t, w.Add(hushcore.EntryInfo{Name: "servers/staging", Modified: modified}, &hushcore.Record{Password: "St4ge!Pass"}))
+	require.NoError(t, w.Close())
+
+	db, err := kdbx.Read(&buf, "export password")
+	require.NoError(t, err)
+	require.Equal(t, "hush", db.Name)
+
+	field := func(key, value string) kdbx.Field { return kdbx.Field{Key: key, Value: value} }
+	protected := func(key, value string) kdbx.Field { return kdbx.Field{Key: key, Value: value, Protected: true} }
+	require.Equal(t, kdbx.Group{
+		Name: "Root",
+		Entries: []kdbx.Entry{{
+			Fields: []kdbx.Field{
+				field("Title", "mail"),
+				field("UserName", "alice"),
+				protected("Password", "Secret123!"),
+				field("URL", "https://mail.example.com"),
+				field("Notes", "first"),
+				field("KP2A_URL_1", "https://webmail.example.com"),
+				protected("otp", "otpauth://totp/?algorithm=SHA1&digits=6&period=30&secret=GEZDGNBVGY3TQOJQ"),
+				protected("PIN", "1234"),
+				field("Title (2)", "Dr"),
+			},
+			Tags:     []string{"work"},
+			Modified: modified,
+		}},
+		Groups: []kdbx.Group{{
+			Name: "servers",
+			Entries: []kdbx.Entry{{
+				Fields:   []kdbx.Field{field("Title", "staging"), field("UserName", ""), protected("Password", "St4ge!Pass"), field("URL", ""), field("Notes", "")},
+				Modified: modified,
+			}},
+			Groups: []kdbx.Group{{
+				Name: "prod",
+				Entries: []kdbx.Entry{{
+					Fields:   []kdbx.Field{field("Title", "db"), field("UserName", ""), protected("Password", "Pr0d!Pass"), field("URL", ""), field("Notes", "")},
+					Modified: modified,
+				}},
+			}},
+		}},
+	}, db.Root)
+}
+
+var testEntries = []struct {
+	info   hushcore.EntryInfo
+	record hushcore.Record
+}{
+	{
+		info: hushcore.EntryInfo{Name: "bank", Revision: 3, Modified: time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)},
+		record: hushcore.Record{
+			Password: "Money$$99",
+			Username: "erin",
+			URLs:     []string{"https://bank.example", "https://m.bank.example"},
+			Notes:    "PIN in safe,\n\"really\"",
+			Fields:   []hushcore.Field{{Key: "pin", Value: "1234", Sensitive: true}},
+			Tags:     []string{"finance", "home"},
+			OTP:      "otpauth://totp/?algorithm=SHA1&digits=6&period=30&secret=GEZDGNBVGY3TQOJQ",
+		},
+	},
+	{
+		info:   hushcore.EntryInfo{Name: "work/mail", Revision: 1, Modified: time.Date(2024, 4, 2, 8, 0, 0, 0, time.UTC)},
+		record: hushcore.Record{Password: "Mail#Secret1"},
+	},
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewJSON(&buf)
+	require.NoError(t, w.Close())
+	require.JSONEq(t, `{"version":1,"entries":[]}`, buf.String())
+
+	buf.Reset()
+	w = NewJSON(&buf)
+	for _, e := range testEntries {
+		require.NoError(t, w.Add(e.info, &e.record))
+	}
+	require.NoError(t, w.Close())
+
+	var doc struct {
+		Version int `json:"version"`
+		Entries []struct {
+			Name     string    `json:"name"`
+			Revision int       `json:"revision"`
+			Modified time.Time `json:"modified"`
+			hushcore.Record
+		} `json:"entries"`
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &doc))
+	require.Equal(t, 1, doc.Version)
+	require.Len(t, doc.Entries, len(testEntries))
+	for i, e := range testEntries {
+		require.Equal(t, e.info.Name, doc.Entries[i].Name)
+		require.Equal(t, e.info.Revision, doc.Entries[i].Revision)
+		require.Equal(t, e.info.Modified, doc.Entries[i].Modified)
+		require.Equal(t, e.record, doc.Entries[i].Record)
+	}
+}
+
+func TestCSV(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewCSV(&buf)
+	for _, e := range testEntries {
+		require.NoError(t, w.Add(e.info, &e.record))
+	}
+	require.NoError(t, w.Close())
+	require.Contains(t, buf.String(), "name,url,username,password,notes,tags,otp,fields,revision,modified\n")
+	require.Contains(t, buf.String(), ",3,2024-03-01T12:30:00Z\n")
+
+	// The export is recognized and imported again, except that custom
+	// fields are no longer sensitive.
+	result, err := importer.ReadCSV(&buf, "", nil)
+	require.NoError(t, err)
+	require.Equal(t, "hush", result.Format)
+	require.Empty(t, result.Rejected)
+	require.Len(t, result.Entries, len(testEntries))
+	for i, e := range testEntries {
+		want := e.record
+		want.Fields = slices.Clone(want.Fields)
+		for j := range want.Fields {
+			want.Fields[j].Sensitive = false
+		}
+		require.Equal(t, e.info.Name, result.Entries[i].Name)
+		require.Equal(t, want, result.Entries[i].Record)
+	}
+}
@@ -0,0 +1,57 @@
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/nochzato/hush/internal/hushcore"
+)
+
+const jsonFormatVersion = 1
+
+type jsonEntry struct {
+	Name     string    `json:"name"`
+	Revision int       `json:"revision"`
+	Modified time.Time `json:"modified"`
+	*hushcore.Record
+}
+
+type jsonWriter struct {
+	w       io.Writer
+	started bool
+}
+
+// NewJSON returns a Writer for a JSON document with every field of every
+// entry. Entries are written as they are added, one per line.
+func NewJSON(w io.Writer) Writer {
+	return &jsonWriter{w: w}
+}
+
+func (j *jsonWriter) Add(info hushcore.EntryInfo, record *hushcore.Record) error {
+	data, err := json.Marshal(jsonEntry{Name: info.Name, Revision: info.Revision, Modified: info.Modified, Record: record})
+	if err != nil {
+		return fmt.Errorf("failed to encode %q: %w", info.Name, err)
+	}
+
+	separator := ",\n"
+	if !j.started {
+		separator = fmt.Sprintf("{\"version\":%d,\"entries\":[\n", jsonFormatVersion)
+		j.started = true
+	}
+	if _, err := io.WriteString(j.w, separator); err != nil {
+		return err
+	}
+	_, err = j.w.Write(data)
+	return err
+}
+
+func (j *jsonWriter) Close() error {
+	end := "\n]}\n"
+	if !j.started {
+		end = fmt.Sprintf("{\"version\":%d,\"entries\":[]}\n", jsonFormatVersion)
+	}
+	_, err := io.WriteString(j.w, end)
+	return err
+}
@@ -0,0 +1,100 @@
+package exporter
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/nochzato/hush/internal/hushcore"
+	"github.com/nochzato/hush/internal/kdbx"
+)
+
+const (
+	kdbxDatabaseName = "hush"
+	kdbxRootGroup    = "Root"
+	kdbxFieldOTP     = "otp"
+	kdbxFieldURL     = "KP2A_URL"
+)
+
+type kdbxWriter struct {
+	w        io.Writer
+	password string
+	db       kdbx.Database
+}
+
+// NewKDBX returns a Writer for a KeePass KDBX 4 database protected by
+// password. Folders become groups. The database is one encrypted document,
+// so it is kept in memory until Close writes it.
+func NewKDBX(w io.Writer, password string) Writer {
+	return &kdbxWriter{
+		w:        w,
+		password: password,
+		db:       kdbx.Database{Name: kdbxDatabaseName, Root: kdbx.Group{Name: kdbxRootGroup}},
+	}
+}
+
+func (k *kdbxWriter) Add(info hushcore.EntryInfo, record *hushcore.Record) error {
+	segments := strings.Split(info.Name, "/")
+	group := &k.db.Root
+	for _, name := range segments[:len(segments)-1] {
+		group = subGroup(group, name)
+	}
+
+	entry := kdbx.Entry{Tags: record.Tags, Modified: info.Modified}
+	add := func(key, value string, protected bool) {
+		// KeePass needs the keys of an entry to be unique.
+		unique := key
+		for n := 2; hasField(entry, unique); n++ {
+			unique = fmt.Sprintf("%s (%d)", key, n)
+		}
+		entry.Fields = append(entry.Fields, kdbx.Field{Key: unique, Value: value, Protected: protected})
+	}
+
+	add(kdbx.FieldTitle, segments[len(segments)-1], false)
+	add(kdbx.FieldUserName, record.Username, false)
+	add(kdbx.FieldPassword, record.Password, true)
+	url := ""
+	if len(record.URLs) > 0 {
+		url = record.URLs[0]
+	}
+	add(kdbx.FieldURL, url, false)
+	add(kdbx.FieldNotes, record.Notes, false)
+	for i, u := range record.URLs[min(1, len(record.URLs)):] {
+		add(fmt.Sprintf("%s_%d", kdbxFieldURL, i+1), u, false)
+	}
+	if record.OTP != "" {
+		add(kdbxFieldOTP, record.OTP, true)
+	}
+	for _, f := range record.Fields {
+		add(f.Key, f.Value, f.Sensitive)
+	}
+
+	group.Entries = append(group.Entries, entry)
+	return nil
+}
+
+func (k *kdbxWriter) Close() error {
+	if err := kdbx.Write(k.w, &k.db, k.password); err != nil {
+		return fmt.Errorf("failed to write KeePass database: %w", err)
+	}
+	return nil
+}
+
+func subGroup(parent *kdbx.Group, name string) *kdbx.Group {
+	for i := range parent.Groups {
+		if parent.Groups[i].Name == name {
+			return &parent.Groups[i]
+		}
+	}
+	parent.Groups = append(parent.Groups, kdbx.Group{Name: name})
+	return &parent.Groups[len(parent.Groups)-1]
+}
+
+func hasField(entry kdbx.Entry, key string) bool {
+	for _, f := range entry.Fields {
+		if f.Key == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+// Package fuzzy ranks entry names against a typed query, the way the
+// interactive picker shows them.
+package fuzzy
+
+import (
+	"math"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	scoreMatch       = 16
+	bonusBoundary    = 8
+	bonusConsecutive = 8
+	bonusPrefix      = 4
+	penaltyGap       = 1
+	// Every lengthPenalty unmatched runes cost a point, so that shorter
+	// names win otherwise equal matches.
+	lengthPenalty = 8
+	// maxRecencyBonus is added for an entry used just now and halves with
+	// every recencyHalfLife since its last use.
+	maxRecencyBonus = 32
+	recencyHalfLife = 7 * 24 * time.Hour
+)
+
+// Match is a name that matches a query. Positions are the indexes of the
+// matched runes in the name.
+type Match struct {
+	Name      string
+	Score     int
+	Positions []int
+}
+
+// Score reports whether every rune of query occurs in name, in order and
+// ignoring case, and how well they match. Matches at the start of the name
+// or of a folder or word, and runs of consecutive runes, score higher; gaps
+// between matched runes and long names score lower. An empty query matches
+// everything with a score of zero.
+func Score(name, query string) (int, []int, bool) {
+	pattern := []rune(query)
+	for i, r := range pattern {
+		pattern[i] = unicode.ToLower(r)
+	}
+	if len(pattern) == 0 {
+		return 0, nil, true
+	}
+	runes := []rune(name)
+
+	// Find the last possible end of a match first, then walk back to find
+	// the shortest one that ends there, as fzf does.
+	p, end := 0, -1
+	for i, r := range runes {
+		if unicode.ToLower(r) == pattern[p] {
+			p++
+			if p == len(pattern) {
+				end = i
+				break
+			}
+		}
+	}
+	if end < 0 {
+		return 0, nil, false
+	}
+
+	start := end
+	for p = len(pattern) - 1; p >= 0; start-- {
+		if unicode.ToLower(runes[start]) == pattern[p] {
+			p--
+		}
+	}
+	start++
+
+	positions := make([]int, 0, len(pattern))
+	score := 0
+	p = 0
+	for i := start; i <= end && p < len(pattern); i++ {
+		if unicode.ToLower(runes[i]) != pattern[p] {
+			continue
+		}
+
+		score += scoreMatch
+		if i == 0 {
+			score += bonusPrefix
+		}
+		if i == 0 || isBoundary(runes[i-1], runes[i]) {
+			score += bonusBoundary
+		}
+		if len(positions) > 0 {
+			prev := positions[len(positions)-1]
+			if prev == i-1 {
+				score += bonusConsecutive
+			} else {
+				score -= penaltyGap * (i - prev - 1)
+			}
+		}
+
+		positions = append(positions, i)
+		p++
+	}
+	score -= (len(runes) - len(pattern)) / lengthPenalty
+
+	return score, positions, true
+}
+
+func isBoundary(prev, r rune) bool {
+	switch prev {
+	case '/', '-', '_', '.', ' ', '@':
+		return true
+	}
+	return unicode.IsLower(prev) && unicode.IsUpper(r)
+}
+
+// recencyBonus favours entries that were used recently.
+func recencyBonus(used, now time.Time) int {
+	if used.IsZero() {
+		return 0
+	}
+	age := max(now.Sub(used), 0)
+	return int(maxRecencyBonus * math.Exp2(-float64(age)/float64(recencyHalfLife)))
+}
+
+// Rank returns the names that match query, best first. Recently used names,
+// by lastUsed, rank higher; ties are broken by name.
+func Rank(names []string, query string, lastUsed map[string]time.Time, now time.Time) []Match {
+	var matches []Match
+	for _, name := range names {
+		score, positions, ok := Score(name, query)
+		if !ok {
+			continue
+		}
+		matches = append(matches, Match{
+			Name:      name,
+			Score:     score + recencyBonus(lastUsed[name], now),
+			Positions: positions,
+		})
+	}
+
+	slices.SortStableFunc(matches, func(a, b Match) int {
+		if a.Score != b.Score {
+			return b.Score - a.Score
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return matches
+}
+
+// Substring returns the names that contain query, ignoring case, in their
+// original order.
+func Substring(names []string, query string) []string {
+	query = strings.ToLower(query)
+
+	var matches []string
+	for _, name := range names {
+		if strings.Contains(strings.ToLower(name), query) {
+			matches = append(matches, name)
+		}
+	}
+	return matches
+}
@@ -0,0 +1,91 @@
+package fuzzy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScore(t *testing.T) {
+	tc := []struct {
+		name      string
+		query     string
+		positions []int
+		ok        bool
+	}{
+		{name: "github", query: "", ok: true},
+		{name: "github", query: "gh", positions: []int{0, 3}, ok: true},
+		{name: "GitHub", query: "gh", positions: []int{0, 3}, ok: true},
+		{name: "work/aws/prod", query: "awsp", positions: []int{5, 6, 7, 9}, ok: true},
+		{name: "Почта", query: "поч", positions: []int{0, 1, 2}, ok: true},
+		{name: "github", query: "hg", ok: false},
+		{name: "git", query: "gitx", ok: false},
+	}
+	for _, tt := range tc {
+		t.Run(tt.name+"/"+tt.query, func(t *testing.T) {
+			_, positions, ok := Score(tt.name, tt.query)
+			require.Equal(t, tt.ok, ok)
+			require.Equal(t, tt.positions, positions)
+		})
+	}
+}
+
+func TestScoreOrder(t *testing.T) {
+	// Each name should score higher for query than the one after it.
+	tc := []struct {
+		query string
+		names []string
+	}{
+		{query: "bank", names: []string{"bank", "bank/savings", "personal/bank", "big-arctic-nook-key"}},
+		{query: "ap", names: []string{"aws/prod", "laptop"}},
+		{query: "db", names: []string{"db", "work/db", "dashboard"}},
+	}
+	for _, tt := range tc {
+		t.Run(tt.query, func(t *testing.T) {
+			for i := 1; i < len(tt.names); i++ {
+				better, _, ok := Score(tt.names[i-1], tt.query)
+				require.True(t, ok)
+				worse, _, ok := Score(tt.names[i], tt.query)
+				require.True(t, ok)
+				require.Greater(t, better, worse, "%q vs %q", tt.names[i-1], tt.names[i])
+			}
+		})
+	}
+}
+
+func TestRank(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	names := []string{"email", "home/mail", "work/mail", "bank"}
+
+	got := Rank(names, "mail", nil, now)
+	require.Equal(t, []string{"home/mail", "work/mail", "email"}, matchNames(got))
+
+	lastUsed := map[string]time.Time{
+		"work/mail": now.Add(-time.Hour),
+		"email":     now.Add(-10 * 24 * time.Hour),
+		"bank":      now.Add(-365 * 24 * time.Hour),
+	}
+	got = Rank(names, "mail", lastUsed, now)
+	require.Equal(t, []string{"work/mail", "email", "home/mail"}, matchNames(got))
+
+	got = Rank(names, "", lastUsed, now)
+	require.Equal(t, []string{"work/mail", "email", "bank", "home/mail"}, matchNames(got))
+
+	require.Empty(t, Rank(names, "xyz", lastUsed, now))
+}
+
+func TestSubstring(t *testing.T) {
+	names := []string{"email", "personal/Mail", "work/aws", "bank"}
+	require.Equal(t, []string{"email", "personal/Mail"}, Substring(names, "MAIL"))
+	require.Equal(t, names, Substring(names, ""))
+	require.Empty(t, Substring(names, "ml"))
+}
+
+func matchNames(matches []Match) []string {
+	names := make([]string, 0, len(matches))
+	for _, m := range matches {
+		names = append(names, m.Name)
+	}
+	return names
+}
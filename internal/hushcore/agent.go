@@ -0,0 +1,102 @@
+package hushcore
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/nochzato/hush/internal/agent"
+)
+
+var ErrMasterPasswordRequired = errors.New("master password required")
+
+// agentSocket is the socket of the hush agent that vault keys are cached
+// in; empty if no agent is used.
+var agentSocket string
+
+// agentPrompt asks for the master password when the agent no longer holds
+// a key that AgentUnlocked reported; nil if the caller cannot prompt.
+var agentPrompt func() (string, error)
+
+// UseAgent makes every vault unlocked with its master password hand its key
+// to the hush agent at socketPath, and calls that pass an empty master
+// password take the key from there. Nothing changes while no agent runs.
+// The agent may forget a key after AgentUnlocked reported it, on a timeout
+// or 'hush lock'; prompt, if not nil, then asks for the master password.
+func UseAgent(socketPath string, prompt func() (string, error)) {
+	agentSocket = socketPath
+	agentPrompt = prompt
+}
+
+// AgentUnlocked reports whether the hush agent holds the key of the current
+// vault, so that it can be used with an empty master password.
+func AgentUnlocked() bool {
+	if agentSocket == "" {
+		return false
+	}
+
+	id, err := VaultID()
+	if err != nil || id == "" {
+		return false
+	}
+
+	vaults, err := agent.Status(agentSocket)
+	if err != nil {
+		return false
+	}
+	return slices.ContainsFunc(vaults, func(s agent.VaultStatus) bool {
+		return s.Vault == id
+	})
+}
+
+// VaultID returns the ID the current vault is known by to the agent. Vaults
+// from before vault IDs existed have none until they are first unlocked.
+func VaultID() (string, error) {
+	meta, err := readVaultMeta()
+	if err != nil {
+		return "", err
+	}
+	return meta.ID, nil
+}
+
+// agentKey returns the key of the vault described by meta from the agent.
+func agentKey(meta *vaultMeta) ([]byte, error) {
+	if agentSocket == "" || meta.ID == "" {
+		return nil, ErrMasterPasswordRequired
+	}
+
+	key, err := agent.GetKey(agentSocket, meta.ID)
+	if errors.Is(err, agent.ErrLocked) || errors.Is(err, agent.ErrNotRunning) {
+		return nil, ErrMasterPasswordRequired
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get key from agent: %w", err)
+	}
+
+	return key, nil
+}
+
+// cacheKey hands the key of a vault unlocked with its master password to
+// the agent, if one is running. The agent only saves time, so failing to
+// reach it is not an error.
+func (v *vault) cacheKey() {
+	if agentSocket != "" && v.meta.ID != "" {
+		_ = agent.PutKey(agentSocket, v.meta.ID, v.key)
+	}
+}
+
+// forgetKey makes the agent drop the key of the vault.
+func (v *vault) forgetKey() {
+	if agentSocket != "" && v.meta.ID != "" {
+		_ = agent.Lock(agentSocket, v.meta.ID)
+	}
+}
+
+// requirePassword refuses the empty master password that stands for the
+// agent's key, for operations that really need the master password.
+func requirePassword(masterPassword string) error {
+	if masterPassword == "" {
+		return ErrMasterPasswordRequired
+	}
+	return nil
+}
@@ -0,0 +1,466 @@
+package hushcore
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nochzato/hush/internal/passutils"
+)
+
+const (
+	// backupManifestName is the last file of a backup archive. It lists
+	// every other file with its size and SHA-256.
+	backupManifestName = "backup.json"
+	backupVersion      = 1
+	maxBackupFileSize  = 64 << 20
+)
+
+var ErrBackupDamaged = errors.New("backup is damaged or incomplete")
+
+// BackupInfo describes a backup, as recorded in its manifest.
+type BackupInfo struct {
+	Version  int          `json:"version"`
+	Created  time.Time    `json:"created"`
+	VaultID  string       `json:"vault_id"`
+	Revision uint64       `json:"revision"`
+	Entries  int          `json:"entries"`
+	Files    []BackupFile `json:"files"`
+}
+
+// BackupFile is a file of the hush directory stored in a backup.
+type BackupFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// RestoreMode decides what restoring a backup does with the current vault.
+type RestoreMode string
+
+const (
+	// RestoreReplace makes the vault exactly what was backed up.
+	RestoreReplace RestoreMode = "replace"
+	// RestoreMerge imports the entries of the backup into the vault.
+	RestoreMerge RestoreMode = "merge"
+)
+
+// Backup writes every file of the hush directory into an archive encrypted
+// with the master password, which also unlocks the vault once restored.
+// Entry history is included.
+func Backup(w io.Writer, masterPassword string) (*BackupInfo, error) {
+	if err := requirePassword(masterPassword); err != nil {
+		return nil, err
+	}
+
+	v, err := unlockVault(masterPassword, lockShared)
+	if err != nil {
+		return nil, fmt.Errorf("error validating master password: %w", err)
+	}
+	defer v.close()
+
+	// A backup of a damaged vault would fail its own verification.
+	for _, issue := range v.issues {
+		if issue.Kind != IssueRollback {
+			return nil, fmt.Errorf("the vault has problems, run 'hush verify' first: %s", issue.Message)
+		}
+	}
+
+	files, err := vaultFiles(v.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := passutils.NewEncryptWriter(w, masterPassword, passutils.DefaultKDFParams())
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt backup: %w", err)
+	}
+	tw := tar.NewWriter(encrypted)
+
+	info := &BackupInfo{
+		Version:  backupVersion,
+		Created:  time.Now().UTC(),
+		VaultID:  v.meta.ID,
+		Revision: v.manifest.Revision,
+		Entries:  len(v.manifest.Entries),
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(filepath.Join(v.dir, filepath.FromSlash(file)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		if err := writeTarFile(tw, file, data); err != nil {
+			return nil, err
+		}
+
+		sum := sha256.Sum256(data)
+		info.Files = append(info.Files, BackupFile{Path: file, Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])})
+	}
+
+	manifest, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode backup manifest: %w", err)
+	}
+	if err := writeTarFile(tw, backupManifestName, manifest); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write backup: %w", err)
+	}
+	if err := encrypted.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write backup: %w", err)
+	}
+
+	return info, nil
+}
+
+// vaultFiles lists the files of a hush directory that make up the vault,
+// as slash-separated paths. The lock, the journal and staged files belong
+// to running operations and are left out, as is the git repository of a
+// vault kept in git.
+func vaultFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == gitDirName {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		switch name := d.Name(); {
+		case name == lockFileName, name == journalFileName, strings.HasSuffix(name, pendingSuffix), name == gitIgnoreName:
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list hush directory: %w", err)
+	}
+	return files, nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(len(data)),
+		Mode:     0600,
+		ModTime:  time.Now(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write backup: %w", err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("failed to write backup: %w", err)
+	}
+	return nil
+}
+
+// readBackup decrypts a backup and checks every file against the backup
+// manifest. Nothing is returned unless the whole archive is intact.
+func readBackup(r io.Reader, masterPassword string) (*BackupInfo, map[string][]byte, error) {
+	decrypted, err := passutils.NewDecryptReader(r, masterPassword)
+	if errors.Is(err, passutils.ErrDecrypt) {
+		return nil, nil, fmt.Errorf("incorrect master password, or %w", ErrBackupDamaged)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read backup: %w", err)
+	}
+
+	damaged := func(format string, args ...any) error {
+		return fmt.Errorf("%w: %s", ErrBackupDamaged, fmt.Sprintf(format, args...))
+	}
+
+	files := map[string][]byte{}
+	var info *BackupInfo
+	tr := tar.NewReader(decrypted)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if errors.Is(err, passutils.ErrDecrypt) {
+			return nil, nil, damaged("the archive has been modified or cut short")
+		}
+		if err != nil {
+			return nil, nil, damaged("%v", err)
+		}
+
+		name := header.Name
+		_, seen := files[name]
+		switch {
+		case info != nil:
+			return nil, nil, damaged("unexpected file %q after the manifest", name)
+		case header.Typeflag != tar.TypeReg:
+			return nil, nil, damaged("%q is not a regular file", name)
+		case !filepath.IsLocal(filepath.FromSlash(name)) || path.Clean(name) != name:
+			return nil, nil, damaged("invalid file name %q", name)
+		case header.Size > maxBackupFileSize:
+			return nil, nil, damaged("%q is too large", name)
+		case seen:
+			return nil, nil, damaged("%q appears twice", name)
+		}
+
+		data, err := io.ReadAll(tr)
+		if errors.Is(err, passutils.ErrDecrypt) {
+			return nil, nil, damaged("the archive has been modified or cut short")
+		}
+		if err != nil {
+			return nil, nil, damaged("%v", err)
+		}
+
+		if name == backupManifestName {
+			info = &BackupInfo{}
+			if err := json.Unmarshal(data, info); err != nil {
+				return nil, nil, damaged("invalid manifest: %v", err)
+			}
+			continue
+		}
+		files[name] = data
+	}
+
+	// The end of the tar archive is not the end of the encrypted stream;
+	// only its last chunk proves that nothing was cut off.
+	if _, err := io.Copy(io.Discard, decrypted); err != nil {
+		return nil, nil, damaged("the archive has been modified or cut short")
+	}
+
+	switch {
+	case info == nil:
+		return nil, nil, damaged("the manifest is missing")
+	case info.Version > backupVersion:
+		return nil, nil, fmt.Errorf("backup version %d is newer than this version of hush supports", info.Version)
+	}
+
+	listed := map[string]bool{}
+	for _, f := range info.Files {
+		data, ok := files[f.Path]
+		if !ok {
+			return nil, nil, damaged("%q is missing", f.Path)
+		}
+		sum := sha256.Sum256(data)
+		if int64(len(data)) != f.Size || hex.EncodeToString(sum[:]) != f.SHA256 {
+			return nil, nil, damaged("%q does not match its checksum", f.Path)
+		}
+		listed[f.Path] = true
+	}
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		if !listed[name] {
+			return nil, nil, damaged("%q is not listed in the manifest", name)
+		}
+	}
+
+	return info, files, nil
+}
+
+// openBackup checks a backup and opens the vault inside it from a temporary
+// directory, which clean removes. Entries that are missing from the backed
+// up vault or do not match its manifest make the backup damaged.
+func openBackup(r io.Reader, masterPassword string) (*BackupInfo, *vault, map[string][]byte, func(), error) {
+	info, files, err := readBackup(r, masterPassword)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	dir, err := os.MkdirTemp("", "hush-backup-")
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	clean := func() { os.RemoveAll(dir) }
+
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			clean()
+			return nil, nil, nil, nil, fmt.Errorf("failed to create temporary directory: %w", err)
+		}
+		if err := os.WriteFile(p, data, 0600); err != nil {
+			clean()
+			return nil, nil, nil, nil, fmt.Errorf("failed to extract backup: %w", err)
+		}
+	}
+
+	v, err := openBackupVault(dir, masterPassword)
+	if err != nil {
+		clean()
+		return nil, nil, nil, nil, err
+	}
+
+	return info, v, files, clean, nil
+}
+
+func openBackupVault(dir, masterPassword string) (*vault, error) {
+	meta, err := readVaultMetaIn(dir)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBackupDamaged, err)
+	}
+	// Backing up unlocks the vault, which brings it up to date first.
+	if meta.Version != vaultVersion {
+		return nil, fmt.Errorf("%w: unexpected vault version %d", ErrBackupDamaged, meta.Version)
+	}
+
+	wrappingKey, err := meta.deriveKey(masterPassword)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	key, err := passutils.UnwrapKey(meta.WrappedKey, wrappingKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: the vault key does not match the backup password", ErrBackupDamaged)
+	}
+
+	v, err := openVaultWithKey(dir, meta, key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBackupDamaged, err)
+	}
+
+	for _, issue := range v.issues {
+		// A backup is older than the vault by nature.
+		if issue.Kind == IssueRollback {
+			continue
+		}
+		return nil, fmt.Errorf("%w: %s", ErrBackupDamaged, issue.Message)
+	}
+
+	return v, nil
+}
+
+// VerifyBackup checks that a backup can be restored: that it decrypts with
+// the master password it was made with, that every file matches its
+// checksum and that every entry of the backed up vault is there.
+func VerifyBackup(r io.Reader, masterPassword string) (*BackupInfo, error) {
+	info, _, _, clean, err := openBackup(r, masterPassword)
+	if err != nil {
+		return nil, err
+	}
+	clean()
+	return info, nil
+}
+
+// RestoreBackup verifies a backup made with backupPassword and then either
+// replaces the current vault with it, or merges its entries into the current
+// vault like ImportEntries does. Replacing an existing vault and merging
+// need its masterPassword. The backed up vault keeps its own master
+// password when it replaces the current one.
+func RestoreBackup(r io.Reader, backupPassword string, mode RestoreMode, conflict ConflictPolicy, masterPassword string) (*BackupInfo, *ImportResult, error) {
+	if err := requirePassword(backupPassword); err != nil {
+		return nil, nil, err
+	}
+
+	info, backup, files, clean, err := openBackup(r, backupPassword)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer clean()
+
+	switch mode {
+	case RestoreReplace:
+		if err := replaceVault(files, backupPassword, masterPassword); err != nil {
+			return nil, nil, err
+		}
+		return info, nil, nil
+
+	case RestoreMerge:
+		var entries []ImportEntry
+		for _, name := range backup.passwordNames() {
+			record, err := backup.getRecord(name)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%w: failed to read %q: %w", ErrBackupDamaged, name, err)
+			}
+			entries = append(entries, ImportEntry{Source: "backup", Name: name, Record: *record})
+		}
+
+		result, err := ImportEntries(entries, conflict, false, masterPassword)
+		if err != nil {
+			return nil, nil, err
+		}
+		return info, result, nil
+	}
+
+	return nil, nil, fmt.Errorf("unknown restore mode %q", mode)
+}
+
+// replaceVault makes the hush directory hold exactly files, in one
+// transaction. The vault it replaces, if any, must be unlocked with
+// masterPassword first.
+func replaceVault(files map[string][]byte, backupPassword, masterPassword string) error {
+	hushDir, err := getHushDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(hushDir, 0700); err != nil {
+		return fmt.Errorf("failed to create hush directory: %w", err)
+	}
+
+	// The exclusive lock of the current vault, or of the empty directory,
+	// is held until the restored vault is committed.
+	if isInitialized(hushDir) {
+		current, err := unlockVault(masterPassword, lockExclusive)
+		if err != nil {
+			return fmt.Errorf("error validating master password: %w", err)
+		}
+		defer current.close()
+		hushDir = current.dir
+	} else {
+		var lock *fileLock
+		hushDir, lock, err = openHushDir(lockExclusive)
+		if err != nil {
+			return err
+		}
+		defer lock.unlock()
+	}
+
+	existing, err := vaultFiles(hushDir)
+	if err != nil {
+		return err
+	}
+
+	tx := beginTx(hushDir)
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		if err := tx.write(filepath.FromSlash(name), files[name]); err != nil {
+			tx.rollback()
+			return err
+		}
+	}
+	for _, name := range existing {
+		if _, ok := files[name]; !ok {
+			tx.remove(filepath.FromSlash(name))
+		}
+	}
+	if err := tx.commit(); err != nil {
+		return fmt.Errorf("failed to restore backup: %w", err)
+	}
+
+	// The restored manifest is older than the last one this machine has
+	// seen of the vault. Committing it again under a new revision keeps it
+	// from being reported as a rollback from now on.
+	v, err := openLockedVault(hushDir, backupPassword)
+	if err != nil {
+		return fmt.Errorf("failed to open restored vault: %w", err)
+	}
+	if err := v.commitAs(beginTx(hushDir), v.manifest.next(), "Restore vault from backup"); err != nil {
+		return fmt.Errorf("failed to update restored manifest: %w", err)
+	}
+
+	return nil
+}
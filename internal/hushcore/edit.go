@@ -0,0 +1,237 @@
+package hushcore
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/nochzato/hush/internal/passutils"
+)
+
+// checkTarget makes sure that storing an entry under name does not replace
+// another one, unless replacing is allowed.
+func (v *vault) checkTarget(name string, replace bool) error {
+	_, err := v.lookupEntry(name)
+	switch {
+	case errors.Is(err, ErrEntryNotFound):
+		return nil
+	case err != nil:
+		return err
+	case !replace:
+		return fmt.Errorf("%w: %q", ErrEntryExists, name)
+	}
+	return nil
+}
+
+// EditRecord applies edit to the record stored under name and saves the
+// result as a new revision.
+func EditRecord(name string, edit func(record *Record) error, masterPassword string) error {
+	sanitizedName, err := sanitizeFileName(name)
+	if err != nil {
+		return fmt.Errorf("invalid filename: %w", err)
+	}
+
+	v, err := unlockVault(masterPassword, lockExclusive)
+	if err != nil {
+		return fmt.Errorf("error validating master password: %w", err)
+	}
+	defer v.close()
+
+	record, err := v.getRecord(sanitizedName)
+	if err != nil {
+		return err
+	}
+
+	oldPassword := record.Password
+	if err := edit(record); err != nil {
+		return err
+	}
+
+	if record.Password != oldPassword {
+		if err := passutils.CheckPasswordStrength(record.Password); err != nil {
+			return fmt.Errorf("password is too weak: %w", err)
+		}
+	}
+	if err := record.Validate(); err != nil {
+		return fmt.Errorf("invalid record: %w", err)
+	}
+
+	return v.addRecord(sanitizedName, record)
+}
+
+// MoveEntry renames an entry, together with its history. With replace, an
+// existing entry under newName is replaced and kept, with its own history,
+// in the history of the moved entry; otherwise MoveEntry fails with
+// ErrEntryExists.
+func MoveEntry(oldName, newName string, replace bool, masterPassword string) error {
+	src, dst, err := sanitizeEntryPair(oldName, newName)
+	if err != nil {
+		return err
+	}
+
+	v, err := unlockVault(masterPassword, lockExclusive)
+	if err != nil {
+		return fmt.Errorf("error validating master password: %w", err)
+	}
+	defer v.close()
+
+	return v.moveEntry(src, dst, replace)
+}
+
+func (v *vault) moveEntry(src, dst string, replace bool) error {
+	record, err := v.getRecord(src)
+	if err != nil {
+		return err
+	}
+	if err := v.checkTarget(dst, replace); err != nil {
+		return err
+	}
+
+	srcFile, err := v.lookupEntry(src)
+	if err != nil {
+		return err
+	}
+	file, err := v.entryFileFor(dst)
+	if err != nil {
+		return err
+	}
+
+	tx := beginTx(v.dir)
+	m := v.manifest.next()
+
+	// Entries are bound to their names, so the moved entry and every
+	// previous revision of it are sealed again under the new name.
+	sealed, err := v.sealEntry(dst, record)
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+	if err := tx.write(file+".hush", sealed); err != nil {
+		tx.rollback()
+		return fmt.Errorf("failed to write password file: %w", err)
+	}
+	tx.remove(srcFile + ".hush")
+
+	prev := m.Entries[src]
+	entry := manifestEntry{File: file, Hash: hashEntry(sealed), Revision: prev.revision(), Modified: prev.Modified}
+
+	// staged holds the revisions that still have to be written; the others
+	// are history files of a replaced entry, already in place.
+	staged := map[int][]byte{}
+
+	// A replaced entry is kept: its revisions, the current one included,
+	// come first in the history and those of the moved entry follow.
+	offset := 0
+	if target, ok := m.Entries[dst]; ok {
+		data, err := readEncryptedPassword(v.dir, target.File)
+		if err != nil {
+			tx.rollback()
+			return fmt.Errorf("failed to read password file: %w", err)
+		}
+		entry.History = append(slices.Clone(target.History), entryRevision{
+			Revision: target.revision(),
+			Modified: target.Modified,
+			Hash:     hashEntry(data),
+		})
+		staged[target.revision()] = data
+		offset = target.revision()
+		entry.Revision += offset
+	}
+
+	for _, rev := range prev.History {
+		data, err := readHistoryFile(v.dir, prev.File, rev.Revision)
+		if err != nil {
+			tx.rollback()
+			return fmt.Errorf("failed to read previous revision: %w", err)
+		}
+		if hashEntry(data) != rev.Hash {
+			tx.rollback()
+			return fmt.Errorf("revision %d of %q: %w", rev.Revision, src, ErrEntryTampered)
+		}
+		old, err := v.openEntry(src, data)
+		if err != nil {
+			tx.rollback()
+			return fmt.Errorf("revision %d of %q: %w", rev.Revision, src, err)
+		}
+
+		resealed, err := v.sealEntry(dst, old)
+		if err != nil {
+			tx.rollback()
+			return err
+		}
+		tx.remove(historyFile(prev.File, rev.Revision))
+
+		rev.Revision += offset
+		rev.Hash = hashEntry(resealed)
+		entry.History = append(entry.History, rev)
+		staged[rev.Revision] = resealed
+	}
+
+	for len(entry.History) > m.historyKeep() {
+		oldest := entry.History[0].Revision
+		if _, ok := staged[oldest]; !ok {
+			tx.remove(historyFile(file, oldest))
+		}
+		delete(staged, oldest)
+		entry.History = entry.History[1:]
+	}
+	for _, rev := range entry.History {
+		if data, ok := staged[rev.Revision]; ok {
+			if err := tx.write(historyFile(file, rev.Revision), data); err != nil {
+				tx.rollback()
+				return err
+			}
+		}
+	}
+
+	delete(m.Entries, src)
+	m.Entries[dst] = entry
+
+	if err := v.commit(tx, m); err != nil {
+		return fmt.Errorf("failed to move entry: %w", err)
+	}
+
+	return nil
+}
+
+// CopyEntry stores a copy of an entry under another name. The copy starts
+// without history. With replace, an existing entry under dstName is
+// replaced and kept in its history; otherwise CopyEntry fails with
+// ErrEntryExists.
+func CopyEntry(srcName, dstName string, replace bool, masterPassword string) error {
+	src, dst, err := sanitizeEntryPair(srcName, dstName)
+	if err != nil {
+		return err
+	}
+
+	v, err := unlockVault(masterPassword, lockExclusive)
+	if err != nil {
+		return fmt.Errorf("error validating master password: %w", err)
+	}
+	defer v.close()
+
+	record, err := v.getRecord(src)
+	if err != nil {
+		return err
+	}
+	if err := v.checkTarget(dst, replace); err != nil {
+		return err
+	}
+
+	return v.addRecord(dst, record)
+}
+
+func sanitizeEntryPair(src, dst string) (string, string, error) {
+	sanitizedSrc, err := sanitizeFileName(src)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid filename: %w", err)
+	}
+	sanitizedDst, err := sanitizeFileName(dst)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid filename: %w", err)
+	}
+	if sanitizedSrc == sanitizedDst {
+		return "", "", fmt.Errorf("%q and %q are the same entry", src, dst)
+	}
+	return sanitizedSrc, sanitizedDst, nil
+}
@@ -0,0 +1,42 @@
+package hushcore
+
+import (
+	"fmt"
+	"time"
+)
+
+// EntryInfo is the metadata of an entry that is not part of its record.
+type EntryInfo struct {
+	Name     string
+	Revision int
+	Modified time.Time
+}
+
+// WalkRecords calls fn for every entry in name order. Records are decrypted
+// one at a time, so exporting a vault never holds all of it in memory. An
+// error from fn stops the walk and is returned as is.
+func WalkRecords(masterPassword string, fn func(info EntryInfo, record *Record) error) error {
+	v, err := unlockVault(masterPassword, lockShared)
+	if err != nil {
+		return fmt.Errorf("error validating master password: %w", err)
+	}
+	defer v.close()
+
+	for _, name := range v.passwordNames() {
+		record, err := v.getRecord(name)
+		if err != nil {
+			return fmt.Errorf("failed to read %q: %w", name, err)
+		}
+
+		info := EntryInfo{Name: name}
+		if entry, ok := v.manifest.Entries[name]; ok {
+			info.Revision = entry.revision()
+			info.Modified = entry.Modified
+		}
+		if err := fn(info, record); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
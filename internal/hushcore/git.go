@@ -0,0 +1,240 @@
+package hushcore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	gitDirName       = ".git"
+	gitIgnoreName    = ".gitignore"
+	gitDefaultRemote = "origin"
+)
+
+// gitIgnore keeps the files that only matter while hush runs out of the
+// repository.
+const gitIgnore = lockFileName + "\n" + journalFileName + "\n*" + pendingSuffix + "\n"
+
+var (
+	ErrNotGitRepository = errors.New("the vault is not a git repository; run 'hush git init' first")
+	ErrGitDiverged      = errors.New("the vault and the remote both have changes the other lacks")
+)
+
+// GitInit makes the hush directory a git repository and commits the vault
+// as it is. If remote is not empty, it is added as the "origin" remote.
+func GitInit(remote string) error {
+	hushDir, lock, err := openHushDir(lockExclusive)
+	if err != nil {
+		return err
+	}
+	if lock == nil || !isInitialized(hushDir) {
+		return ErrNotInitialized
+	}
+	defer lock.unlock()
+
+	if isGitRepo(hushDir) {
+		return fmt.Errorf("%s is already a git repository", hushDir)
+	}
+
+	if _, err := runGit(hushDir, "init", "--quiet"); err != nil {
+		return err
+	}
+	// Commits must not fail for want of an identity, but one configured
+	// for the user wins.
+	if _, err := runGit(hushDir, "config", "user.email"); err != nil {
+		if _, err := runGit(hushDir, "config", "user.name", "hush"); err != nil {
+			return err
+		}
+		if _, err := runGit(hushDir, "config", "user.email", "hush@localhost"); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(filepath.Join(hushDir, gitIgnoreName), []byte(gitIgnore), 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", gitIgnoreName, err)
+	}
+	if remote != "" {
+		if _, err := runGit(hushDir, "remote", "add", gitDefaultRemote, remote); err != nil {
+			return err
+		}
+	}
+
+	return gitCommit(hushDir, "Initialize hush vault")
+}
+
+// GitPush pushes the vault to a remote. Without args it pushes the current
+// branch to origin and makes it the upstream branch. Output of git goes to
+// out.
+func GitPush(args []string, out io.Writer) error {
+	hushDir, lock, err := openGitRepo(lockShared)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+
+	if len(args) == 0 {
+		args = []string{"--set-upstream", gitDefaultRemote, "HEAD"}
+	}
+	return runGitTo(hushDir, out, append([]string{"push"}, args...)...)
+}
+
+// GitPull fast-forwards the vault to its upstream branch. Encrypted entries
+// and the manifest cannot be merged, so a vault that has diverged from the
+// remote is left untouched and ErrGitDiverged is returned.
+func GitPull(args []string, out io.Writer) error {
+	hushDir, lock, err := openGitRepo(lockExclusive)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+
+	if err := runGitTo(hushDir, out, append([]string{"pull", "--ff-only"}, args...)...); err != nil {
+		if _, statusErr := runGit(hushDir, "merge-base", "--is-ancestor", "HEAD", "@{upstream}"); statusErr != nil {
+			return fmt.Errorf("%w: %w", ErrGitDiverged, err)
+		}
+		return err
+	}
+	return nil
+}
+
+func openGitRepo(mode lockMode) (string, *fileLock, error) {
+	hushDir, lock, err := openHushDir(mode)
+	if err != nil {
+		return "", nil, err
+	}
+	if lock == nil {
+		return "", nil, ErrNotInitialized
+	}
+	if !isGitRepo(hushDir) {
+		lock.unlock()
+		return "", nil, ErrNotGitRepository
+	}
+	return hushDir, lock, nil
+}
+
+func isGitRepo(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, gitDirName))
+	return err == nil
+}
+
+// gitCommit commits every change in the hush directory, if there is any.
+func gitCommit(dir, message string) error {
+	if _, err := runGit(dir, "add", "--all"); err != nil {
+		return err
+	}
+	if _, err := runGit(dir, "diff", "--cached", "--quiet"); err == nil {
+		return nil
+	}
+	_, err := runGit(dir, "commit", "--quiet", "--message", message)
+	return err
+}
+
+// gitRecord commits a change to the vault if the hush directory is a git
+// repository. The change is already saved, so a failed commit is reported
+// but does not fail the operation; the next one commits it as well.
+func (v *vault) gitRecord(message string) {
+	if !isGitRepo(v.dir) {
+		return
+	}
+	if err := gitCommit(v.dir, message); err != nil {
+		fmt.Fprintf(warningOutput, "WARNING: failed to commit to git: %v\n", err)
+	}
+}
+
+func runGit(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, fmt.Errorf("git %s failed: %w: %s", args[0], err, message)
+		}
+		return nil, fmt.Errorf("git %s failed: %w", args[0], err)
+	}
+	return output, nil
+}
+
+func runGitTo(dir string, out io.Writer, args ...string) error {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git %s failed: %w", args[0], err)
+	}
+	return nil
+}
+
+// changeMessage describes the difference between two manifests for a git
+// commit. It names entries, never their contents, and only counts them when
+// names are encrypted.
+func changeMessage(old, m *manifest, encryptedNames bool) string {
+	var oldEntries map[string]manifestEntry
+	if old != nil {
+		oldEntries = old.Entries
+	}
+
+	var added, updated, removed []string
+	for _, name := range slices.Sorted(maps.Keys(m.Entries)) {
+		prev, ok := oldEntries[name]
+		switch {
+		case !ok:
+			added = append(added, name)
+		case prev.Hash != m.Entries[name].Hash || prev.File != m.Entries[name].File:
+			updated = append(updated, name)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(oldEntries)) {
+		if _, ok := m.Entries[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+
+	changes := []struct {
+		verb  string
+		names []string
+	}{{"add", added}, {"update", updated}, {"remove", removed}}
+	var counts, lines []string
+	for _, change := range changes {
+		if len(change.names) == 0 {
+			continue
+		}
+		counts = append(counts, change.verb+" "+countEntries(len(change.names)))
+		for _, name := range change.names {
+			lines = append(lines, capitalize(change.verb)+" "+name)
+		}
+	}
+
+	switch {
+	case len(lines) == 0:
+		return "Update vault settings"
+	case encryptedNames:
+		return capitalize(strings.Join(counts, ", "))
+	case len(lines) == 1:
+		return lines[0]
+	case len(added) == 1 && len(removed) == 1 && len(updated) == 0:
+		return fmt.Sprintf("Move %s to %s", removed[0], added[0])
+	}
+	return capitalize(strings.Join(counts, ", ")) + "\n\n" + strings.Join(lines, "\n")
+}
+
+func countEntries(n int) string {
+	if n == 1 {
+		return "1 entry"
+	}
+	return fmt.Sprintf("%d entries", n)
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
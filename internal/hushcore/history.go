@@ -0,0 +1,233 @@
+package hushcore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	historyDirName = "history"
+	// defaultHistoryKeep is the number of previous revisions kept per entry
+	// until the user picks another retention.
+	defaultHistoryKeep = 10
+)
+
+var ErrRevisionNotFound = errors.New("revision not found")
+
+// entryRevision is a previous version of an entry, kept as a copy of its
+// password file in the history directory.
+type entryRevision struct {
+	Revision int       `json:"revision"`
+	Modified time.Time `json:"modified"`
+	Hash     string    `json:"hash"`
+}
+
+// EntryRevision describes one version of an entry, as listed by
+// EntryHistory.
+type EntryRevision struct {
+	Revision int
+	Modified time.Time
+	Current  bool
+}
+
+func historyFile(file string, revision int) string {
+	return filepath.Join(historyDirName, file+"."+strconv.Itoa(revision)+".hush")
+}
+
+func (m *manifest) historyKeep() int {
+	if m.HistoryKeep == 0 {
+		return defaultHistoryKeep
+	}
+	return m.HistoryKeep
+}
+
+// revision returns the revision number of the current version; entries
+// written before history existed count as revision 1.
+func (e manifestEntry) revision() int {
+	return max(e.Revision, 1)
+}
+
+// stageHistory stages a copy of the current version of prev into the history
+// directory and records it in entry, which replaces prev, pruning revisions
+// beyond keep.
+func (v *vault) stageHistory(tx *vaultTx, entry *manifestEntry, prev manifestEntry, keep int) error {
+	entry.Revision = prev.revision() + 1
+	entry.History = slices.Clone(prev.History)
+
+	data, err := readEncryptedPassword(v.dir, prev.File)
+	if err != nil {
+		return fmt.Errorf("failed to read password file: %w", err)
+	}
+
+	if err := tx.write(historyFile(entry.File, prev.revision()), data); err != nil {
+		return err
+	}
+	entry.History = append(entry.History, entryRevision{
+		Revision: prev.revision(),
+		Modified: prev.Modified,
+		Hash:     hashEntry(data),
+	})
+
+	for len(entry.History) > keep {
+		tx.remove(historyFile(entry.File, entry.History[0].Revision))
+		entry.History = entry.History[1:]
+	}
+
+	return nil
+}
+
+// removeHistory stages the removal of every previous revision of entry.
+func removeHistory(tx *vaultTx, entry manifestEntry) {
+	for _, rev := range entry.History {
+		tx.remove(historyFile(entry.File, rev.Revision))
+	}
+}
+
+// moveHistory stages copies of every previous revision of entry under the
+// history files for file and the removal of the old ones.
+func (v *vault) moveHistory(tx *vaultTx, entry manifestEntry, file string) error {
+	for _, rev := range entry.History {
+		data, err := readHistoryFile(v.dir, entry.File, rev.Revision)
+		if err != nil {
+			return fmt.Errorf("failed to read previous revision: %w", err)
+		}
+		if err := tx.write(historyFile(file, rev.Revision), data); err != nil {
+			return err
+		}
+		tx.remove(historyFile(entry.File, rev.Revision))
+	}
+	return nil
+}
+
+func EntryHistory(name, masterPassword string) ([]EntryRevision, error) {
+	sanitizedName, err := sanitizeFileName(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filename: %w", err)
+	}
+
+	v, err := unlockVault(masterPassword, lockShared)
+	if err != nil {
+		return nil, fmt.Errorf("error validating master password: %w", err)
+	}
+	defer v.close()
+
+	return v.entryHistory(sanitizedName)
+}
+
+// entryHistory lists every version of an entry, newest first.
+func (v *vault) entryHistory(name string) ([]EntryRevision, error) {
+	entry, ok := v.manifest.Entries[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrEntryNotFound, name)
+	}
+
+	revisions := []EntryRevision{{Revision: entry.revision(), Modified: entry.Modified, Current: true}}
+	for _, rev := range slices.Backward(entry.History) {
+		revisions = append(revisions, EntryRevision{Revision: rev.Revision, Modified: rev.Modified})
+	}
+
+	return revisions, nil
+}
+
+// RestoreRevision makes a previous revision of an entry current again. The
+// version it replaces is kept in the history like any other overwrite.
+func RestoreRevision(name string, revision int, masterPassword string) error {
+	sanitizedName, err := sanitizeFileName(name)
+	if err != nil {
+		return fmt.Errorf("invalid filename: %w", err)
+	}
+
+	v, err := unlockVault(masterPassword, lockExclusive)
+	if err != nil {
+		return fmt.Errorf("error validating master password: %w", err)
+	}
+	defer v.close()
+
+	return v.restoreRevision(sanitizedName, revision)
+}
+
+func (v *vault) restoreRevision(name string, revision int) error {
+	entry, ok := v.manifest.Entries[name]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrEntryNotFound, name)
+	}
+
+	i := slices.IndexFunc(entry.History, func(rev entryRevision) bool {
+		return rev.Revision == revision
+	})
+	if i < 0 {
+		if revision == entry.revision() {
+			return fmt.Errorf("revision %d of %q is already the current one", revision, name)
+		}
+		return fmt.Errorf("%w: %q has no revision %d", ErrRevisionNotFound, name, revision)
+	}
+
+	data, err := readHistoryFile(v.dir, entry.File, revision)
+	if err != nil {
+		return fmt.Errorf("failed to read revision %d: %w", revision, err)
+	}
+
+	if hashEntry(data) != entry.History[i].Hash {
+		return fmt.Errorf("revision %d of %q: %w", revision, name, ErrEntryTampered)
+	}
+	if _, err := v.openEntry(name, data); err != nil {
+		return fmt.Errorf("revision %d of %q: %w", revision, name, err)
+	}
+
+	if err := v.savePassword(name, data); err != nil {
+		return fmt.Errorf("failed to restore revision: %w", err)
+	}
+
+	return nil
+}
+
+func readHistoryFile(hushDir, file string, revision int) ([]byte, error) {
+	return os.ReadFile(filepath.Join(hushDir, historyFile(file, revision)))
+}
+
+func HistoryRetention(masterPassword string) (int, error) {
+	v, err := unlockVault(masterPassword, lockShared)
+	if err != nil {
+		return 0, fmt.Errorf("error validating master password: %w", err)
+	}
+	defer v.close()
+
+	return v.manifest.historyKeep(), nil
+}
+
+// SetHistoryRetention sets how many previous revisions are kept per entry
+// and prunes every entry down to that number right away.
+func SetHistoryRetention(masterPassword string, keep int) error {
+	if keep < 1 {
+		return fmt.Errorf("history retention must be at least 1 revision")
+	}
+
+	v, err := unlockVault(masterPassword, lockExclusive)
+	if err != nil {
+		return fmt.Errorf("error validating master password: %w", err)
+	}
+	defer v.close()
+
+	tx := beginTx(v.dir)
+	m := v.manifest.next()
+	m.HistoryKeep = keep
+
+	for name, entry := range m.Entries {
+		for len(entry.History) > keep {
+			tx.remove(historyFile(entry.File, entry.History[0].Revision))
+			entry.History = entry.History[1:]
+		}
+		m.Entries[name] = entry
+	}
+
+	if err := v.commit(tx, m); err != nil {
+		return fmt.Errorf("failed to save history retention: %w", err)
+	}
+
+	return nil
+}
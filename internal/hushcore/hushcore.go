@@ -1,11 +1,16 @@
 package hushcore
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
-	"regexp"
+	"slices"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/nochzato/hush/internal/passutils"
 )
@@ -19,6 +24,10 @@ const (
 var getHushDir = defaultGetHushDir
 
 func defaultGetHushDir() (string, error) {
+	if dir := os.Getenv(hushDirEnv); dir != "" {
+		return expandHome(dir)
+	}
+
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
 		return "", fmt.Errorf("failed to get home directory: %w", err)
@@ -26,19 +35,46 @@ func defaultGetHushDir() (string, error) {
 	return filepath.Join(homeDir, hushDirName), nil
 }
 
-func readSalt() (string, error) {
+// openHushDir locks the hush directory and finishes any operation that was
+// interrupted. A shared lock is turned into an exclusive one when opening
+// the vault will write to it. If the directory does not exist, nothing is
+// locked and the returned lock is nil.
+func openHushDir(mode lockMode) (string, *fileLock, error) {
 	hushDir, err := getHushDir()
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
-	saltFile := filepath.Join(hushDir, saltFileName)
-	salt, err := os.ReadFile(saltFile)
+	lock, err := lockFile(filepath.Join(hushDir, lockFileName), mode)
+	if errors.Is(err, fs.ErrNotExist) {
+		return hushDir, nil, nil
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to read salt: %w", err)
+		return "", nil, fmt.Errorf("failed to lock hush directory: %w", err)
+	}
+
+	if mode == lockShared && needsWriteOnOpen(hushDir) {
+		lock.unlock()
+		return openHushDir(lockExclusive)
+	}
+
+	if err := recoverTx(hushDir); err != nil {
+		lock.unlock()
+		return "", nil, fmt.Errorf("failed to recover interrupted operation: %w", err)
+	}
+
+	return hushDir, lock, nil
+}
+
+// needsWriteOnOpen reports whether an interrupted operation has to be
+// finished or the vault has to be migrated before it can be read.
+func needsWriteOnOpen(hushDir string) bool {
+	if _, err := os.Stat(filepath.Join(hushDir, journalFileName)); err == nil {
+		return true
 	}
 
-	return string(salt), err
+	meta, err := readVaultMeta()
+	return err == nil && meta.Version < vaultVersion
 }
 
 func InitHush(masterPassword string) error {
@@ -51,10 +87,13 @@ func InitHush(masterPassword string) error {
 		return fmt.Errorf("failed to create hush directory: %w", err)
 	}
 
-	masterPasswordFile := filepath.Join(hushDir, masterHashFileName)
-	saltFile := filepath.Join(hushDir, saltFileName)
+	lock, err := lockFile(filepath.Join(hushDir, lockFileName), lockExclusive)
+	if err != nil {
+		return fmt.Errorf("failed to lock hush directory: %w", err)
+	}
+	defer lock.unlock()
 
-	if _, err := os.Stat(masterPasswordFile); err == nil {
+	if isInitialized(hushDir) {
 		return fmt.Errorf("hush is already initialized")
 	}
 
@@ -62,59 +101,86 @@ func InitHush(masterPassword string) error {
 		return fmt.Errorf("master password is too weak: %w", err)
 	}
 
-	key, salt, err := passutils.DeriveKey(masterPassword)
+	key, err := passutils.GenerateKey()
 	if err != nil {
-		return fmt.Errorf("failed to derive key: %w", err)
+		return fmt.Errorf("failed to generate vault key: %w", err)
 	}
 
-	encryptedMasterPassword, err := passutils.EncryptPassword(masterPassword, key)
+	meta, err := newVaultMeta(passutils.DefaultKDFParams(), key, masterPassword)
 	if err != nil {
-		return fmt.Errorf("failed to encrypt master password: %w", err)
+		return err
 	}
 
-	if err := os.WriteFile(masterPasswordFile, []byte(encryptedMasterPassword), 0600); err != nil {
-		return fmt.Errorf("failed to save encrypted master password: %w", err)
+	v := &vault{dir: hushDir, meta: meta, key: key}
+	tx := beginTx(hushDir)
+
+	if err := v.stageMeta(tx); err != nil {
+		tx.rollback()
+		return err
 	}
 
-	if err := os.WriteFile(saltFile, []byte(salt), 0600); err != nil {
-		return fmt.Errorf("failed to save salt: %w", err)
+	if err := v.commit(tx, &manifest{Revision: 1, Entries: map[string]manifestEntry{}}); err != nil {
+		return fmt.Errorf("failed to save vault metadata: %w", err)
 	}
 
 	fmt.Println("Hush initialized successfully!")
 	return nil
 }
 
+// AddPassword stores a new entry. It fails with ErrEntryExists if name is
+// taken; SetPassword replaces existing entries.
 func AddPassword(name, password, masterPassword string) error {
+	return AddRecord(name, &Record{Password: password}, masterPassword)
+}
+
+func AddRecord(name string, record *Record, masterPassword string) error {
+	return storeRecord(name, record, false, masterPassword)
+}
+
+// SetPassword stores an entry, replacing the current one if name is taken.
+// The replaced version is kept in the history.
+func SetPassword(name, password, masterPassword string) error {
+	return SetRecord(name, &Record{Password: password}, masterPassword)
+}
+
+func SetRecord(name string, record *Record, masterPassword string) error {
+	return storeRecord(name, record, true, masterPassword)
+}
+
+func storeRecord(name string, record *Record, replace bool, masterPassword string) error {
 	sanitizedName, err := sanitizeFileName(name)
 	if err != nil {
 		return fmt.Errorf("invalid filename: %w", err)
 	}
 
-	if err := passutils.CheckPasswordStrength(password); err != nil {
+	if err := passutils.CheckPasswordStrength(record.Password); err != nil {
 		return fmt.Errorf("password is too weak: %w", err)
 	}
 
-	salt, err := readSalt()
-	if err != nil {
-		return fmt.Errorf("failed to read salt: %w", err)
+	if err := record.Validate(); err != nil {
+		return fmt.Errorf("invalid record: %w", err)
 	}
 
-	decryptedMasterPassword, err := validateMasterPassword(salt, masterPassword)
+	v, err := unlockVault(masterPassword, lockExclusive)
 	if err != nil {
 		return fmt.Errorf("error validating master password: %w", err)
 	}
+	defer v.close()
 
-	encryptionKey, err := passutils.DeriveKeyWithSalt(decryptedMasterPassword, salt)
-	if err != nil {
-		return fmt.Errorf("failed to derive encryption key: %w", err)
+	if err := v.checkTarget(sanitizedName, replace); err != nil {
+		return err
 	}
 
-	encryptedPassword, err := passutils.EncryptPassword(password, encryptionKey)
+	return v.addRecord(sanitizedName, record)
+}
+
+func (v *vault) addRecord(name string, record *Record) error {
+	sealedPassword, err := v.sealEntry(name, record)
 	if err != nil {
-		return fmt.Errorf("failed to encrypt password: %w", err)
+		return err
 	}
 
-	err = savePassword(sanitizedName, encryptedPassword)
+	err = v.savePassword(name, sealedPassword)
 	if err != nil {
 		return fmt.Errorf("failed to save password: %w", err)
 	}
@@ -122,27 +188,83 @@ func AddPassword(name, password, masterPassword string) error {
 	return nil
 }
 
-func savePassword(name, encryptedPassword string) error {
-	hushDir, err := getHushDir()
-	if err != nil {
+// savePassword stores sealedPassword as the new current revision of name,
+// keeping the one it replaces in the history.
+func (v *vault) savePassword(name string, sealedPassword []byte) error {
+	tx := beginTx(v.dir)
+	m := v.manifest.next()
+	if err := v.stageEntry(tx, m, name, sealedPassword); err != nil {
+		tx.rollback()
 		return err
 	}
 
-	filePath := filepath.Join(hushDir, name+".hush")
+	return v.commit(tx, m)
+}
 
-	err = os.WriteFile(filePath, []byte(encryptedPassword), 0600)
+// stageEntry stages sealedPassword as the new current revision of name in
+// tx and m. Each name may only be staged once per transaction.
+func (v *vault) stageEntry(tx *vaultTx, m *manifest, name string, sealedPassword []byte) error {
+	file, err := v.entryFileFor(name)
 	if err != nil {
+		return err
+	}
+
+	if err := tx.write(file+".hush", sealedPassword); err != nil {
 		return fmt.Errorf("failed to write password file: %w", err)
 	}
+
+	entry := manifestEntry{File: file, Hash: hashEntry(sealedPassword), Revision: 1, Modified: time.Now().UTC()}
+	if prev, ok := m.Entries[name]; ok {
+		if err := v.stageHistory(tx, &entry, prev, m.historyKeep()); err != nil {
+			return err
+		}
+	}
+	m.Entries[name] = entry
+
 	return nil
 }
 
-func ListPasswordNames() ([]string, error) {
-	hushDir, err := getHushDir()
+// ListPasswordNames returns the names of all stored passwords. With the
+// master password, or the key in the agent, the names come from the
+// manifest and damage to the vault is reported. Plain names can be listed
+// without either, but then only from the files in the hush directory.
+func ListPasswordNames(masterPassword string) ([]string, error) {
+	encrypted, err := NamesEncrypted()
+	if err != nil {
+		return nil, err
+	}
+
+	if encrypted || masterPassword != "" || AgentUnlocked() {
+		v, err := unlockVault(masterPassword, lockShared)
+		if err != nil {
+			return nil, fmt.Errorf("error validating master password: %w", err)
+		}
+		defer v.close()
+		return v.passwordNames(), nil
+	}
+
+	hushDir, lock, err := openHushDir(lockShared)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.unlock()
+
+	files, err := listEntryFiles(hushDir)
 	if err != nil {
 		return nil, err
 	}
 
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		names = append(names, entryNameFromFile(file))
+	}
+	slices.Sort(names)
+
+	fmt.Fprintln(warningOutput, "WARNING: names were listed without checking them against the manifest; run 'hush verify' to check the vault.")
+	return names, nil
+}
+
+func listEntryFiles(hushDir string) ([]string, error) {
 	entries, err := os.ReadDir(hushDir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list hush directory: %w", err)
@@ -161,150 +283,217 @@ func ListPasswordNames() ([]string, error) {
 }
 
 func GetPassword(name, masterPassword string) (string, error) {
-	sanitizedName, err := sanitizeFileName(name)
-	if err != nil {
-		return "", fmt.Errorf("invalid filename: %w", err)
-	}
-
-	hushDir, err := getHushDir()
+	record, err := GetRecord(name, masterPassword)
 	if err != nil {
 		return "", err
 	}
 
-	encryptedPassword, err := readEncryptedPassword(hushDir, sanitizedName)
-	if err != nil {
-		return "", fmt.Errorf("failed to read password file: %w", err)
-	}
-
-	salt, err := readSalt()
-	if err != nil {
-		return "", fmt.Errorf("failed to read salt: %w", err)
-	}
+	return record.Password, nil
+}
 
-	decryptedMasterPassword, err := validateMasterPassword(salt, masterPassword)
+func GetRecord(name, masterPassword string) (*Record, error) {
+	sanitizedName, err := sanitizeFileName(name)
 	if err != nil {
-		return "", fmt.Errorf("error validating master password: %w", err)
+		return nil, fmt.Errorf("invalid filename: %w", err)
 	}
 
-	encryptionKey, err := passutils.DeriveKeyWithSalt(decryptedMasterPassword, salt)
+	v, err := unlockVault(masterPassword, lockShared)
 	if err != nil {
-		return "", fmt.Errorf("failed to derive encryption key: %w", err)
+		return nil, fmt.Errorf("error validating master password: %w", err)
 	}
+	defer v.close()
 
-	decryptedPassword, err := passutils.DecryptPassword(string(encryptedPassword), encryptionKey)
+	record, err := v.getRecord(sanitizedName)
 	if err != nil {
-		return "", fmt.Errorf("failed to decrypt password: %w", err)
+		return nil, err
 	}
 
-	trimmedPassword := strings.TrimSpace(decryptedPassword)
+	// Usage only ranks entries in the picker; losing it is no reason to
+	// withhold the entry.
+	_ = v.recordUsage(sanitizedName)
 
-	return trimmedPassword, nil
+	return record, nil
 }
 
-func validateMasterPassword(salt, masterPassword string) (decryptedMasterPassword string, err error) {
-	encryptedMasterPassword, err := readEncryptedMasterPassword()
+func (v *vault) getRecord(name string) (*Record, error) {
+	file, err := v.lookupEntry(name)
 	if err != nil {
-		return "", fmt.Errorf("failed to read encrypted master password: %w", err)
+		return nil, err
 	}
 
-	key, err := passutils.DeriveKeyWithSalt(masterPassword, salt)
+	sealedPassword, err := readEncryptedPassword(v.dir, file)
 	if err != nil {
-		return "", fmt.Errorf("failed to derive key: %w", err)
+		return nil, fmt.Errorf("failed to read password file: %w", err)
 	}
 
-	decryptedMasterPassword, err = passutils.DecryptPassword(encryptedMasterPassword, key)
+	record, err := v.openEntry(name, sealedPassword)
 	if err != nil {
-		return "", fmt.Errorf("incorrect master password")
+		return nil, fmt.Errorf("failed to decrypt password: %w", err)
 	}
 
-	return decryptedMasterPassword, nil
+	return record, nil
 }
 
-func readEncryptedPassword(hushDir, name string) ([]byte, error) {
-	filePath := filepath.Join(hushDir, name+".hush")
+func readEncryptedPassword(hushDir, file string) ([]byte, error) {
+	filePath := filepath.Join(hushDir, file+".hush")
 
 	encryptedPassword, err := os.ReadFile(filePath)
 	return encryptedPassword, err
 }
 
 func RemovePassword(name, masterPassword string) error {
-	hushDir, err := getHushDir()
+	sanitizedName, err := sanitizeFileName(name)
 	if err != nil {
-		return err
+		return fmt.Errorf("invalid filename: %w", err)
+	}
+
+	v, err := unlockVault(masterPassword, lockExclusive)
+	if err != nil {
+		return fmt.Errorf("error validating master password: %w", err)
 	}
+	defer v.close()
 
-	_, err = readEncryptedPassword(hushDir, name)
+	return v.removePassword(sanitizedName)
+}
+
+func (v *vault) removePassword(name string) error {
+	return v.removeEntries([]string{name})
+}
+
+// RemoveFolder removes every entry in folder and its subfolders in a single
+// operation and returns their names.
+func RemoveFolder(folder, masterPassword string) ([]string, error) {
+	sanitizedFolder, err := sanitizeFolderName(folder)
 	if err != nil {
-		return fmt.Errorf("failed to read password file: %w", err)
+		return nil, fmt.Errorf("invalid folder name: %w", err)
 	}
 
-	salt, err := readSalt()
+	v, err := unlockVault(masterPassword, lockExclusive)
 	if err != nil {
-		return fmt.Errorf("failed to read salt: %w", err)
+		return nil, fmt.Errorf("error validating master password: %w", err)
 	}
+	defer v.close()
 
-	_, err = validateMasterPassword(salt, masterPassword)
+	index, err := v.entryIndex()
 	if err != nil {
-		return fmt.Errorf("error validating master password: %w", err)
+		return nil, err
 	}
 
-	filePath := filepath.Join(hushDir, name+".hush")
-	if err := os.Remove(filePath); err != nil {
+	var names []string
+	for name := range index {
+		if InFolder(name, sanitizedFolder) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("%w: folder %q is empty", ErrEntryNotFound, sanitizedFolder)
+	}
+	slices.Sort(names)
+
+	if err := v.removeEntries(names); err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+func (v *vault) removeEntries(names []string) error {
+	tx := beginTx(v.dir)
+	m := v.manifest.next()
+
+	for _, name := range names {
+		file, err := v.lookupEntry(name)
+		if err != nil {
+			return err
+		}
+
+		tx.remove(file + ".hush")
+		if entry, ok := m.Entries[name]; ok {
+			removeHistory(tx, entry)
+		}
+		delete(m.Entries, name)
+	}
+
+	if err := v.commit(tx, m); err != nil {
 		return fmt.Errorf("failed to delete password file: %w", err)
 	}
 
 	return nil
 }
 
-func readEncryptedMasterPassword() (string, error) {
-	hushDir, err := getHushDir()
+func ImplodeHush(masterPassword string) error {
+	if err := requirePassword(masterPassword); err != nil {
+		return err
+	}
+
+	v, err := unlockVault(masterPassword, lockExclusive)
 	if err != nil {
-		return "", err
+		return err
 	}
+	defer v.close()
 
-	masterPasswordFile := filepath.Join(hushDir, masterHashFileName)
-	encryptedPassword, err := os.ReadFile(masterPasswordFile)
+	err = os.RemoveAll(v.dir)
 	if err != nil {
-		return "", fmt.Errorf("failed to read encrypted master password: %w", err)
+		return fmt.Errorf("failed to delete hush directory: %w", err)
 	}
+	v.forgetKey()
 
-	return string(encryptedPassword), nil
+	return nil
 }
 
-func ImplodeHush(masterPassword string) error {
-	encryptedMasterPassword, err := readEncryptedMasterPassword()
-	if err != nil {
-		return fmt.Errorf("failed to read stored master password hash: %w", err)
+func ChangeMasterPassword(oldMasterPassword, newMasterPassword string) error {
+	if err := passutils.CheckPasswordStrength(newMasterPassword); err != nil {
+		return fmt.Errorf("new master password is too weak: %w", err)
 	}
 
-	salt, err := readSalt()
-	if err != nil {
-		return fmt.Errorf("failed to read salt: %w", err)
+	if err := requirePassword(oldMasterPassword); err != nil {
+		return err
 	}
 
-	key, err := passutils.DeriveKeyWithSalt(masterPassword, salt)
+	v, err := unlockVault(oldMasterPassword, lockExclusive)
 	if err != nil {
-		return fmt.Errorf("failed to derive key: %w", err)
+		return fmt.Errorf("error validating master password: %w", err)
 	}
+	defer v.close()
 
-	_, err = passutils.DecryptPassword(encryptedMasterPassword, key)
+	return v.rewrap(newMasterPassword, v.meta.KDF.Params)
+}
+
+func VaultKDFParams() (passutils.KDFParams, error) {
+	_, lock, err := openHushDir(lockShared)
 	if err != nil {
-		return fmt.Errorf("incorrect master password")
+		return passutils.KDFParams{}, err
 	}
+	defer lock.unlock()
 
-	hushDir, err := getHushDir()
+	meta, err := readVaultMeta()
 	if err != nil {
-		return fmt.Errorf("failed to get hush directory: %w", err)
+		return passutils.KDFParams{}, err
+	}
+
+	return meta.KDF.Params, nil
+}
+
+func UpgradeKDF(masterPassword string, params passutils.KDFParams) error {
+	if err := params.Validate(); err != nil {
+		return fmt.Errorf("invalid kdf parameters: %w", err)
+	}
+	if err := requirePassword(masterPassword); err != nil {
+		return err
 	}
 
-	err = os.RemoveAll(hushDir)
+	v, err := unlockVault(masterPassword, lockExclusive)
 	if err != nil {
-		return fmt.Errorf("failed to delete hush directory: %w", err)
+		return fmt.Errorf("error validating master password: %w", err)
 	}
+	defer v.close()
 
-	return nil
+	return v.rewrap(masterPassword, params)
 }
 
+// sanitizeFileName checks an entry name. Any printable name is allowed, as
+// entryFileName encodes it for the file system. Names may be split into
+// folders with "/", as in "work/aws/prod".
 func sanitizeFileName(name string) (string, error) {
 	name = strings.TrimSpace(name)
 
@@ -312,18 +501,43 @@ func sanitizeFileName(name string) (string, error) {
 		return "", fmt.Errorf("filename cannot be empty")
 	}
 
-	if len(name) > 255 {
-		return "", fmt.Errorf("filename is too long (max 255 characters)")
+	if !utf8.ValidString(name) {
+		return "", fmt.Errorf("filename is not valid UTF-8")
 	}
 
-	validChars := regexp.MustCompile(`^[a-zA-Z0-9)\-\.]+$`)
-	if !validChars.MatchString(name) {
-		return "", fmt.Errorf("filename contains invalid characters (only alphanumeric, underscore, hyphen, and dot are allowed)")
+	if strings.IndexFunc(name, func(r rune) bool { return !unicode.IsGraphic(r) }) >= 0 {
+		return "", fmt.Errorf("filename cannot contain control characters")
 	}
 
-	if strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".") {
-		return "", fmt.Errorf("filename cannot start or end with a dot")
+	if len(name) > 255 || len(entryFileName(name)) > maxFileStemLength {
+		return "", fmt.Errorf("filename is too long")
+	}
+
+	for _, segment := range strings.Split(name, folderSeparator) {
+		if err := sanitizeSegment(segment); err != nil {
+			return "", err
+		}
 	}
 
 	return name, nil
 }
+
+func sanitizeSegment(segment string) error {
+	if segment == "" {
+		return fmt.Errorf("filename cannot contain empty folder names")
+	}
+
+	if segment == "." || segment == ".." {
+		return fmt.Errorf("filename cannot contain %q as a folder name", segment)
+	}
+
+	if strings.TrimSpace(segment) != segment {
+		return fmt.Errorf("folder names cannot start or end with spaces")
+	}
+
+	return nil
+}
+
+func sanitizeFolderName(folder string) (string, error) {
+	return sanitizeFileName(strings.TrimSuffix(strings.TrimSpace(folder), folderSeparator))
+}
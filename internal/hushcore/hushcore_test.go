@@ -1,10 +1,21 @@
 package hushcore
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/nochzato/hush/internal/agent"
+	"github.com/nochzato/hush/internal/passutils"
 	"github.com/stretchr/testify/require"
 )
 
@@ -24,12 +35,42 @@ func TestSanitizeFileName(t *testing.T) {
 		{
 			name:     "name with spaces",
 			input:    "my account",
+			expected: "my account",
+			wantErr:  false,
+		},
+		{
+			name:     "name with special chars",
+			input:    "my&account_(old)",
+			expected: "my&account_(old)",
+			wantErr:  false,
+		},
+		{
+			name:     "unicode name",
+			input:    "Почта",
+			expected: "Почта",
+			wantErr:  false,
+		},
+		{
+			name:     "leading dot",
+			input:    ".env",
+			expected: ".env",
+			wantErr:  false,
+		},
+		{
+			name:     "surrounding spaces are trimmed",
+			input:    "  My Bank ",
+			expected: "My Bank",
+			wantErr:  false,
+		},
+		{
+			name:     "control characters",
+			input:    "my\taccount",
 			expected: "",
 			wantErr:  true,
 		},
 		{
-			name:     "name with special chars",
-			input:    "my&account",
+			name:     "invalid utf-8",
+			input:    "my\xffaccount",
 			expected: "",
 			wantErr:  true,
 		},
@@ -39,6 +80,60 @@ func TestSanitizeFileName(t *testing.T) {
 			expected: "",
 			wantErr:  true,
 		},
+		{
+			name:     "too long once encoded",
+			input:    strings.Repeat("я", 60),
+			expected: "",
+			wantErr:  true,
+		},
+		{
+			name:     "folder with surrounding spaces",
+			input:    "work /db",
+			expected: "",
+			wantErr:  true,
+		},
+		{
+			name:     "name in folders",
+			input:    "work/aws/prod",
+			expected: "work/aws/prod",
+			wantErr:  false,
+		},
+		{
+			name:     "parent folder",
+			input:    "../outside",
+			expected: "",
+			wantErr:  true,
+		},
+		{
+			name:     "parent folder inside",
+			input:    "work/../../etc",
+			expected: "",
+			wantErr:  true,
+		},
+		{
+			name:     "current folder",
+			input:    "work/./prod",
+			expected: "",
+			wantErr:  true,
+		},
+		{
+			name:     "absolute path",
+			input:    "/etc/passwd",
+			expected: "",
+			wantErr:  true,
+		},
+		{
+			name:     "empty folder name",
+			input:    "work//prod",
+			expected: "",
+			wantErr:  true,
+		},
+		{
+			name:     "trailing slash",
+			input:    "work/",
+			expected: "",
+			wantErr:  true,
+		},
 	}
 
 	for _, tt := range tc {
@@ -67,9 +162,16 @@ func setupTestDir(t *testing.T) (string, func()) {
 		return tempDir, nil
 	}
 
+	stateDir := t.TempDir()
+	originalGetStateDir := getStateDir
+	getStateDir = func() (string, error) {
+		return stateDir, nil
+	}
+
 	return tempDir, func() {
 		os.RemoveAll(tempDir)
 		func() { getHushDir = originalGetHushDir }()
+		func() { getStateDir = originalGetStateDir }()
 	}
 }
 
@@ -91,6 +193,13 @@ func TestAddPassword(t *testing.T) {
 
 	_, err = os.Stat(filePath)
 	require.NoError(t, err)
+
+	err = AddPassword(name, "otherPassword456!", masterPassword)
+	require.ErrorIs(t, err, ErrEntryExists)
+
+	got, err := GetPassword(name, masterPassword)
+	require.NoError(t, err)
+	require.Equal(t, password, got)
 }
 
 func TestAddAndGetPassword(t *testing.T) {
@@ -158,7 +267,7 @@ func TestImplodeHush(t *testing.T) {
 }
 
 func TestListPasswordNames(t *testing.T) {
-	_, clean := setupTestDir(t)
+	tempDir, clean := setupTestDir(t)
 	defer clean()
 
 	masterPassword := "strongMasterPassword123!"
@@ -173,8 +282,1990 @@ func TestListPasswordNames(t *testing.T) {
 		require.NoError(t, err)
 	}
 
-	got, err := ListPasswordNames()
+	var warnings bytes.Buffer
+	originalWarningOutput := warningOutput
+	warningOutput = &warnings
+	defer func() { warningOutput = originalWarningOutput }()
+
+	got, err := ListPasswordNames(masterPassword)
 	require.NoError(t, err)
+	require.Equal(t, got, passwordNames)
+	require.Empty(t, warnings.String())
 
+	// Without the master password or an agent the listing is unchecked.
+	got, err = ListPasswordNames("")
+	require.NoError(t, err)
 	require.Equal(t, got, passwordNames)
+	require.Contains(t, warnings.String(), "without checking them against the manifest")
+
+	warnings.Reset()
+	require.NoError(t, os.Remove(filepath.Join(tempDir, "testname1.hush")))
+
+	_, err = ListPasswordNames(masterPassword)
+	require.NoError(t, err)
+	require.Contains(t, warnings.String(), `entry "testname1" is listed in the manifest but missing`)
+}
+
+func TestChangeMasterPassword(t *testing.T) {
+	_, clean := setupTestDir(t)
+	defer clean()
+
+	masterPassword := "strongMasterPassword123!"
+	err := InitHush(masterPassword)
+	require.NoError(t, err)
+
+	passwords := map[string]string{
+		"testname":  "testPassword123!",
+		"testname1": "otherPassword456?",
+	}
+
+	for name, password := range passwords {
+		err = AddPassword(name, password, masterPassword)
+		require.NoError(t, err)
+	}
+
+	newMasterPassword := "newMasterPassword789!"
+	err = ChangeMasterPassword("wrongMasterPassword1", newMasterPassword)
+	require.Error(t, err)
+
+	err = ChangeMasterPassword(masterPassword, newMasterPassword)
+	require.NoError(t, err)
+
+	_, err = GetPassword("testname", masterPassword)
+	require.Error(t, err)
+
+	for name, password := range passwords {
+		got, err := GetPassword(name, newMasterPassword)
+		require.NoError(t, err)
+		require.Equal(t, password, got)
+	}
+}
+
+func TestRecoverTx(t *testing.T) {
+	tempDir, clean := setupTestDir(t)
+	defer clean()
+
+	require.NoError(t, os.MkdirAll(tempDir, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "a"), []byte("old a"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "b"), []byte("old b"), 0600))
+
+	t.Run("uncommitted changes are discarded", func(t *testing.T) {
+		tx := beginTx(tempDir)
+		require.NoError(t, tx.write("a", []byte("new a")))
+		require.NoError(t, tx.write("b", []byte("new b")))
+
+		require.NoError(t, recoverTx(tempDir))
+
+		for name, want := range map[string]string{"a": "old a", "b": "old b"} {
+			got, err := os.ReadFile(filepath.Join(tempDir, name))
+			require.NoError(t, err)
+			require.Equal(t, want, string(got))
+		}
+
+		_, err := os.Stat(filepath.Join(tempDir, "a"+pendingSuffix))
+		require.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("committed changes are completed", func(t *testing.T) {
+		tx := beginTx(tempDir)
+		require.NoError(t, tx.write("a", []byte("new a")))
+		require.NoError(t, tx.write("b", []byte("new b")))
+
+		// Simulate a crash after the journal was written and only the first
+		// rename happened.
+		journal, err := json.Marshal(tx)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(tempDir, journalFileName), journal, 0600))
+		require.NoError(t, os.Rename(filepath.Join(tempDir, "a"+pendingSuffix), filepath.Join(tempDir, "a")))
+
+		require.NoError(t, recoverTx(tempDir))
+
+		for name, want := range map[string]string{"a": "new a", "b": "new b"} {
+			got, err := os.ReadFile(filepath.Join(tempDir, name))
+			require.NoError(t, err)
+			require.Equal(t, want, string(got))
+		}
+
+		_, err = os.Stat(filepath.Join(tempDir, journalFileName))
+		require.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("subdirectories and git", func(t *testing.T) {
+		tx := beginTx(tempDir)
+		require.NoError(t, tx.write(filepath.Join("history", "c", "1"), []byte("c")))
+		require.NoError(t, tx.commit())
+
+		got, err := os.ReadFile(filepath.Join(tempDir, "history", "c", "1"))
+		require.NoError(t, err)
+		require.Equal(t, "c", string(got))
+
+		// Files inside the git repository are git's business.
+		gitFile := filepath.Join(tempDir, gitDirName, "objects", "x"+pendingSuffix)
+		require.NoError(t, os.MkdirAll(filepath.Dir(gitFile), 0700))
+		require.NoError(t, os.WriteFile(gitFile, nil, 0600))
+
+		require.NoError(t, recoverTx(tempDir))
+
+		_, err = os.Stat(gitFile)
+		require.NoError(t, err)
+	})
+}
+
+func createLegacyVault(t *testing.T, dir, masterPassword string, passwords map[string]string) {
+	t.Helper()
+
+	require.NoError(t, os.MkdirAll(dir, 0700))
+
+	key, salt, err := passutils.DeriveKey(masterPassword)
+	require.NoError(t, err)
+
+	encryptedMasterPassword, err := passutils.EncryptPassword(masterPassword, key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, masterHashFileName), []byte(encryptedMasterPassword), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, saltFileName), []byte(salt), 0600))
+
+	for name, password := range passwords {
+		encryptedPassword, err := passutils.EncryptPassword(password, key)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name+".hush"), []byte(encryptedPassword), 0600))
+	}
+}
+
+func TestLegacyVault(t *testing.T) {
+	tempDir, clean := setupTestDir(t)
+	defer clean()
+
+	masterPassword := "strongMasterPassword123!"
+	createLegacyVault(t, tempDir, masterPassword, map[string]string{"testname": "testPassword123!"})
+
+	got, err := GetPassword("testname", masterPassword)
+	require.NoError(t, err)
+	require.Equal(t, "testPassword123!", got)
+
+	newMasterPassword := "newMasterPassword789!"
+	err = ChangeMasterPassword(masterPassword, newMasterPassword)
+	require.NoError(t, err)
+
+	_, err = os.Stat(filepath.Join(tempDir, saltFileName))
+	require.True(t, os.IsNotExist(err))
+
+	meta, err := readVaultMeta()
+	require.NoError(t, err)
+	require.Equal(t, vaultVersion, meta.Version)
+	require.Equal(t, passutils.LegacyKDFParams(), meta.KDF.Params)
+
+	got, err = GetPassword("testname", newMasterPassword)
+	require.NoError(t, err)
+	require.Equal(t, "testPassword123!", got)
+}
+
+func TestVaultMetaParams(t *testing.T) {
+	tempDir, clean := setupTestDir(t)
+	defer clean()
+
+	masterPassword := "strongMasterPassword123!"
+	err := InitHush(masterPassword)
+	require.NoError(t, err)
+
+	meta, err := readVaultMeta()
+	require.NoError(t, err)
+	require.Equal(t, passutils.DefaultKDFParams(), meta.KDF.Params)
+
+	meta.KDF.Params.Time = 3
+	meta.KDF.Params.Memory = 16 * 1024
+	encodedMeta, err := meta.encode()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, vaultFileName), encodedMeta, 0600))
+
+	// The stored parameters no longer match the ones master.hash was sealed
+	// with, so unlocking has to fail rather than silently use the defaults.
+	err = AddPassword("testname", "testPassword123!", masterPassword)
+	require.Error(t, err)
+
+	meta.Version = vaultVersion + 1
+	encodedMeta, err = meta.encode()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, vaultFileName), encodedMeta, 0600))
+
+	_, err = readVaultMeta()
+	require.ErrorContains(t, err, "newer than this version")
+}
+
+func TestUpgradeKDF(t *testing.T) {
+	_, clean := setupTestDir(t)
+	defer clean()
+
+	masterPassword := "strongMasterPassword123!"
+	err := InitHush(masterPassword)
+	require.NoError(t, err)
+
+	err = AddPassword("testname", "testPassword123!", masterPassword)
+	require.NoError(t, err)
+
+	params := passutils.DefaultKDFParams()
+	params.Time = 2
+	params.Memory = 32 * 1024
+
+	err = UpgradeKDF("wrongMasterPassword1", params)
+	require.Error(t, err)
+
+	params.Threads = 0
+	err = UpgradeKDF(masterPassword, params)
+	require.Error(t, err)
+
+	params.Threads = 2
+	err = UpgradeKDF(masterPassword, params)
+	require.NoError(t, err)
+
+	got, err := VaultKDFParams()
+	require.NoError(t, err)
+	require.Equal(t, params, got)
+
+	password, err := GetPassword("testname", masterPassword)
+	require.NoError(t, err)
+	require.Equal(t, "testPassword123!", password)
+}
+
+func TestEnvelopeEncryption(t *testing.T) {
+	tempDir, clean := setupTestDir(t)
+	defer clean()
+
+	masterPassword := "strongMasterPassword123!"
+	err := InitHush(masterPassword)
+	require.NoError(t, err)
+
+	_, err = os.Stat(filepath.Join(tempDir, masterHashFileName))
+	require.True(t, os.IsNotExist(err))
+
+	err = AddPassword("testname", "testPassword123!", masterPassword)
+	require.NoError(t, err)
+
+	entryPath := filepath.Join(tempDir, "testname.hush")
+	sealedBefore, err := os.ReadFile(entryPath)
+	require.NoError(t, err)
+
+	newMasterPassword := "newMasterPassword789!"
+	err = ChangeMasterPassword(masterPassword, newMasterPassword)
+	require.NoError(t, err)
+
+	// Only the wrapped data key changes, entries are left alone.
+	sealedAfter, err := os.ReadFile(entryPath)
+	require.NoError(t, err)
+	require.Equal(t, sealedBefore, sealedAfter)
+
+	got, err := GetPassword("testname", newMasterPassword)
+	require.NoError(t, err)
+	require.Equal(t, "testPassword123!", got)
+}
+
+func TestUpgradeLegacyVault(t *testing.T) {
+	tempDir, clean := setupTestDir(t)
+	defer clean()
+
+	masterPassword := "strongMasterPassword123!"
+	createLegacyVault(t, tempDir, masterPassword, map[string]string{
+		"testname":  "testPassword123!",
+		"testname1": "otherPassword456?",
+	})
+
+	err := AddPassword("testname2", "thirdPassword789#", "wrongMasterPassword1")
+	require.Error(t, err)
+
+	err = AddPassword("testname2", "thirdPassword789#", masterPassword)
+	require.NoError(t, err)
+
+	meta, err := readVaultMeta()
+	require.NoError(t, err)
+	require.Equal(t, vaultVersion, meta.Version)
+	require.NotEmpty(t, meta.WrappedKey)
+
+	for _, fileName := range []string{masterHashFileName, saltFileName} {
+		_, err = os.Stat(filepath.Join(tempDir, fileName))
+		require.True(t, os.IsNotExist(err))
+	}
+
+	for name, password := range map[string]string{
+		"testname":  "testPassword123!",
+		"testname1": "otherPassword456?",
+		"testname2": "thirdPassword789#",
+	} {
+		got, err := GetPassword(name, masterPassword)
+		require.NoError(t, err)
+		require.Equal(t, password, got)
+	}
+}
+
+func TestEntryBinding(t *testing.T) {
+	tempDir, clean := setupTestDir(t)
+	defer clean()
+
+	masterPassword := "strongMasterPassword123!"
+	err := InitHush(masterPassword)
+	require.NoError(t, err)
+
+	require.NoError(t, AddPassword("bank", "bankPassword123!", masterPassword))
+	require.NoError(t, AddPassword("email", "emailPassword456!", masterPassword))
+
+	bankPath := filepath.Join(tempDir, "bank.hush")
+	emailPath := filepath.Join(tempDir, "email.hush")
+
+	bank, err := os.ReadFile(bankPath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(emailPath, bank, 0600))
+
+	_, err = GetPassword("email", masterPassword)
+	require.ErrorIs(t, err, ErrEntryTampered)
+
+	got, err := GetPassword("bank", masterPassword)
+	require.NoError(t, err)
+	require.Equal(t, "bankPassword123!", got)
+
+	require.NoError(t, os.Rename(bankPath, filepath.Join(tempDir, "other.hush")))
+	_, err = GetPassword("other", masterPassword)
+	require.ErrorIs(t, err, ErrEntryTampered)
+}
+
+func TestEntryBindingAcrossVaults(t *testing.T) {
+	tempDir, clean := setupTestDir(t)
+	defer clean()
+
+	masterPassword := "strongMasterPassword123!"
+	err := InitHush(masterPassword)
+	require.NoError(t, err)
+	require.NoError(t, AddPassword("bank", "bankPassword123!", masterPassword))
+
+	// A second vault sharing the data key but not the ID, as if restored
+	// next to the original.
+	meta, err := readVaultMeta()
+	require.NoError(t, err)
+	meta.ID = "00000000000000000000000000000000"
+	encodedMeta, err := meta.encode()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, vaultFileName), encodedMeta, 0600))
+
+	_, err = GetPassword("bank", masterPassword)
+	require.ErrorIs(t, err, ErrEntryTampered)
+}
+
+func TestMigrateUnboundEntries(t *testing.T) {
+	tempDir, clean := setupTestDir(t)
+	defer clean()
+
+	masterPassword := "strongMasterPassword123!"
+	err := InitHush(masterPassword)
+	require.NoError(t, err)
+
+	v, err := unlockVault(masterPassword, lockExclusive)
+	require.NoError(t, err)
+	v.close()
+
+	// Rewrite the vault the way the previous format stored it: no vault ID
+	// and entries sealed without associated data.
+	v.meta.Version = envelopeVaultVersion
+	v.meta.ID = ""
+	encodedMeta, err := v.meta.encode()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, vaultFileName), encodedMeta, 0600))
+
+	unbound := map[string][]byte{}
+	for name, password := range map[string]string{"bank": "bankPassword123!", "email": "emailPassword456!"} {
+		salt, err := passutils.GenerateSalt()
+		require.NoError(t, err)
+		key, err := v.entryKey(salt)
+		require.NoError(t, err)
+		data, err := passutils.EncryptPassword(password, key)
+		require.NoError(t, err)
+		sealed, err := json.Marshal(entryFile{Version: unboundEntryVersion, Salt: salt, Data: data})
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(tempDir, name+".hush"), sealed, 0600))
+		unbound[name] = sealed
+	}
+
+	got, err := GetPassword("bank", masterPassword)
+	require.NoError(t, err)
+	require.Equal(t, "bankPassword123!", got)
+
+	meta, err := readVaultMeta()
+	require.NoError(t, err)
+	require.Equal(t, vaultVersion, meta.Version)
+	require.NotEmpty(t, meta.ID)
+
+	// Putting back a pre-migration copy under another name must not work.
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "email.hush"), unbound["bank"], 0600))
+	_, err = GetPassword("email", masterPassword)
+	require.ErrorIs(t, err, ErrEntryTampered)
+}
+
+func issueKinds(issues []VaultIssue) []IssueKind {
+	kinds := []IssueKind{}
+	for _, issue := range issues {
+		kinds = append(kinds, issue.Kind)
+	}
+	return kinds
+}
+
+func copyDir(t *testing.T, src, dst string) {
+	t.Helper()
+
+	require.NoError(t, os.RemoveAll(dst))
+	require.NoError(t, os.CopyFS(dst, os.DirFS(src)))
+}
+
+func TestVerifyVault(t *testing.T) {
+	tempDir, clean := setupTestDir(t)
+	defer clean()
+
+	var warnings bytes.Buffer
+	originalWarningOutput := warningOutput
+	warningOutput = &warnings
+	defer func() { warningOutput = originalWarningOutput }()
+
+	masterPassword := "strongMasterPassword123!"
+	err := InitHush(masterPassword)
+	require.NoError(t, err)
+
+	for _, name := range []string{"bank", "email", "work"} {
+		require.NoError(t, AddPassword(name, "testPassword123!", masterPassword))
+	}
+
+	issues, err := VerifyVault(masterPassword)
+	require.NoError(t, err)
+	require.Empty(t, issues)
+	require.Empty(t, warnings.String())
+
+	snapshot := filepath.Join(t.TempDir(), "snapshot")
+	copyDir(t, tempDir, snapshot)
+
+	t.Run("deleted, extra and stale entries", func(t *testing.T) {
+		staleBank, err := os.ReadFile(filepath.Join(tempDir, "bank.hush"))
+		require.NoError(t, err)
+
+		require.NoError(t, SetPassword("bank", "newPassword456!", masterPassword))
+		require.NoError(t, os.WriteFile(filepath.Join(tempDir, "bank.hush"), staleBank, 0600))
+		require.NoError(t, os.Remove(filepath.Join(tempDir, "email.hush")))
+		require.NoError(t, os.WriteFile(filepath.Join(tempDir, "intruder.hush"), staleBank, 0600))
+
+		issues, err := VerifyVault(masterPassword)
+		require.NoError(t, err)
+		require.Equal(t, []IssueKind{IssueModified, IssueMissing, IssueExtra}, issueKinds(issues))
+
+		warnings.Reset()
+		_, err = GetPassword("work", masterPassword)
+		require.NoError(t, err)
+		require.Contains(t, warnings.String(), `entry "email" is listed in the manifest but missing`)
+	})
+
+	t.Run("whole vault rolled back", func(t *testing.T) {
+		copyDir(t, snapshot, tempDir)
+
+		issues, err := VerifyVault(masterPassword)
+		require.NoError(t, err)
+		require.Equal(t, []IssueKind{IssueRollback}, issueKinds(issues))
+	})
+
+	t.Run("manifest deleted", func(t *testing.T) {
+		require.NoError(t, os.Remove(filepath.Join(tempDir, manifestFileName)))
+
+		issues, err := VerifyVault(masterPassword)
+		require.NoError(t, err)
+		require.Equal(t, []IssueKind{IssueManifest, IssueExtra, IssueExtra, IssueExtra}, issueKinds(issues))
+	})
+
+	t.Run("repair", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(tempDir, "swapped.hush"), []byte("garbage"), 0600))
+
+		rejected, err := RepairManifest(masterPassword)
+		require.NoError(t, err)
+		require.Equal(t, []string{"swapped"}, rejected)
+
+		issues, err := VerifyVault(masterPassword)
+		require.NoError(t, err)
+		require.Equal(t, []IssueKind{IssueExtra}, issueKinds(issues))
+	})
+}
+
+func TestEncryptedNames(t *testing.T) {
+	tempDir, clean := setupTestDir(t)
+	defer clean()
+
+	masterPassword := "strongMasterPassword123!"
+	err := InitHush(masterPassword)
+	require.NoError(t, err)
+
+	passwords := map[string]string{
+		"bank":  "bankPassword123!",
+		"email": "emailPassword456!",
+	}
+	for name, password := range passwords {
+		require.NoError(t, AddPassword(name, password, masterPassword))
+	}
+
+	require.Error(t, SetNameEncryption("wrongMasterPassword1", true))
+	require.NoError(t, SetNameEncryption(masterPassword, true))
+
+	encrypted, err := NamesEncrypted()
+	require.NoError(t, err)
+	require.True(t, encrypted)
+
+	require.NoError(t, AddPassword("work", "workPassword789!", masterPassword))
+	passwords["work"] = "workPassword789!"
+
+	files, err := listEntryFiles(tempDir)
+	require.NoError(t, err)
+	require.Len(t, files, 3)
+	for _, file := range files {
+		require.NotContains(t, passwords, file)
+	}
+
+	_, err = ListPasswordNames("wrongMasterPassword1")
+	require.Error(t, err)
+
+	names, err := ListPasswordNames(masterPassword)
+	require.NoError(t, err)
+	require.Equal(t, []string{"bank", "email", "work"}, names)
+
+	for name, password := range passwords {
+		got, err := GetPassword(name, masterPassword)
+		require.NoError(t, err)
+		require.Equal(t, password, got)
+	}
+
+	require.NoError(t, RemovePassword("email", masterPassword))
+	_, err = GetPassword("email", masterPassword)
+	require.ErrorIs(t, err, ErrEntryNotFound)
+
+	issues, err := VerifyVault(masterPassword)
+	require.NoError(t, err)
+	require.Empty(t, issues)
+
+	newMasterPassword := "newStrongMasterPassword456!"
+	require.NoError(t, ChangeMasterPassword(masterPassword, newMasterPassword))
+	masterPassword = newMasterPassword
+
+	encrypted, err = NamesEncrypted()
+	require.NoError(t, err)
+	require.True(t, encrypted)
+
+	require.NoError(t, SetNameEncryption(masterPassword, false))
+
+	files, err = listEntryFiles(tempDir)
+	require.NoError(t, err)
+	require.Equal(t, []string{"bank", "work"}, files)
+
+	names, err = ListPasswordNames("")
+	require.NoError(t, err)
+	require.Equal(t, []string{"bank", "work"}, names)
+}
+
+func TestRecords(t *testing.T) {
+	tempDir, clean := setupTestDir(t)
+	defer clean()
+
+	masterPassword := "strongMasterPassword123!"
+	err := InitHush(masterPassword)
+	require.NoError(t, err)
+
+	record := &Record{
+		Password: "bankPassword123!",
+		Username: "alice",
+		URLs:     []string{"https://bank.example", "https://m.bank.example"},
+		Notes:    "branch 42",
+		Fields: []Field{
+			{Key: "pin", Value: "1234", Sensitive: true},
+			{Key: "account", Value: "DE00 1234"},
+		},
+	}
+	require.NoError(t, AddRecord("bank", record, masterPassword))
+
+	got, err := GetRecord("bank", masterPassword)
+	require.NoError(t, err)
+	require.Equal(t, record, got)
+
+	password, err := GetPassword("bank", masterPassword)
+	require.NoError(t, err)
+	require.Equal(t, record.Password, password)
+
+	tc := []struct {
+		key       string
+		value     string
+		sensitive bool
+		wantErr   bool
+	}{
+		{key: "password", value: "bankPassword123!", sensitive: true},
+		{key: "username", value: "alice"},
+		{key: "URL", value: "https://bank.example"},
+		{key: "notes", value: "branch 42"},
+		{key: "pin", value: "1234", sensitive: true},
+		{key: "Account", value: "DE00 1234"},
+		{key: "missing", wantErr: true},
+	}
+	for _, tt := range tc {
+		t.Run(tt.key, func(t *testing.T) {
+			value, sensitive, err := got.Get(tt.key)
+			if tt.wantErr {
+				require.ErrorIs(t, err, ErrFieldNotFound)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.value, value)
+			require.Equal(t, tt.sensitive, sensitive)
+		})
+	}
+
+	invalid := []Record{
+		{Password: "bankPassword123!", Fields: []Field{{Key: "", Value: "x"}}},
+		{Password: "bankPassword123!", Fields: []Field{{Key: "username", Value: "x"}}},
+		{Password: "bankPassword123!", Fields: []Field{{Key: "pin", Value: "1"}, {Key: "PIN", Value: "2"}}},
+	}
+	for _, r := range invalid {
+		require.Error(t, AddRecord("other", &r, masterPassword))
+	}
+
+	// Entries written before records existed hold a bare password.
+	v, err := unlockVault(masterPassword, lockExclusive)
+	require.NoError(t, err)
+	v.close()
+	salt, err := passutils.GenerateSalt()
+	require.NoError(t, err)
+	key, err := v.entryKey(salt)
+	require.NoError(t, err)
+	data, err := passutils.EncryptPasswordWithAD("emailPassword456!", key, v.entryAD(passwordEntryVersion, "email"))
+	require.NoError(t, err)
+	sealed, err := json.Marshal(entryFile{Version: passwordEntryVersion, Salt: salt, Data: data})
+	require.NoError(t, err)
+	require.NoError(t, v.savePassword("email", sealed))
+
+	got, err = GetRecord("email", masterPassword)
+	require.NoError(t, err)
+	require.Equal(t, &Record{Password: "emailPassword456!"}, got)
+
+	// A record cannot be passed off as a bare password entry.
+	bankFile := filepath.Join(tempDir, "bank.hush")
+	bankData, err := os.ReadFile(bankFile)
+	require.NoError(t, err)
+	var entry entryFile
+	require.NoError(t, json.Unmarshal(bankData, &entry))
+	entry.Version = passwordEntryVersion
+	downgraded, err := json.Marshal(entry)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(bankFile, downgraded, 0600))
+
+	_, err = GetRecord("bank", masterPassword)
+	require.ErrorIs(t, err, ErrEntryTampered)
+}
+
+func TestEntryHistory(t *testing.T) {
+	tempDir, clean := setupTestDir(t)
+	defer clean()
+
+	masterPassword := "strongMasterPassword123!"
+	err := InitHush(masterPassword)
+	require.NoError(t, err)
+
+	passwords := []string{"firstPassword1!", "secondPassword2!", "thirdPassword3!"}
+	for _, password := range passwords {
+		require.NoError(t, SetPassword("bank", password, masterPassword))
+	}
+
+	revisionNumbers := func(revisions []EntryRevision) []int {
+		var numbers []int
+		for _, rev := range revisions {
+			numbers = append(numbers, rev.Revision)
+		}
+		return numbers
+	}
+
+	history, err := EntryHistory("bank", masterPassword)
+	require.NoError(t, err)
+	require.Equal(t, []int{3, 2, 1}, revisionNumbers(history))
+	require.True(t, history[0].Current)
+	require.False(t, history[0].Modified.IsZero())
+
+	_, err = EntryHistory("missing", masterPassword)
+	require.ErrorIs(t, err, ErrEntryNotFound)
+
+	require.ErrorIs(t, RestoreRevision("bank", 7, masterPassword), ErrRevisionNotFound)
+	require.Error(t, RestoreRevision("bank", 3, masterPassword))
+
+	require.NoError(t, RestoreRevision("bank", 1, masterPassword))
+	got, err := GetPassword("bank", masterPassword)
+	require.NoError(t, err)
+	require.Equal(t, passwords[0], got)
+
+	history, err = EntryHistory("bank", masterPassword)
+	require.NoError(t, err)
+	require.Equal(t, []int{4, 3, 2, 1}, revisionNumbers(history))
+
+	// A previous revision that was tampered with is not restored.
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, historyFile("bank", 2)), []byte("{}"), 0600))
+	require.ErrorIs(t, RestoreRevision("bank", 2, masterPassword), ErrEntryTampered)
+
+	keep, err := HistoryRetention(masterPassword)
+	require.NoError(t, err)
+	require.Equal(t, defaultHistoryKeep, keep)
+
+	require.Error(t, SetHistoryRetention(masterPassword, 0))
+	require.NoError(t, SetHistoryRetention(masterPassword, 2))
+
+	history, err = EntryHistory("bank", masterPassword)
+	require.NoError(t, err)
+	require.Equal(t, []int{4, 3, 2}, revisionNumbers(history))
+	_, err = os.Stat(filepath.Join(tempDir, historyFile("bank", 1)))
+	require.True(t, os.IsNotExist(err))
+
+	require.NoError(t, SetPassword("bank", "fifthPassword5!", masterPassword))
+	history, err = EntryHistory("bank", masterPassword)
+	require.NoError(t, err)
+	require.Equal(t, []int{5, 4, 3}, revisionNumbers(history))
+
+	// History follows entries when their files move.
+	require.NoError(t, SetNameEncryption(masterPassword, true))
+	require.NoError(t, RestoreRevision("bank", 3, masterPassword))
+	got, err = GetPassword("bank", masterPassword)
+	require.NoError(t, err)
+	require.Equal(t, passwords[2], got)
+
+	issues, err := VerifyVault(masterPassword)
+	require.NoError(t, err)
+	require.Empty(t, issues)
+
+	require.NoError(t, RemovePassword("bank", masterPassword))
+	leftover, err := os.ReadDir(filepath.Join(tempDir, historyDirName))
+	require.NoError(t, err)
+	require.Empty(t, leftover)
+}
+
+// initFastVault initializes a vault with the cheapest KDF parameters, so
+// that tests which unlock it many times stay fast.
+func initFastVault(t *testing.T, masterPassword string) {
+	t.Helper()
+
+	require.NoError(t, InitHush(masterPassword))
+	require.NoError(t, UpgradeKDF(masterPassword, passutils.KDFParams{Time: 1, Memory: 64, Threads: 1, KeySize: 32}))
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	_, clean := setupTestDir(t)
+	defer clean()
+
+	masterPassword := "strongMasterPassword123!"
+	initFastVault(t, masterPassword)
+	require.NoError(t, AddPassword("shared", "sharedPassword0!", masterPassword))
+
+	const workers, writes = 8, 5
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*writes*3)
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range writes {
+				name := fmt.Sprintf("worker%d-%d", w, i)
+				errs <- AddPassword(name, "workerPassword1!", masterPassword)
+				errs <- SetPassword("shared", fmt.Sprintf("sharedPassword%d!", w), masterPassword)
+
+				_, err := GetPassword("shared", masterPassword)
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	names, err := ListPasswordNames("")
+	require.NoError(t, err)
+	require.Len(t, names, workers*writes+1)
+
+	issues, err := VerifyVault(masterPassword)
+	require.NoError(t, err)
+	require.Empty(t, issues)
+
+	history, err := EntryHistory("shared", masterPassword)
+	require.NoError(t, err)
+	require.Equal(t, workers*writes+1, history[0].Revision)
+}
+
+// TestHelperProcess is run as a separate hush process by
+// TestConcurrentProcesses.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("HUSH_TEST_HELPER") != "1" {
+		t.Skip("only run as a helper process")
+	}
+
+	getHushDir = func() (string, error) { return os.Getenv("HUSH_TEST_DIR"), nil }
+	getStateDir = func() (string, error) { return os.Getenv("HUSH_TEST_STATE_DIR"), nil }
+
+	masterPassword, worker := os.Getenv("HUSH_TEST_MASTER"), os.Getenv("HUSH_TEST_WORKER")
+	for i := range 5 {
+		require.NoError(t, AddPassword(fmt.Sprintf("%s-%d", worker, i), "workerPassword1!", masterPassword))
+		require.NoError(t, SetPassword("shared", "sharedPassword"+worker+"!", masterPassword))
+
+		_, err := GetPassword("shared", masterPassword)
+		require.NoError(t, err)
+	}
+}
+
+func TestConcurrentProcesses(t *testing.T) {
+	tempDir, clean := setupTestDir(t)
+	defer clean()
+
+	masterPassword := "strongMasterPassword123!"
+	initFastVault(t, masterPassword)
+	require.NoError(t, AddPassword("shared", "sharedPassword0!", masterPassword))
+
+	stateDir, err := getStateDir()
+	require.NoError(t, err)
+
+	const workers = 4
+
+	cmds := make([]*exec.Cmd, workers)
+	outputs := make([]bytes.Buffer, workers)
+	for w := range workers {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$")
+		cmd.Env = append(os.Environ(),
+			"HUSH_TEST_HELPER=1",
+			"HUSH_TEST_DIR="+tempDir,
+			"HUSH_TEST_STATE_DIR="+stateDir,
+			"HUSH_TEST_MASTER="+masterPassword,
+			fmt.Sprintf("HUSH_TEST_WORKER=worker%d", w),
+		)
+		cmd.Stdout = &outputs[w]
+		cmd.Stderr = &outputs[w]
+		require.NoError(t, cmd.Start())
+		cmds[w] = cmd
+	}
+
+	for w, cmd := range cmds {
+		require.NoError(t, cmd.Wait(), outputs[w].String())
+	}
+
+	names, err := ListPasswordNames("")
+	require.NoError(t, err)
+	require.Len(t, names, workers*5+1)
+
+	issues, err := VerifyVault(masterPassword)
+	require.NoError(t, err)
+	require.Empty(t, issues)
+
+	history, err := EntryHistory("shared", masterPassword)
+	require.NoError(t, err)
+	require.Equal(t, workers*5+1, history[0].Revision)
+}
+
+func TestResolveVault(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv(hushDirEnv, "")
+
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+
+	tc := []struct {
+		name     string
+		input    string
+		env      string
+		expected string
+		wantErr  bool
+	}{
+		{name: "default", input: "", expected: filepath.Join(home, ".hush")},
+		{name: "default by name", input: "default", expected: filepath.Join(home, ".hush")},
+		{name: "HUSH_DIR", input: "", env: "~/vaults/personal", expected: filepath.Join(home, "vaults/personal")},
+		{name: "profile", input: "work", expected: filepath.Join(home, ".hush-work")},
+		{name: "profile ignores HUSH_DIR", input: "work", env: "/elsewhere", expected: filepath.Join(home, ".hush-work")},
+		{name: "absolute path", input: "/srv/team-vault", expected: "/srv/team-vault"},
+		{name: "relative path", input: "./team", expected: filepath.Join(cwd, "team")},
+		{name: "home path", input: "~/team", expected: filepath.Join(home, "team")},
+		{name: "invalid profile", input: "my vault", wantErr: true},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(hushDirEnv, tt.env)
+
+			result, err := ResolveVault(tt.input)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, result)
+		})
+	}
+}
+
+func TestNamedVaults(t *testing.T) {
+	_, clean := setupTestDir(t)
+	defer clean()
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv(hushDirEnv, "")
+
+	vaults := map[string]string{
+		"default": "personalMasterPassword1!",
+		"work":    "workMasterPassword2!",
+	}
+	for name, masterPassword := range vaults {
+		require.NoError(t, SelectVault(name))
+		require.NoError(t, InitHush(masterPassword))
+		require.NoError(t, AddPassword("db", name+"Password123!", masterPassword))
+	}
+
+	for name, masterPassword := range vaults {
+		require.NoError(t, SelectVault(name))
+
+		got, err := GetPassword("db", masterPassword)
+		require.NoError(t, err)
+		require.Equal(t, name+"Password123!", got)
+	}
+
+	require.NoError(t, SelectVault("work"))
+	_, err := GetPassword("db", vaults["default"])
+	require.Error(t, err)
+
+	list, err := ListVaults()
+	require.NoError(t, err)
+	require.Equal(t, []VaultInfo{
+		{Name: "default", Dir: filepath.Join(home, ".hush"), Initialized: true},
+		{Name: "work", Dir: filepath.Join(home, ".hush-work"), Initialized: true},
+	}, list)
+
+	require.NoError(t, ImplodeHush(vaults["work"]))
+
+	require.NoError(t, SelectVault("default"))
+	names, err := ListPasswordNames("")
+	require.NoError(t, err)
+	require.Equal(t, []string{"db"}, names)
+
+	require.NoError(t, SelectVault("missing"))
+	_, err = ListPasswordNames("")
+	require.ErrorIs(t, err, ErrNotInitialized)
+}
+
+func TestFolders(t *testing.T) {
+	for _, encryptNames := range []bool{false, true} {
+		t.Run(fmt.Sprintf("encrypted names %v", encryptNames), func(t *testing.T) {
+			tempDir, clean := setupTestDir(t)
+			defer clean()
+
+			masterPassword := "strongMasterPassword123!"
+			initFastVault(t, masterPassword)
+			require.NoError(t, SetNameEncryption(masterPassword, encryptNames))
+
+			names := []string{"personal/bank", "top", "work/aws/prod", "work/aws/staging", "work/db", "workshop"}
+			for _, name := range names {
+				require.NoError(t, AddPassword(name, name+"Password1!", masterPassword))
+			}
+
+			// Every entry is a single file directly in the hush directory.
+			dirEntries, err := os.ReadDir(tempDir)
+			require.NoError(t, err)
+			for _, e := range dirEntries {
+				require.False(t, e.IsDir(), e.Name())
+			}
+
+			got, err := ListPasswordNames(masterPassword)
+			require.NoError(t, err)
+			require.Equal(t, names, got)
+
+			password, err := GetPassword("work/aws/prod", masterPassword)
+			require.NoError(t, err)
+			require.Equal(t, "work/aws/prodPassword1!", password)
+
+			_, err = RemoveFolder("missing", masterPassword)
+			require.ErrorIs(t, err, ErrEntryNotFound)
+			_, err = RemoveFolder("../work", masterPassword)
+			require.Error(t, err)
+
+			removed, err := RemoveFolder("work/", masterPassword)
+			require.NoError(t, err)
+			require.Equal(t, []string{"work/aws/prod", "work/aws/staging", "work/db"}, removed)
+
+			got, err = ListPasswordNames(masterPassword)
+			require.NoError(t, err)
+			require.Equal(t, []string{"personal/bank", "top", "workshop"}, got)
+
+			issues, err := VerifyVault(masterPassword)
+			require.NoError(t, err)
+			require.Empty(t, issues)
+		})
+	}
+}
+
+func TestInFolder(t *testing.T) {
+	tc := []struct {
+		name     string
+		folder   string
+		expected bool
+	}{
+		{name: "work/db", folder: "work", expected: true},
+		{name: "work/aws/prod", folder: "work", expected: true},
+		{name: "work/aws/prod", folder: "work/aws/", expected: true},
+		{name: "workshop", folder: "work", expected: false},
+		{name: "work", folder: "work", expected: false},
+		{name: "top", folder: "", expected: true},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name+" in "+tt.folder, func(t *testing.T) {
+			require.Equal(t, tt.expected, InFolder(tt.name, tt.folder))
+		})
+	}
+}
+
+func TestEntryFileName(t *testing.T) {
+	tc := []struct {
+		name     string
+		expected string
+	}{
+		{name: "bank", expected: "bank"},
+		{name: "Bank", expected: "_42ank"},
+		{name: "my bank", expected: "my_20bank"},
+		{name: "work/aws/prod", expected: "work_2faws_2fprod"},
+		{name: "under_score", expected: "under_5fscore"},
+		{name: "Почта", expected: "_d0_9f_d0_be_d1_87_d1_82_d0_b0"},
+		{name: ".env", expected: "_2eenv"},
+		{name: "v1.2", expected: "v1.2"},
+		{name: "trailing.", expected: "trailing_2e"},
+		{name: "con", expected: "_63on"},
+		{name: "com1.backup", expected: "_63om1.backup"},
+		{name: "console", expected: "console"},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			file := entryFileName(tt.name)
+			require.Equal(t, tt.expected, file)
+			require.Equal(t, tt.name, entryNameFromFile(file))
+		})
+	}
+
+	// Stems of vaults from before names were encoded decode to themselves.
+	require.Equal(t, "MyBank", entryNameFromFile("MyBank"))
+	require.Equal(t, "work/db", entryNameFromFile("work_2fdb"))
+}
+
+func TestUnicodeNames(t *testing.T) {
+	tempDir, clean := setupTestDir(t)
+	defer clean()
+
+	masterPassword := "strongMasterPassword123!"
+	initFastVault(t, masterPassword)
+
+	names := []string{".env", "My Bank", "con", "my bank", "work/Почта", "Почта"}
+	for _, name := range names {
+		require.NoError(t, AddPassword(name, name+"Password1!", masterPassword))
+	}
+
+	got, err := ListPasswordNames("")
+	require.NoError(t, err)
+	require.Equal(t, names, got)
+
+	for _, name := range names {
+		password, err := GetPassword(name, masterPassword)
+		require.NoError(t, err)
+		require.Equal(t, name+"Password1!", password)
+	}
+
+	// No two files may clash on a case-insensitive file system.
+	files, err := listEntryFiles(tempDir)
+	require.NoError(t, err)
+	folded := map[string]bool{}
+	for _, file := range files {
+		require.False(t, folded[strings.ToLower(file)], file)
+		folded[strings.ToLower(file)] = true
+	}
+}
+
+func TestMigrateEncodedNames(t *testing.T) {
+	tempDir, clean := setupTestDir(t)
+	defer clean()
+
+	masterPassword := "strongMasterPassword123!"
+	initFastVault(t, masterPassword)
+	require.NoError(t, AddPassword("MyBank", "firstPassword1!", masterPassword))
+	require.NoError(t, SetPassword("MyBank", "secondPassword2!", masterPassword))
+	require.NoError(t, AddPassword("work/db", "dbPassword3!", masterPassword))
+
+	// Put the vault back the way the previous version stored it: entry
+	// files named after their entries as they were.
+	v, err := unlockVault(masterPassword, lockExclusive)
+	require.NoError(t, err)
+	v.close()
+
+	tx := beginTx(tempDir)
+	m := v.manifest.next()
+	entry := m.Entries["MyBank"]
+	data, err := readEncryptedPassword(tempDir, entry.File)
+	require.NoError(t, err)
+	history, err := readHistoryFile(tempDir, entry.File, 1)
+	require.NoError(t, err)
+	require.NoError(t, tx.write("MyBank.hush", data))
+	require.NoError(t, tx.write(historyFile("MyBank", 1), history))
+	tx.remove(entry.File + ".hush")
+	tx.remove(historyFile(entry.File, 1))
+	entry.File = "MyBank"
+	m.Entries["MyBank"] = entry
+
+	v.meta.Version = manifestVaultVersion
+	require.NoError(t, v.stageMeta(tx))
+	require.NoError(t, v.commit(tx, m))
+
+	password, err := GetPassword("MyBank", masterPassword)
+	require.NoError(t, err)
+	require.Equal(t, "secondPassword2!", password)
+
+	meta, err := readVaultMeta()
+	require.NoError(t, err)
+	require.Equal(t, vaultVersion, meta.Version)
+
+	files, err := listEntryFiles(tempDir)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"_4dy_42ank", "work_2fdb"}, files)
+
+	require.NoError(t, RestoreRevision("MyBank", 1, masterPassword))
+	password, err = GetPassword("MyBank", masterPassword)
+	require.NoError(t, err)
+	require.Equal(t, "firstPassword1!", password)
+
+	issues, err := VerifyVault(masterPassword)
+	require.NoError(t, err)
+	require.Empty(t, issues)
+}
+
+func TestParseTagQuery(t *testing.T) {
+	tags := []string{"prod", "Postgres", "eu"}
+
+	tc := []struct {
+		query   string
+		match   bool
+		wantErr bool
+	}{
+		{query: "prod", match: true},
+		{query: "PROD", match: true},
+		{query: "staging", match: false},
+		{query: "prod postgres", match: true},
+		{query: "prod and mysql", match: false},
+		{query: "prod & eu", match: true},
+		{query: "mysql or postgres", match: true},
+		{query: "mysql|staging", match: false},
+		{query: "not staging", match: true},
+		{query: "!prod", match: false},
+		{query: "not not prod", match: true},
+		{query: "prod and not (mysql or us)", match: true},
+		{query: "staging or prod and eu", match: true},
+		{query: "(staging or prod) and us", match: false},
+		{query: "NOT prod OR eu", match: true},
+		{query: "", wantErr: true},
+		{query: "prod and", wantErr: true},
+		{query: "or prod", wantErr: true},
+		{query: "(prod", wantErr: true},
+		{query: "prod)", wantErr: true},
+		{query: "()", wantErr: true},
+		{query: "not", wantErr: true},
+	}
+	for _, tt := range tc {
+		t.Run(tt.query, func(t *testing.T) {
+			q, err := ParseTagQuery(tt.query)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.match, q.Match(tags))
+		})
+	}
+}
+
+func TestTags(t *testing.T) {
+	for _, encryptNames := range []bool{false, true} {
+		t.Run(fmt.Sprintf("encrypted names %v", encryptNames), func(t *testing.T) {
+			tempDir, clean := setupTestDir(t)
+			defer clean()
+
+			masterPassword := "strongMasterPassword123!"
+			initFastVault(t, masterPassword)
+			require.NoError(t, SetNameEncryption(masterPassword, encryptNames))
+
+			entries := map[string][]string{
+				"db/main":    {"prod", "postgres"},
+				"db/replica": {"staging", "postgres"},
+				"cache":      {"prod", "redis"},
+				"untagged":   nil,
+			}
+			for name, tags := range entries {
+				record := &Record{Password: "tagPassword123!", Tags: tags}
+				require.NoError(t, AddRecord(name, record, masterPassword))
+			}
+
+			// Tags are stored encrypted, so they never show up in a file.
+			dirEntries, err := os.ReadDir(tempDir)
+			require.NoError(t, err)
+			for _, e := range dirEntries {
+				if e.IsDir() {
+					continue
+				}
+				data, err := os.ReadFile(filepath.Join(tempDir, e.Name()))
+				require.NoError(t, err)
+				require.NotContains(t, string(data), "postgres", e.Name())
+			}
+
+			tc := []struct {
+				query string
+				want  []string
+			}{
+				{query: "prod", want: []string{"cache", "db/main"}},
+				{query: "prod postgres", want: []string{"db/main"}},
+				{query: "redis or staging", want: []string{"cache", "db/replica"}},
+				{query: "not prod", want: []string{"db/replica", "untagged"}},
+				{query: "mysql", want: nil},
+			}
+			for _, tt := range tc {
+				q, err := ParseTagQuery(tt.query)
+				require.NoError(t, err)
+				got, err := FindTagged(q, masterPassword)
+				require.NoError(t, err)
+				require.Equal(t, tt.want, got, tt.query)
+			}
+
+			record, err := GetRecord("db/main", masterPassword)
+			require.NoError(t, err)
+			value, sensitive, err := record.Get(FieldTags)
+			require.NoError(t, err)
+			require.Equal(t, "prod postgres", value)
+			require.False(t, sensitive)
+
+			invalid := [][]string{{""}, {"two words"}, {"a|b"}, {"not"}, {"prod", "PROD"}}
+			for _, tags := range invalid {
+				require.Error(t, AddRecord("other", &Record{Password: "tagPassword123!", Tags: tags}, masterPassword), tags)
+			}
+
+			// A damaged entry is skipped with a warning instead of failing
+			// the search.
+			var warnings bytes.Buffer
+			originalWarningOutput := warningOutput
+			warningOutput = &warnings
+			defer func() { warningOutput = originalWarningOutput }()
+
+			v, err := openVault(masterPassword, lockShared)
+			require.NoError(t, err)
+			file := v.manifest.Entries["cache"].File
+			v.close()
+			require.NoError(t, os.WriteFile(filepath.Join(tempDir, file+".hush"), []byte("garbage"), 0600))
+
+			q, err := ParseTagQuery("prod")
+			require.NoError(t, err)
+			got, err := FindTagged(q, masterPassword)
+			require.NoError(t, err)
+			require.Equal(t, []string{"db/main"}, got)
+			require.Contains(t, warnings.String(), `"cache"`)
+		})
+	}
+}
+
+func TestEntryUsage(t *testing.T) {
+	_, clean := setupTestDir(t)
+	defer clean()
+
+	masterPassword := "strongMasterPassword123!"
+	initFastVault(t, masterPassword)
+	require.NoError(t, SetNameEncryption(masterPassword, true))
+
+	for _, name := range []string{"bank", "email", "work/db"} {
+		require.NoError(t, AddPassword(name, "usagePassword123!", masterPassword))
+	}
+
+	usage, err := EntryUsage(masterPassword)
+	require.NoError(t, err)
+	require.Len(t, usage, 3)
+	for name, used := range usage {
+		require.True(t, used.IsZero(), name)
+	}
+
+	before := time.Now()
+	_, err = GetPassword("work/db", masterPassword)
+	require.NoError(t, err)
+	_, err = GetPassword("email", masterPassword)
+	require.NoError(t, err)
+
+	usage, err = EntryUsage(masterPassword)
+	require.NoError(t, err)
+	require.True(t, usage["bank"].IsZero())
+	require.False(t, usage["work/db"].Before(before))
+	require.False(t, usage["email"].Before(usage["work/db"]))
+
+	// Names are encrypted, so usage must not reveal them either.
+	stateDir, err := getStateDir()
+	require.NoError(t, err)
+	data, err := os.ReadFile(filepath.Join(stateDir, stateFileName))
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "email")
+
+	// Removed entries are forgotten the next time usage is recorded.
+	require.NoError(t, RemovePassword("email", masterPassword))
+	_, err = GetPassword("bank", masterPassword)
+	require.NoError(t, err)
+	state, err := readLocalState()
+	require.NoError(t, err)
+	for _, usage := range state.Usage {
+		require.Len(t, usage, 2)
+	}
+}
+
+func TestEditRecord(t *testing.T) {
+	_, clean := setupTestDir(t)
+	defer clean()
+
+	masterPassword := "strongMasterPassword123!"
+	initFastVault(t, masterPassword)
+	require.NoError(t, AddRecord("bank", &Record{Password: "bankPassword123!", Username: "alice"}, masterPassword))
+
+	err := EditRecord("bank", func(r *Record) error {
+		r.Password = "newBankPassword456!"
+		r.Notes = "branch 42"
+		return nil
+	}, masterPassword)
+	require.NoError(t, err)
+
+	got, err := GetRecord("bank", masterPassword)
+	require.NoError(t, err)
+	require.Equal(t, &Record{Password: "newBankPassword456!", Username: "alice", Notes: "branch 42"}, got)
+
+	history, err := EntryHistory("bank", masterPassword)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+
+	err = EditRecord("bank", func(r *Record) error {
+		r.Password = "weak"
+		return nil
+	}, masterPassword)
+	require.Error(t, err)
+
+	err = EditRecord("bank", func(r *Record) error {
+		r.Tags = []string{"a b"}
+		return nil
+	}, masterPassword)
+	require.Error(t, err)
+
+	err = EditRecord("missing", func(r *Record) error { return nil }, masterPassword)
+	require.ErrorIs(t, err, ErrEntryNotFound)
+
+	got, err = GetRecord("bank", masterPassword)
+	require.NoError(t, err)
+	require.Equal(t, "newBankPassword456!", got.Password)
+}
+
+func TestMoveAndCopyEntry(t *testing.T) {
+	for _, encryptNames := range []bool{false, true} {
+		t.Run(fmt.Sprintf("encrypted names %v", encryptNames), func(t *testing.T) {
+			tempDir, clean := setupTestDir(t)
+			defer clean()
+
+			masterPassword := "strongMasterPassword123!"
+			initFastVault(t, masterPassword)
+			require.NoError(t, SetNameEncryption(masterPassword, encryptNames))
+
+			require.NoError(t, AddPassword("bank", "firstPassword1!", masterPassword))
+			require.NoError(t, SetPassword("bank", "secondPassword2!", masterPassword))
+			require.NoError(t, AddPassword("email", "emailPassword3!", masterPassword))
+
+			require.ErrorIs(t, MoveEntry("bank", "email", false, masterPassword), ErrEntryExists)
+			require.ErrorIs(t, CopyEntry("bank", "email", false, masterPassword), ErrEntryExists)
+			require.ErrorIs(t, MoveEntry("missing", "other", false, masterPassword), ErrEntryNotFound)
+			require.Error(t, MoveEntry("bank", "bank", true, masterPassword))
+			require.Error(t, MoveEntry("bank", "../bank", false, masterPassword))
+
+			// The moved entry keeps its history, which still restores.
+			require.NoError(t, MoveEntry("bank", "personal/bank", false, masterPassword))
+			_, err := GetPassword("bank", masterPassword)
+			require.ErrorIs(t, err, ErrEntryNotFound)
+			history, err := EntryHistory("personal/bank", masterPassword)
+			require.NoError(t, err)
+			require.Len(t, history, 2)
+			require.NoError(t, RestoreRevision("personal/bank", 1, masterPassword))
+			password, err := GetPassword("personal/bank", masterPassword)
+			require.NoError(t, err)
+			require.Equal(t, "firstPassword1!", password)
+
+			require.NoError(t, CopyEntry("personal/bank", "bank-copy", false, masterPassword))
+			password, err = GetPassword("bank-copy", masterPassword)
+			require.NoError(t, err)
+			require.Equal(t, "firstPassword1!", password)
+			history, err = EntryHistory("bank-copy", masterPassword)
+			require.NoError(t, err)
+			require.Len(t, history, 1)
+
+			// Copying over an entry keeps the replaced version in its history.
+			require.NoError(t, CopyEntry("email", "bank-copy", true, masterPassword))
+			password, err = GetPassword("bank-copy", masterPassword)
+			require.NoError(t, err)
+			require.Equal(t, "emailPassword3!", password)
+			history, err = EntryHistory("bank-copy", masterPassword)
+			require.NoError(t, err)
+			require.Len(t, history, 2)
+
+			// Moving over an entry keeps the replaced one, with its history,
+			// ahead of the history of the moved entry.
+			require.NoError(t, MoveEntry("personal/bank", "bank-copy", true, masterPassword))
+			password, err = GetPassword("bank-copy", masterPassword)
+			require.NoError(t, err)
+			require.Equal(t, "firstPassword1!", password)
+			history, err = EntryHistory("bank-copy", masterPassword)
+			require.NoError(t, err)
+			require.Len(t, history, 5)
+			require.Equal(t, 5, history[0].Revision)
+			require.NoError(t, RestoreRevision("bank-copy", 2, masterPassword))
+			password, err = GetPassword("bank-copy", masterPassword)
+			require.NoError(t, err)
+			require.Equal(t, "emailPassword3!", password)
+
+			// Revisions beyond the retention are dropped, oldest first.
+			require.NoError(t, AddPassword("shop", "shopPassword4!", masterPassword))
+			require.NoError(t, SetPassword("shop", "shopPassword5!", masterPassword))
+			require.NoError(t, SetPassword("shop", "shopPassword6!", masterPassword))
+			require.NoError(t, SetHistoryRetention(masterPassword, 2))
+			require.NoError(t, MoveEntry("bank-copy", "shop", true, masterPassword))
+			history, err = EntryHistory("shop", masterPassword)
+			require.NoError(t, err)
+			require.Len(t, history, 3)
+			require.Equal(t, []int{9, 8, 7}, []int{history[0].Revision, history[1].Revision, history[2].Revision})
+			password, err = GetPassword("shop", masterPassword)
+			require.NoError(t, err)
+			require.Equal(t, "emailPassword3!", password)
+			historyFiles, err := os.ReadDir(filepath.Join(tempDir, historyDirName))
+			require.NoError(t, err)
+			require.Len(t, historyFiles, 2)
+
+			names, err := ListPasswordNames(masterPassword)
+			require.NoError(t, err)
+			require.Equal(t, []string{"email", "shop"}, names)
+
+			issues, err := VerifyVault(masterPassword)
+			require.NoError(t, err)
+			require.Empty(t, issues)
+		})
+	}
+}
+
+func TestAgent(t *testing.T) {
+	_, clean := setupTestDir(t)
+	defer clean()
+
+	masterPassword := "strongMasterPassword123!"
+	initFastVault(t, masterPassword)
+	require.NoError(t, AddPassword("bank", "bankPassword123!", masterPassword))
+
+	// Without an agent, an empty master password gets nowhere.
+	_, err := GetPassword("bank", "")
+	require.ErrorIs(t, err, ErrMasterPasswordRequired)
+
+	socketDir, err := os.MkdirTemp("", "hush-agent")
+	require.NoError(t, err)
+	defer os.RemoveAll(socketDir)
+	socket := filepath.Join(socketDir, "agent.sock")
+
+	UseAgent(socket, nil)
+	defer UseAgent("", nil)
+	require.False(t, AgentUnlocked())
+
+	l, err := agent.Listen(socket)
+	require.NoError(t, err)
+	server := agent.NewServer(time.Minute, time.Hour)
+	go server.Serve(l)
+	defer server.Stop()
+
+	require.False(t, AgentUnlocked())
+	_, err = GetPassword("bank", "")
+	require.ErrorIs(t, err, ErrMasterPasswordRequired)
+
+	// Unlocking with the master password hands the key to the agent.
+	_, err = GetPassword("bank", "wrongMasterPassword1!")
+	require.Error(t, err)
+	require.False(t, AgentUnlocked())
+	_, err = GetPassword("bank", masterPassword)
+	require.NoError(t, err)
+	require.True(t, AgentUnlocked())
+
+	require.NoError(t, AddPassword("email", "emailPassword456!", ""))
+	password, err := GetPassword("email", "")
+	require.NoError(t, err)
+	require.Equal(t, "emailPassword456!", password)
+
+	// Operations that use the master password itself still need it.
+	require.ErrorIs(t, ChangeMasterPassword("", "newMasterPassword456!"), ErrMasterPasswordRequired)
+	require.ErrorIs(t, UpgradeKDF("", passutils.KDFParams{Time: 1, Memory: 64, Threads: 1, KeySize: 32}), ErrMasterPasswordRequired)
+	require.ErrorIs(t, ImplodeHush(""), ErrMasterPasswordRequired)
+
+	// The data key stays the same when the master password changes.
+	require.NoError(t, ChangeMasterPassword(masterPassword, "newMasterPassword456!"))
+	_, err = GetPassword("bank", "")
+	require.NoError(t, err)
+
+	require.NoError(t, agent.Lock(socket, ""))
+	require.False(t, AgentUnlocked())
+	_, err = GetPassword("bank", "")
+	require.ErrorIs(t, err, ErrMasterPasswordRequired)
+
+	// A key the agent forgot after the caller checked for it is asked for.
+	prompts := 0
+	UseAgent(socket, func() (string, error) {
+		prompts++
+		return "newMasterPassword456!", nil
+	})
+	password, err = GetPassword("bank", "")
+	require.NoError(t, err)
+	require.Equal(t, "bankPassword123!", password)
+	require.Equal(t, 1, prompts)
+	require.True(t, AgentUnlocked())
+}
+
+func TestOTPCode(t *testing.T) {
+	_, clean := setupTestDir(t)
+	defer clean()
+
+	defer func(orig func() time.Time) { otpNow = orig }(otpNow)
+	otpNow = func() time.Time { return time.Unix(59, 0) }
+
+	masterPassword := "strongMasterPassword123!"
+	initFastVault(t, masterPassword)
+
+	// "12345678901234567890" in base32, as in RFC 4226 and RFC 6238.
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	require.NoError(t, AddRecord("totp", &Record{
+		Password: "totpPassword123!",
+		OTP:      "otpauth://totp/alice?secret=" + secret + "&digits=8",
+	}, masterPassword))
+	require.NoError(t, AddRecord("hotp", &Record{
+		Password: "hotpPassword123!",
+		OTP:      "otpauth://hotp/alice?secret=" + secret + "&counter=0",
+	}, masterPassword))
+	require.NoError(t, AddRecord("plain", &Record{Password: "plainPassword123!"}, masterPassword))
+
+	// TOTP codes only need a shared lock, so they do not wait for other
+	// readers of the vault.
+	hushDir, err := getHushDir()
+	require.NoError(t, err)
+	reader, err := lockFile(filepath.Join(hushDir, lockFileName), lockShared)
+	require.NoError(t, err)
+	code, err := OTPCode("totp", masterPassword)
+	reader.unlock()
+	require.NoError(t, err)
+	require.Equal(t, &OneTimeCode{Code: "94287082", Remaining: time.Second}, code)
+
+	for counter, want := range []string{"755224", "287082", "359152"} {
+		code, err := OTPCode("hotp", masterPassword)
+		require.NoError(t, err)
+		require.Equal(t, &OneTimeCode{Code: want, HOTP: true, Counter: uint64(counter)}, code)
+	}
+
+	// Counter updates must not crowd out the password history.
+	history, err := EntryHistory("hotp", masterPassword)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+
+	issues, err := VerifyVault(masterPassword)
+	require.NoError(t, err)
+	require.Empty(t, issues)
+
+	_, err = OTPCode("plain", masterPassword)
+	require.Error(t, err)
+
+	_, err = OTPCode("missing", masterPassword)
+	require.ErrorIs(t, err, ErrEntryNotFound)
+
+	err = AddRecord("broken", &Record{Password: "brokenPassword123!", OTP: "otpauth://totp/x?secret=!!"}, masterPassword)
+	require.Error(t, err)
+}
+
+func TestImportEntries(t *testing.T) {
+	_, clean := setupTestDir(t)
+	defer clean()
+
+	masterPassword := "strongMasterPassword123!"
+	initFastVault(t, masterPassword)
+	require.NoError(t, AddPassword("bank", "bankPassword123!", masterPassword))
+
+	entries := []ImportEntry{
+		{Source: "line 2", Name: "bank", Record: Record{Password: "importedBank123!"}},
+		{Source: "line 3", Name: "mail", Record: Record{Password: "mailPassword123!", Username: "alice"}},
+		{Source: "line 4", Name: "mail", Record: Record{Password: "mailPassword456!", Username: "bob"}},
+		{Source: "line 5", Name: "weak", Record: Record{Password: "1234"}},
+		{Source: "line 6", Name: "note", Record: Record{Notes: "no password"}},
+		{Source: "line 7", Name: "../bad", Record: Record{Password: "badPassword123!"}},
+	}
+	rejected := []string{"line 5", "line 6", "line 7"}
+	sources := func(r []RejectedEntry) []string {
+		var s []string
+		for _, e := range r {
+			s = append(s, e.Source)
+		}
+		return s
+	}
+
+	t.Run("dry run", func(t *testing.T) {
+		result, err := ImportEntries(entries, ConflictOverwrite, true, masterPassword)
+		require.NoError(t, err)
+		require.Equal(t, []string{"mail"}, result.Added)
+		require.Equal(t, []string{"bank"}, result.Replaced)
+		require.Equal(t, rejected, sources(result.Rejected))
+		require.Contains(t, result.Rejected[0].Reason, "too weak")
+
+		names, err := ListPasswordNames(masterPassword)
+		require.NoError(t, err)
+		require.Equal(t, []string{"bank"}, names)
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		result, err := ImportEntries(entries, ConflictSkip, false, masterPassword)
+		require.NoError(t, err)
+		require.Equal(t, []string{"mail"}, result.Added)
+		require.Equal(t, []string{"bank", "mail"}, result.Skipped)
+		require.Equal(t, rejected, sources(result.Rejected))
+
+		got, err := GetRecord("mail", masterPassword)
+		require.NoError(t, err)
+		require.Equal(t, "alice", got.Username)
+		password, err := GetPassword("bank", masterPassword)
+		require.NoError(t, err)
+		require.Equal(t, "bankPassword123!", password)
+	})
+
+	t.Run("rename", func(t *testing.T) {
+		result, err := ImportEntries(entries, ConflictRename, false, masterPassword)
+		require.NoError(t, err)
+		require.Empty(t, result.Added)
+		require.Equal(t, []RenamedEntry{
+			{From: "bank", To: "bank (2)"},
+			{From: "mail", To: "mail (2)"},
+			{From: "mail", To: "mail (3)"},
+		}, result.Renamed)
+
+		got, err := GetRecord("mail (3)", masterPassword)
+		require.NoError(t, err)
+		require.Equal(t, "bob", got.Username)
+
+		// A name at the length limit has no room for a suffix.
+		long := strings.Repeat("x", maxFileStemLength)
+		require.NoError(t, AddPassword(long, "longPassword123!", masterPassword))
+		result, err = ImportEntries([]ImportEntry{
+			{Source: "line 2", Name: long, Record: Record{Password: "longPassword456!"}},
+		}, ConflictRename, false, masterPassword)
+		require.NoError(t, err)
+		require.Empty(t, result.Renamed)
+		require.Len(t, result.Rejected, 1)
+		require.Contains(t, result.Rejected[0].Reason, "too long")
+		require.NoError(t, RemovePassword(long, masterPassword))
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		result, err := ImportEntries(entries, ConflictOverwrite, false, masterPassword)
+		require.NoError(t, err)
+		require.Equal(t, []string{"bank", "mail"}, result.Replaced)
+
+		got, err := GetRecord("mail", masterPassword)
+		require.NoError(t, err)
+		require.Equal(t, "bob", got.Username)
+
+		history, err := EntryHistory("bank", masterPassword)
+		require.NoError(t, err)
+		require.Len(t, history, 2)
+
+		names, err := ListPasswordNames(masterPassword)
+		require.NoError(t, err)
+		require.Equal(t, []string{"bank", "bank (2)", "mail", "mail (2)", "mail (3)"}, names)
+
+		issues, err := VerifyVault(masterPassword)
+		require.NoError(t, err)
+		require.Empty(t, issues)
+	})
+}
+
+func TestWalkRecords(t *testing.T) {
+	_, clean := setupTestDir(t)
+	defer clean()
+
+	masterPassword := "strongMasterPassword123!"
+	initFastVault(t, masterPassword)
+	require.NoError(t, AddRecord("work/mail", &Record{Password: "mailPassword123!", Username: "alice"}, masterPassword))
+	require.NoError(t, AddPassword("bank", "bankPassword123!", masterPassword))
+	require.NoError(t, SetPassword("bank", "bankPassword456!", masterPassword))
+
+	var infos []EntryInfo
+	var passwords []string
+	err := WalkRecords(masterPassword, func(info EntryInfo, record *Record) error {
+		infos = append(infos, info)
+		passwords = append(passwords, record.Password)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	require.Equal(t, "bank", infos[0].Name)
+	require.Equal(t, 2, infos[0].Revision)
+	require.False(t, infos[0].Modified.IsZero())
+	require.Equal(t, "work/mail", infos[1].Name)
+	require.Equal(t, []string{"bankPassword456!", "mailPassword123!"}, passwords)
+
+	stop := errors.New("stop")
+	calls := 0
+	err = WalkRecords(masterPassword, func(EntryInfo, *Record) error {
+		calls++
+		return stop
+	})
+	require.ErrorIs(t, err, stop)
+	require.Equal(t, 1, calls)
+
+	err = WalkRecords("wrongMasterPassword123!", func(EntryInfo, *Record) error { return nil })
+	require.Error(t, err)
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	tempDir, clean := setupTestDir(t)
+	defer clean()
+
+	masterPassword := "strongMasterPassword123!"
+	initFastVault(t, masterPassword)
+	require.NoError(t, AddRecord("work/mail", &Record{Password: "mailPassword123!", Username: "alice"}, masterPassword))
+	require.NoError(t, AddPassword("bank", "bankPassword123!", masterPassword))
+	require.NoError(t, SetPassword("bank", "bankPassword456!", masterPassword))
+
+	var buf bytes.Buffer
+	info, err := Backup(&buf, masterPassword)
+	require.NoError(t, err)
+	require.Equal(t, 2, info.Entries)
+	backup := buf.Bytes()
+
+	_, err = Backup(&bytes.Buffer{}, "")
+	require.ErrorIs(t, err, ErrMasterPasswordRequired)
+
+	t.Run("verify", func(t *testing.T) {
+		verified, err := VerifyBackup(bytes.NewReader(backup), masterPassword)
+		require.NoError(t, err)
+		require.Equal(t, info.Files, verified.Files)
+		require.Equal(t, info.Revision, verified.Revision)
+
+		_, err = VerifyBackup(bytes.NewReader(backup), "wrongMasterPassword123!")
+		require.ErrorIs(t, err, ErrBackupDamaged)
+
+		tampered := bytes.Clone(backup)
+		tampered[len(tampered)/2] ^= 1
+		_, err = VerifyBackup(bytes.NewReader(tampered), masterPassword)
+		require.ErrorIs(t, err, ErrBackupDamaged)
+
+		_, err = VerifyBackup(bytes.NewReader(backup[:len(backup)-20]), masterPassword)
+		require.ErrorIs(t, err, ErrBackupDamaged)
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		require.NoError(t, RemovePassword("bank", masterPassword))
+		require.NoError(t, AddPassword("later", "laterPassword123!", masterPassword))
+
+		_, _, err := RestoreBackup(bytes.NewReader(backup), masterPassword, RestoreReplace, ConflictSkip, "wrongMasterPassword123!")
+		require.Error(t, err)
+
+		_, result, err := RestoreBackup(bytes.NewReader(backup), masterPassword, RestoreReplace, ConflictSkip, masterPassword)
+		require.NoError(t, err)
+		require.Nil(t, result)
+
+		names, err := ListPasswordNames(masterPassword)
+		require.NoError(t, err)
+		require.Equal(t, []string{"bank", "work/mail"}, names)
+		history, err := EntryHistory("bank", masterPassword)
+		require.NoError(t, err)
+		require.Len(t, history, 2)
+
+		// The restored vault is older than the one it replaced, but that is
+		// no rollback.
+		issues, err := VerifyVault(masterPassword)
+		require.NoError(t, err)
+		require.Empty(t, issues)
+		_, err = os.Stat(filepath.Join(tempDir, "later.hush"))
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		require.NoError(t, RemovePassword("bank", masterPassword))
+		require.NoError(t, SetPassword("work/mail", "mailPassword789!", masterPassword))
+		require.NoError(t, AddPassword("later", "laterPassword123!", masterPassword))
+
+		_, result, err := RestoreBackup(bytes.NewReader(backup), masterPassword, RestoreMerge, ConflictSkip, masterPassword)
+		require.NoError(t, err)
+		require.Equal(t, []string{"bank"}, result.Added)
+		require.Equal(t, []string{"work/mail"}, result.Skipped)
+
+		names, err := ListPasswordNames(masterPassword)
+		require.NoError(t, err)
+		require.Equal(t, []string{"bank", "later", "work/mail"}, names)
+		password, err := GetPassword("work/mail", masterPassword)
+		require.NoError(t, err)
+		require.Equal(t, "mailPassword789!", password)
+	})
+
+	t.Run("new machine", func(t *testing.T) {
+		dir := t.TempDir()
+		getHushDir = func() (string, error) { return filepath.Join(dir, "vault"), nil }
+
+		_, _, err := RestoreBackup(bytes.NewReader(backup), masterPassword, RestoreReplace, ConflictSkip, "")
+		require.NoError(t, err)
+
+		password, err := GetPassword("bank", masterPassword)
+		require.NoError(t, err)
+		require.Equal(t, "bankPassword456!", password)
+	})
+}
+
+func TestGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+
+	tempDir, clean := setupTestDir(t)
+	defer clean()
+
+	stateDir, err := getStateDir()
+	require.NoError(t, err)
+
+	masterPassword := "strongMasterPassword123!"
+	initFastVault(t, masterPassword)
+	require.NoError(t, AddPassword("bank", "bankPassword123!", masterPassword))
+
+	git := func(dir string, args ...string) string {
+		t.Helper()
+		output, err := runGit(dir, args...)
+		require.NoError(t, err)
+		return strings.TrimSpace(string(output))
+	}
+	// Each machine keeps its own record of the revisions it has seen.
+	stateDirs := map[string]string{tempDir: stateDir}
+	useVault := func(dir string) {
+		if _, ok := stateDirs[dir]; !ok {
+			stateDirs[dir] = t.TempDir()
+		}
+		getHushDir = func() (string, error) { return dir, nil }
+		getStateDir = func() (string, error) { return stateDirs[dir], nil }
+	}
+
+	require.ErrorIs(t, GitPush(nil, io.Discard), ErrNotGitRepository)
+
+	remote := filepath.Join(t.TempDir(), "remote.git")
+	git(filepath.Dir(remote), "init", "--quiet", "--bare", remote)
+	require.NoError(t, GitInit(remote))
+	require.Error(t, GitInit(remote))
+
+	require.NoError(t, AddRecord("work/mail", &Record{Password: "mailPassword123!"}, masterPassword))
+	require.NoError(t, SetPassword("bank", "bankPassword456!", masterPassword))
+	require.NoError(t, MoveEntry("bank", "money", false, masterPassword))
+	require.NoError(t, RemovePassword("work/mail", masterPassword))
+	require.NoError(t, GitPush(nil, io.Discard))
+
+	require.Equal(t, []string{
+		"Remove work/mail",
+		"Move bank to money",
+		"Update bank",
+		"Add work/mail",
+		"Initialize hush vault",
+	}, strings.Split(git(tempDir, "log", "--format=%s"), "\n"))
+	require.Empty(t, git(tempDir, "status", "--porcelain"))
+	require.Equal(t, git(tempDir, "rev-parse", "HEAD"), git(remote, "rev-parse", "HEAD"))
+
+	clone := filepath.Join(t.TempDir(), "clone")
+	git(filepath.Dir(clone), "clone", "--quiet", remote, clone)
+	git(clone, "config", "user.name", "other")
+	git(clone, "config", "user.email", "other@localhost")
+
+	t.Run("pull", func(t *testing.T) {
+		useVault(tempDir)
+		require.NoError(t, AddPassword("later", "laterPassword123!", masterPassword))
+		require.NoError(t, GitPush(nil, io.Discard))
+
+		useVault(clone)
+		require.NoError(t, GitPull(nil, io.Discard))
+		names, err := ListPasswordNames(masterPassword)
+		require.NoError(t, err)
+		require.Equal(t, []string{"later", "money"}, names)
+		issues, err := VerifyVault(masterPassword)
+		require.NoError(t, err)
+		require.Empty(t, issues)
+	})
+
+	t.Run("diverged", func(t *testing.T) {
+		useVault(tempDir)
+		require.NoError(t, AddPassword("here", "herePassword123!", masterPassword))
+		require.NoError(t, GitPush(nil, io.Discard))
+
+		useVault(clone)
+		require.NoError(t, AddPassword("there", "therePassword123!", masterPassword))
+		require.ErrorIs(t, GitPull(nil, io.Discard), ErrGitDiverged)
+		names, err := ListPasswordNames(masterPassword)
+		require.NoError(t, err)
+		require.Equal(t, []string{"later", "money", "there"}, names)
+	})
+
+	t.Run("encrypted names", func(t *testing.T) {
+		useVault(tempDir)
+		require.NoError(t, SetNameEncryption(masterPassword, true))
+		require.NoError(t, AddPassword("secret-name", "secretPassword123!", masterPassword))
+
+		require.Equal(t, []string{"Add 1 entry", "Enable name encryption"},
+			strings.Split(git(tempDir, "log", "--format=%s", "-2"), "\n"))
+		log := git(tempDir, "log", "--format=%B")
+		require.NotContains(t, log, "secret-name")
+		require.NotContains(t, log, "Password123!")
+	})
+}
+
+func TestChangeMessage(t *testing.T) {
+	entries := func(hashes ...string) map[string]manifestEntry {
+		m := map[string]manifestEntry{}
+		for i := 0; i < len(hashes); i += 2 {
+			m[hashes[i]] = manifestEntry{File: hashes[i], Hash: hashes[i+1]}
+		}
+		return m
+	}
+
+	tc := []struct {
+		name      string
+		old, new  map[string]manifestEntry
+		encrypted bool
+		expected  string
+	}{
+		{
+			name:     "add",
+			old:      entries("a", "1"),
+			new:      entries("a", "1", "b", "2"),
+			expected: "Add b",
+		},
+		{
+			name:     "settings",
+			old:      entries("a", "1"),
+			new:      entries("a", "1"),
+			expected: "Update vault settings",
+		},
+		{
+			name:     "several",
+			old:      entries("a", "1", "b", "2", "c", "3"),
+			new:      entries("a", "4", "b", "5", "d", "6"),
+			expected: "Add 1 entry, update 2 entries, remove 1 entry\n\nAdd d\nUpdate a\nUpdate b\nRemove c",
+		},
+		{
+			name:      "encrypted names",
+			old:       entries("a", "1", "b", "2"),
+			new:       entries("a", "3", "c", "4"),
+			encrypted: true,
+			expected:  "Add 1 entry, update 1 entry, remove 1 entry",
+		},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			message := changeMessage(&manifest{Entries: tt.old}, &manifest{Entries: tt.new}, tt.encrypted)
+			require.Equal(t, tt.expected, message)
+		})
+	}
 }
@@ -0,0 +1,208 @@
+package hushcore
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/nochzato/hush/internal/passutils"
+)
+
+// ConflictPolicy decides what importing does with an entry whose name is
+// already taken, in the vault or earlier in the same import.
+type ConflictPolicy string
+
+const (
+	ConflictSkip      ConflictPolicy = "skip"
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	ConflictRename    ConflictPolicy = "rename"
+)
+
+// ImportEntry is an entry read from another password manager's export.
+type ImportEntry struct {
+	// Source tells the user where the entry came from, such as "line 12".
+	Source string
+	Name   string
+	Record Record
+}
+
+// RejectedEntry is an entry that could not be imported.
+type RejectedEntry struct {
+	Source string
+	Name   string
+	Reason string
+}
+
+// RenamedEntry is an entry imported under another name because its own was
+// taken.
+type RenamedEntry struct {
+	From string
+	To   string
+}
+
+// ImportResult lists what an import did, or would do on a dry run.
+type ImportResult struct {
+	Added    []string
+	Replaced []string
+	Renamed  []RenamedEntry
+	Skipped  []string
+	Rejected []RejectedEntry
+}
+
+func ParseConflictPolicy(policy string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(policy); p {
+	case ConflictSkip, ConflictOverwrite, ConflictRename:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q (expected skip, overwrite or rename)", policy)
+}
+
+// ImportEntries stores entries in one transaction, so an import either
+// happens completely or not at all. Entries that cannot be stored as they
+// are, such as ones with weak passwords, are rejected and reported instead.
+// With dryRun nothing is written.
+func ImportEntries(entries []ImportEntry, conflict ConflictPolicy, dryRun bool, masterPassword string) (*ImportResult, error) {
+	mode := lockExclusive
+	if dryRun {
+		mode = lockShared
+	}
+
+	v, err := unlockVault(masterPassword, mode)
+	if err != nil {
+		return nil, fmt.Errorf("error validating master password: %w", err)
+	}
+	defer v.close()
+
+	result, staged, err := v.planImport(entries, conflict)
+	if err != nil || dryRun || len(staged) == 0 {
+		return result, err
+	}
+
+	tx := beginTx(v.dir)
+	m := v.manifest.next()
+	for _, s := range staged {
+		sealedPassword, err := v.sealEntry(s.name, s.record)
+		if err != nil {
+			tx.rollback()
+			return nil, err
+		}
+		if err := v.stageEntry(tx, m, s.name, sealedPassword); err != nil {
+			tx.rollback()
+			return nil, err
+		}
+	}
+
+	if err := v.commit(tx, m); err != nil {
+		return nil, fmt.Errorf("failed to save imported entries: %w", err)
+	}
+
+	return result, nil
+}
+
+type stagedImport struct {
+	name   string
+	record *Record
+}
+
+// planImport decides what happens to each entry and returns the entries to
+// store, one per name.
+func (v *vault) planImport(entries []ImportEntry, conflict ConflictPolicy) (*ImportResult, []stagedImport, error) {
+	result := &ImportResult{}
+	var staged []stagedImport
+	planned := map[string]int{}
+
+	taken := func(name string) (bool, error) {
+		if _, ok := planned[name]; ok {
+			return true, nil
+		}
+		_, err := v.lookupEntry(name)
+		if errors.Is(err, ErrEntryNotFound) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	for _, e := range entries {
+		reject := func(reason string) {
+			result.Rejected = append(result.Rejected, RejectedEntry{Source: e.Source, Name: e.Name, Reason: reason})
+		}
+
+		name, err := sanitizeFileName(e.Name)
+		if err != nil {
+			reject(fmt.Sprintf("invalid name: %v", err))
+			continue
+		}
+		record := e.Record
+		if record.Password == "" {
+			reject("no password")
+			continue
+		}
+		if err := passutils.CheckPasswordStrength(record.Password); err != nil {
+			reject(fmt.Sprintf("password is too weak: %v", err))
+			continue
+		}
+		if err := record.Validate(); err != nil {
+			reject(fmt.Sprintf("invalid record: %v", err))
+			continue
+		}
+
+		exists, err := taken(name)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch {
+		case !exists:
+			result.Added = append(result.Added, name)
+		case conflict == ConflictSkip:
+			result.Skipped = append(result.Skipped, name)
+			continue
+		case conflict == ConflictOverwrite:
+			// A later entry of the same name replaces the earlier one in
+			// place and is not counted again.
+			if i, ok := planned[name]; ok {
+				staged[i].record = &record
+				continue
+			}
+			result.Replaced = append(result.Replaced, name)
+		case conflict == ConflictRename:
+			newName, err := freeName(name, taken)
+			if errors.Is(err, errNoFreeName) {
+				reject(err.Error())
+				continue
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			result.Renamed = append(result.Renamed, RenamedEntry{From: name, To: newName})
+			name = newName
+		default:
+			return nil, nil, fmt.Errorf("unknown conflict policy %q", conflict)
+		}
+
+		planned[name] = len(staged)
+		staged = append(staged, stagedImport{name: name, record: &record})
+	}
+
+	return result, staged, nil
+}
+
+var errNoFreeName = errors.New("no free name to rename to")
+
+// freeName returns the first of "name (2)", "name (3)", ... that is not
+// taken. Candidates must be valid names, so a name close to the length
+// limit may have none.
+func freeName(name string, taken func(string) (bool, error)) (string, error) {
+	for i := 2; ; i++ {
+		candidate, err := sanitizeFileName(fmt.Sprintf("%s (%d)", name, i))
+		if err != nil {
+			return "", fmt.Errorf("%w: %w", errNoFreeName, err)
+		}
+		exists, err := taken(candidate)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return candidate, nil
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package hushcore
+
+import (
+	"fmt"
+	"os"
+)
+
+const lockFileName = "lock"
+
+type lockMode int
+
+const (
+	// lockShared is taken by operations that only read the vault; any
+	// number of them can run at once.
+	lockShared lockMode = iota
+	// lockExclusive is taken by operations that write to the vault.
+	lockExclusive
+)
+
+// fileLock is an advisory lock on a file, held until unlock is called or
+// the process exits. A nil fileLock holds nothing.
+type fileLock struct {
+	f *os.File
+}
+
+// lockFile locks path, creating it if needed, and blocks until the lock is
+// granted. The error wraps fs.ErrNotExist if the directory of path does not
+// exist.
+func lockFile(path string, mode lockMode) (*fileLock, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := flock(f, mode == lockExclusive); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+		}
+
+		// The lock file may have been removed while we were waiting for it,
+		// for instance by hush implode. A lock on the removed file would not
+		// keep out whoever creates the next one, so start over.
+		locked, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+		}
+		current, err := os.Stat(path)
+		if err == nil && os.SameFile(locked, current) {
+			return &fileLock{f: f}, nil
+		}
+		f.Close()
+	}
+}
+
+func (l *fileLock) unlock() {
+	if l == nil {
+		return
+	}
+	l.f.Close()
+}
@@ -0,0 +1,11 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows)
+
+package hushcore
+
+import "os"
+
+// flock is a no-op on platforms without advisory file locks; concurrent
+// hush processes are not protected from each other there.
+func flock(f *os.File, exclusive bool) error {
+	return nil
+}
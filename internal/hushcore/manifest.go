@@ -0,0 +1,387 @@
+package hushcore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/nochzato/hush/internal/passutils"
+)
+
+const (
+	manifestFileName = "manifest"
+	// Version 1 manifests mapped names straight to hashes; the file was
+	// always the name.
+	legacyManifestVersion = 1
+	manifestVersion       = 2
+	manifestKeyInfo       = "hush manifest key"
+)
+
+type IssueKind string
+
+const (
+	IssueMissing  IssueKind = "missing"
+	IssueExtra    IssueKind = "extra"
+	IssueModified IssueKind = "modified"
+	IssueRollback IssueKind = "rollback"
+	IssueManifest IssueKind = "manifest"
+)
+
+// VaultIssue is a difference between the hush directory and its manifest.
+type VaultIssue struct {
+	Kind    IssueKind
+	Name    string
+	Message string
+}
+
+func (i VaultIssue) String() string {
+	return i.Message
+}
+
+// manifest lists every entry with the password file it is stored in and the
+// SHA-256 of that file. Revision grows with every write, so an older manifest
+// can be told apart from the current one. When entry names are encrypted,
+// the manifest is the only place that maps names to files. It also keeps
+// the history of every entry, so that previous revisions cannot be swapped
+// or dropped unnoticed either.
+type manifest struct {
+	Revision uint64                   `json:"revision"`
+	Entries  map[string]manifestEntry `json:"entries"`
+	// HistoryKeep is the number of previous revisions kept per entry;
+	// zero means defaultHistoryKeep.
+	HistoryKeep int `json:"history_keep,omitempty"`
+}
+
+type manifestEntry struct {
+	File     string          `json:"file"`
+	Hash     string          `json:"hash"`
+	Revision int             `json:"revision,omitempty"`
+	Modified time.Time       `json:"modified"`
+	History  []entryRevision `json:"history,omitempty"`
+}
+
+type legacyManifest struct {
+	Revision uint64            `json:"revision"`
+	Entries  map[string]string `json:"entries"`
+}
+
+type manifestFile struct {
+	Version int    `json:"version"`
+	Data    string `json:"data"`
+}
+
+var warningOutput io.Writer = os.Stderr
+
+func hashEntry(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (m *manifest) next() *manifest {
+	return &manifest{Revision: m.Revision + 1, Entries: maps.Clone(m.Entries), HistoryKeep: m.HistoryKeep}
+}
+
+func (v *vault) manifestKey() ([]byte, error) {
+	return passutils.DeriveSubkey(v.key, nil, manifestKeyInfo)
+}
+
+func (v *vault) manifestAD() []byte {
+	return []byte("hush manifest\x00" + v.meta.ID)
+}
+
+func (v *vault) readManifest() (*manifest, error) {
+	data, err := os.ReadFile(filepath.Join(v.dir, manifestFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	var file manifestFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	if file.Version != manifestVersion && file.Version != legacyManifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d", file.Version)
+	}
+
+	key, err := v.manifestKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive manifest key: %w", err)
+	}
+
+	plaintext, err := passutils.DecryptPasswordWithAD(file.Data, key, v.manifestAD())
+	if err != nil {
+		return nil, fmt.Errorf("manifest cannot be authenticated")
+	}
+
+	if file.Version == legacyManifestVersion {
+		var legacy legacyManifest
+		if err := json.Unmarshal([]byte(plaintext), &legacy); err != nil {
+			return nil, fmt.Errorf("failed to parse manifest: %w", err)
+		}
+
+		m := &manifest{Revision: legacy.Revision, Entries: map[string]manifestEntry{}}
+		for name, hash := range legacy.Entries {
+			m.Entries[name] = manifestEntry{File: name, Hash: hash}
+		}
+		return m, nil
+	}
+
+	m := &manifest{}
+	if err := json.Unmarshal([]byte(plaintext), m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	if m.Entries == nil {
+		m.Entries = map[string]manifestEntry{}
+	}
+
+	return m, nil
+}
+
+func (v *vault) stageManifest(tx *vaultTx, m *manifest) error {
+	plaintext, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	key, err := v.manifestKey()
+	if err != nil {
+		return fmt.Errorf("failed to derive manifest key: %w", err)
+	}
+
+	data, err := passutils.EncryptPasswordWithAD(string(plaintext), key, v.manifestAD())
+	if err != nil {
+		return fmt.Errorf("failed to encrypt manifest: %w", err)
+	}
+
+	encoded, err := json.Marshal(manifestFile{Version: manifestVersion, Data: data})
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	return tx.write(manifestFileName, encoded)
+}
+
+// commit stages m as the new manifest and commits tx together with it.
+func (v *vault) commit(tx *vaultTx, m *manifest) error {
+	return v.commitAs(tx, m, changeMessage(v.manifest, m, v.meta.EncryptedNames))
+}
+
+// commitAs is commit with the message the change is recorded under in git.
+func (v *vault) commitAs(tx *vaultTx, m *manifest, message string) error {
+	if err := v.stageManifest(tx, m); err != nil {
+		tx.rollback()
+		return err
+	}
+
+	if err := tx.commit(); err != nil {
+		return err
+	}
+
+	v.manifest = m
+	v.gitRecord(message)
+	return recordRevision(v.meta.ID, m.Revision)
+}
+
+// loadManifest reads the manifest and compares it with the hush directory
+// and with the newest revision this machine has seen for the vault.
+func (v *vault) loadManifest() error {
+	seen, err := lastSeenRevision(v.meta.ID)
+	if err != nil {
+		return err
+	}
+
+	v.issues = nil
+
+	m, err := v.readManifest()
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		v.issues = append(v.issues, VaultIssue{
+			Kind:    IssueManifest,
+			Message: "the vault manifest is missing",
+		})
+	case err != nil:
+		v.issues = append(v.issues, VaultIssue{
+			Kind:    IssueManifest,
+			Message: fmt.Sprintf("the vault manifest is invalid: %v", err),
+		})
+	}
+	if m == nil {
+		// Start over from the last revision we know of, so that the next
+		// write cannot look like a rollback.
+		m = &manifest{Revision: seen, Entries: map[string]manifestEntry{}}
+	}
+
+	if m.Revision < seen {
+		v.issues = append(v.issues, VaultIssue{
+			Kind:    IssueRollback,
+			Message: fmt.Sprintf("the vault has been rolled back from revision %d to revision %d", seen, m.Revision),
+		})
+		m.Revision = seen
+	}
+
+	onDisk, err := v.fileHashes()
+	if err != nil {
+		return err
+	}
+
+	listed := map[string]bool{}
+	for _, name := range slices.Sorted(maps.Keys(m.Entries)) {
+		entry := m.Entries[name]
+		listed[entry.File] = true
+
+		hash, ok := onDisk[entry.File]
+		switch {
+		case !ok:
+			v.issues = append(v.issues, VaultIssue{
+				Kind:    IssueMissing,
+				Name:    name,
+				Message: fmt.Sprintf("entry %q is listed in the manifest but missing from the vault", name),
+			})
+		case hash != entry.Hash:
+			v.issues = append(v.issues, VaultIssue{
+				Kind:    IssueModified,
+				Name:    name,
+				Message: fmt.Sprintf("entry %q does not match the manifest (modified or restored from an older copy)", name),
+			})
+		}
+	}
+
+	for _, file := range slices.Sorted(maps.Keys(onDisk)) {
+		if !listed[file] {
+			v.issues = append(v.issues, VaultIssue{
+				Kind:    IssueExtra,
+				Name:    file,
+				Message: fmt.Sprintf("password file %q is not listed in the manifest", file+".hush"),
+			})
+		}
+	}
+
+	v.manifest = m
+	return recordRevision(v.meta.ID, m.Revision)
+}
+
+func (v *vault) fileHashes() (map[string]string, error) {
+	files, err := listEntryFiles(v.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make(map[string]string, len(files))
+	for _, file := range files {
+		data, err := readEncryptedPassword(v.dir, file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read password file: %w", err)
+		}
+		hashes[file] = hashEntry(data)
+	}
+
+	return hashes, nil
+}
+
+// scanEntries builds a manifest of every entry in the hush directory that
+// authenticates under this vault, returning the names of those that do not
+// and of password files that cannot be attributed to any entry.
+func (v *vault) scanEntries() (*manifest, []string, error) {
+	index, err := v.entryIndex()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	files, err := listEntryFiles(v.dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m := &manifest{Entries: map[string]manifestEntry{}}
+	if v.manifest != nil {
+		m.HistoryKeep = v.manifest.HistoryKeep
+	}
+	var rejected []string
+
+	indexed := map[string]bool{}
+	for _, name := range slices.Sorted(maps.Keys(index)) {
+		file := index[name]
+		indexed[file] = true
+
+		data, err := readEncryptedPassword(v.dir, file)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read password file: %w", err)
+		}
+
+		if _, err := v.openEntry(name, data); err != nil {
+			rejected = append(rejected, name)
+			continue
+		}
+
+		entry := manifestEntry{File: file, Hash: hashEntry(data)}
+		// Keep the history of entries the manifest already knows about.
+		if v.manifest != nil {
+			if known, ok := v.manifest.Entries[name]; ok && known.File == file {
+				entry.Revision, entry.Modified, entry.History = known.Revision, known.Modified, known.History
+			}
+		}
+		m.Entries[name] = entry
+	}
+
+	for _, file := range files {
+		if !indexed[file] {
+			rejected = append(rejected, file+".hush")
+		}
+	}
+
+	return m, rejected, nil
+}
+
+func warnIssues(issues []VaultIssue) {
+	for _, issue := range issues {
+		fmt.Fprintf(warningOutput, "WARNING: %s\n", issue)
+	}
+	if len(issues) > 0 {
+		fmt.Fprintln(warningOutput, "WARNING: the vault may have been tampered with or damaged by a sync; run 'hush verify' for details.")
+	}
+}
+
+func VerifyVault(masterPassword string) ([]VaultIssue, error) {
+	v, err := openVault(masterPassword, lockShared)
+	if err != nil {
+		return nil, fmt.Errorf("error validating master password: %w", err)
+	}
+	defer v.close()
+
+	return v.issues, nil
+}
+
+// RepairManifest accepts the current state of the hush directory by writing
+// a new manifest for every entry that still authenticates. The names of
+// entries that were left out are returned.
+func RepairManifest(masterPassword string) ([]string, error) {
+	v, err := openVault(masterPassword, lockExclusive)
+	if err != nil {
+		return nil, fmt.Errorf("error validating master password: %w", err)
+	}
+	defer v.close()
+
+	m, rejected, err := v.scanEntries()
+	if err != nil {
+		return nil, err
+	}
+	m.Revision = v.manifest.Revision + 1
+
+	if err := v.commit(beginTx(v.dir), m); err != nil {
+		return nil, fmt.Errorf("failed to save manifest: %w", err)
+	}
+
+	return rejected, nil
+}
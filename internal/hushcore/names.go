@@ -0,0 +1,332 @@
+package hushcore
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/nochzato/hush/internal/passutils"
+)
+
+const (
+	folderSeparator = "/"
+	// Room for ".hush" and for the revision number of history files.
+	maxFileStemLength = 255 - len(".hush") - len(".4294967295")
+)
+
+var ErrEntryNotFound = errors.New("password not found")
+
+var ErrEntryExists = errors.New("an entry with this name already exists")
+
+// entryFileName returns the file stem for a plain entry name. Lower case
+// ASCII letters, digits, hyphens and inner dots are kept; every other byte,
+// upper case letters included, is written as "_" and two hex digits. The
+// result is safe on every file system, never starts with a dot, and names
+// that differ only by case still get different files on case-insensitive
+// file systems. Folder separators are escaped as well, so every entry is a
+// single file directly in the hush directory.
+func entryFileName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-':
+			b.WriteByte(c)
+		case c == '.' && i > 0 && i < len(name)-1:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "_%02x", c)
+		}
+	}
+
+	file := b.String()
+	if isReservedFileName(file) {
+		// Windows refuses device names whatever their extension.
+		file = fmt.Sprintf("_%02x", file[0]) + file[1:]
+	}
+	return file
+}
+
+func isReservedFileName(file string) bool {
+	base, _, _ := strings.Cut(file, ".")
+	switch base {
+	case "con", "prn", "aux", "nul":
+		return true
+	}
+	return len(base) == 4 && (strings.HasPrefix(base, "com") || strings.HasPrefix(base, "lpt")) &&
+		'1' <= base[3] && base[3] <= '9'
+}
+
+// entryNameFromFile decodes a file stem written by entryFileName. Stems of
+// older vaults, which were not encoded, decode to themselves.
+func entryNameFromFile(file string) string {
+	name := make([]byte, 0, len(file))
+	for i := 0; i < len(file); i++ {
+		if file[i] == '_' && i+3 <= len(file) {
+			if c, err := strconv.ParseUint(file[i+1:i+3], 16, 8); err == nil {
+				name = append(name, byte(c))
+				i += 2
+				continue
+			}
+		}
+		name = append(name, file[i])
+	}
+	return string(name)
+}
+
+// legacyEntryFileName is the file stem entries had before names were
+// encoded.
+func legacyEntryFileName(name string) string {
+	return strings.ReplaceAll(name, folderSeparator, "_2f")
+}
+
+// InFolder reports whether name is in folder or in one of its subfolders.
+// The empty folder holds every entry.
+func InFolder(name, folder string) bool {
+	folder = strings.TrimSuffix(folder, folderSeparator)
+	return folder == "" || strings.HasPrefix(name, folder+folderSeparator)
+}
+
+// lookupEntry returns the password file stem that holds name.
+func (v *vault) lookupEntry(name string) (string, error) {
+	if entry, ok := v.manifest.Entries[name]; ok {
+		return entry.File, nil
+	}
+
+	if !v.meta.EncryptedNames {
+		// The manifest may have lost track of a plain entry; the file
+		// itself still says where it is.
+		for _, file := range []string{entryFileName(name), legacyEntryFileName(name)} {
+			_, err := os.Stat(filepath.Join(v.dir, file+".hush"))
+			if err == nil {
+				return file, nil
+			}
+			if !errors.Is(err, fs.ErrNotExist) {
+				return "", fmt.Errorf("failed to read password file: %w", err)
+			}
+		}
+	}
+
+	return "", fmt.Errorf("%w: %q", ErrEntryNotFound, name)
+}
+
+// entryFileFor returns the file stem to store name in, reusing the existing
+// file when the entry is already present.
+func (v *vault) entryFileFor(name string) (string, error) {
+	file, err := v.lookupEntry(name)
+	if err == nil {
+		return file, nil
+	}
+	if !errors.Is(err, ErrEntryNotFound) {
+		return "", err
+	}
+
+	if !v.meta.EncryptedNames {
+		return entryFileName(name), nil
+	}
+
+	return newEntryID()
+}
+
+func newEntryID() (string, error) {
+	id, err := passutils.GenerateSalt()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate entry id: %w", err)
+	}
+	return id, nil
+}
+
+// entryIndex maps every known entry name to its password file stem. With
+// plain names that is whatever is in the hush directory; with encrypted
+// names only the manifest knows.
+func (v *vault) entryIndex() (map[string]string, error) {
+	index := map[string]string{}
+	indexed := map[string]bool{}
+	if v.manifest != nil {
+		for name, entry := range v.manifest.Entries {
+			index[name] = entry.File
+			indexed[entry.File] = true
+		}
+	}
+
+	if v.meta.EncryptedNames {
+		return index, nil
+	}
+
+	files, err := listEntryFiles(v.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if !indexed[file] {
+			index[entryNameFromFile(file)] = file
+		}
+	}
+
+	return index, nil
+}
+
+// renameEntryFiles stages moving every plain entry in m, together with its
+// history, to the file entryFileName gives it.
+func (v *vault) renameEntryFiles(tx *vaultTx, m *manifest) error {
+	if v.meta.EncryptedNames {
+		return nil
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(m.Entries)) {
+		entry := m.Entries[name]
+		newFile := entryFileName(name)
+		if entry.File == newFile {
+			continue
+		}
+
+		data, err := readEncryptedPassword(v.dir, entry.File)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Reported as missing once the manifest is loaded.
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read password file: %w", err)
+		}
+
+		if err := tx.write(newFile+".hush", data); err != nil {
+			return err
+		}
+		tx.remove(entry.File + ".hush")
+
+		if err := v.moveHistory(tx, entry, newFile); err != nil {
+			return err
+		}
+
+		entry.File = newFile
+		m.Entries[name] = entry
+	}
+
+	return nil
+}
+
+func (v *vault) passwordNames() []string {
+	return slices.Sorted(maps.Keys(v.manifest.Entries))
+}
+
+func NamesEncrypted() (bool, error) {
+	_, lock, err := openHushDir(lockShared)
+	if err != nil {
+		return false, err
+	}
+	defer lock.unlock()
+
+	meta, err := readVaultMeta()
+	if err != nil {
+		return false, err
+	}
+
+	return meta.EncryptedNames, nil
+}
+
+// SetNameEncryption switches the vault between password files named after
+// their entries and files with random IDs, moving every entry in a single
+// transaction. The file contents stay the same because entries are bound to
+// their names, not to their files.
+func SetNameEncryption(masterPassword string, enabled bool) error {
+	v, err := unlockVault(masterPassword, lockExclusive)
+	if err != nil {
+		return fmt.Errorf("error validating master password: %w", err)
+	}
+	defer v.close()
+
+	return v.setNameEncryption(enabled)
+}
+
+func (v *vault) setNameEncryption(enabled bool) error {
+	if v.meta.EncryptedNames == enabled {
+		return nil
+	}
+
+	index, err := v.entryIndex()
+	if err != nil {
+		return err
+	}
+
+	meta := *v.meta
+	meta.EncryptedNames = enabled
+	moved := &vault{dir: v.dir, meta: &meta, key: v.key}
+
+	oldFiles := map[string]bool{}
+	for _, file := range index {
+		oldFiles[file] = true
+	}
+
+	tx := beginTx(v.dir)
+	m := v.manifest.next()
+	m.Entries = map[string]manifestEntry{}
+
+	for _, name := range slices.Sorted(maps.Keys(index)) {
+		file := index[name]
+
+		data, err := readEncryptedPassword(v.dir, file)
+		if err != nil {
+			tx.rollback()
+			return fmt.Errorf("failed to read password file: %w", err)
+		}
+
+		if _, err := v.openEntry(name, data); err != nil {
+			tx.rollback()
+			return fmt.Errorf("failed to decrypt password %q: %w", name, err)
+		}
+
+		newFile := entryFileName(name)
+		if enabled {
+			newFile, err = newEntryID()
+			if err != nil {
+				tx.rollback()
+				return err
+			}
+		}
+
+		if newFile != file && oldFiles[newFile] {
+			tx.rollback()
+			return fmt.Errorf("cannot move %q: its file name is already taken by another entry", name)
+		}
+
+		entry := v.manifest.Entries[name]
+		if newFile != file {
+			if err := tx.write(newFile+".hush", data); err != nil {
+				tx.rollback()
+				return err
+			}
+			tx.remove(file + ".hush")
+
+			if err := v.moveHistory(tx, entry, newFile); err != nil {
+				tx.rollback()
+				return err
+			}
+		}
+
+		entry.File = newFile
+		entry.Hash = hashEntry(data)
+		m.Entries[name] = entry
+	}
+
+	if err := moved.stageMeta(tx); err != nil {
+		tx.rollback()
+		return err
+	}
+
+	message := "Disable name encryption"
+	if enabled {
+		message = "Enable name encryption"
+	}
+	if err := moved.commitAs(tx, m, message); err != nil {
+		return fmt.Errorf("failed to move password files: %w", err)
+	}
+
+	v.meta = &meta
+	return nil
+}
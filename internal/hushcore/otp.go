@@ -0,0 +1,127 @@
+package hushcore
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nochzato/hush/internal/passutils"
+)
+
+// otpNow is the clock TOTP codes are generated for.
+var otpNow = time.Now
+
+// OneTimeCode is a code generated from the OTP secret of an entry.
+type OneTimeCode struct {
+	Code string
+	// Remaining is how long a TOTP code stays valid. It is zero for HOTP
+	// codes, which are valid until used.
+	Remaining time.Duration
+	HOTP      bool
+	// Counter is the HOTP counter the code was generated from.
+	Counter uint64
+}
+
+// OTPCode returns the current one-time code of an entry. Generating an HOTP
+// code advances the stored counter, so every call returns a new code.
+//
+// The counter is advanced in place: the entry gets no new revision, so the
+// bump does not show in its history, while the manifest records the new
+// hash of the entry like any other write and verify accepts it.
+func OTPCode(name, masterPassword string) (*OneTimeCode, error) {
+	sanitizedName, err := sanitizeFileName(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filename: %w", err)
+	}
+
+	// TOTP codes only read the vault; HOTP codes take the exclusive lock
+	// once they turn out to be needed.
+	v, err := unlockVault(masterPassword, lockShared)
+	if err != nil {
+		return nil, fmt.Errorf("error validating master password: %w", err)
+	}
+	defer v.close()
+
+	record, key, err := v.otpKey(sanitizedName)
+	if err != nil {
+		return nil, err
+	}
+
+	_ = v.recordUsage(sanitizedName)
+
+	if key.Type == passutils.OTPTypeTOTP {
+		code, remaining, err := key.TOTP(otpNow())
+		if err != nil {
+			return nil, err
+		}
+		return &OneTimeCode{Code: code, Remaining: remaining}, nil
+	}
+
+	// The entry is read again under the exclusive lock, as another hush
+	// may have used the counter in the meantime.
+	if err := v.relock(lockExclusive); err != nil {
+		return nil, fmt.Errorf("failed to lock vault: %w", err)
+	}
+	record, key, err = v.otpKey(sanitizedName)
+	if err != nil {
+		return nil, err
+	}
+
+	code, err := passutils.HOTP(key.Secret, key.Counter, key.Digits, key.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	counter := key.Counter
+	key.Counter++
+	record.OTP = key.URI()
+	if err := v.rewriteEntry(sanitizedName, record); err != nil {
+		return nil, fmt.Errorf("failed to advance HOTP counter: %w", err)
+	}
+
+	return &OneTimeCode{Code: code, HOTP: true, Counter: counter}, nil
+}
+
+// otpKey returns the record of an entry and its parsed OTP secret.
+func (v *vault) otpKey(name string) (*Record, *passutils.OTPKey, error) {
+	record, err := v.getRecord(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if record.OTP == "" {
+		return nil, nil, fmt.Errorf("%q has no OTP secret", name)
+	}
+
+	key, err := passutils.ParseOTP(record.OTP)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid OTP secret: %w", err)
+	}
+	return record, key, nil
+}
+
+// rewriteEntry replaces the current revision of name with record without
+// adding a revision. HOTP counter updates go through here; a revision per
+// login would push the password history out within days.
+func (v *vault) rewriteEntry(name string, record *Record) error {
+	entry, ok := v.manifest.Entries[name]
+	if !ok {
+		return v.addRecord(name, record)
+	}
+
+	sealedPassword, err := v.sealEntry(name, record)
+	if err != nil {
+		return err
+	}
+
+	tx := beginTx(v.dir)
+	if err := tx.write(entry.File+".hush", sealedPassword); err != nil {
+		tx.rollback()
+		return fmt.Errorf("failed to write password file: %w", err)
+	}
+
+	m := v.manifest.next()
+	entry.Hash = hashEntry(sealedPassword)
+	entry.Modified = time.Now().UTC()
+	m.Entries[name] = entry
+
+	return v.commit(tx, m)
+}
@@ -0,0 +1,122 @@
+package hushcore
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/nochzato/hush/internal/passutils"
+)
+
+// Names of the built-in record fields, as accepted by Record.Get.
+const (
+	FieldPassword = "password"
+	FieldUsername = "username"
+	FieldURL      = "url"
+	FieldNotes    = "notes"
+	FieldTags     = "tags"
+	FieldOTP      = "otp"
+)
+
+var ErrFieldNotFound = errors.New("field not found")
+
+// Record is everything stored under an entry name. It is serialized as JSON
+// inside the entry ciphertext, so none of it is visible on disk.
+type Record struct {
+	Password string   `json:"password"`
+	Username string   `json:"username,omitempty"`
+	URLs     []string `json:"urls,omitempty"`
+	Notes    string   `json:"notes,omitempty"`
+	Fields   []Field  `json:"fields,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	// OTP is an otpauth:// URI holding the one-time password secret.
+	OTP string `json:"otp,omitempty"`
+}
+
+// Field is a custom key/value pair. Sensitive fields are treated like the
+// password: copied to the clipboard rather than printed.
+type Field struct {
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Sensitive bool   `json:"sensitive,omitempty"`
+}
+
+func isBuiltinField(key string) bool {
+	switch strings.ToLower(key) {
+	case FieldPassword, FieldUsername, FieldURL, FieldNotes, FieldTags, FieldOTP:
+		return true
+	}
+	return false
+}
+
+func (r *Record) Validate() error {
+	seen := map[string]bool{}
+	for _, field := range r.Fields {
+		key := strings.TrimSpace(field.Key)
+		if key == "" {
+			return fmt.Errorf("field name cannot be empty")
+		}
+		if key != field.Key {
+			return fmt.Errorf("field name %q cannot start or end with spaces", field.Key)
+		}
+		if isBuiltinField(key) {
+			return fmt.Errorf("field name %q is reserved", key)
+		}
+		if seen[strings.ToLower(key)] {
+			return fmt.Errorf("duplicate field %q", key)
+		}
+		seen[strings.ToLower(key)] = true
+	}
+
+	seenTags := map[string]bool{}
+	for _, tag := range r.Tags {
+		if err := validateTag(tag); err != nil {
+			return err
+		}
+		if seenTags[strings.ToLower(tag)] {
+			return fmt.Errorf("duplicate tag %q", tag)
+		}
+		seenTags[strings.ToLower(tag)] = true
+	}
+
+	if r.OTP != "" {
+		if _, err := passutils.ParseOTP(r.OTP); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Get returns the value of a built-in or custom field and whether it is
+// sensitive. Field names are matched case-insensitively; "url" returns the
+// first URL.
+func (r *Record) Get(key string) (string, bool, error) {
+	switch strings.ToLower(key) {
+	case FieldPassword:
+		return r.Password, true, nil
+	case FieldUsername:
+		return r.Username, false, nil
+	case FieldURL:
+		if len(r.URLs) == 0 {
+			return "", false, nil
+		}
+		return r.URLs[0], false, nil
+	case FieldNotes:
+		return r.Notes, false, nil
+	case FieldTags:
+		return strings.Join(r.Tags, " "), false, nil
+	case FieldOTP:
+		return r.OTP, true, nil
+	}
+
+	i := slices.IndexFunc(r.Fields, func(f Field) bool {
+		return strings.EqualFold(f.Key, key)
+	})
+	if i < 0 {
+		return "", false, fmt.Errorf("%w: %q", ErrFieldNotFound, key)
+	}
+
+	return r.Fields[i].Value, r.Fields[i].Sensitive, nil
+}
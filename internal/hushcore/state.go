@@ -0,0 +1,136 @@
+package hushcore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	stateDirName  = "hush"
+	stateFileName = "state.json"
+	stateLockName = "state.lock"
+)
+
+// localState is kept per machine, outside of the hush directory, so that it
+// is not synced or rolled back together with the vault.
+type localState struct {
+	Revisions map[string]uint64 `json:"revisions"`
+	// Usage maps vault IDs to when each entry was last retrieved, keyed by
+	// usageTag so that encrypted names do not leak.
+	Usage map[string]map[string]time.Time `json:"usage,omitempty"`
+}
+
+var getStateDir = defaultGetStateDir
+
+func defaultGetStateDir() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get config directory: %w", err)
+	}
+	return filepath.Join(configDir, stateDirName), nil
+}
+
+func readLocalState() (*localState, error) {
+	stateDir, err := getStateDir()
+	if err != nil {
+		return nil, err
+	}
+
+	state := &localState{Revisions: map[string]uint64{}}
+
+	data, err := os.ReadFile(filepath.Join(stateDir, stateFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read local state: %w", err)
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse local state: %w", err)
+	}
+	if state.Revisions == nil {
+		state.Revisions = map[string]uint64{}
+	}
+
+	return state, nil
+}
+
+func writeLocalState(state *localState) error {
+	stateDir, err := getStateDir()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode local state: %w", err)
+	}
+
+	statePath := filepath.Join(stateDir, stateFileName)
+	if err := writeFileSync(statePath+pendingSuffix, data, 0600); err != nil {
+		return fmt.Errorf("failed to write local state: %w", err)
+	}
+	if err := os.Rename(statePath+pendingSuffix, statePath); err != nil {
+		return fmt.Errorf("failed to write local state: %w", err)
+	}
+
+	return nil
+}
+
+func lastSeenRevision(vaultID string) (uint64, error) {
+	state, err := readLocalState()
+	if err != nil {
+		return 0, err
+	}
+	return state.Revisions[vaultID], nil
+}
+
+func recordRevision(vaultID string, revision uint64) error {
+	return updateLocalState(func(state *localState) bool {
+		if state.Revisions[vaultID] >= revision {
+			return false
+		}
+		state.Revisions[vaultID] = revision
+		return true
+	})
+}
+
+// updateLocalState applies update to the local state and writes it back if
+// update reports a change.
+func updateLocalState(update func(state *localState) bool) error {
+	stateDir, err := getStateDir()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	// Other hush processes may be updating the state of other vaults.
+	lock, err := lockFile(filepath.Join(stateDir, stateLockName), lockExclusive)
+	if err != nil {
+		return fmt.Errorf("failed to lock local state: %w", err)
+	}
+	defer lock.unlock()
+
+	state, err := readLocalState()
+	if err != nil {
+		return err
+	}
+
+	if !update(state) {
+		return nil
+	}
+	return writeLocalState(state)
+}
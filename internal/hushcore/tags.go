@@ -0,0 +1,271 @@
+package hushcore
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// TagQuery selects entries by their tags.
+type TagQuery interface {
+	Match(tags []string) bool
+}
+
+type tagTerm string
+
+func (q tagTerm) Match(tags []string) bool {
+	return slices.ContainsFunc(tags, func(tag string) bool {
+		return strings.EqualFold(tag, string(q))
+	})
+}
+
+type tagNot struct {
+	q TagQuery
+}
+
+func (q tagNot) Match(tags []string) bool {
+	return !q.q.Match(tags)
+}
+
+type tagAnd []TagQuery
+
+func (q tagAnd) Match(tags []string) bool {
+	for _, sub := range q {
+		if !sub.Match(tags) {
+			return false
+		}
+	}
+	return true
+}
+
+type tagOr []TagQuery
+
+func (q tagOr) Match(tags []string) bool {
+	for _, sub := range q {
+		if sub.Match(tags) {
+			return true
+		}
+	}
+	return false
+}
+
+const tagOperators = "()!&|"
+
+func validateTag(tag string) error {
+	if tag == "" {
+		return fmt.Errorf("tag cannot be empty")
+	}
+	if strings.ContainsAny(tag, tagOperators) || strings.ContainsFunc(tag, isSpace) {
+		return fmt.Errorf("tag %q cannot contain spaces or any of %s", tag, tagOperators)
+	}
+	switch strings.ToLower(tag) {
+	case "and", "or", "not":
+		return fmt.Errorf("%q cannot be used as a tag", tag)
+	}
+	return nil
+}
+
+func isSpace(r rune) bool {
+	return strings.ContainsRune(" \t\n\r\v\f", r)
+}
+
+// ParseTagQuery parses a tag query such as "prod and (postgres or mysql)
+// and not staging". Terms next to each other are ANDed; "&", "|" and "!"
+// may be used instead of "and", "or" and "not". Tags match
+// case-insensitively.
+func ParseTagQuery(query string) (TagQuery, error) {
+	p := &tagParser{tokens: tokenizeTagQuery(query)}
+	if len(p.tokens) == 0 {
+		return nil, fmt.Errorf("tag query cannot be empty")
+	}
+
+	q, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in tag query", p.tokens[p.pos])
+	}
+
+	return q, nil
+}
+
+func tokenizeTagQuery(query string) []string {
+	var tokens []string
+	var current strings.Builder
+	flush := func() {
+		if current.Len() > 0 {
+			tokens = append(tokens, current.String())
+			current.Reset()
+		}
+	}
+
+	for _, r := range query {
+		switch {
+		case isSpace(r):
+			flush()
+		case strings.ContainsRune(tagOperators, r):
+			flush()
+			tokens = append(tokens, string(r))
+		default:
+			current.WriteRune(r)
+		}
+	}
+	flush()
+
+	return tokens
+}
+
+type tagParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *tagParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return strings.ToLower(p.tokens[p.pos])
+	}
+	return ""
+}
+
+func (p *tagParser) parseOr() (TagQuery, error) {
+	q, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	or := tagOr{q}
+	for p.peek() == "or" || p.peek() == "|" {
+		p.pos++
+		q, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		or = append(or, q)
+	}
+
+	if len(or) == 1 {
+		return or[0], nil
+	}
+	return or, nil
+}
+
+func (p *tagParser) parseAnd() (TagQuery, error) {
+	q, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	and := tagAnd{q}
+	for {
+		switch p.peek() {
+		case "and", "&":
+			p.pos++
+		case "", "or", "|", ")":
+			if len(and) == 1 {
+				return and[0], nil
+			}
+			return and, nil
+		}
+
+		q, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		and = append(and, q)
+	}
+}
+
+func (p *tagParser) parseNot() (TagQuery, error) {
+	switch p.peek() {
+	case "not", "!":
+		p.pos++
+		q, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return tagNot{q}, nil
+	case "(":
+		p.pos++
+		q, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing ) in tag query")
+		}
+		p.pos++
+		return q, nil
+	case "":
+		return nil, fmt.Errorf("tag query ends unexpectedly")
+	}
+
+	token := p.tokens[p.pos]
+	if err := validateTag(token); err != nil {
+		return nil, fmt.Errorf("unexpected %q in tag query", token)
+	}
+	p.pos++
+	return tagTerm(token), nil
+}
+
+// FindTagged returns the names of all entries whose tags match query.
+// Entries that cannot be read or fail to authenticate are left out with a
+// warning, like the other differences from the manifest.
+func FindTagged(query TagQuery, masterPassword string) ([]string, error) {
+	v, err := unlockVault(masterPassword, lockShared)
+	if err != nil {
+		return nil, fmt.Errorf("error validating master password: %w", err)
+	}
+	defer v.close()
+
+	index, err := v.entryIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	// Entries the manifest check already warned about, by name or by file,
+	// are not repeated.
+	reported := map[string]bool{}
+	for _, issue := range v.issues {
+		reported[issue.Name] = true
+	}
+	for name, file := range index {
+		reported[name] = reported[name] || reported[file]
+	}
+
+	var names []string
+	var issues []VaultIssue
+	for _, name := range slices.Sorted(maps.Keys(index)) {
+		data, err := readEncryptedPassword(v.dir, index[name])
+		if err != nil {
+			if !reported[name] {
+				issues = append(issues, VaultIssue{
+					Kind:    IssueMissing,
+					Name:    name,
+					Message: fmt.Sprintf("entry %q cannot be read: %v", name, err),
+				})
+			}
+			continue
+		}
+
+		record, err := v.openEntry(name, data)
+		if err != nil {
+			if !reported[name] {
+				issues = append(issues, VaultIssue{
+					Kind:    IssueModified,
+					Name:    name,
+					Message: fmt.Sprintf("entry %q cannot be decrypted: %v", name, err),
+				})
+			}
+			continue
+		}
+
+		if query.Match(record.Tags) {
+			names = append(names, name)
+		}
+	}
+	warnIssues(issues)
+
+	return names, nil
+}
@@ -0,0 +1,201 @@
+package hushcore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	journalFileName = "journal"
+	pendingSuffix   = ".pending"
+)
+
+// vaultTx stages a set of file writes and removals inside the hush directory
+// and applies them all-or-nothing. New contents are written next to their
+// targets with a ".pending" suffix; the journal file is the commit point.
+// If the process dies before the journal is written, recoverTx discards the
+// staged files. If it dies after, recoverTx finishes the job.
+type vaultTx struct {
+	dir     string
+	Writes  []string `json:"writes"`
+	Removes []string `json:"removes"`
+}
+
+func beginTx(dir string) *vaultTx {
+	return &vaultTx{dir: dir}
+}
+
+func (tx *vaultTx) write(name string, data []byte) error {
+	path := filepath.Join(tx.dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	if err := writeFileSync(path+pendingSuffix, data, 0600); err != nil {
+		return fmt.Errorf("failed to stage %s: %w", name, err)
+	}
+	tx.Writes = append(tx.Writes, name)
+	return nil
+}
+
+func (tx *vaultTx) remove(name string) {
+	tx.Removes = append(tx.Removes, name)
+}
+
+func (tx *vaultTx) commit() error {
+	// A file that is both replaced and removed, such as the target of a
+	// move onto an existing entry, ends up written.
+	tx.Removes = slices.DeleteFunc(tx.Removes, func(name string) bool {
+		return slices.Contains(tx.Writes, name)
+	})
+
+	journal, err := json.Marshal(tx)
+	if err != nil {
+		return fmt.Errorf("failed to encode journal: %w", err)
+	}
+
+	journalPath := filepath.Join(tx.dir, journalFileName)
+	if err := writeFileSync(journalPath+pendingSuffix, journal, 0600); err != nil {
+		tx.rollback()
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	if err := os.Rename(journalPath+pendingSuffix, journalPath); err != nil {
+		tx.rollback()
+		return fmt.Errorf("failed to commit journal: %w", err)
+	}
+	if err := syncDir(tx.dir); err != nil {
+		return fmt.Errorf("failed to commit journal: %w", err)
+	}
+
+	return tx.apply()
+}
+
+func (tx *vaultTx) apply() error {
+	for _, name := range tx.Writes {
+		path := filepath.Join(tx.dir, name)
+		err := os.Rename(path+pendingSuffix, path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to apply %s: %w", name, err)
+		}
+	}
+
+	for _, name := range tx.Removes {
+		err := os.Remove(filepath.Join(tx.dir, name))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %w", name, err)
+		}
+	}
+
+	if err := tx.syncDirs(); err != nil {
+		return err
+	}
+
+	err := os.Remove(filepath.Join(tx.dir, journalFileName))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove journal: %w", err)
+	}
+
+	return nil
+}
+
+// syncDirs syncs every directory between the touched files and the hush
+// directory, so that renames and removals in subdirectories such as
+// history/, and the subdirectories themselves, survive a crash before the
+// journal goes away.
+func (tx *vaultTx) syncDirs() error {
+	dirs := map[string]bool{tx.dir: true}
+	for _, name := range slices.Concat(tx.Writes, tx.Removes) {
+		dir := filepath.Dir(filepath.Join(tx.dir, name))
+		for dir != tx.dir && strings.HasPrefix(dir, tx.dir) {
+			dirs[dir] = true
+			dir = filepath.Dir(dir)
+		}
+	}
+
+	// Deepest first, so a new directory is synced before its parent.
+	sorted := slices.Sorted(maps.Keys(dirs))
+	slices.Reverse(sorted)
+	for _, dir := range sorted {
+		err := syncDir(dir)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *vaultTx) rollback() {
+	for _, name := range tx.Writes {
+		os.Remove(filepath.Join(tx.dir, name) + pendingSuffix)
+	}
+	os.Remove(filepath.Join(tx.dir, journalFileName) + pendingSuffix)
+}
+
+func recoverTx(dir string) error {
+	journal, err := os.ReadFile(filepath.Join(dir, journalFileName))
+	switch {
+	case err == nil:
+		tx := beginTx(dir)
+		if err := json.Unmarshal(journal, tx); err != nil {
+			return fmt.Errorf("failed to decode journal: %w", err)
+		}
+		if err := tx.apply(); err != nil {
+			return err
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return fmt.Errorf("failed to read journal: %w", err)
+	}
+
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == gitDirName {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() && strings.HasSuffix(d.Name(), pendingSuffix) {
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to discard staged files: %w", err)
+	}
+
+	return nil
+}
+
+func writeFileSync(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return nil
+}
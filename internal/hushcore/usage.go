@@ -0,0 +1,96 @@
+package hushcore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/nochzato/hush/internal/passutils"
+)
+
+const usageKeyInfo = "hush usage key"
+
+// usageTags maps entry names to the keyed hashes their usage is recorded
+// under in the local state.
+func (v *vault) usageTags(names []string) (map[string]string, error) {
+	key, err := passutils.DeriveSubkey(v.key, nil, usageKeyInfo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive usage key: %w", err)
+	}
+
+	tags := make(map[string]string, len(names))
+	for _, name := range names {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(name))
+		tags[name] = hex.EncodeToString(mac.Sum(nil)[:16])
+	}
+	return tags, nil
+}
+
+// recordUsage notes that name was just retrieved, forgetting entries that
+// no longer exist.
+func (v *vault) recordUsage(name string) error {
+	index, err := v.entryIndex()
+	if err != nil {
+		return err
+	}
+	tags, err := v.usageTags(slices.Collect(maps.Keys(index)))
+	if err != nil {
+		return err
+	}
+	live := map[string]bool{}
+	for _, tag := range tags {
+		live[tag] = true
+	}
+
+	return updateLocalState(func(state *localState) bool {
+		if state.Usage == nil {
+			state.Usage = map[string]map[string]time.Time{}
+		}
+		usage := map[string]time.Time{}
+		for tag, used := range state.Usage[v.meta.ID] {
+			if live[tag] {
+				usage[tag] = used
+			}
+		}
+		if tag, ok := tags[name]; ok {
+			usage[tag] = time.Now().UTC()
+		}
+		state.Usage[v.meta.ID] = usage
+		return true
+	})
+}
+
+// EntryUsage returns every entry name with the time it was last retrieved
+// on this machine, which is zero for entries never retrieved here.
+func EntryUsage(masterPassword string) (map[string]time.Time, error) {
+	v, err := unlockVault(masterPassword, lockShared)
+	if err != nil {
+		return nil, fmt.Errorf("error validating master password: %w", err)
+	}
+	defer v.close()
+
+	index, err := v.entryIndex()
+	if err != nil {
+		return nil, err
+	}
+	tags, err := v.usageTags(slices.Collect(maps.Keys(index)))
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := readLocalState()
+	if err != nil {
+		return nil, err
+	}
+
+	usage := make(map[string]time.Time, len(tags))
+	for name, tag := range tags {
+		usage[name] = state.Usage[v.meta.ID][tag]
+	}
+	return usage, nil
+}
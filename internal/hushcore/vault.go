@@ -0,0 +1,629 @@
+package hushcore
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nochzato/hush/internal/passutils"
+)
+
+const (
+	vaultFileName = "vault.json"
+
+	// legacyVaultVersion marks vaults that predate vault.json and keep a
+	// bare hex salt in the salt file.
+	legacyVaultVersion = 0
+	// Vaults older than envelopeVaultVersion store the master password
+	// encrypted with itself in master.hash and derive entry keys from it.
+	envelopeVaultVersion = 2
+	// From boundVaultVersion on, every entry is bound to its name and the
+	// vault ID through AEAD associated data, and unbound entries are refused.
+	boundVaultVersion = 3
+	// Vaults older than manifestVaultVersion have no manifest yet.
+	manifestVaultVersion = 4
+	// Before encodedVaultVersion, plain entry files were named after their
+	// entries as they were, upper case letters included.
+	encodedVaultVersion = 5
+	vaultVersion        = 5
+
+	unboundEntryVersion = 2
+	// passwordEntryVersion entries hold a bare password; entryVersion
+	// entries hold a JSON record.
+	passwordEntryVersion = 3
+	entryVersion         = 4
+	entryKeyInfo         = "hush entry key"
+)
+
+var ErrNotInitialized = errors.New("hush is not initialized")
+
+var ErrEntryTampered = errors.New("password file does not belong to this entry or has been modified")
+
+type vaultMeta struct {
+	Version    int     `json:"version"`
+	ID         string  `json:"id,omitempty"`
+	KDF        kdfMeta `json:"kdf"`
+	Cipher     string  `json:"cipher"`
+	WrappedKey string  `json:"wrapped_key,omitempty"`
+	// EncryptedNames stores entries under random IDs; names are then only
+	// kept in the encrypted manifest.
+	EncryptedNames bool `json:"encrypted_names,omitempty"`
+}
+
+type kdfMeta struct {
+	Algorithm string              `json:"algorithm"`
+	Salt      string              `json:"salt"`
+	Params    passutils.KDFParams `json:"params"`
+}
+
+type entryFile struct {
+	Version int    `json:"version"`
+	Salt    string `json:"salt"`
+	Data    string `json:"data"`
+}
+
+// vault is an unlocked hush directory. key is the random data key that
+// every entry subkey is derived from; it is stored on disk only wrapped by
+// the key derived from the master password.
+type vault struct {
+	dir      string
+	meta     *vaultMeta
+	key      []byte
+	manifest *manifest
+	issues   []VaultIssue
+	lock     *fileLock
+}
+
+func newVaultMeta(params passutils.KDFParams, key []byte, masterPassword string) (*vaultMeta, error) {
+	salt, err := passutils.GenerateSalt()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	id, err := passutils.GenerateSalt()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate vault id: %w", err)
+	}
+
+	meta := &vaultMeta{
+		Version: vaultVersion,
+		ID:      id,
+		KDF: kdfMeta{
+			Algorithm: passutils.KDFArgon2id,
+			Salt:      salt,
+			Params:    params,
+		},
+		Cipher: passutils.CipherAES256GCM,
+	}
+
+	wrappingKey, err := meta.deriveKey(masterPassword)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+
+	meta.WrappedKey, err = passutils.WrapKey(key, wrappingKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap vault key: %w", err)
+	}
+
+	return meta, nil
+}
+
+func readVaultMeta() (*vaultMeta, error) {
+	hushDir, err := getHushDir()
+	if err != nil {
+		return nil, err
+	}
+	return readVaultMetaIn(hushDir)
+}
+
+func readVaultMetaIn(hushDir string) (*vaultMeta, error) {
+	data, err := os.ReadFile(filepath.Join(hushDir, vaultFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return readLegacyVaultMeta(hushDir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vault metadata: %w", err)
+	}
+
+	var meta vaultMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("failed to parse vault metadata: %w", err)
+	}
+
+	if err := meta.validate(); err != nil {
+		return nil, err
+	}
+
+	return &meta, nil
+}
+
+func readLegacyVaultMeta(hushDir string) (*vaultMeta, error) {
+	salt, err := os.ReadFile(filepath.Join(hushDir, saltFileName))
+	if errors.Is(err, fs.ErrNotExist) && !isInitialized(hushDir) {
+		return nil, fmt.Errorf("%w in %s (run 'hush init' first)", ErrNotInitialized, hushDir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read salt: %w", err)
+	}
+
+	return &vaultMeta{
+		Version: legacyVaultVersion,
+		KDF: kdfMeta{
+			Algorithm: passutils.KDFArgon2id,
+			Salt:      string(salt),
+			Params:    passutils.LegacyKDFParams(),
+		},
+		Cipher: passutils.CipherAES256GCM,
+	}, nil
+}
+
+func (m *vaultMeta) validate() error {
+	if m.Version > vaultVersion {
+		return fmt.Errorf("vault version %d is newer than this version of hush supports", m.Version)
+	}
+	if m.KDF.Algorithm != passutils.KDFArgon2id {
+		return fmt.Errorf("unsupported key derivation function %q", m.KDF.Algorithm)
+	}
+	if m.Cipher != passutils.CipherAES256GCM {
+		return fmt.Errorf("unsupported cipher %q", m.Cipher)
+	}
+	if err := m.KDF.Params.Validate(); err != nil {
+		return fmt.Errorf("invalid kdf parameters: %w", err)
+	}
+	if m.Version >= envelopeVaultVersion && m.WrappedKey == "" {
+		return fmt.Errorf("vault metadata is missing the wrapped vault key")
+	}
+	if m.Version >= boundVaultVersion && m.ID == "" {
+		return fmt.Errorf("vault metadata is missing the vault id")
+	}
+	return nil
+}
+
+func (m *vaultMeta) deriveKey(password string) ([]byte, error) {
+	return passutils.DeriveKeyWithParams(password, m.KDF.Salt, m.KDF.Params)
+}
+
+func (m *vaultMeta) encode() ([]byte, error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode vault metadata: %w", err)
+	}
+	return data, nil
+}
+
+// unlockVault opens the vault and warns about every difference between the
+// hush directory and its manifest. The vault stays locked in the given mode
+// until it is closed.
+func unlockVault(masterPassword string, mode lockMode) (*vault, error) {
+	v, err := openVault(masterPassword, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	warnIssues(v.issues)
+	return v, nil
+}
+
+func openVault(masterPassword string, mode lockMode) (*vault, error) {
+	v, err := openVaultAs(masterPassword, mode)
+	if masterPassword == "" && agentPrompt != nil && errors.Is(err, ErrMasterPasswordRequired) {
+		// The agent forgot the key since the caller checked AgentUnlocked.
+		// The lock is not held while the user types.
+		if masterPassword, err = agentPrompt(); err != nil {
+			return nil, err
+		}
+		return openVaultAs(masterPassword, mode)
+	}
+	return v, err
+}
+
+func openVaultAs(masterPassword string, mode lockMode) (*vault, error) {
+	hushDir, lock, err := openHushDir(mode)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := openLockedVault(hushDir, masterPassword)
+	if err != nil {
+		lock.unlock()
+		return nil, err
+	}
+
+	v.lock = lock
+	return v, nil
+}
+
+func (v *vault) close() {
+	v.lock.unlock()
+	v.lock = nil
+}
+
+// relock reopens v in another lock mode. The lock is given up in between,
+// so the vault is read again, with the key v was unlocked with.
+func (v *vault) relock(mode lockMode) error {
+	v.close()
+
+	hushDir, lock, err := openHushDir(mode)
+	if err != nil {
+		return err
+	}
+	meta, err := readVaultMetaIn(hushDir)
+	if err != nil {
+		lock.unlock()
+		return err
+	}
+	reopened, err := openVaultWithKey(hushDir, meta, v.key)
+	if err != nil {
+		lock.unlock()
+		return err
+	}
+
+	reopened.lock = lock
+	*v = *reopened
+	return nil
+}
+
+func openLockedVault(hushDir, masterPassword string) (*vault, error) {
+	meta, err := readVaultMeta()
+	if err != nil {
+		return nil, err
+	}
+
+	if masterPassword == "" {
+		// An empty master password asks for the key held by the agent.
+		key, err := agentKey(meta)
+		if err != nil {
+			return nil, err
+		}
+		return openVaultWithKey(hushDir, meta, key)
+	}
+
+	if meta.Version < envelopeVaultVersion {
+		v, err := upgradeLegacyVault(hushDir, meta, masterPassword)
+		if err != nil {
+			return nil, err
+		}
+		if err := v.loadManifest(); err != nil {
+			return nil, err
+		}
+		v.cacheKey()
+		return v, nil
+	}
+
+	wrappingKey, err := meta.deriveKey(masterPassword)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+
+	key, err := passutils.UnwrapKey(meta.WrappedKey, wrappingKey)
+	if err != nil {
+		return nil, fmt.Errorf("incorrect master password")
+	}
+
+	v, err := openVaultWithKey(hushDir, meta, key)
+	if err != nil {
+		return nil, err
+	}
+	v.cacheKey()
+	return v, nil
+}
+
+func openVaultWithKey(hushDir string, meta *vaultMeta, key []byte) (*vault, error) {
+	v := &vault{dir: hushDir, meta: meta, key: key}
+	if meta.Version < vaultVersion {
+		if err := v.migrate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := v.loadManifest(); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// upgradeLegacyVault moves a vault that still encrypts entries directly with
+// the master password key over to a wrapped data key, re-encrypting every
+// entry in a single transaction.
+func upgradeLegacyVault(hushDir string, meta *vaultMeta, masterPassword string) (*vault, error) {
+	legacyKey, err := meta.deriveKey(masterPassword)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+
+	encryptedMasterPassword, err := os.ReadFile(filepath.Join(hushDir, masterHashFileName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encrypted master password: %w", err)
+	}
+
+	decryptedMasterPassword, err := passutils.DecryptPassword(string(encryptedMasterPassword), legacyKey)
+	if err != nil || decryptedMasterPassword != masterPassword {
+		return nil, fmt.Errorf("incorrect master password")
+	}
+
+	key, err := passutils.GenerateKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate vault key: %w", err)
+	}
+
+	newMeta, err := newVaultMeta(meta.KDF.Params, key, masterPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &vault{dir: hushDir, meta: newMeta, key: key}
+
+	tx := beginTx(hushDir)
+
+	m, err := v.resealEntries(tx, func(name string, data []byte) (*Record, error) {
+		password, err := passutils.DecryptPassword(string(data), legacyKey)
+		if err != nil {
+			return nil, err
+		}
+		return &Record{Password: strings.TrimSpace(password)}, nil
+	})
+	if err != nil {
+		tx.rollback()
+		return nil, err
+	}
+
+	tx.remove(masterHashFileName)
+	if meta.Version == legacyVaultVersion {
+		tx.remove(saltFileName)
+	}
+
+	m.Revision = 1
+	if err := v.commitAs(tx, m, "Upgrade vault format"); err != nil {
+		return nil, fmt.Errorf("failed to upgrade vault: %w", err)
+	}
+
+	return v, nil
+}
+
+// migrate brings an unlocked vault written by an older version of hush up to
+// vaultVersion, rewriting every entry in the current format.
+func (v *vault) migrate() error {
+	meta := *v.meta
+	meta.Version = vaultVersion
+	if meta.ID == "" {
+		id, err := passutils.GenerateSalt()
+		if err != nil {
+			return fmt.Errorf("failed to generate vault id: %w", err)
+		}
+		meta.ID = id
+	}
+
+	migrated := &vault{dir: v.dir, meta: &meta, key: v.key}
+	tx := beginTx(v.dir)
+
+	var m *manifest
+	var err error
+	switch {
+	case v.meta.Version < boundVaultVersion:
+		// Entries are still read with the old metadata so that unbound
+		// entries are accepted one last time.
+		m, err = migrated.resealEntries(tx, v.openEntry)
+	case v.meta.Version < manifestVaultVersion:
+		m, _, err = migrated.scanEntries()
+		if err == nil {
+			err = migrated.stageMeta(tx)
+		}
+	default:
+		// Keep the manifest, and with it the entry history, if it can
+		// be read; loadManifest still checks it against the directory.
+		m, err = migrated.readManifest()
+		if err != nil {
+			m, _, err = migrated.scanEntries()
+		}
+		if err == nil {
+			err = migrated.stageMeta(tx)
+		}
+	}
+	if err == nil {
+		err = migrated.renameEntryFiles(tx, m)
+	}
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+
+	seen, err := lastSeenRevision(meta.ID)
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+	m.Revision = max(m.Revision, seen) + 1
+
+	if err := migrated.commitAs(tx, m, "Upgrade vault format"); err != nil {
+		return fmt.Errorf("failed to migrate vault: %w", err)
+	}
+
+	v.meta = &meta
+	return nil
+}
+
+func (v *vault) stageMeta(tx *vaultTx) error {
+	encodedMeta, err := v.meta.encode()
+	if err != nil {
+		return err
+	}
+
+	return tx.write(vaultFileName, encodedMeta)
+}
+
+// resealEntries stages every entry re-encrypted with v's key and metadata,
+// reading the existing contents with open, and stages the metadata itself.
+// It returns a manifest of the resealed entries.
+func (v *vault) resealEntries(tx *vaultTx, open func(name string, data []byte) (*Record, error)) (*manifest, error) {
+	index, err := v.entryIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &manifest{Entries: map[string]manifestEntry{}}
+
+	for name, file := range index {
+		data, err := readEncryptedPassword(v.dir, file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read password file: %w", err)
+		}
+
+		record, err := open(name, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt password %q: %w", name, err)
+		}
+
+		sealedPassword, err := v.sealEntry(name, record)
+		if err != nil {
+			return nil, err
+		}
+
+		// Legacy files are moved to their encoded names right away;
+		// renameEntryFiles would only see their old contents.
+		newFile := file
+		if !v.meta.EncryptedNames {
+			newFile = entryFileName(name)
+		}
+
+		if err := tx.write(newFile+".hush", sealedPassword); err != nil {
+			return nil, err
+		}
+		if newFile != file {
+			tx.remove(file + ".hush")
+		}
+		m.Entries[name] = manifestEntry{File: newFile, Hash: hashEntry(sealedPassword)}
+	}
+
+	return m, v.stageMeta(tx)
+}
+
+// rewrap wraps the data key under a key derived from masterPassword with a
+// fresh salt and the given parameters. Entries are untouched.
+func (v *vault) rewrap(masterPassword string, params passutils.KDFParams) error {
+	meta, err := newVaultMeta(params, v.key, masterPassword)
+	if err != nil {
+		return err
+	}
+	meta.ID = v.meta.ID
+	meta.EncryptedNames = v.meta.EncryptedNames
+
+	encodedMeta, err := meta.encode()
+	if err != nil {
+		return err
+	}
+
+	tx := beginTx(v.dir)
+	if err := tx.write(vaultFileName, encodedMeta); err != nil {
+		tx.rollback()
+		return err
+	}
+
+	if err := tx.commit(); err != nil {
+		return fmt.Errorf("failed to save vault metadata: %w", err)
+	}
+
+	v.meta = meta
+	v.gitRecord("Update vault key")
+	return nil
+}
+
+func (v *vault) entryKey(saltHex string) ([]byte, error) {
+	salt, err := hex.DecodeString(saltHex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid entry salt: %w", err)
+	}
+
+	return passutils.DeriveSubkey(v.key, salt, entryKeyInfo)
+}
+
+// entryAD binds an entry to its name and to the vault. Records use their
+// own prefix so that a password entry cannot be passed off as a record or
+// the other way around.
+func (v *vault) entryAD(version int, name string) []byte {
+	prefix := "hush entry"
+	if version == entryVersion {
+		prefix = "hush record"
+	}
+	return []byte(prefix + "\x00" + v.meta.ID + "\x00" + name)
+}
+
+func (v *vault) sealEntry(name string, record *Record) ([]byte, error) {
+	plaintext, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode record: %w", err)
+	}
+
+	salt, err := passutils.GenerateSalt()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate entry salt: %w", err)
+	}
+
+	key, err := v.entryKey(salt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive entry key: %w", err)
+	}
+
+	encryptedPassword, err := passutils.EncryptPasswordWithAD(string(plaintext), key, v.entryAD(entryVersion, name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt password: %w", err)
+	}
+
+	return json.Marshal(entryFile{Version: entryVersion, Salt: salt, Data: encryptedPassword})
+}
+
+// openEntry decrypts an entry file. Entries written before records existed
+// are returned as records with only a password.
+func (v *vault) openEntry(name string, data []byte) (*Record, error) {
+	var entry entryFile
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("failed to parse password file: %w", err)
+	}
+
+	switch {
+	case entry.Version == entryVersion:
+	case entry.Version == passwordEntryVersion:
+	case entry.Version == unboundEntryVersion && v.meta.Version < boundVaultVersion:
+	case entry.Version == unboundEntryVersion:
+		// An unbound entry in a vault that has been migrated can only be an
+		// old copy that was put back in place.
+		return nil, ErrEntryTampered
+	default:
+		return nil, fmt.Errorf("unsupported password file version %d", entry.Version)
+	}
+
+	key, err := v.entryKey(entry.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive entry key: %w", err)
+	}
+
+	if entry.Version == unboundEntryVersion {
+		password, err := passutils.DecryptPassword(entry.Data, key)
+		if err != nil {
+			return nil, err
+		}
+		return &Record{Password: strings.TrimSpace(password)}, nil
+	}
+
+	plaintext, err := passutils.DecryptPasswordWithAD(entry.Data, key, v.entryAD(entry.Version, name))
+	if err != nil {
+		return nil, ErrEntryTampered
+	}
+
+	if entry.Version == passwordEntryVersion {
+		return &Record{Password: strings.TrimSpace(plaintext)}, nil
+	}
+
+	var record Record
+	if err := json.Unmarshal([]byte(plaintext), &record); err != nil {
+		return nil, fmt.Errorf("failed to parse record: %w", err)
+	}
+
+	return &record, nil
+}
@@ -0,0 +1,136 @@
+package hushcore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	hushDirEnv = "HUSH_DIR"
+	// DefaultVaultName is the profile name of the vault in HUSH_DIR or
+	// ~/.hush.
+	DefaultVaultName = "default"
+	// Named vaults live next to the default one, in ~/.hush-<name>.
+	vaultDirPrefix = hushDirName + "-"
+)
+
+var validVaultName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]*$`)
+
+// VaultInfo describes a vault found by ListVaults.
+type VaultInfo struct {
+	Name        string
+	Dir         string
+	Initialized bool
+}
+
+// SelectVault makes every following call operate on the given vault, which
+// is either the name of a vault profile or a path to a hush directory.
+func SelectVault(vault string) error {
+	dir, err := ResolveVault(vault)
+	if err != nil {
+		return err
+	}
+
+	getHushDir = func() (string, error) {
+		return dir, nil
+	}
+	return nil
+}
+
+// ResolveVault returns the hush directory for a vault profile name or path.
+// Anything that contains a path separator or starts with "." or "~" is a
+// path.
+func ResolveVault(vault string) (string, error) {
+	if vault == "" || vault == DefaultVaultName {
+		return defaultGetHushDir()
+	}
+
+	if isVaultPath(vault) {
+		return expandHome(vault)
+	}
+
+	if !validVaultName.MatchString(vault) {
+		return "", fmt.Errorf("invalid vault name %q (only alphanumeric, underscore and hyphen are allowed)", vault)
+	}
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+	return filepath.Join(homeDir, vaultDirPrefix+vault), nil
+}
+
+func isVaultPath(vault string) bool {
+	return strings.ContainsRune(vault, '/') ||
+		strings.ContainsRune(vault, filepath.Separator) ||
+		strings.HasPrefix(vault, ".") ||
+		strings.HasPrefix(vault, "~")
+}
+
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return filepath.Abs(path)
+	}
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+	return filepath.Join(homeDir, strings.TrimPrefix(path, "~")), nil
+}
+
+// ListVaults returns the default vault and every named vault profile.
+func ListVaults() ([]VaultInfo, error) {
+	defaultDir, err := defaultGetHushDir()
+	if err != nil {
+		return nil, err
+	}
+	vaults := []VaultInfo{{Name: DefaultVaultName, Dir: defaultDir, Initialized: isInitialized(defaultDir)}}
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get home directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(homeDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list home directory: %w", err)
+	}
+
+	for _, e := range entries {
+		name, found := strings.CutPrefix(e.Name(), vaultDirPrefix)
+		if !found || !e.IsDir() || !validVaultName.MatchString(name) {
+			continue
+		}
+
+		dir := filepath.Join(homeDir, e.Name())
+		if dir == defaultDir {
+			continue
+		}
+		vaults = append(vaults, VaultInfo{Name: name, Dir: dir, Initialized: isInitialized(dir)})
+	}
+
+	slices.SortFunc(vaults[1:], func(a, b VaultInfo) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return vaults, nil
+}
+
+// CurrentVaultDir returns the hush directory that calls operate on.
+func CurrentVaultDir() (string, error) {
+	return getHushDir()
+}
+
+func isInitialized(dir string) bool {
+	for _, fileName := range []string{vaultFileName, masterHashFileName} {
+		if _, err := os.Stat(filepath.Join(dir, fileName)); err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,299 @@
+package importer
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/nochzato/hush/internal/hushcore"
+)
+
+// Columns a CSV mapping can fill. Any other target becomes a custom field.
+const (
+	ColumnName     = "name"
+	ColumnFolder   = "folder"
+	ColumnURL      = "url"
+	ColumnUsername = "username"
+	ColumnPassword = "password"
+	ColumnNotes    = "notes"
+	ColumnTags     = "tags"
+	ColumnOTP      = "otp"
+	// ColumnFields holds custom fields as "key: value" lines, the way
+	// Bitwarden exports them.
+	ColumnFields = "fields"
+)
+
+func isBuiltinColumn(column string) bool {
+	switch column {
+	case ColumnName, ColumnFolder, ColumnURL, ColumnUsername, ColumnPassword,
+		ColumnNotes, ColumnTags, ColumnOTP, ColumnFields:
+		return true
+	}
+	return false
+}
+
+// csvPreset maps hush columns to the headers of one password manager's CSV
+// export. Optional headers are not needed to detect the format.
+type csvPreset struct {
+	columns  map[string]string
+	optional []string
+}
+
+var csvPresets = map[string]csvPreset{
+	"chrome": {
+		columns: map[string]string{
+			ColumnName:     "name",
+			ColumnURL:      "url",
+			ColumnUsername: "username",
+			ColumnPassword: "password",
+			ColumnNotes:    "note",
+		},
+		optional: []string{ColumnNotes},
+	},
+	"firefox": {
+		columns: map[string]string{
+			ColumnURL:      "url",
+			ColumnUsername: "username",
+			ColumnPassword: "password",
+		},
+	},
+	"bitwarden": {
+		columns: map[string]string{
+			ColumnFolder:   "folder",
+			ColumnName:     "name",
+			ColumnNotes:    "notes",
+			ColumnFields:   "fields",
+			ColumnURL:      "login_uri",
+			ColumnUsername: "login_username",
+			ColumnPassword: "login_password",
+			ColumnOTP:      "login_totp",
+		},
+	},
+	"hush": {
+		columns: map[string]string{
+			ColumnName:     "name",
+			ColumnURL:      "url",
+			ColumnUsername: "username",
+			ColumnPassword: "password",
+			ColumnNotes:    "notes",
+			ColumnTags:     "tags",
+			ColumnOTP:      "otp",
+			ColumnFields:   "fields",
+		},
+	},
+	"1password": {
+		columns: map[string]string{
+			ColumnName:     "title",
+			ColumnURL:      "url",
+			ColumnUsername: "username",
+			ColumnPassword: "password",
+			ColumnOTP:      "otpauth",
+			ColumnTags:     "tags",
+			ColumnNotes:    "notes",
+		},
+		optional: []string{ColumnOTP, ColumnTags},
+	},
+}
+
+// CSVPresets returns the names of the built-in CSV column mappings.
+func CSVPresets() []string {
+	return slices.Sorted(maps.Keys(csvPresets))
+}
+
+// ParseColumnMap parses "column=header" mappings, as given to --map.
+func ParseColumnMap(mappings []string) (map[string]string, error) {
+	columns := map[string]string{}
+	for _, mapping := range mappings {
+		column, header, ok := strings.Cut(mapping, "=")
+		column, header = strings.TrimSpace(column), strings.TrimSpace(header)
+		if !ok || column == "" || header == "" {
+			return nil, fmt.Errorf("invalid column mapping %q (expected column=header)", mapping)
+		}
+		if isBuiltinColumn(strings.ToLower(column)) {
+			column = strings.ToLower(column)
+		}
+		columns[column] = header
+	}
+	return columns, nil
+}
+
+// ReadCSV reads a CSV export with a header row. preset picks one of
+// CSVPresets; when it is empty and columns is empty, the preset is detected
+// from the header. columns maps hush columns to headers, on top of the
+// preset.
+func ReadCSV(r io.Reader, preset string, columns map[string]string) (*Result, error) {
+	// Spreadsheets tend to save CSV files with a byte order mark.
+	br := bufio.NewReader(r)
+	if bom, _ := br.Peek(3); string(bom) == "\ufeff" {
+		_, _ = br.Discard(3)
+	}
+
+	reader := csv.NewReader(br)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("CSV file is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+
+	headerIndex := map[string]int{}
+	for i, h := range header {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if _, ok := headerIndex[h]; !ok {
+			headerIndex[h] = i
+		}
+	}
+
+	result := &Result{Format: preset}
+	mapping := map[string]string{}
+	switch {
+	case preset != "":
+		p, ok := csvPresets[preset]
+		if !ok {
+			return nil, fmt.Errorf("unknown CSV preset %q (expected one of %s)", preset, strings.Join(CSVPresets(), ", "))
+		}
+		maps.Copy(mapping, p.columns)
+	case len(columns) == 0:
+		result.Format = detectCSVPreset(headerIndex)
+		if result.Format == "" {
+			return nil, fmt.Errorf("unrecognized CSV header; pick a --preset or map the columns with --map")
+		}
+		maps.Copy(mapping, csvPresets[result.Format].columns)
+	default:
+		result.Format = "csv"
+	}
+	maps.Copy(mapping, columns)
+
+	index := map[string]int{}
+	for column, h := range mapping {
+		i, ok := headerIndex[strings.ToLower(h)]
+		if ok {
+			index[column] = i
+			continue
+		}
+		if _, mapped := columns[column]; mapped {
+			return nil, fmt.Errorf("CSV file has no %q column", h)
+		}
+	}
+	if _, ok := index[ColumnPassword]; !ok {
+		return nil, fmt.Errorf("no password column; map one with --map password=<header>")
+	}
+	_, hasName := index[ColumnName]
+	_, hasURL := index[ColumnURL]
+	if !hasName && !hasURL {
+		return nil, fmt.Errorf("no name or url column; map one with --map name=<header>")
+	}
+
+	for {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CSV file: %w", err)
+		}
+
+		line, _ := reader.FieldPos(0)
+		source := fmt.Sprintf("line %d", line)
+		if len(row) != len(header) {
+			result.reject(source, "", fmt.Sprintf("has %d columns, the header has %d", len(row), len(header)))
+			continue
+		}
+
+		entry, err := csvEntry(row, index)
+		if err != nil {
+			result.reject(source, entry.Name, err.Error())
+			continue
+		}
+		entry.Source = source
+		result.Entries = append(result.Entries, entry)
+	}
+
+	return result, nil
+}
+
+// detectCSVPreset returns the preset whose headers all appear in the header
+// row, preferring the one that uses the most of them.
+func detectCSVPreset(headerIndex map[string]int) string {
+	best, bestCount := "", 0
+	for _, name := range CSVPresets() {
+		p := csvPresets[name]
+		count := 0
+		for column, h := range p.columns {
+			if _, ok := headerIndex[h]; ok {
+				count++
+			} else if !slices.Contains(p.optional, column) {
+				count = -1
+				break
+			}
+		}
+		if count > bestCount {
+			best, bestCount = name, count
+		}
+	}
+	return best
+}
+
+func csvEntry(row []string, index map[string]int) (hushcore.ImportEntry, error) {
+	get := func(column string) string {
+		if i, ok := index[column]; ok {
+			return row[i]
+		}
+		return ""
+	}
+
+	var entry hushcore.ImportEntry
+	entry.Name = strings.TrimSpace(get(ColumnName))
+	urls := strings.FieldsFunc(get(ColumnURL), func(r rune) bool { return r == ',' || r == '\n' })
+	for i := range urls {
+		urls[i] = strings.TrimSpace(urls[i])
+	}
+	urls = slices.DeleteFunc(urls, func(u string) bool { return u == "" })
+	if len(urls) == 0 {
+		urls = nil
+	}
+
+	if entry.Name == "" && len(urls) > 0 {
+		entry.Name = nameFromURL(urls[0])
+	}
+	if entry.Name == "" {
+		return entry, fmt.Errorf("no name or URL")
+	}
+	if folder := strings.Trim(get(ColumnFolder), "/ "); folder != "" {
+		entry.Name = folder + "/" + entry.Name
+	}
+
+	record := &entry.Record
+	record.Password = get(ColumnPassword)
+	record.Username = strings.TrimSpace(get(ColumnUsername))
+	record.URLs = urls
+	record.Notes = get(ColumnNotes)
+	record.OTP = normalizeOTP(get(ColumnOTP))
+	addTags(record, strings.FieldsFunc(get(ColumnTags), func(r rune) bool { return r == ',' || r == ';' }))
+
+	for _, line := range strings.Split(get(ColumnFields), "\n") {
+		key, value, ok := strings.Cut(line, ": ")
+		if key = strings.TrimSpace(key); ok && key != "" {
+			record.Fields = append(record.Fields, hushcore.Field{Key: key, Value: value})
+		}
+	}
+
+	for _, column := range slices.Sorted(maps.Keys(index)) {
+		if isBuiltinColumn(column) {
+			continue
+		}
+		if value := get(column); value != "" {
+			record.Fields = append(record.Fields, hushcore.Field{Key: column, Value: value})
+		}
+	}
+
+	return entry, nil
+}
@@ -0,0 +1,85 @@
+// Package importer reads the exports of other password managers into
+// entries for hushcore.ImportEntries.
+package importer
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/nochzato/hush/internal/hushcore"
+	"github.com/nochzato/hush/internal/passutils"
+)
+
+// Result is what was read from an export. Entries are not checked against
+// the vault yet; Rejected lists what could not even be read.
+type Result struct {
+	// Format names the detected or requested format, such as "bitwarden".
+	Format   string
+	Entries  []hushcore.ImportEntry
+	Rejected []hushcore.RejectedEntry
+}
+
+func (r *Result) reject(source, name, reason string) {
+	r.Rejected = append(r.Rejected, hushcore.RejectedEntry{Source: source, Name: name, Reason: reason})
+}
+
+// nameFromURL returns the host of rawURL, for exports that do not name
+// their entries.
+func nameFromURL(rawURL string) string {
+	rawURL = strings.TrimSpace(rawURL)
+	if rawURL == "" {
+		return ""
+	}
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "https://" + rawURL
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// tagFromLabel turns a label from another password manager, which may
+// contain spaces or query operators, into a valid hush tag.
+func tagFromLabel(label string) string {
+	label = strings.Join(strings.Fields(label), "-")
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune("()!&|", r) {
+			return -1
+		}
+		return r
+	}, label)
+}
+
+// addTags adds labels as tags, skipping ones the record already has and
+// ones that cannot be made into a tag.
+func addTags(record *hushcore.Record, labels []string) {
+	for _, label := range labels {
+		tag := tagFromLabel(label)
+		switch strings.ToLower(tag) {
+		case "", "and", "or", "not":
+			continue
+		}
+		if !slices.ContainsFunc(record.Tags, func(t string) bool { return strings.EqualFold(t, tag) }) {
+			record.Tags = append(record.Tags, tag)
+		}
+	}
+}
+
+// normalizeOTP stores OTP secrets as otpauth:// URIs like hush does. A
+// secret that does not parse is kept, so that the entry is rejected with
+// the reason.
+func normalizeOTP(secret string) string {
+	secret = strings.TrimSpace(secret)
+	if secret == "" {
+		return ""
+	}
+	key, err := passutils.ParseOTP(secret)
+	if err != nil {
+		return secret
+	}
+	return key.URI()
+}
@@ -0,0 +1,329 @@
+package importer
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nochzato/hush/internal/hushcore"
+	"github.com/nochzato/hush/internal/kdbx"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadCSV(t *testing.T) {
+	tc := []struct {
+		name       string
+		csv        string
+		preset     string
+		columns    map[string]string
+		wantFormat string
+		want       []hushcore.ImportEntry
+		wantReject []hushcore.RejectedEntry
+		wantErr    bool
+	}{
+		{
+			name: "chrome",
+			csv: "name,url,username,password,note\n" +
+				"example.com,https://example.com/login,alice,Secret123!,first\n" +
+				"broken,https://broken.example\n",
+			wantFormat: "chrome",
+			want: []hushcore.ImportEntry{{
+				Source: "line 2",
+				Name:   "example.com",
+				Record: hushcore.Record{Password: "Secret123!", Username: "alice", URLs: []string{"https://example.com/login"}, Notes: "first"},
+			}},
+			wantReject: []hushcore.RejectedEntry{{Source: "line 3", Reason: "has 2 columns, the header has 5"}},
+		},
+		{
+			name: "firefox",
+			csv: "\ufeff\"url\",\"username\",\"password\",\"httpRealm\",\"formActionOrigin\",\"guid\",\"timeCreated\",\"timeLastUsed\",\"timePasswordChanged\"\n" +
+				"\"https://accounts.example.com\",\"bob\",\"Hunter22!\",,\"https://accounts.example.com\",\"{1}\",\"1\",\"1\",\"1\"\n" +
+				"\"\",\"carol\",\"Hunter22!\",,,\"{2}\",\"1\",\"1\",\"1\"\n",
+			wantFormat: "firefox",
+			want: []hushcore.ImportEntry{{
+				Source: "line 2",
+				Name:   "accounts.example.com",
+				Record: hushcore.Record{Password: "Hunter22!", Username: "bob", URLs: []string{"https://accounts.example.com"}},
+			}},
+			wantReject: []hushcore.RejectedEntry{{Source: "line 3", Reason: "no name or URL"}},
+		},
+		{
+			name: "bitwarden",
+			csv: "folder,favorite,type,name,notes,fields,reprompt,login_uri,login_username,login_password,login_totp\n" +
+				"Work,,login,VPN,,\"pin: 1234\nregion: eu\",0,\"https://vpn.example.com,https://vpn2.example.com\",dave,Tunnel42!,GEZDGNBVGY3TQOJQ\n",
+			wantFormat: "bitwarden",
+			want: []hushcore.ImportEntry{{
+				Source: "line 2",
+				Name:   "Work/VPN",
+				Record: hushcore.Record{
+					Password: "Tunnel42!",
+					Username: "dave",
+					URLs:     []string{"https://vpn.example.com", "https://vpn2.example.com"},
+					Fields:   []hushcore.Field{{Key: "pin", Value: "1234"}, {Key: "region", Value: "eu"}},
+					OTP:      "otpauth://totp/?algorithm=SHA1&digits=6&period=30&secret=GEZDGNBVGY3TQOJQ",
+				},
+			}},
+		},
+		{
+			name: "1password",
+			csv: "Title,Url,Username,Password,OTPAuth,Favorite,Archived,Tags,Notes\n" +
+				"Bank,https://bank.example,erin,Money$$99,,false,false,\"finance,Home Office\",PIN in safe\n",
+			wantFormat: "1password",
+			want: []hushcore.ImportEntry{{
+				Source: "line 2",
+				Name:   "Bank",
+				Record: hushcore.Record{
+					Password: "Money$$99",
+					Username: "erin",
+					URLs:     []string{"https://bank.example"},
+					Notes:    "PIN in safe",
+					Tags:     []string{"finance", "Home-Office"},
+				},
+			}},
+		},
+		{
+			name:       "custom map",
+			csv:        "Site,Login,Secret,PIN\nmail,frank,Letters7!,4321\n",
+			columns:    map[string]string{"name": "Site", "username": "Login", "password": "Secret", "Pin": "pin"},
+			wantFormat: "csv",
+			want: []hushcore.ImportEntry{{
+				Source: "line 2",
+				Name:   "mail",
+				Record: hushcore.Record{Password: "Letters7!", Username: "frank", Fields: []hushcore.Field{{Key: "Pin", Value: "4321"}}},
+			}},
+		},
+		{
+			name:    "unknown header",
+			csv:     "Site,Login,Secret\nmail,frank,Letters7!\n",
+			wantErr: true,
+		},
+		{
+			name:    "unknown preset",
+			csv:     "name,url,username,password\n",
+			preset:  "lastpass",
+			wantErr: true,
+		},
+		{
+			name:    "missing mapped column",
+			csv:     "Site,Secret\nmail,Letters7!\n",
+			columns: map[string]string{"name": "Site", "password": "Password"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := ReadCSV(strings.NewReader(tt.csv), tt.preset, tt.columns)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantFormat, result.Format)
+			require.Equal(t, tt.want, result.Entries)
+			require.Equal(t, tt.wantReject, result.Rejected)
+		})
+	}
+}
+
+func TestParseColumnMap(t *testing.T) {
+	columns, err := ParseColumnMap([]string{"Name=Title", "password = Secret", "PIN=pin code"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"name": "Title", "password": "Secret", "PIN": "pin code"}, columns)
+
+	_, err = ParseColumnMap([]string{"name"})
+	require.Error(t, err)
+	_, err = ParseColumnMap([]string{"name="})
+	require.Error(t, err)
+}
+
+func TestReadKDBX(t *testing.T) {
+	field := func(key, value string) kdbx.Field { return kdbx.Field{Key: key, Value: value} }
+	db := &kdbx.Database{
+		Name: "Shared",
+		Root: kdbx.Group{
+			Name: "Root",
+			Entries: []kdbx.Entry{
+				{
+					Fields: []kdbx.Field{
+						field(kdbx.FieldTitle, "mail"),
+						field(kdbx.FieldUserName, "alice"),
+						{Key: kdbx.FieldPassword, Value: "Secret123!", Protected: true},
+						field(kdbx.FieldURL, "https://mail.example.com"),
+						field("KP2A_URL_1", "https://webmail.example.com"),
+						field(kdbx.FieldNotes, "first"),
+						field("otp", "GEZDGNBVGY3TQOJQ"),
+						{Key: "PIN", Value: "1234", Protected: true},
+						field("Empty", ""),
+					},
+					Tags: []string{"work", "Home Office"},
+				},
+				{Fields: []kdbx.Field{field(kdbx.FieldNotes, "nameless")}},
+			},
+			Groups: []kdbx.Group{{
+				Name: "Servers",
+				Groups: []kdbx.Group{{
+					Name: "Prod",
+					Entries: []kdbx.Entry{{
+						Fields: []kdbx.Field{
+							field(kdbx.FieldURL, "https://db.example.com"),
+							{Key: kdbx.FieldPassword, Value: "Pr0d!Pass", Protected: true},
+							field("TOTP Seed", "GEZDGNBVGY3TQOJQ"),
+							field("TOTP Settings", "60;8"),
+						},
+					}},
+				}},
+			}},
+		},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, kdbx.Write(&buf, db, "team password"))
+	data := buf.Bytes()
+
+	result, err := ReadKDBX(bytes.NewReader(data), "team password")
+	require.NoError(t, err)
+	require.Equal(t, "kdbx", result.Format)
+	require.Equal(t, []hushcore.ImportEntry{
+		{
+			Source: "entry 1",
+			Name:   "mail",
+			Record: hushcore.Record{
+				Password: "Secret123!",
+				Username: "alice",
+				URLs:     []string{"https://mail.example.com", "https://webmail.example.com"},
+				Notes:    "first",
+				Fields:   []hushcore.Field{{Key: "PIN", Value: "1234", Sensitive: true}},
+				Tags:     []string{"work", "Home-Office"},
+				OTP:      "otpauth://totp/?algorithm=SHA1&digits=6&period=30&secret=GEZDGNBVGY3TQOJQ",
+			},
+		},
+		{
+			Source: "entry 3",
+			Name:   "Servers/Prod/db.example.com",
+			Record: hushcore.Record{
+				Password: "Pr0d!Pass",
+				URLs:     []string{"https://db.example.com"},
+				OTP:      "otpauth://totp/?algorithm=SHA1&digits=8&period=60&secret=GEZDGNBVGY3TQOJQ",
+			},
+		},
+	}, result.Entries)
+	require.Equal(t, []hushcore.RejectedEntry{{Source: "entry 2", Reason: "no title or URL"}}, result.Rejected)
+
+	_, err = ReadKDBX(bytes.NewReader(data), "wrong password")
+	require.ErrorIs(t, err, kdbx.ErrInvalidCredentials)
+}
+
+func TestReadKDBXFixture(t *testing.T) {
+	// Written by testdata/make_kdbx_fixture.py in the layout of KeePassXC
+	// 2.7, with AES-256 and AES-KDF, rather than by hush's own writer.
+	data, err := os.ReadFile(filepath.Join("testdata", "keepassxc-layout.kdbx"))
+	require.NoError(t, err)
+
+	result, err := ReadKDBX(bytes.NewReader(data), "fixture password")
+	require.NoError(t, err)
+	require.Equal(t, []hushcore.ImportEntry{
+		{
+			Source: "entry 1",
+			Name:   "Mail",
+			Record: hushcore.Record{
+				Password: "Mail!Secret42",
+				Username: "alice",
+				URLs:     []string{"https://mail.example.com"},
+				Notes:    "Personal mail\nsecond line",
+				Fields: []hushcore.Field{
+					{Key: "Recovery email", Value: "alice@backup.example.com"},
+					{Key: "PIN", Value: "4921", Sensitive: true},
+				},
+				Tags: []string{"personal", "email"},
+				OTP:  "otpauth://totp/Example:alice?algorithm=SHA1&digits=6&issuer=Example&period=30&secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ",
+			},
+		},
+		{
+			Source: "entry 2",
+			Name:   "Work/VPN",
+			Record: hushcore.Record{
+				Password: "Vpn<Pass>&99",
+				Username: "bob",
+				Notes:    "R&D <lab> access",
+				Tags:     []string{"work"},
+			},
+		},
+		{
+			Source: "entry 3",
+			Name:   "Work/Servers/db",
+			Record: hushcore.Record{
+				Password: "Pr0d!Database",
+				Username: "postgres",
+				URLs:     []string{"https://db.example.com"},
+				OTP:      "otpauth://totp/db?algorithm=SHA256&digits=8&period=60&secret=JBSWY3DPEHPK3PXP",
+			},
+		},
+	}, result.Entries)
+	require.Empty(t, result.Rejected)
+
+	_, err = ReadKDBX(bytes.NewReader(data), "wrong password")
+	require.ErrorIs(t, err, kdbx.ErrInvalidCredentials)
+}
+
+func TestReadPass(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		".gpg-id":             "alice@example.com\n",
+		".git/objects/x.gpg":  "ignored\n",
+		"email.gpg":           "Mail#Secret1\n",
+		"work/vpn.gpg":        "Tunnel42!\r\nlogin: dave\r\nurl: vpn.example.com\r\n",
+		"work/servers/db.gpg": "broken",
+		"work/servers/readme": "not an entry",
+		"personal/bank.gpg":   "Money$$99\n\nPIN in safe\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	}
+
+	decrypt := func(path string) ([]byte, error) {
+		if filepath.Base(path) == "db.gpg" {
+			return nil, errors.New("no secret key")
+		}
+		return os.ReadFile(path)
+	}
+
+	result, err := ReadPass(dir, decrypt)
+	require.NoError(t, err)
+	require.Equal(t, "pass", result.Format)
+	require.Equal(t, []hushcore.ImportEntry{
+		{Source: "email.gpg", Name: "email", Record: hushcore.Record{Password: "Mail#Secret1"}},
+		{Source: "personal/bank.gpg", Name: "personal/bank", Record: hushcore.Record{Password: "Money$$99", Notes: "PIN in safe"}},
+		{Source: "work/vpn.gpg", Name: "work/vpn", Record: hushcore.Record{Password: "Tunnel42!", Notes: "login: dave\nurl: vpn.example.com"}},
+	}, result.Entries)
+	require.Equal(t, []hushcore.RejectedEntry{
+		{Source: "work/servers/db.gpg", Name: "work/servers/db", Reason: "could not decrypt: no secret key"},
+	}, result.Rejected)
+
+	_, err = ReadPass(filepath.Join(dir, "missing"), decrypt)
+	require.Error(t, err)
+}
+
+func TestCommandDecrypter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "entry.gpg")
+	require.NoError(t, os.WriteFile(path, []byte("Secret123!\n"), 0600))
+
+	decrypt, err := CommandDecrypter("cat --")
+	require.NoError(t, err)
+	data, err := decrypt(path)
+	require.NoError(t, err)
+	require.Equal(t, "Secret123!\n", string(data))
+
+	decrypt, err = CommandDecrypter("false")
+	require.NoError(t, err)
+	_, err = decrypt(path)
+	require.Error(t, err)
+
+	_, err = CommandDecrypter("  ")
+	require.Error(t, err)
+}
@@ -0,0 +1,129 @@
+package importer
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/nochzato/hush/internal/hushcore"
+	"github.com/nochzato/hush/internal/kdbx"
+	"github.com/nochzato/hush/internal/passutils"
+)
+
+// Fields KeePass plugins and KeePassXC store TOTP secrets and extra URLs in.
+const (
+	kdbxFieldOTP          = "otp"
+	kdbxFieldTOTPSeed     = "TOTP Seed"
+	kdbxFieldTOTPSettings = "TOTP Settings"
+	kdbxFieldURLPrefix    = "KP2A_URL"
+)
+
+// ReadKDBX reads a KeePass KDBX 4 database. Groups below the root become
+// folders, and string fields other than the standard ones become custom
+// fields, sensitive when KeePass protects them.
+func ReadKDBX(r io.Reader, password string) (*Result, error) {
+	db, err := kdbx.Read(r, password)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{Format: "kdbx"}
+	count := 0
+	var walk func(g kdbx.Group, folder string)
+	walk = func(g kdbx.Group, folder string) {
+		for _, e := range g.Entries {
+			count++
+			source := fmt.Sprintf("entry %d", count)
+
+			entry, err := kdbxEntry(e, folder)
+			if err != nil {
+				result.reject(source, entry.Name, err.Error())
+				continue
+			}
+			entry.Source = source
+			result.Entries = append(result.Entries, entry)
+		}
+		for _, sub := range g.Groups {
+			walk(sub, joinFolder(folder, sub.Name))
+		}
+	}
+	walk(db.Root, "")
+
+	return result, nil
+}
+
+func joinFolder(folder, name string) string {
+	name = strings.Trim(name, "/ ")
+	switch {
+	case name == "":
+		return folder
+	case folder == "":
+		return name
+	}
+	return folder + "/" + name
+}
+
+func kdbxEntry(e kdbx.Entry, folder string) (hushcore.ImportEntry, error) {
+	var entry hushcore.ImportEntry
+	record := &entry.Record
+	var totpSeed, totpSettings string
+
+	for _, f := range e.Fields {
+		switch {
+		case f.Key == kdbx.FieldTitle:
+			entry.Name = strings.TrimSpace(f.Value)
+		case f.Key == kdbx.FieldUserName:
+			record.Username = strings.TrimSpace(f.Value)
+		case f.Key == kdbx.FieldPassword:
+			record.Password = f.Value
+		case f.Key == kdbx.FieldNotes:
+			record.Notes = f.Value
+		case f.Key == kdbx.FieldURL, strings.HasPrefix(f.Key, kdbxFieldURLPrefix):
+			if u := strings.TrimSpace(f.Value); u != "" {
+				record.URLs = append(record.URLs, u)
+			}
+		case f.Key == kdbxFieldOTP:
+			record.OTP = normalizeOTP(f.Value)
+		case f.Key == kdbxFieldTOTPSeed:
+			totpSeed = f.Value
+		case f.Key == kdbxFieldTOTPSettings:
+			totpSettings = f.Value
+		case f.Value != "":
+			record.Fields = append(record.Fields, hushcore.Field{Key: f.Key, Value: f.Value, Sensitive: f.Protected})
+		}
+	}
+
+	if record.OTP == "" && totpSeed != "" {
+		record.OTP = legacyTOTP(totpSeed, totpSettings)
+	}
+	addTags(record, e.Tags)
+
+	if entry.Name == "" && len(record.URLs) > 0 {
+		entry.Name = nameFromURL(record.URLs[0])
+	}
+	if entry.Name == "" {
+		return entry, fmt.Errorf("no title or URL")
+	}
+	entry.Name = joinFolder(folder, entry.Name)
+
+	return entry, nil
+}
+
+// legacyTOTP converts the "TOTP Seed" and "TOTP Settings" fields of older
+// KeePassXC versions, where the settings are "period;digits".
+func legacyTOTP(seed, settings string) string {
+	key, err := passutils.ParseOTP(seed)
+	if err != nil {
+		return seed
+	}
+
+	period, digits, _ := strings.Cut(settings, ";")
+	if n, err := strconv.Atoi(strings.TrimSpace(period)); err == nil {
+		key.Period = n
+	}
+	if n, err := strconv.Atoi(strings.TrimSpace(digits)); err == nil {
+		key.Digits = n
+	}
+	return key.URI()
+}
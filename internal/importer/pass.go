@@ -0,0 +1,107 @@
+package importer
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/nochzato/hush/internal/hushcore"
+)
+
+// DefaultGPGCommand decrypts a pass file to standard output. The file is
+// added as the last argument.
+const DefaultGPGCommand = "gpg --quiet --batch --decrypt"
+
+// Decrypter returns the decrypted content of a file.
+type Decrypter func(path string) ([]byte, error)
+
+// CommandDecrypter runs command, split on spaces, with the file as its last
+// argument and returns what it writes to standard output. Standard error is
+// the user's, so that gpg's complaints are seen; gpg asks for passphrases
+// through its agent, not on standard input, which is left to hush.
+func CommandDecrypter(command string) (Decrypter, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty decryption command")
+	}
+
+	return func(path string) ([]byte, error) {
+		var stdout bytes.Buffer
+		cmd := exec.Command(args[0], append(args[1:], path)...)
+		cmd.Stdout = &stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return nil, err
+		}
+		return stdout.Bytes(), nil
+	}, nil
+}
+
+// ReadPass reads a pass (password-store) directory. Every .gpg file is an
+// entry named after its path in the store; the first line of the file is
+// the password and the rest are kept as notes. Files that cannot be
+// decrypted are rejected.
+func ReadPass(dir string, decrypt Decrypter) (*Result, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open password store: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+
+	result := &Result{Format: "pass"}
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Skip the .git directory and .gpg-id files of the store.
+		if strings.HasPrefix(d.Name(), ".") && path != dir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), ".gpg") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		source := filepath.ToSlash(rel)
+		name := strings.TrimSuffix(source, ".gpg")
+
+		data, err := decrypt(path)
+		if err != nil {
+			result.reject(source, name, fmt.Sprintf("could not decrypt: %v", err))
+			return nil
+		}
+		result.Entries = append(result.Entries, passEntry(source, name, data))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read password store: %w", err)
+	}
+
+	return result, nil
+}
+
+func passEntry(source, name string, data []byte) hushcore.ImportEntry {
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	password, notes, _ := strings.Cut(text, "\n")
+
+	return hushcore.ImportEntry{
+		Source: source,
+		Name:   name,
+		Record: hushcore.Record{
+			Password: password,
+			Notes:    strings.Trim(notes, "\n"),
+		},
+	}
+}
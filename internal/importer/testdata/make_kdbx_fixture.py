@@ -0,0 +1,314 @@
+#!/usr/bin/env python3
+"""Builds keepassxc-layout.kdbx, the KeePass fixture of TestReadKDBXFixture.
+
+The database is not saved by KeePassXC itself. It is written from the KDBX 4
+specification by this script, with OpenSSL for the ciphers, so that the
+reader is checked against an implementation that shares no code with it.
+The XML follows what KeePassXC 2.7 writes: its Meta block, recycle bin,
+entry history, "otp" attribute, semicolon-separated tags and custom fields,
+and protected values in document order, history included.
+
+The outer cipher is AES-256 and the KDF is AES-KDF, both KeePassXC options,
+because neither Python nor this OpenSSL offers Argon2. The rounds are kept
+low so that the script and the test run fast.
+
+Password: "fixture password". Run from this directory:
+
+    python3 make_kdbx_fixture.py
+"""
+
+import base64
+import gzip
+import hashlib
+import hmac
+import struct
+import subprocess
+from datetime import datetime, timezone
+from xml.sax.saxutils import escape
+
+PASSWORD = "fixture password"
+OUTPUT = "keepassxc-layout.kdbx"
+AES_KDF_ROUNDS = 64
+
+CIPHER_AES256 = bytes.fromhex("31c1f2e6bf714350be5805216afc5aff")
+KDF_AES = bytes.fromhex("c9d9f39a628a4460bf740d08c18a4fea")
+
+
+def fixed(label, size):
+    """Deterministic "random" bytes, so the fixture is reproducible."""
+    out = b""
+    counter = 0
+    while len(out) < size:
+        out += hashlib.sha256(f"{label}/{counter}".encode()).digest()
+        counter += 1
+    return out[:size]
+
+
+def openssl(args, data):
+    return subprocess.run(["openssl", *args], input=data, capture_output=True, check=True).stdout
+
+
+def aes_ecb(key, block):
+    return openssl(["enc", "-aes-256-ecb", "-nopad", "-K", key.hex()], block)
+
+
+def aes_cbc(key, iv, data):
+    return openssl(["enc", "-aes-256-cbc", "-K", key.hex(), "-iv", iv.hex()], data)
+
+
+def chacha20(key, nonce, data):
+    # OpenSSL takes a 32-bit block counter followed by a 96-bit nonce.
+    iv = b"\x00\x00\x00\x00" + nonce
+    return openssl(["enc", "-chacha20", "-K", key.hex(), "-iv", iv.hex()], data)
+
+
+def variant_dict(items):
+    out = struct.pack("<H", 0x0100)
+    for kind, key, value in items:
+        out += bytes([kind]) + struct.pack("<i", len(key)) + key.encode()
+        out += struct.pack("<i", len(value)) + value
+    return out + b"\x00"
+
+
+def kdbx_time(year, month, day, hour=0, minute=0):
+    dt = datetime(year, month, day, hour, minute, tzinfo=timezone.utc)
+    seconds = int((dt - datetime(1, 1, 1, tzinfo=timezone.utc)).total_seconds())
+    return base64.b64encode(struct.pack("<q", seconds)).decode()
+
+
+def uuid(label):
+    return base64.b64encode(fixed("uuid/" + label, 16)).decode()
+
+
+class Protector:
+    """Encrypts protected values with the inner ChaCha20 stream, in document
+    order, as KeePassXC does while it writes the XML."""
+
+    def __init__(self, inner_key):
+        digest = hashlib.sha512(inner_key).digest()
+        self.key, self.nonce = digest[:32], digest[32:44]
+        self.offset = 0
+
+    def __call__(self, value):
+        data = value.encode()
+        stream = chacha20(self.key, self.nonce, bytes(self.offset + len(data)))
+        self.offset += len(data)
+        cipher = bytes(a ^ b for a, b in zip(data, stream[-len(data):])) if data else b""
+        return base64.b64encode(cipher).decode()
+
+
+def times(modified, expires=False):
+    return f"""<Times>
+\t\t\t\t\t<LastModificationTime>{modified}</LastModificationTime>
+\t\t\t\t\t<CreationTime>{kdbx_time(2024, 1, 10, 9)}</CreationTime>
+\t\t\t\t\t<LastAccessTime>{modified}</LastAccessTime>
+\t\t\t\t\t<ExpiryTime>{kdbx_time(2024, 1, 10, 9)}</ExpiryTime>
+\t\t\t\t\t<Expires>{"True" if expires else "False"}</Expires>
+\t\t\t\t\t<UsageCount>0</UsageCount>
+\t\t\t\t\t<LocationChanged>{kdbx_time(2024, 1, 10, 9)}</LocationChanged>
+\t\t\t\t</Times>"""
+
+
+def string(protect, key, value, protected=False):
+    if protected:
+        return f'<String><Key>{escape(key)}</Key><Value Protected="True">{protect(value)}</Value></String>'
+    if value == "":
+        return f"<String><Key>{escape(key)}</Key><Value/></String>"
+    return f"<String><Key>{escape(key)}</Key><Value>{escape(value)}</Value></String>"
+
+
+def entry(protect, label, fields, tags="", history=None, modified=None):
+    modified = modified or kdbx_time(2024, 3, 1, 12, 30)
+    strings = "\n\t\t\t\t".join(string(protect, *f) for f in fields)
+    # History follows the fields in the document, so its protected values
+    # must come after theirs in the stream.
+    history = history() if history else ""
+    return f"""<Entry>
+\t\t\t\t<UUID>{uuid(label)}</UUID>
+\t\t\t\t<IconID>0</IconID>
+\t\t\t\t<ForegroundColor/>
+\t\t\t\t<BackgroundColor/>
+\t\t\t\t<OverrideURL/>
+\t\t\t\t<Tags>{tags}</Tags>
+\t\t\t\t{times(modified)}
+\t\t\t\t{strings}
+\t\t\t\t<AutoType>
+\t\t\t\t\t<Enabled>True</Enabled>
+\t\t\t\t\t<DataTransferObfuscation>0</DataTransferObfuscation>
+\t\t\t\t\t<DefaultSequence/>
+\t\t\t\t</AutoType>
+\t\t\t\t<History>{history}</History>
+\t\t\t</Entry>"""
+
+
+def group(label, name, body, icon=48):
+    return f"""<Group>
+\t\t\t<UUID>{uuid(label)}</UUID>
+\t\t\t<Name>{name}</Name>
+\t\t\t<Notes/>
+\t\t\t<IconID>{icon}</IconID>
+\t\t\t{times(kdbx_time(2024, 1, 10, 9))}
+\t\t\t<IsExpanded>True</IsExpanded>
+\t\t\t<DefaultAutoTypeSequence/>
+\t\t\t<EnableAutoType>null</EnableAutoType>
+\t\t\t<EnableSearching>null</EnableSearching>
+\t\t\t<LastTopVisibleEntry>AAAAAAAAAAAAAAAAAAAAAA==</LastTopVisibleEntry>
+\t\t\t{body}
+\t\t</Group>"""
+
+
+def document(protect):
+    otp = "otpauth://totp/Example:alice?secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ&period=30&digits=6&issuer=Example"
+
+    def mail_history():
+        return entry(protect, "mail", [
+            ("Title", "Mail"),
+            ("UserName", "alice"),
+            ("Password", "OldMail!Secret1", True),
+            ("URL", "https://mail.example.com"),
+            ("Notes", ""),
+        ], modified=kdbx_time(2024, 2, 1, 8))
+
+    mail = entry(protect, "mail", [
+        ("Notes", "Personal mail\nsecond line"),
+        ("Password", "Mail!Secret42", True),
+        ("Recovery email", "alice@backup.example.com"),
+        ("PIN", "4921", True),
+        ("Title", "Mail"),
+        ("URL", "https://mail.example.com"),
+        ("UserName", "alice"),
+        ("otp", otp, True),
+    ], tags="personal;email", history=mail_history)
+
+    vpn = entry(protect, "vpn", [
+        ("Notes", "R&D <lab> access"),
+        ("Password", "Vpn<Pass>&99", True),
+        ("Title", "VPN"),
+        ("URL", ""),
+        ("UserName", "bob"),
+    ], tags="work")
+    db = entry(protect, "db", [
+        ("Notes", ""),
+        ("Password", "Pr0d!Database", True),
+        ("Title", "db"),
+        ("URL", "https://db.example.com"),
+        ("UserName", "postgres"),
+        ("otp", "otpauth://totp/db?secret=JBSWY3DPEHPK3PXP&period=60&digits=8&algorithm=SHA256", True),
+    ])
+    trashed = entry(protect, "trashed", [
+        ("Password", "Deleted!Pass1", True),
+        ("Title", "Old account"),
+    ])
+
+    servers = group("servers", "Servers", db)
+    work = group("work", "Work", vpn + "\n\t\t\t" + servers)
+    recycle_bin = group("recycle-bin", "Recycle Bin", trashed, icon=43)
+    root = group("root", "Root", mail + "\n\t\t\t" + work + "\n\t\t\t" + recycle_bin)
+
+    changed = kdbx_time(2024, 1, 10, 9)
+    return f"""<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<KeePassFile>
+\t<Meta>
+\t\t<Generator>KeePassXC</Generator>
+\t\t<DatabaseName>Fixture</DatabaseName>
+\t\t<DatabaseNameChanged>{changed}</DatabaseNameChanged>
+\t\t<DatabaseDescription/>
+\t\t<DatabaseDescriptionChanged>{changed}</DatabaseDescriptionChanged>
+\t\t<DefaultUserName/>
+\t\t<DefaultUserNameChanged>{changed}</DefaultUserNameChanged>
+\t\t<MaintenanceHistoryDays>365</MaintenanceHistoryDays>
+\t\t<Color/>
+\t\t<MasterKeyChanged>{changed}</MasterKeyChanged>
+\t\t<MasterKeyChangeRec>-1</MasterKeyChangeRec>
+\t\t<MasterKeyChangeForce>-1</MasterKeyChangeForce>
+\t\t<MemoryProtection>
+\t\t\t<ProtectTitle>False</ProtectTitle>
+\t\t\t<ProtectUserName>False</ProtectUserName>
+\t\t\t<ProtectPassword>True</ProtectPassword>
+\t\t\t<ProtectURL>False</ProtectURL>
+\t\t\t<ProtectNotes>False</ProtectNotes>
+\t\t</MemoryProtection>
+\t\t<CustomIcons/>
+\t\t<RecycleBinEnabled>True</RecycleBinEnabled>
+\t\t<RecycleBinUUID>{uuid("recycle-bin")}</RecycleBinUUID>
+\t\t<RecycleBinChanged>{changed}</RecycleBinChanged>
+\t\t<EntryTemplatesGroup>AAAAAAAAAAAAAAAAAAAAAA==</EntryTemplatesGroup>
+\t\t<EntryTemplatesGroupChanged>{changed}</EntryTemplatesGroupChanged>
+\t\t<LastSelectedGroup>{uuid("root")}</LastSelectedGroup>
+\t\t<LastTopVisibleGroup>{uuid("root")}</LastTopVisibleGroup>
+\t\t<HistoryMaxItems>10</HistoryMaxItems>
+\t\t<HistoryMaxSize>6291456</HistoryMaxSize>
+\t\t<SettingsChanged>{changed}</SettingsChanged>
+\t\t<CustomData>
+\t\t\t<Item>
+\t\t\t\t<Key>KPXC_DECRYPTION_TIME_PREFERENCE</Key>
+\t\t\t\t<Value>1000</Value>
+\t\t\t</Item>
+\t\t</CustomData>
+\t</Meta>
+\t<Root>
+\t\t{root}
+\t\t<DeletedObjects>
+\t\t\t<DeletedObject>
+\t\t\t\t<UUID>{uuid("deleted")}</UUID>
+\t\t\t\t<DeletionTime>{changed}</DeletionTime>
+\t\t\t</DeletedObject>
+\t\t</DeletedObjects>
+\t</Root>
+</KeePassFile>
+"""
+
+
+def main():
+    master_seed = fixed("master seed", 32)
+    iv = fixed("iv", 16)
+    kdf_seed = fixed("kdf seed", 32)
+    inner_key = fixed("inner key", 64)
+
+    header = struct.pack("<III", 0x9AA2D903, 0xB54BFB67, 0x00040000)
+
+    def field(fid, data):
+        return bytes([fid]) + struct.pack("<I", len(data)) + data
+
+    kdf = variant_dict([
+        (0x42, "$UUID", KDF_AES),
+        (0x05, "R", struct.pack("<Q", AES_KDF_ROUNDS)),
+        (0x42, "S", kdf_seed),
+    ])
+    header += field(2, CIPHER_AES256)
+    header += field(3, struct.pack("<I", 1))
+    header += field(4, master_seed)
+    header += field(7, iv)
+    header += field(11, kdf)
+    header += field(0, b"\r\n\r\n")
+
+    composite = hashlib.sha256(hashlib.sha256(PASSWORD.encode()).digest()).digest()
+    left, right = composite[:16], composite[16:]
+    for _ in range(AES_KDF_ROUNDS):
+        left, right = aes_ecb(kdf_seed, left), aes_ecb(kdf_seed, right)
+    transformed = hashlib.sha256(left + right).digest()
+
+    enc_key = hashlib.sha256(master_seed + transformed).digest()
+    mac_key = hashlib.sha512(master_seed + transformed + b"\x01").digest()
+
+    def block_key(index):
+        return hashlib.sha512(struct.pack("<Q", index) + mac_key).digest()
+
+    inner = field(1, struct.pack("<I", 3)) + field(2, inner_key) + field(0, b"")
+    payload = inner + document(Protector(inner_key)).encode()
+    ciphertext = aes_cbc(enc_key, iv, gzip.compress(payload, mtime=0))
+
+    out = header + hashlib.sha256(header).digest()
+    out += hmac.new(block_key(0xFFFFFFFFFFFFFFFF), header, hashlib.sha256).digest()
+
+    blocks = [ciphertext[i:i + (1 << 20)] for i in range(0, len(ciphertext), 1 << 20)] + [b""]
+    for index, data in enumerate(blocks):
+        mac = hmac.new(block_key(index), struct.pack("<QI", index, len(data)) + data, hashlib.sha256)
+        out += mac.digest() + struct.pack("<i", len(data)) + data
+
+    with open(OUTPUT, "wb") as f:
+        f.write(out)
+
+
+if __name__ == "__main__":
+    main()
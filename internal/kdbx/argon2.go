@@ -0,0 +1,327 @@
+package kdbx
+
+import (
+	"encoding/binary"
+	"hash"
+	"sync"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// golang.org/x/crypto/argon2 only offers Argon2i and Argon2id, but most
+// KDBX 4 files are protected with Argon2d. This is Argon2 version 1.3 as
+// specified in RFC 9106, for all three variants so that it can be checked
+// against x/crypto.
+
+type argon2Mode uint32
+
+const (
+	argon2d argon2Mode = iota
+	argon2i
+	argon2id
+)
+
+const (
+	argon2Version    = 0x13
+	argon2SyncPoints = 4
+	// argon2BlockWords is the number of 64-bit words in a 1 KiB block.
+	argon2BlockWords = 128
+)
+
+type argon2Block [argon2BlockWords]uint64
+
+// argon2Key derives keyLen bytes from password with the given number of
+// passes, memory in KiB and lanes. secret and data are the optional key and
+// associated data of the Argon2 specification.
+func argon2Key(mode argon2Mode, password, salt, secret, data []byte, passes, memory uint32, lanes uint8, keyLen uint32) []byte {
+	h0 := argon2InitHash(mode, password, salt, secret, data, passes, memory, uint32(lanes), keyLen)
+
+	p := uint32(lanes)
+	memory = memory / (argon2SyncPoints * p) * (argon2SyncPoints * p)
+	if memory < 2*argon2SyncPoints*p {
+		memory = 2 * argon2SyncPoints * p
+	}
+
+	B := argon2InitBlocks(h0, memory, p)
+	argon2Fill(B, mode, passes, memory, p)
+
+	return argon2Extract(B, memory, p, keyLen)
+}
+
+func argon2InitHash(mode argon2Mode, password, salt, secret, data []byte, passes, memory, lanes, keyLen uint32) [blake2b.Size + 8]byte {
+	var h0 [blake2b.Size + 8]byte
+	var params [24]byte
+	var tmp [4]byte
+
+	b2, _ := blake2b.New512(nil)
+	binary.LittleEndian.PutUint32(params[0:4], lanes)
+	binary.LittleEndian.PutUint32(params[4:8], keyLen)
+	binary.LittleEndian.PutUint32(params[8:12], memory)
+	binary.LittleEndian.PutUint32(params[12:16], passes)
+	binary.LittleEndian.PutUint32(params[16:20], argon2Version)
+	binary.LittleEndian.PutUint32(params[20:24], uint32(mode))
+	b2.Write(params[:])
+	for _, input := range [][]byte{password, salt, secret, data} {
+		binary.LittleEndian.PutUint32(tmp[:], uint32(len(input)))
+		b2.Write(tmp[:])
+		b2.Write(input)
+	}
+	b2.Sum(h0[:0])
+
+	return h0
+}
+
+func argon2InitBlocks(h0 [blake2b.Size + 8]byte, memory, lanes uint32) []argon2Block {
+	var buf [1024]byte
+	B := make([]argon2Block, memory)
+	columns := memory / lanes
+
+	for lane := uint32(0); lane < lanes; lane++ {
+		binary.LittleEndian.PutUint32(h0[blake2b.Size+4:], lane)
+		for i := uint32(0); i < 2; i++ {
+			binary.LittleEndian.PutUint32(h0[blake2b.Size:], i)
+			argon2Hash(buf[:], h0[:])
+			block := &B[lane*columns+i]
+			for j := range block {
+				block[j] = binary.LittleEndian.Uint64(buf[j*8:])
+			}
+		}
+	}
+
+	return B
+}
+
+// argon2Fill runs every pass over memory. The lanes of a slice are
+// independent of each other and are filled in parallel.
+func argon2Fill(B []argon2Block, mode argon2Mode, passes, memory, lanes uint32) {
+	for pass := uint32(0); pass < passes; pass++ {
+		for slice := uint32(0); slice < argon2SyncPoints; slice++ {
+			var wg sync.WaitGroup
+			for lane := uint32(0); lane < lanes; lane++ {
+				wg.Add(1)
+				go func(lane uint32) {
+					defer wg.Done()
+					argon2FillSegment(B, mode, passes, memory, lanes, pass, slice, lane)
+				}(lane)
+			}
+			wg.Wait()
+		}
+	}
+}
+
+func argon2FillSegment(B []argon2Block, mode argon2Mode, passes, memory, lanes, pass, slice, lane uint32) {
+	columns := memory / lanes
+	segmentLength := columns / argon2SyncPoints
+
+	// Argon2i, and Argon2id in the first half of the first pass, pick
+	// reference blocks independently of the password.
+	independent := mode == argon2i || (mode == argon2id && pass == 0 && slice < argon2SyncPoints/2)
+
+	var addresses, input, zero argon2Block
+	nextAddresses := func() {
+		input[6]++
+		argon2Compress(&addresses, &input, &zero, false)
+		argon2Compress(&addresses, &addresses, &zero, false)
+	}
+	if independent {
+		input[0] = uint64(pass)
+		input[1] = uint64(lane)
+		input[2] = uint64(slice)
+		input[3] = uint64(memory)
+		input[4] = uint64(passes)
+		input[5] = uint64(mode)
+	}
+
+	index := uint32(0)
+	if pass == 0 && slice == 0 {
+		// The first two blocks of every lane come from the initial hash.
+		index = 2
+		if independent {
+			nextAddresses()
+		}
+	}
+
+	offset := lane*columns + slice*segmentLength + index
+	for ; index < segmentLength; index, offset = index+1, offset+1 {
+		prev := offset - 1
+		if index == 0 && slice == 0 {
+			prev += columns
+		}
+
+		var random uint64
+		if independent {
+			if index%argon2BlockWords == 0 {
+				nextAddresses()
+			}
+			random = addresses[index%argon2BlockWords]
+		} else {
+			random = B[prev][0]
+		}
+
+		ref := argon2RefIndex(random, columns, segmentLength, lanes, pass, slice, lane, index)
+		// Blocks are zero in the first pass, so XORing into them is the
+		// same as overwriting them.
+		argon2Compress(&B[offset], &B[prev], &B[ref], true)
+	}
+}
+
+// argon2RefIndex maps the pseudo-random value of a block to the block it
+// references, as described in section 3.4 of RFC 9106.
+func argon2RefIndex(random uint64, columns, segmentLength, lanes, pass, slice, lane, index uint32) uint32 {
+	refLane := uint32(random>>32) % lanes
+	if pass == 0 && slice == 0 {
+		refLane = lane
+	}
+
+	// The reference area is every finished block that may be referenced,
+	// starting at start.
+	area, start := 3*segmentLength, ((slice+1)%argon2SyncPoints)*segmentLength
+	if lane == refLane {
+		area += index
+	}
+	if pass == 0 {
+		area, start = slice*segmentLength, 0
+		if slice == 0 || lane == refLane {
+			area += index
+		}
+	}
+	if index == 0 || lane == refLane {
+		area--
+	}
+
+	x := random & 0xffffffff
+	x = x * x >> 32
+	x = uint64(area) * x >> 32
+	relative := uint64(area) - 1 - x
+
+	return refLane*columns + uint32((uint64(start)+relative)%uint64(columns))
+}
+
+func argon2Extract(B []argon2Block, memory, lanes, keyLen uint32) []byte {
+	columns := memory / lanes
+	final := B[columns-1]
+	for lane := uint32(1); lane < lanes; lane++ {
+		last := &B[lane*columns+columns-1]
+		for i := range final {
+			final[i] ^= last[i]
+		}
+	}
+
+	var buf [1024]byte
+	for i, word := range final {
+		binary.LittleEndian.PutUint64(buf[i*8:], word)
+	}
+
+	key := make([]byte, keyLen)
+	argon2Hash(key, buf[:])
+	return key
+}
+
+// argon2Hash is the variable-length hash function H' of RFC 9106.
+func argon2Hash(out, in []byte) {
+	var b2 hash.Hash
+	if len(out) < blake2b.Size {
+		b2, _ = blake2b.New(len(out), nil)
+	} else {
+		b2, _ = blake2b.New512(nil)
+	}
+
+	var buf [blake2b.Size]byte
+	binary.LittleEndian.PutUint32(buf[:4], uint32(len(out)))
+	b2.Write(buf[:4])
+	b2.Write(in)
+	if len(out) <= blake2b.Size {
+		b2.Sum(out[:0])
+		return
+	}
+
+	outLen := len(out)
+	b2.Sum(buf[:0])
+	copy(out, buf[:32])
+	out = out[32:]
+	for len(out) > blake2b.Size {
+		b2.Reset()
+		b2.Write(buf[:])
+		b2.Sum(buf[:0])
+		copy(out, buf[:32])
+		out = out[32:]
+	}
+
+	if outLen%blake2b.Size != 0 {
+		r := (outLen+31)/32 - 2
+		b2, _ = blake2b.New(outLen-32*r, nil)
+	} else {
+		b2.Reset()
+	}
+	b2.Write(buf[:])
+	b2.Sum(out[:0])
+}
+
+// argon2Compress is the compression function G. With xor, the result is
+// XORed into out as Argon2 1.3 requires for every pass after the first.
+func argon2Compress(out, x, y *argon2Block, xor bool) {
+	var r argon2Block
+	for i := range r {
+		r[i] = x[i] ^ y[i]
+	}
+	z := r
+
+	for i := 0; i < argon2BlockWords; i += 16 {
+		blamkaRound(&z[i], &z[i+1], &z[i+2], &z[i+3], &z[i+4], &z[i+5], &z[i+6], &z[i+7],
+			&z[i+8], &z[i+9], &z[i+10], &z[i+11], &z[i+12], &z[i+13], &z[i+14], &z[i+15])
+	}
+	for i := 0; i < argon2BlockWords/8; i += 2 {
+		blamkaRound(&z[i], &z[i+1], &z[16+i], &z[16+i+1], &z[32+i], &z[32+i+1], &z[48+i], &z[48+i+1],
+			&z[64+i], &z[64+i+1], &z[80+i], &z[80+i+1], &z[96+i], &z[96+i+1], &z[112+i], &z[112+i+1])
+	}
+
+	if xor {
+		for i := range out {
+			out[i] ^= r[i] ^ z[i]
+		}
+	} else {
+		for i := range out {
+			out[i] = r[i] ^ z[i]
+		}
+	}
+}
+
+// blamka is the BLAKE2b mixing function G with the multiplications that
+// Argon2 adds.
+func blamka(a, b, c, d uint64) (uint64, uint64, uint64, uint64) {
+	a += b + 2*uint64(uint32(a))*uint64(uint32(b))
+	d ^= a
+	d = d>>32 | d<<32
+	c += d + 2*uint64(uint32(c))*uint64(uint32(d))
+	b ^= c
+	b = b>>24 | b<<40
+	a += b + 2*uint64(uint32(a))*uint64(uint32(b))
+	d ^= a
+	d = d>>16 | d<<48
+	c += d + 2*uint64(uint32(c))*uint64(uint32(d))
+	b ^= c
+	b = b>>63 | b<<1
+	return a, b, c, d
+}
+
+func blamkaRound(t00, t01, t02, t03, t04, t05, t06, t07, t08, t09, t10, t11, t12, t13, t14, t15 *uint64) {
+	v00, v01, v02, v03 := *t00, *t01, *t02, *t03
+	v04, v05, v06, v07 := *t04, *t05, *t06, *t07
+	v08, v09, v10, v11 := *t08, *t09, *t10, *t11
+	v12, v13, v14, v15 := *t12, *t13, *t14, *t15
+
+	v00, v04, v08, v12 = blamka(v00, v04, v08, v12)
+	v01, v05, v09, v13 = blamka(v01, v05, v09, v13)
+	v02, v06, v10, v14 = blamka(v02, v06, v10, v14)
+	v03, v07, v11, v15 = blamka(v03, v07, v11, v15)
+
+	v00, v05, v10, v15 = blamka(v00, v05, v10, v15)
+	v01, v06, v11, v12 = blamka(v01, v06, v11, v12)
+	v02, v07, v08, v13 = blamka(v02, v07, v08, v13)
+	v03, v04, v09, v14 = blamka(v03, v04, v09, v14)
+
+	*t00, *t01, *t02, *t03 = v00, v01, v02, v03
+	*t04, *t05, *t06, *t07 = v04, v05, v06, v07
+	*t08, *t09, *t10, *t11 = v08, v09, v10, v11
+	*t12, *t13, *t14, *t15 = v12, v13, v14, v15
+}
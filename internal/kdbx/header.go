@@ -0,0 +1,336 @@
+package kdbx
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	signature1 = 0x9aa2d903
+	signature2 = 0xb54bfb67
+	// Version 4.0, with the major version in the upper half.
+	fileVersion4  = 0x00040000
+	majorVersion4 = 4
+)
+
+// Outer header field IDs.
+const (
+	headerEnd            = 0
+	headerCipherID       = 2
+	headerCompression    = 3
+	headerMasterSeed     = 4
+	headerEncryptionIV   = 7
+	headerKDFParameters  = 11
+	compressionNone      = 0
+	compressionGzip      = 1
+	variantDictVersion   = 0x0100
+	variantDictMajorMask = 0xff00
+)
+
+var (
+	cipherAES256   = mustUUID("31c1f2e6bf714350be5805216afc5aff")
+	cipherChaCha20 = mustUUID("d6038a2b8b6f4cb5a524339a31dbb59a")
+	kdfAES         = mustUUID("c9d9f39a628a4460bf740d08c18a4fea")
+	kdfArgon2d     = mustUUID("ef636ddf8c29444b91f7a9a403e30a0c")
+	kdfArgon2id    = mustUUID("9e298b1956db4773b23dfc3ec6f0a1e6")
+)
+
+func mustUUID(s string) [16]byte {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 16 {
+		panic("kdbx: invalid UUID " + s)
+	}
+	return [16]byte(b)
+}
+
+type header struct {
+	cipherID    [16]byte
+	compression uint32
+	masterSeed  []byte
+	iv          []byte
+	kdf         variantDict
+}
+
+func readHeader(r io.Reader) (*header, []byte, error) {
+	var raw bytes.Buffer
+	tr := io.TeeReader(r, &raw)
+
+	var start [3]uint32
+	if err := binary.Read(tr, binary.LittleEndian, &start); err != nil {
+		return nil, nil, fmt.Errorf("failed to read file signature: %w", err)
+	}
+	if start[0] != signature1 || start[1] != signature2 {
+		return nil, nil, ErrNotKDBX
+	}
+	if major := start[2] >> 16; major != majorVersion4 {
+		return nil, nil, fmt.Errorf("%w: KDBX version %d", ErrUnsupported, major)
+	}
+
+	h := &header{}
+	for {
+		var id uint8
+		var size uint32
+		if err := binary.Read(tr, binary.LittleEndian, &id); err != nil {
+			return nil, nil, fmt.Errorf("failed to read header: %w", err)
+		}
+		if err := binary.Read(tr, binary.LittleEndian, &size); err != nil {
+			return nil, nil, fmt.Errorf("failed to read header: %w", err)
+		}
+		if size > maxFieldSize {
+			return nil, nil, fmt.Errorf("header field %d is too large", id)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(tr, data); err != nil {
+			return nil, nil, fmt.Errorf("failed to read header: %w", err)
+		}
+
+		switch id {
+		case headerEnd:
+			return h, raw.Bytes(), h.validate()
+		case headerCipherID:
+			if len(data) != len(h.cipherID) {
+				return nil, nil, fmt.Errorf("invalid cipher ID")
+			}
+			copy(h.cipherID[:], data)
+		case headerCompression:
+			if len(data) != 4 {
+				return nil, nil, fmt.Errorf("invalid compression flags")
+			}
+			h.compression = binary.LittleEndian.Uint32(data)
+		case headerMasterSeed:
+			h.masterSeed = data
+		case headerEncryptionIV:
+			h.iv = data
+		case headerKDFParameters:
+			kdf, err := parseVariantDict(data)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid KDF parameters: %w", err)
+			}
+			h.kdf = kdf
+		}
+	}
+}
+
+func (h *header) validate() error {
+	switch {
+	case h.cipherID != cipherAES256 && h.cipherID != cipherChaCha20:
+		return fmt.Errorf("%w: cipher %x", ErrUnsupported, h.cipherID)
+	case h.compression != compressionNone && h.compression != compressionGzip:
+		return fmt.Errorf("%w: compression %d", ErrUnsupported, h.compression)
+	case len(h.masterSeed) != 32:
+		return fmt.Errorf("invalid master seed")
+	case h.cipherID == cipherAES256 && len(h.iv) != aes.BlockSize,
+		h.cipherID == cipherChaCha20 && len(h.iv) != 12:
+		return fmt.Errorf("invalid encryption IV")
+	case h.kdf == nil:
+		return fmt.Errorf("missing KDF parameters")
+	}
+	return nil
+}
+
+func (h *header) marshal() []byte {
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.LittleEndian, [3]uint32{signature1, signature2, fileVersion4})
+
+	field := func(id uint8, data []byte) {
+		buf.WriteByte(id)
+		_ = binary.Write(&buf, binary.LittleEndian, uint32(len(data)))
+		buf.Write(data)
+	}
+	field(headerCipherID, h.cipherID[:])
+	field(headerCompression, binary.LittleEndian.AppendUint32(nil, h.compression))
+	field(headerMasterSeed, h.masterSeed)
+	field(headerEncryptionIV, h.iv)
+	field(headerKDFParameters, h.kdf.marshal())
+	field(headerEnd, []byte("\r\n\r\n"))
+
+	return buf.Bytes()
+}
+
+// transformKey runs the key derivation function of the header over the
+// composite key.
+func (h *header) transformKey(compositeKey []byte) ([]byte, error) {
+	uuid, ok := h.kdf["$UUID"].([]byte)
+	if !ok || len(uuid) != 16 {
+		return nil, fmt.Errorf("missing KDF UUID")
+	}
+
+	switch [16]byte(uuid) {
+	case kdfArgon2d, kdfArgon2id:
+		salt, _ := h.kdf["S"].([]byte)
+		lanes, _ := h.kdf["P"].(uint32)
+		memory, _ := h.kdf["M"].(uint64)
+		passes, _ := h.kdf["I"].(uint64)
+		version, _ := h.kdf["V"].(uint32)
+		secret, _ := h.kdf["K"].([]byte)
+		data, _ := h.kdf["A"].([]byte)
+
+		switch {
+		case version != argon2Version:
+			return nil, fmt.Errorf("%w: Argon2 version %#x", ErrUnsupported, version)
+		case len(salt) == 0, lanes < 1, lanes > 255, memory < 8*1024, passes < 1:
+			return nil, fmt.Errorf("invalid Argon2 parameters")
+		case memory/1024 > maxArgon2Memory, passes > maxArgon2Passes:
+			return nil, fmt.Errorf("%w: Argon2 costs are too high", ErrUnsupported)
+		}
+
+		if [16]byte(uuid) == kdfArgon2id && len(secret) == 0 && len(data) == 0 {
+			return argon2.IDKey(compositeKey, salt, uint32(passes), uint32(memory/1024), uint8(lanes), 32), nil
+		}
+		mode := argon2d
+		if [16]byte(uuid) == kdfArgon2id {
+			mode = argon2id
+		}
+		return argon2Key(mode, compositeKey, salt, secret, data, uint32(passes), uint32(memory/1024), uint8(lanes), 32), nil
+
+	case kdfAES:
+		seed, _ := h.kdf["S"].([]byte)
+		rounds, _ := h.kdf["R"].(uint64)
+		switch {
+		case len(seed) != 32:
+			return nil, fmt.Errorf("invalid AES-KDF parameters")
+		case rounds > maxAESKDFRounds:
+			return nil, fmt.Errorf("%w: AES-KDF rounds are too high", ErrUnsupported)
+		}
+		block, err := aes.NewCipher(seed)
+		if err != nil {
+			return nil, err
+		}
+		key := bytes.Clone(compositeKey)
+		for range rounds {
+			block.Encrypt(key[:16], key[:16])
+			block.Encrypt(key[16:], key[16:])
+		}
+		sum := sha256.Sum256(key)
+		return sum[:], nil
+	}
+
+	return nil, fmt.Errorf("%w: KDF %x", ErrUnsupported, uuid)
+}
+
+// variantDict is the typed key/value map KDBX 4 stores KDF parameters in.
+// Values are uint32, uint64, bool, int32, int64, string or []byte.
+type variantDict map[string]any
+
+const (
+	variantEnd    = 0x00
+	variantUint32 = 0x04
+	variantUint64 = 0x05
+	variantBool   = 0x08
+	variantInt32  = 0x0c
+	variantInt64  = 0x0d
+	variantString = 0x18
+	variantBytes  = 0x42
+)
+
+func parseVariantDict(data []byte) (variantDict, error) {
+	r := bytes.NewReader(data)
+	var version uint16
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+		return nil, err
+	}
+	if version&variantDictMajorMask != variantDictVersion&variantDictMajorMask {
+		return nil, fmt.Errorf("%w: variant dictionary version %#x", ErrUnsupported, version)
+	}
+
+	readChunk := func() ([]byte, error) {
+		var size int32
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return nil, err
+		}
+		if size < 0 || int(size) > r.Len() {
+			return nil, fmt.Errorf("invalid variant dictionary")
+		}
+		chunk := make([]byte, size)
+		_, err := io.ReadFull(r, chunk)
+		return chunk, err
+	}
+
+	dict := variantDict{}
+	for {
+		kind, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if kind == variantEnd {
+			return dict, nil
+		}
+
+		key, err := readChunk()
+		if err != nil {
+			return nil, err
+		}
+		value, err := readChunk()
+		if err != nil {
+			return nil, err
+		}
+
+		size := map[byte]int{variantUint32: 4, variantUint64: 8, variantBool: 1, variantInt32: 4, variantInt64: 8}
+		if want, ok := size[kind]; ok && len(value) != want {
+			return nil, fmt.Errorf("invalid variant dictionary value %q", key)
+		}
+
+		switch kind {
+		case variantUint32:
+			dict[string(key)] = binary.LittleEndian.Uint32(value)
+		case variantUint64:
+			dict[string(key)] = binary.LittleEndian.Uint64(value)
+		case variantBool:
+			dict[string(key)] = value[0] != 0
+		case variantInt32:
+			dict[string(key)] = int32(binary.LittleEndian.Uint32(value))
+		case variantInt64:
+			dict[string(key)] = int64(binary.LittleEndian.Uint64(value))
+		case variantString:
+			dict[string(key)] = string(value)
+		case variantBytes:
+			dict[string(key)] = value
+		default:
+			return nil, errors.New("invalid variant dictionary type")
+		}
+	}
+}
+
+func (d variantDict) marshal() []byte {
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.LittleEndian, uint16(variantDictVersion))
+
+	// KDBX readers do not care about the order, but a stable one makes the
+	// header reproducible.
+	for _, key := range []string{"$UUID", "S", "P", "M", "I", "V", "R", "K", "A"} {
+		value, ok := d[key]
+		if !ok {
+			continue
+		}
+
+		var kind byte
+		var data []byte
+		switch v := value.(type) {
+		case uint32:
+			kind, data = variantUint32, binary.LittleEndian.AppendUint32(nil, v)
+		case uint64:
+			kind, data = variantUint64, binary.LittleEndian.AppendUint64(nil, v)
+		case []byte:
+			kind, data = variantBytes, v
+		default:
+			panic(fmt.Sprintf("kdbx: unsupported variant %T", value))
+		}
+
+		buf.WriteByte(kind)
+		_ = binary.Write(&buf, binary.LittleEndian, int32(len(key)))
+		buf.WriteString(key)
+		_ = binary.Write(&buf, binary.LittleEndian, int32(len(data)))
+		buf.Write(data)
+	}
+	buf.WriteByte(variantEnd)
+
+	return buf.Bytes()
+}
@@ -0,0 +1,432 @@
+// Package kdbx reads and writes KeePass KDBX 4 databases protected by a
+// password. Key files, attachments and entry history are not supported.
+package kdbx
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"golang.org/x/crypto/chacha20"
+)
+
+// Standard entry fields.
+const (
+	FieldTitle    = "Title"
+	FieldUserName = "UserName"
+	FieldPassword = "Password"
+	FieldURL      = "URL"
+	FieldNotes    = "Notes"
+)
+
+const (
+	maxFieldSize    = 1 << 20
+	maxArgon2Memory = 4 << 20
+	maxArgon2Passes = 1 << 16
+	// Around a minute of AES-KDF with hardware AES; KeePass calibrates a
+	// second to a few million rounds.
+	maxAESKDFRounds = 1 << 30
+	blockSize       = 1 << 20
+	// KeePass and KeePassXC write blocks of blockSize; larger ones are
+	// accepted up to a limit, so a damaged size cannot exhaust memory.
+	maxBlockSize = 64 << 20
+
+	// Inner header field IDs.
+	innerEnd          = 0
+	innerStreamID     = 1
+	innerStreamKey    = 2
+	innerStreamChaCha = 3
+
+	// Argon2id costs of written databases.
+	writeArgon2Passes = 3
+	writeArgon2Memory = 64 * 1024
+	writeArgon2Lanes  = 4
+)
+
+var (
+	ErrNotKDBX = errors.New("not a KeePass database")
+	// ErrInvalidCredentials means that the password is wrong, that the
+	// database also needs a key file, or that the file is damaged.
+	ErrInvalidCredentials = errors.New("wrong password, or the database needs a key file")
+	ErrUnsupported        = errors.New("unsupported KeePass database")
+	ErrCorrupted          = errors.New("KeePass database is damaged")
+)
+
+// Database is the content of a KDBX file. The root group holds every
+// other group and entry.
+type Database struct {
+	Name string
+	Root Group
+}
+
+type Group struct {
+	Name    string
+	Groups  []Group
+	Entries []Entry
+}
+
+type Entry struct {
+	Fields   []Field
+	Tags     []string
+	Modified time.Time
+}
+
+// Field is a string field of an entry. Protected fields, such as the
+// password, are encrypted a second time inside the database.
+type Field struct {
+	Key       string
+	Value     string
+	Protected bool
+}
+
+// Get returns the value of the field with the given key, or "".
+func (e *Entry) Get(key string) string {
+	for _, f := range e.Fields {
+		if f.Key == key {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// Read decrypts a KDBX 4 database. Entries in the recycle bin are left out.
+func Read(r io.Reader, password string) (*Database, error) {
+	h, rawHeader, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var headerHash, headerMAC [32]byte
+	if _, err := io.ReadFull(r, headerHash[:]); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorrupted, err)
+	}
+	if _, err := io.ReadFull(r, headerMAC[:]); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorrupted, err)
+	}
+	if sha256.Sum256(rawHeader) != headerHash {
+		return nil, fmt.Errorf("%w: header checksum mismatch", ErrCorrupted)
+	}
+
+	encKey, macKey, err := deriveKeys(h, password)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(headerHMAC(macKey, rawHeader), headerMAC[:]) {
+		return nil, ErrInvalidCredentials
+	}
+
+	ciphertext, err := readBlocks(r, macKey)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := decryptPayload(h, encKey, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.compression == compressionGzip {
+		gz, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCorrupted, err)
+		}
+		if payload, err = io.ReadAll(gz); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCorrupted, err)
+		}
+	}
+
+	stream, xmlData, err := readInnerHeader(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseXML(xmlData, stream)
+}
+
+// Write encrypts db as a KDBX 4 database with ChaCha20 and Argon2id.
+func Write(w io.Writer, db *Database, password string) error {
+	h, err := newHeader(cipherChaCha20, variantDict{
+		"$UUID": kdfArgon2id[:],
+		"P":     uint32(writeArgon2Lanes),
+		"M":     uint64(writeArgon2Memory * 1024),
+		"I":     uint64(writeArgon2Passes),
+		"V":     uint32(argon2Version),
+	})
+	if err != nil {
+		return err
+	}
+	return write(w, db, password, h)
+}
+
+// newHeader returns a header with fresh random seeds for the given cipher
+// and KDF parameters.
+func newHeader(cipherID [16]byte, kdf variantDict) (*header, error) {
+	h := &header{
+		cipherID:    cipherID,
+		compression: compressionGzip,
+		masterSeed:  make([]byte, 32),
+		iv:          make([]byte, 12),
+		kdf:         kdf,
+	}
+	if cipherID == cipherAES256 {
+		h.iv = make([]byte, aes.BlockSize)
+	}
+	kdf["S"] = make([]byte, 32)
+
+	for _, b := range [][]byte{h.masterSeed, h.iv, kdf["S"].([]byte)} {
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("failed to generate random data: %w", err)
+		}
+	}
+	return h, nil
+}
+
+func write(w io.Writer, db *Database, password string, h *header) error {
+	streamKey := make([]byte, 64)
+	if _, err := rand.Read(streamKey); err != nil {
+		return fmt.Errorf("failed to generate random data: %w", err)
+	}
+
+	encKey, macKey, err := deriveKeys(h, password)
+	if err != nil {
+		return err
+	}
+
+	xmlData, err := marshalXML(db, newInnerStream(streamKey))
+	if err != nil {
+		return err
+	}
+
+	var payload bytes.Buffer
+	gz := gzip.NewWriter(&payload)
+	inner := func(id uint8, data []byte) {
+		gz.Write([]byte{id})
+		_ = binary.Write(gz, binary.LittleEndian, uint32(len(data)))
+		gz.Write(data)
+	}
+	inner(innerStreamID, binary.LittleEndian.AppendUint32(nil, innerStreamChaCha))
+	inner(innerStreamKey, streamKey)
+	inner(innerEnd, nil)
+	gz.Write(xmlData)
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to compress database: %w", err)
+	}
+
+	ciphertext, err := encryptPayload(h, encKey, payload.Bytes())
+	if err != nil {
+		return err
+	}
+
+	rawHeader := h.marshal()
+	headerHash := sha256.Sum256(rawHeader)
+
+	var out bytes.Buffer
+	out.Write(rawHeader)
+	out.Write(headerHash[:])
+	out.Write(headerHMAC(macKey, rawHeader))
+	writeBlocks(&out, macKey, ciphertext)
+
+	if _, err := w.Write(out.Bytes()); err != nil {
+		return fmt.Errorf("failed to write database: %w", err)
+	}
+	return nil
+}
+
+// deriveKeys returns the payload encryption key and the base key of the
+// block HMACs.
+func deriveKeys(h *header, password string) ([]byte, []byte, error) {
+	passwordHash := sha256.Sum256([]byte(password))
+	compositeKey := sha256.Sum256(passwordHash[:])
+
+	transformed, err := h.transformKey(compositeKey[:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encKey := sha256.Sum256(append(bytes.Clone(h.masterSeed), transformed...))
+	macKey := sha512.Sum512(append(append(bytes.Clone(h.masterSeed), transformed...), 0x01))
+
+	return encKey[:], macKey[:], nil
+}
+
+func blockHMACKey(macKey []byte, index uint64) []byte {
+	key := sha512.Sum512(append(binary.LittleEndian.AppendUint64(nil, index), macKey...))
+	return key[:]
+}
+
+func headerHMAC(macKey, rawHeader []byte) []byte {
+	mac := hmac.New(sha256.New, blockHMACKey(macKey, math.MaxUint64))
+	mac.Write(rawHeader)
+	return mac.Sum(nil)
+}
+
+func blockHMAC(macKey []byte, index uint64, data []byte) []byte {
+	mac := hmac.New(sha256.New, blockHMACKey(macKey, index))
+	_ = binary.Write(mac, binary.LittleEndian, index)
+	_ = binary.Write(mac, binary.LittleEndian, uint32(len(data)))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// readBlocks reads the HMAC-authenticated blocks that hold the encrypted
+// payload, up to the empty block that ends them.
+func readBlocks(r io.Reader, macKey []byte) ([]byte, error) {
+	var payload bytes.Buffer
+	for index := uint64(0); ; index++ {
+		var mac [32]byte
+		var size int32
+		if _, err := io.ReadFull(r, mac[:]); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCorrupted, err)
+		}
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCorrupted, err)
+		}
+		if size < 0 || size > maxBlockSize {
+			return nil, fmt.Errorf("%w: invalid block size", ErrCorrupted)
+		}
+
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCorrupted, err)
+		}
+		if !hmac.Equal(blockHMAC(macKey, index, data), mac[:]) {
+			return nil, fmt.Errorf("%w: block %d fails authentication", ErrCorrupted, index)
+		}
+
+		if size == 0 {
+			return payload.Bytes(), nil
+		}
+		payload.Write(data)
+	}
+}
+
+func writeBlocks(w *bytes.Buffer, macKey, payload []byte) {
+	for index := uint64(0); ; index++ {
+		n := min(len(payload), blockSize)
+		data := payload[:n]
+		payload = payload[n:]
+
+		w.Write(blockHMAC(macKey, index, data))
+		_ = binary.Write(w, binary.LittleEndian, int32(len(data)))
+		w.Write(data)
+
+		if n == 0 {
+			return
+		}
+	}
+}
+
+func encryptPayload(h *header, key, plaintext []byte) ([]byte, error) {
+	if h.cipherID == cipherChaCha20 {
+		stream, err := chacha20.NewUnauthenticatedCipher(key, h.iv)
+		if err != nil {
+			return nil, err
+		}
+		ciphertext := make([]byte, len(plaintext))
+		stream.XORKeyStream(ciphertext, plaintext)
+		return ciphertext, nil
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	ciphertext := append(bytes.Clone(plaintext), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, h.iv).CryptBlocks(ciphertext, ciphertext)
+	return ciphertext, nil
+}
+
+func decryptPayload(h *header, key, ciphertext []byte) ([]byte, error) {
+	if h.cipherID == cipherChaCha20 {
+		stream, err := chacha20.NewUnauthenticatedCipher(key, h.iv)
+		if err != nil {
+			return nil, err
+		}
+		plaintext := make([]byte, len(ciphertext))
+		stream.XORKeyStream(plaintext, ciphertext)
+		return plaintext, nil
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("%w: invalid payload length", ErrCorrupted)
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, h.iv).CryptBlocks(plaintext, ciphertext)
+
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize || padding > len(plaintext) {
+		return nil, fmt.Errorf("%w: invalid padding", ErrCorrupted)
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
+
+// readInnerHeader reads the inner header in front of the XML document and
+// returns the stream that protected values are encrypted with.
+func readInnerHeader(payload []byte) (cipher.Stream, []byte, error) {
+	r := bytes.NewReader(payload)
+	var streamID uint32
+	var streamKey []byte
+
+	for {
+		var id uint8
+		var size uint32
+		if err := binary.Read(r, binary.LittleEndian, &id); err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", ErrCorrupted, err)
+		}
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", ErrCorrupted, err)
+		}
+		if int64(size) > int64(r.Len()) {
+			return nil, nil, fmt.Errorf("%w: invalid inner header", ErrCorrupted)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", ErrCorrupted, err)
+		}
+
+		switch id {
+		case innerEnd:
+			if streamID != innerStreamChaCha {
+				return nil, nil, fmt.Errorf("%w: inner stream %d", ErrUnsupported, streamID)
+			}
+			if len(streamKey) == 0 {
+				return nil, nil, fmt.Errorf("%w: missing inner stream key", ErrCorrupted)
+			}
+			return newInnerStream(streamKey), payload[len(payload)-r.Len():], nil
+		case innerStreamID:
+			if len(data) != 4 {
+				return nil, nil, fmt.Errorf("%w: invalid inner stream ID", ErrCorrupted)
+			}
+			streamID = binary.LittleEndian.Uint32(data)
+		case innerStreamKey:
+			streamKey = data
+		}
+	}
+}
+
+// newInnerStream returns the ChaCha20 stream that protected values are
+// encrypted with, in document order.
+func newInnerStream(key []byte) cipher.Stream {
+	h := sha512.Sum512(key)
+	stream, err := chacha20.NewUnauthenticatedCipher(h[:32], h[32:44])
+	if err != nil {
+		panic(err)
+	}
+	return stream
+}
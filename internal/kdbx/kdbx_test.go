@@ -0,0 +1,193 @@
+package kdbx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/argon2"
+)
+
+func TestArgon2(t *testing.T) {
+	// RFC 9106, section 5.
+	password := make([]byte, 32)
+	salt := make([]byte, 16)
+	secret := make([]byte, 8)
+	data := make([]byte, 12)
+	for i := range password {
+		password[i] = 0x01
+	}
+	for i := range salt {
+		salt[i] = 0x02
+	}
+	for i := range secret {
+		secret[i] = 0x03
+	}
+	for i := range data {
+		data[i] = 0x04
+	}
+
+	tc := []struct {
+		mode argon2Mode
+		want string
+	}{
+		{argon2d, "512b391b6f1162975371d30919734294f868e3be3984f3c1a13a4db9fabe4acb"},
+		{argon2i, "c814d9d1dc7f37aa13f0d77f2494bda1c8de6b016dd388d29952a4c4672b6ce8"},
+		{argon2id, "0d640df58d78766c08c037a34a8b53c9d01ef0452d75b65eb52520e96b01e659"},
+	}
+	for _, tt := range tc {
+		got := argon2Key(tt.mode, password, salt, secret, data, 3, 32, 4, 32)
+		require.Equal(t, tt.want, hex.EncodeToString(got), "mode %d", tt.mode)
+	}
+
+	// Uneven memory sizes, several passes and long keys, against x/crypto.
+	for _, params := range []struct {
+		passes, memory uint32
+		lanes          uint8
+		keyLen         uint32
+	}{
+		{1, 64, 1, 16},
+		{2, 100, 3, 64},
+		{3, 1024, 4, 100},
+		{1, 4096, 2, 32},
+	} {
+		got := argon2Key(argon2i, []byte("password"), []byte("somesalt"), nil, nil, params.passes, params.memory, params.lanes, params.keyLen)
+		require.Equal(t, argon2.Key([]byte("password"), []byte("somesalt"), params.passes, params.memory, params.lanes, params.keyLen), got)
+
+		got = argon2Key(argon2id, []byte("password"), []byte("somesalt"), nil, nil, params.passes, params.memory, params.lanes, params.keyLen)
+		require.Equal(t, argon2.IDKey([]byte("password"), []byte("somesalt"), params.passes, params.memory, params.lanes, params.keyLen), got)
+	}
+}
+
+func testDatabase() *Database {
+	modified := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	return &Database{
+		Name: "Team",
+		Root: Group{
+			Name: "Root",
+			Entries: []Entry{{
+				Fields: []Field{
+					{Key: FieldTitle, Value: "mail"},
+					{Key: FieldUserName, Value: "alice"},
+					{Key: FieldPassword, Value: "s3cret <&> \"pass\"", Protected: true},
+					{Key: FieldURL, Value: "https://mail.example.com"},
+					{Key: FieldNotes, Value: "line one\nline two"},
+					{Key: "PIN", Value: "1234", Protected: true},
+					{Key: "Empty", Value: "", Protected: true},
+				},
+				Tags:     []string{"work", "email"},
+				Modified: modified,
+			}},
+			Groups: []Group{{
+				Name: "Servers",
+				Groups: []Group{{
+					Name: "Prod",
+					Entries: []Entry{{
+						Fields:   []Field{{Key: FieldTitle, Value: "db"}, {Key: FieldPassword, Value: "Pr0d!", Protected: true}},
+						Modified: modified,
+					}},
+				}},
+			}},
+		},
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	argon2dParams := variantDict{"$UUID": kdfArgon2d[:], "P": uint32(2), "M": uint64(1024 * 1024), "I": uint64(2), "V": uint32(argon2Version)}
+	aesParams := variantDict{"$UUID": kdfAES[:], "R": uint64(1000)}
+
+	tc := []struct {
+		name   string
+		header func() (*header, error)
+	}{
+		{"default", nil},
+		{"aes with argon2d", func() (*header, error) { return newHeader(cipherAES256, argon2dParams) }},
+		{"chacha20 with aes-kdf", func() (*header, error) { return newHeader(cipherChaCha20, aesParams) }},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if tt.header == nil {
+				require.NoError(t, Write(&buf, testDatabase(), "correct horse"))
+			} else {
+				h, err := tt.header()
+				require.NoError(t, err)
+				require.NoError(t, write(&buf, testDatabase(), "correct horse", h))
+			}
+			data := buf.Bytes()
+
+			db, err := Read(bytes.NewReader(data), "correct horse")
+			require.NoError(t, err)
+			require.Equal(t, testDatabase(), db)
+
+			_, err = Read(bytes.NewReader(data), "wrong horse")
+			require.ErrorIs(t, err, ErrInvalidCredentials)
+
+			tampered := bytes.Clone(data)
+			tampered[len(tampered)-50] ^= 1
+			_, err = Read(bytes.NewReader(tampered), "correct horse")
+			require.ErrorIs(t, err, ErrCorrupted)
+		})
+	}
+
+	_, err := Read(bytes.NewReader([]byte("not a database at all")), "correct horse")
+	require.ErrorIs(t, err, ErrNotKDBX)
+
+	t.Run("limits", func(t *testing.T) {
+		h, err := newHeader(cipherChaCha20, variantDict{"$UUID": kdfAES[:], "R": uint64(maxAESKDFRounds + 1)})
+		require.NoError(t, err)
+		_, _, err = deriveKeys(h, "correct horse")
+		require.ErrorIs(t, err, ErrUnsupported)
+
+		h, err = newHeader(cipherChaCha20, variantDict{"$UUID": kdfAES[:], "R": uint64(1000)})
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		require.NoError(t, write(&buf, testDatabase(), "correct horse", h))
+
+		// The size of the first block follows the header, its SHA-256, its
+		// HMAC and the HMAC of the block.
+		data := buf.Bytes()
+		binary.LittleEndian.PutUint32(data[len(h.marshal())+3*32:], maxBlockSize+1)
+		_, err = Read(bytes.NewReader(data), "correct horse")
+		require.ErrorIs(t, err, ErrCorrupted)
+		require.ErrorContains(t, err, "invalid block size")
+	})
+}
+
+func TestTransformProtected(t *testing.T) {
+	// The key stream runs through protected values in document order,
+	// including those in parts of the document that are not read, such as
+	// the entry history.
+	doc := []byte(`<KeePassFile><Root><Group><Entry>` +
+		`<String><Key>Password</Key><Value Protected="True">first</Value></String>` +
+		`<History><Entry><String><Key>Password</Key><Value Protected="True">old</Value></String></Entry></History>` +
+		`</Entry><Entry><String><Key>Password</Key><Value Protected="True">second</Value></String></Entry>` +
+		`</Group></Root></KeePassFile>`)
+
+	key := bytes.Repeat([]byte{7}, 64)
+	encrypted, err := transformProtected(doc, newInnerStream(key), true)
+	require.NoError(t, err)
+	require.NotContains(t, string(encrypted), "second")
+
+	db, err := parseXML(encrypted, newInnerStream(key))
+	require.NoError(t, err)
+	require.Len(t, db.Root.Entries, 2)
+	require.Equal(t, "first", db.Root.Entries[0].Get(FieldPassword))
+	require.Equal(t, "second", db.Root.Entries[1].Get(FieldPassword))
+}
+
+func TestRecycleBin(t *testing.T) {
+	doc := []byte(`<KeePassFile><Meta><RecycleBinEnabled>True</RecycleBinEnabled><RecycleBinUUID>AQ==</RecycleBinUUID></Meta>` +
+		`<Root><Group><Name>Root</Name>` +
+		`<Group><UUID>AQ==</UUID><Name>Recycle Bin</Name><Entry><String><Key>Title</Key><Value>gone</Value></String></Entry></Group>` +
+		`<Group><UUID>Ag==</UUID><Name>Kept</Name></Group>` +
+		`</Group></Root></KeePassFile>`)
+
+	db, err := parseXML(doc, newInnerStream(make([]byte, 64)))
+	require.NoError(t, err)
+	require.Equal(t, []Group{{Name: "Kept"}}, db.Root.Groups)
+}
@@ -0,0 +1,328 @@
+package kdbx
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const generator = "hush"
+
+// epochOffset is the number of seconds between 0001-01-01, where KDBX 4
+// timestamps count from, and the Unix epoch.
+const epochOffset = 62135596800
+
+type xmlFile struct {
+	XMLName xml.Name `xml:"KeePassFile"`
+	Meta    xmlMeta  `xml:"Meta"`
+	Root    xmlRoot  `xml:"Root"`
+}
+
+type xmlMeta struct {
+	Generator         string               `xml:"Generator"`
+	DatabaseName      string               `xml:"DatabaseName"`
+	MemoryProtection  *xmlMemoryProtection `xml:"MemoryProtection,omitempty"`
+	RecycleBinEnabled string               `xml:"RecycleBinEnabled"`
+	RecycleBinUUID    string               `xml:"RecycleBinUUID,omitempty"`
+}
+
+type xmlMemoryProtection struct {
+	ProtectTitle    string `xml:"ProtectTitle"`
+	ProtectUserName string `xml:"ProtectUserName"`
+	ProtectPassword string `xml:"ProtectPassword"`
+	ProtectURL      string `xml:"ProtectURL"`
+	ProtectNotes    string `xml:"ProtectNotes"`
+}
+
+type xmlRoot struct {
+	Group xmlGroup `xml:"Group"`
+}
+
+type xmlGroup struct {
+	UUID       string     `xml:"UUID"`
+	Name       string     `xml:"Name"`
+	IconID     int        `xml:"IconID"`
+	Times      xmlTimes   `xml:"Times"`
+	IsExpanded string     `xml:"IsExpanded,omitempty"`
+	Entries    []xmlEntry `xml:"Entry"`
+	Groups     []xmlGroup `xml:"Group"`
+}
+
+type xmlEntry struct {
+	UUID    string      `xml:"UUID"`
+	IconID  int         `xml:"IconID"`
+	Tags    string      `xml:"Tags,omitempty"`
+	Times   xmlTimes    `xml:"Times"`
+	Strings []xmlString `xml:"String"`
+}
+
+type xmlTimes struct {
+	CreationTime         string `xml:"CreationTime"`
+	LastModificationTime string `xml:"LastModificationTime"`
+	LastAccessTime       string `xml:"LastAccessTime"`
+	ExpiryTime           string `xml:"ExpiryTime"`
+	Expires              string `xml:"Expires"`
+	UsageCount           int    `xml:"UsageCount"`
+	LocationChanged      string `xml:"LocationChanged"`
+}
+
+type xmlString struct {
+	Key   string   `xml:"Key"`
+	Value xmlValue `xml:"Value"`
+}
+
+type xmlValue struct {
+	Protected string `xml:"Protected,attr,omitempty"`
+	Text      string `xml:",chardata"`
+}
+
+func isTrue(s string) bool {
+	return strings.EqualFold(s, "true")
+}
+
+func boolString(b bool) string {
+	if b {
+		return "True"
+	}
+	return "False"
+}
+
+func formatTime(t time.Time) string {
+	seconds := t.Unix() + epochOffset
+	return base64.StdEncoding.EncodeToString(binary.LittleEndian.AppendUint64(nil, uint64(seconds)))
+}
+
+// parseTime reads a KDBX 4 timestamp, or the ISO 8601 ones of older
+// versions.
+func parseTime(s string) time.Time {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t
+	}
+
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(data) != 8 {
+		return time.Time{}
+	}
+	seconds := int64(binary.LittleEndian.Uint64(data))
+	return time.Unix(seconds-epochOffset, 0).UTC()
+}
+
+func newUUID() (string, error) {
+	uuid := make([]byte, 16)
+	if _, err := rand.Read(uuid); err != nil {
+		return "", fmt.Errorf("failed to generate UUID: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(uuid), nil
+}
+
+func parseXML(data []byte, stream cipher.Stream) (*Database, error) {
+	plain, err := transformProtected(data, stream, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var file xmlFile
+	if err := xml.Unmarshal(plain, &file); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorrupted, err)
+	}
+
+	recycleBin := ""
+	if isTrue(file.Meta.RecycleBinEnabled) {
+		recycleBin = file.Meta.RecycleBinUUID
+	}
+
+	return &Database{
+		Name: file.Meta.DatabaseName,
+		Root: convertGroup(file.Root.Group, recycleBin),
+	}, nil
+}
+
+func convertGroup(g xmlGroup, recycleBin string) Group {
+	group := Group{Name: g.Name}
+	for _, e := range g.Entries {
+		entry := Entry{Modified: parseTime(e.Times.LastModificationTime)}
+		for _, s := range e.Strings {
+			entry.Fields = append(entry.Fields, Field{Key: s.Key, Value: s.Value.Text, Protected: isTrue(s.Value.Protected)})
+		}
+		if e.Tags != "" {
+			entry.Tags = strings.FieldsFunc(e.Tags, func(r rune) bool { return r == ';' || r == ',' })
+		}
+		group.Entries = append(group.Entries, entry)
+	}
+	for _, sub := range g.Groups {
+		if recycleBin != "" && sub.UUID == recycleBin {
+			continue
+		}
+		group.Groups = append(group.Groups, convertGroup(sub, recycleBin))
+	}
+	return group
+}
+
+func marshalXML(db *Database, stream cipher.Stream) ([]byte, error) {
+	now := formatTime(time.Now().UTC())
+	root, err := buildGroup(db.Root, now)
+	if err != nil {
+		return nil, err
+	}
+	root.IsExpanded = "True"
+
+	file := xmlFile{
+		Meta: xmlMeta{
+			Generator:    generator,
+			DatabaseName: db.Name,
+			MemoryProtection: &xmlMemoryProtection{
+				ProtectTitle:    "False",
+				ProtectUserName: "False",
+				ProtectPassword: "True",
+				ProtectURL:      "False",
+				ProtectNotes:    "False",
+			},
+			RecycleBinEnabled: "False",
+		},
+		Root: xmlRoot{Group: root},
+	}
+
+	plain, err := xml.MarshalIndent(file, "", "\t")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode database: %w", err)
+	}
+	plain = append([]byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>`+"\n"), plain...)
+
+	return transformProtected(plain, stream, true)
+}
+
+func buildGroup(g Group, now string) (xmlGroup, error) {
+	uuid, err := newUUID()
+	if err != nil {
+		return xmlGroup{}, err
+	}
+	group := xmlGroup{UUID: uuid, Name: g.Name, Times: newTimes(now, now)}
+
+	for _, e := range g.Entries {
+		uuid, err := newUUID()
+		if err != nil {
+			return xmlGroup{}, err
+		}
+
+		modified := now
+		if !e.Modified.IsZero() {
+			modified = formatTime(e.Modified)
+		}
+		entry := xmlEntry{UUID: uuid, Tags: strings.Join(e.Tags, ";"), Times: newTimes(modified, now)}
+		for _, f := range e.Fields {
+			value := xmlValue{Text: f.Value}
+			if f.Protected {
+				value.Protected = "True"
+			}
+			entry.Strings = append(entry.Strings, xmlString{Key: f.Key, Value: value})
+		}
+		group.Entries = append(group.Entries, entry)
+	}
+
+	for _, sub := range g.Groups {
+		subGroup, err := buildGroup(sub, now)
+		if err != nil {
+			return xmlGroup{}, err
+		}
+		group.Groups = append(group.Groups, subGroup)
+	}
+
+	return group, nil
+}
+
+func newTimes(modified, now string) xmlTimes {
+	return xmlTimes{
+		CreationTime:         modified,
+		LastModificationTime: modified,
+		LastAccessTime:       now,
+		ExpiryTime:           now,
+		Expires:              "False",
+		LocationChanged:      now,
+	}
+}
+
+// transformProtected encrypts or decrypts the protected values of an XML
+// document. The values share one key stream in document order, so the
+// whole document has to be walked, including the parts that are ignored
+// afterwards.
+func transformProtected(data []byte, stream cipher.Stream, encrypt bool) ([]byte, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	var out bytes.Buffer
+	enc := xml.NewEncoder(&out)
+
+	var protected *strings.Builder
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCorrupted, err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "Value" && isTrue(attr(t, "Protected")) {
+				protected = &strings.Builder{}
+			}
+		case xml.CharData:
+			if protected != nil {
+				protected.Write(t)
+				continue
+			}
+		case xml.EndElement:
+			if protected != nil {
+				value, err := transformValue(protected.String(), stream, encrypt)
+				if err != nil {
+					return nil, err
+				}
+				if err := enc.EncodeToken(xml.CharData(value)); err != nil {
+					return nil, err
+				}
+				protected = nil
+			}
+		}
+
+		if err := enc.EncodeToken(xml.CopyToken(tok)); err != nil {
+			return nil, fmt.Errorf("failed to encode database: %w", err)
+		}
+	}
+
+	if err := enc.Flush(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func transformValue(value string, stream cipher.Stream, encrypt bool) (string, error) {
+	if encrypt {
+		data := []byte(value)
+		stream.XORKeyStream(data, data)
+		return base64.StdEncoding.EncodeToString(data), nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid protected value", ErrCorrupted)
+	}
+	stream.XORKeyStream(data, data)
+	return string(data), nil
+}
+
+func attr(e xml.StartElement, name string) string {
+	for _, a := range e.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
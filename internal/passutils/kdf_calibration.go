@@ -0,0 +1,76 @@
+package passutils
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const maxCalibrationTime = 64
+
+var measureKDF = defaultMeasureKDF
+
+func defaultMeasureKDF(params KDFParams) (time.Duration, error) {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	argon2.IDKey([]byte("hush calibration"), salt, params.Time, params.Memory, params.Threads, params.KeySize)
+	return time.Since(start), nil
+}
+
+// CalibrateKDF times Argon2id on this machine and returns parameters whose
+// derivation takes roughly target. Memory is raised first, up to maxMemory
+// KiB or MaxKDFMemory, because it is the more expensive cost for an
+// attacker; the time cost then makes up the rest. The result is never
+// weaker than the defaults. The measured duration of the returned
+// parameters is returned alongside.
+func CalibrateKDF(target time.Duration, maxMemory uint32) (KDFParams, time.Duration, error) {
+	params := DefaultKDFParams()
+	maxMemory = min(max(maxMemory, params.Memory), MaxKDFMemory)
+
+	base, err := measureKDF(params)
+	if err != nil {
+		return KDFParams{}, 0, fmt.Errorf("failed to measure kdf: %w", err)
+	}
+	if base <= 0 {
+		base = 1
+	}
+
+	perKiB := float64(base) / float64(params.Memory)
+	for params.Memory*2 <= maxMemory && time.Duration(perKiB*float64(params.Memory*2)) <= target {
+		params.Memory *= 2
+	}
+
+	perPass := time.Duration(perKiB * float64(params.Memory))
+	if perPass > 0 {
+		params.Time = uint32(min(max(target/perPass, 1), maxCalibrationTime))
+	}
+
+	elapsed, err := measureKDF(params)
+	if err != nil {
+		return KDFParams{}, 0, fmt.Errorf("failed to measure kdf: %w", err)
+	}
+
+	if params.Time > 1 && elapsed > target+target/4 {
+		for params.Time > 1 && elapsed > target+target/4 {
+			elapsed = elapsed * time.Duration(params.Time-1) / time.Duration(params.Time)
+			params.Time--
+		}
+		// The trimmed time cost is only an estimate until it is measured.
+		if elapsed, err = measureKDF(params); err != nil {
+			return KDFParams{}, 0, fmt.Errorf("failed to measure kdf: %w", err)
+		}
+	}
+
+	return params, elapsed, nil
+}
+
+func (p KDFParams) String() string {
+	return fmt.Sprintf("argon2id time=%d memory=%dMiB threads=%d", p.Time, p.Memory/1024, p.Threads)
+}
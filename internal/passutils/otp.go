@@ -0,0 +1,224 @@
+package passutils
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	OTPTypeTOTP = "totp"
+	OTPTypeHOTP = "hotp"
+
+	OTPAlgorithmSHA1   = "SHA1"
+	OTPAlgorithmSHA256 = "SHA256"
+	OTPAlgorithmSHA512 = "SHA512"
+
+	defaultOTPDigits = 6
+	defaultOTPPeriod = 30
+	minOTPDigits     = 6
+	maxOTPDigits     = 10
+)
+
+// OTPKey is a one-time password generator as described by an otpauth://
+// URI.
+type OTPKey struct {
+	Type      string
+	Label     string
+	Issuer    string
+	Secret    []byte
+	Algorithm string
+	Digits    int
+	// Period is the TOTP time step in seconds.
+	Period int
+	// Counter is the next HOTP counter value.
+	Counter uint64
+}
+
+// ParseOTP parses an otpauth:// URI or a bare base32 secret. A bare secret
+// is a TOTP key with the defaults most services use: SHA1, 6 digits and a
+// 30 second period.
+func ParseOTP(s string) (*OTPKey, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(strings.ToLower(s), "otpauth://") {
+		return parseOTPURI(s)
+	}
+
+	secret, err := decodeOTPSecret(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OTPKey{
+		Type:      OTPTypeTOTP,
+		Secret:    secret,
+		Algorithm: OTPAlgorithmSHA1,
+		Digits:    defaultOTPDigits,
+		Period:    defaultOTPPeriod,
+	}, nil
+}
+
+func parseOTPURI(s string) (*OTPKey, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid otpauth URI: %w", err)
+	}
+
+	key := &OTPKey{
+		Type:      strings.ToLower(u.Host),
+		Label:     strings.TrimPrefix(u.Path, "/"),
+		Algorithm: OTPAlgorithmSHA1,
+		Digits:    defaultOTPDigits,
+		Period:    defaultOTPPeriod,
+	}
+	if key.Type != OTPTypeTOTP && key.Type != OTPTypeHOTP {
+		return nil, fmt.Errorf("unsupported OTP type %q", u.Host)
+	}
+
+	query := u.Query()
+	key.Issuer = query.Get("issuer")
+
+	key.Secret, err = decodeOTPSecret(query.Get("secret"))
+	if err != nil {
+		return nil, err
+	}
+
+	if algorithm := query.Get("algorithm"); algorithm != "" {
+		key.Algorithm = strings.ToUpper(algorithm)
+	}
+
+	if digits := query.Get("digits"); digits != "" {
+		if key.Digits, err = strconv.Atoi(digits); err != nil {
+			return nil, fmt.Errorf("invalid OTP digits %q", digits)
+		}
+	}
+
+	if period := query.Get("period"); period != "" {
+		if key.Period, err = strconv.Atoi(period); err != nil {
+			return nil, fmt.Errorf("invalid OTP period %q", period)
+		}
+	}
+
+	counter := query.Get("counter")
+	switch {
+	case counter != "":
+		if key.Counter, err = strconv.ParseUint(counter, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid HOTP counter %q", counter)
+		}
+	case key.Type == OTPTypeHOTP:
+		return nil, fmt.Errorf("HOTP URI is missing the counter")
+	}
+
+	if err := key.Validate(); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func decodeOTPSecret(s string) ([]byte, error) {
+	s = strings.ToUpper(strings.Join(strings.Fields(s), ""))
+	s = strings.TrimRight(s, "=")
+	if s == "" {
+		return nil, fmt.Errorf("OTP secret cannot be empty")
+	}
+
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("OTP secret is not valid base32: %w", err)
+	}
+
+	return secret, nil
+}
+
+func (k *OTPKey) Validate() error {
+	if len(k.Secret) == 0 {
+		return fmt.Errorf("OTP secret cannot be empty")
+	}
+	if _, err := otpHash(k.Algorithm); err != nil {
+		return err
+	}
+	if k.Digits < minOTPDigits || k.Digits > maxOTPDigits {
+		return fmt.Errorf("OTP digits must be between %d and %d", minOTPDigits, maxOTPDigits)
+	}
+	if k.Type == OTPTypeTOTP && k.Period < 1 {
+		return fmt.Errorf("TOTP period must be at least 1 second")
+	}
+	return nil
+}
+
+// URI returns the otpauth:// URI for the key.
+func (k *OTPKey) URI() string {
+	query := url.Values{}
+	query.Set("secret", base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(k.Secret))
+	if k.Issuer != "" {
+		query.Set("issuer", k.Issuer)
+	}
+	query.Set("algorithm", k.Algorithm)
+	query.Set("digits", strconv.Itoa(k.Digits))
+	if k.Type == OTPTypeHOTP {
+		query.Set("counter", strconv.FormatUint(k.Counter, 10))
+	} else {
+		query.Set("period", strconv.Itoa(k.Period))
+	}
+
+	u := url.URL{Scheme: "otpauth", Host: k.Type, Path: "/" + k.Label, RawQuery: query.Encode()}
+	return u.String()
+}
+
+// TOTP returns the RFC 6238 code at t and how long it stays valid.
+func (k *OTPKey) TOTP(t time.Time) (string, time.Duration, error) {
+	period := int64(k.Period)
+	step := t.Unix() / period
+	next := time.Unix((step+1)*period, 0)
+
+	code, err := HOTP(k.Secret, uint64(step), k.Digits, k.Algorithm)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return code, next.Sub(t), nil
+}
+
+// HOTP returns the RFC 4226 code for counter.
+func HOTP(secret []byte, counter uint64, digits int, algorithm string) (string, error) {
+	newHash, err := otpHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(newHash, secret)
+	_ = binary.Write(mac, binary.BigEndian, counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := uint64(binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff)
+
+	modulus := uint64(1)
+	for range digits {
+		modulus *= 10
+	}
+
+	return fmt.Sprintf("%0*d", digits, value%modulus), nil
+}
+
+func otpHash(algorithm string) (func() hash.Hash, error) {
+	switch algorithm {
+	case OTPAlgorithmSHA1:
+		return sha1.New, nil
+	case OTPAlgorithmSHA256:
+		return sha256.New, nil
+	case OTPAlgorithmSHA512:
+		return sha512.New, nil
+	}
+	return nil, fmt.Errorf("unsupported OTP algorithm %q", algorithm)
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
@@ -15,17 +16,63 @@ import (
 
 	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/hkdf"
 	"golang.org/x/term"
 )
 
 const (
 	saltSize = 16
 	keySize  = 32
-	time     = 1
+	timeCost = 1
 	memory   = 64 * 1024
 	threads  = 4
 )
 
+// MaxKDFMemory is the largest Argon2id memory cost in KiB that hush derives
+// keys with, 4 GiB.
+const MaxKDFMemory = 4 * 1024 * 1024
+
+const (
+	KDFArgon2id     = "argon2id"
+	CipherAES256GCM = "aes-256-gcm"
+)
+
+type KDFParams struct {
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+	KeySize uint32 `json:"key_size"`
+}
+
+// LegacyKDFParams returns the parameters that vaults created before the
+// vault metadata file existed were derived with.
+func LegacyKDFParams() KDFParams {
+	return KDFParams{Time: timeCost, Memory: memory, Threads: threads, KeySize: keySize}
+}
+
+func DefaultKDFParams() KDFParams {
+	return KDFParams{Time: timeCost, Memory: memory, Threads: threads, KeySize: keySize}
+}
+
+func (p KDFParams) Validate() error {
+	if p.Time < 1 {
+		return fmt.Errorf("kdf time cost must be at least 1")
+	}
+	if p.Threads < 1 {
+		return fmt.Errorf("kdf parallelism must be at least 1")
+	}
+	if p.Memory < 8*uint32(p.Threads) {
+		return fmt.Errorf("kdf memory cost must be at least 8 KiB per thread")
+	}
+	if p.Memory > MaxKDFMemory {
+		return fmt.Errorf("kdf memory cost must be at most %d KiB", MaxKDFMemory)
+	}
+	if p.KeySize != keySize {
+		return fmt.Errorf("unsupported key size %d", p.KeySize)
+	}
+	return nil
+}
+
 func ReadPassword(reader io.Reader) (string, error) {
 	if f, ok := reader.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
 		bytePassword, err := term.ReadPassword(int(syscall.Stdin))
@@ -55,27 +102,82 @@ func VerifyMasterPassword(hashedPassword, password string) bool {
 	return err == nil
 }
 
-func DeriveKey(password string) ([]byte, string, error) {
+func GenerateSalt() (string, error) {
 	salt := make([]byte, saltSize)
 	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(salt), nil
+}
+
+func DeriveKey(password string) ([]byte, string, error) {
+	salt, err := GenerateSalt()
+	if err != nil {
 		return nil, "", err
 	}
 
-	key := argon2.IDKey([]byte(password), salt, time, memory, threads, keySize)
-	return key, hex.EncodeToString(salt), nil
+	key, err := DeriveKeyWithParams(password, salt, LegacyKDFParams())
+	return key, salt, err
 }
 
 func DeriveKeyWithSalt(password, saltHex string) ([]byte, error) {
+	return DeriveKeyWithParams(password, saltHex, LegacyKDFParams())
+}
+
+func DeriveKeyWithParams(password, saltHex string, params KDFParams) ([]byte, error) {
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+
 	salt, err := hex.DecodeString(saltHex)
 	if err != nil {
 		return nil, err
 	}
 
-	key := argon2.IDKey([]byte(password), salt, time, memory, threads, keySize)
+	key := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeySize)
 	return key, nil
 }
 
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// DeriveSubkey expands key into an independent subkey with HKDF-SHA256.
+func DeriveSubkey(key, salt []byte, info string) ([]byte, error) {
+	subkey := make([]byte, keySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte(info)), subkey); err != nil {
+		return nil, err
+	}
+	return subkey, nil
+}
+
+func WrapKey(key, wrappingKey []byte) (string, error) {
+	return EncryptPassword(string(key), wrappingKey)
+}
+
+func UnwrapKey(wrappedKey string, wrappingKey []byte) ([]byte, error) {
+	key, err := DecryptPassword(wrappedKey, wrappingKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("unwrapped key has invalid length")
+	}
+	return []byte(key), nil
+}
+
 func EncryptPassword(password string, key []byte) (string, error) {
+	return EncryptPasswordWithAD(password, key, nil)
+}
+
+// EncryptPasswordWithAD encrypts password like EncryptPassword and binds
+// additionalData to the ciphertext; the same data must be supplied to
+// DecryptPasswordWithAD.
+func EncryptPasswordWithAD(password string, key, additionalData []byte) (string, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return "", err
@@ -91,11 +193,15 @@ func EncryptPassword(password string, key []byte) (string, error) {
 		return "", err
 	}
 
-	ciphertext := gcm.Seal(nonce, nonce, []byte(password), nil)
+	ciphertext := gcm.Seal(nonce, nonce, []byte(password), additionalData)
 	return base64.StdEncoding.EncodeToString(ciphertext), nil
 }
 
 func DecryptPassword(encryptedPassword string, key []byte) (string, error) {
+	return DecryptPasswordWithAD(encryptedPassword, key, nil)
+}
+
+func DecryptPasswordWithAD(encryptedPassword string, key, additionalData []byte) (string, error) {
 	ciphertext, err := base64.StdEncoding.DecodeString(encryptedPassword)
 	if err != nil {
 		return "", err
@@ -117,7 +223,7 @@ func DecryptPassword(encryptedPassword string, key []byte) (string, error) {
 	}
 
 	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, additionalData)
 	if err != nil {
 		return "", err
 	}
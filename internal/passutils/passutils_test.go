@@ -1,8 +1,13 @@
 package passutils
 
 import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"math"
 	"testing"
 	"testing/quick"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -89,3 +94,222 @@ func TestGeneratePassword(t *testing.T) {
 		t.Errorf("test failed: %v", err)
 	}
 }
+
+func TestCalibrateKDF(t *testing.T) {
+	originalMeasureKDF := measureKDF
+	defer func() { measureKDF = originalMeasureKDF }()
+
+	// Pretend every pass over 64 MiB takes 50ms.
+	measureKDF = func(params KDFParams) (time.Duration, error) {
+		return time.Duration(params.Time) * time.Duration(params.Memory) * 50 * time.Millisecond / (64 * 1024), nil
+	}
+
+	tc := []struct {
+		name      string
+		target    time.Duration
+		maxMemory uint32
+		want      KDFParams
+	}{
+		{
+			name:      "memory bound",
+			target:    500 * time.Millisecond,
+			maxMemory: 256 * 1024,
+			want:      KDFParams{Time: 2, Memory: 256 * 1024, Threads: threads, KeySize: keySize},
+		},
+		{
+			name:      "memory raised first",
+			target:    500 * time.Millisecond,
+			maxMemory: 1024 * 1024,
+			want:      KDFParams{Time: 1, Memory: 512 * 1024, Threads: threads, KeySize: keySize},
+		},
+		{
+			name:      "memory capped",
+			target:    10 * time.Second,
+			maxMemory: math.MaxUint32,
+			want:      KDFParams{Time: 3, Memory: MaxKDFMemory, Threads: threads, KeySize: keySize},
+		},
+		{
+			name:      "never weaker than defaults",
+			target:    time.Millisecond,
+			maxMemory: 1024 * 1024,
+			want:      DefaultKDFParams(),
+		},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			got, elapsed, err := CalibrateKDF(tt.target, tt.maxMemory)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+			require.NoError(t, got.Validate())
+
+			measured, err := measureKDF(got)
+			require.NoError(t, err)
+			require.Equal(t, measured, elapsed)
+		})
+	}
+}
+
+func TestHOTP(t *testing.T) {
+	// RFC 4226, Appendix D.
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+
+	for counter, code := range want {
+		got, err := HOTP([]byte("12345678901234567890"), uint64(counter), 6, OTPAlgorithmSHA1)
+		require.NoError(t, err)
+		require.Equal(t, code, got)
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238, Appendix B.
+	secrets := map[string][]byte{
+		OTPAlgorithmSHA1:   []byte("12345678901234567890"),
+		OTPAlgorithmSHA256: []byte("12345678901234567890123456789012"),
+		OTPAlgorithmSHA512: []byte("1234567890123456789012345678901234567890123456789012345678901234"),
+	}
+
+	tc := []struct {
+		unix      int64
+		algorithm string
+		want      string
+	}{
+		{59, OTPAlgorithmSHA1, "94287082"},
+		{59, OTPAlgorithmSHA256, "46119246"},
+		{59, OTPAlgorithmSHA512, "90693936"},
+		{1111111109, OTPAlgorithmSHA1, "07081804"},
+		{1111111109, OTPAlgorithmSHA256, "68084774"},
+		{1111111109, OTPAlgorithmSHA512, "25091201"},
+		{1234567890, OTPAlgorithmSHA1, "89005924"},
+		{1234567890, OTPAlgorithmSHA256, "91819424"},
+		{1234567890, OTPAlgorithmSHA512, "93441116"},
+		{20000000000, OTPAlgorithmSHA1, "65353130"},
+		{20000000000, OTPAlgorithmSHA256, "77737706"},
+		{20000000000, OTPAlgorithmSHA512, "47863826"},
+	}
+
+	for _, tt := range tc {
+		key := &OTPKey{Type: OTPTypeTOTP, Secret: secrets[tt.algorithm], Algorithm: tt.algorithm, Digits: 8, Period: 30}
+		code, remaining, err := key.TOTP(time.Unix(tt.unix, 0))
+		require.NoError(t, err)
+		require.Equal(t, tt.want, code, "%s at %d", tt.algorithm, tt.unix)
+		require.Equal(t, time.Duration(30-tt.unix%30)*time.Second, remaining)
+	}
+
+	key := &OTPKey{Type: OTPTypeTOTP, Secret: secrets[OTPAlgorithmSHA1], Algorithm: OTPAlgorithmSHA1, Digits: 6, Period: 60}
+	code, remaining, err := key.TOTP(time.Unix(59, 0))
+	require.NoError(t, err)
+	require.Equal(t, "755224", code)
+	require.Equal(t, time.Second, remaining)
+}
+
+func TestParseOTP(t *testing.T) {
+	tc := []struct {
+		name    string
+		input   string
+		want    *OTPKey
+		wantErr bool
+	}{
+		{
+			name:  "bare secret",
+			input: "gezd gnbv gy3t qojq",
+			want:  &OTPKey{Type: OTPTypeTOTP, Secret: []byte("1234567890"), Algorithm: OTPAlgorithmSHA1, Digits: 6, Period: 30},
+		},
+		{
+			name:  "totp uri",
+			input: "otpauth://totp/Example:alice@example.com?secret=GEZDGNBVGY3TQOJQ&issuer=Example&algorithm=sha256&digits=8&period=60",
+			want: &OTPKey{
+				Type: OTPTypeTOTP, Label: "Example:alice@example.com", Issuer: "Example",
+				Secret: []byte("1234567890"), Algorithm: OTPAlgorithmSHA256, Digits: 8, Period: 60,
+			},
+		},
+		{
+			name:  "hotp uri",
+			input: "otpauth://hotp/alice?secret=GEZDGNBVGY3TQOJQ&counter=42",
+			want: &OTPKey{
+				Type: OTPTypeHOTP, Label: "alice", Secret: []byte("1234567890"),
+				Algorithm: OTPAlgorithmSHA1, Digits: 6, Period: 30, Counter: 42,
+			},
+		},
+		{name: "hotp without counter", input: "otpauth://hotp/alice?secret=GEZDGNBVGY3TQOJQ", wantErr: true},
+		{name: "unknown type", input: "otpauth://motp/alice?secret=GEZDGNBVGY3TQOJQ", wantErr: true},
+		{name: "unknown algorithm", input: "otpauth://totp/alice?secret=GEZDGNBVGY3TQOJQ&algorithm=MD5", wantErr: true},
+		{name: "too few digits", input: "otpauth://totp/alice?secret=GEZDGNBVGY3TQOJQ&digits=4", wantErr: true},
+		{name: "zero period", input: "otpauth://totp/alice?secret=GEZDGNBVGY3TQOJQ&period=0", wantErr: true},
+		{name: "missing secret", input: "otpauth://totp/alice", wantErr: true},
+		{name: "invalid base32", input: "not-base32!", wantErr: true},
+	}
+
+	for _, tt := range tc {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseOTP(tt.input)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+
+			reparsed, err := ParseOTP(got.URI())
+			require.NoError(t, err)
+			require.Equal(t, got, reparsed)
+		})
+	}
+}
+
+func TestEncryptedStream(t *testing.T) {
+	params := KDFParams{Time: 1, Memory: 64, Threads: 1, KeySize: keySize}
+	encrypt := func(t *testing.T, data []byte) []byte {
+		var buf bytes.Buffer
+		w, err := NewEncryptWriter(&buf, "export passphrase", params)
+		require.NoError(t, err)
+		// Odd write sizes cross chunk boundaries.
+		for len(data) > 0 {
+			n := min(len(data), 1000)
+			_, err := w.Write(data[:n])
+			require.NoError(t, err)
+			data = data[n:]
+		}
+		require.NoError(t, w.Close())
+		return buf.Bytes()
+	}
+	decrypt := func(data []byte, passphrase string) ([]byte, error) {
+		r, err := NewDecryptReader(bytes.NewReader(data), passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(r)
+	}
+
+	for _, size := range []int{0, 1, streamChunkSize - 1, streamChunkSize, streamChunkSize + 1, 3 * streamChunkSize} {
+		data := make([]byte, size)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+
+		encrypted := encrypt(t, data)
+		require.True(t, IsEncryptedStream(encrypted))
+		decrypted, err := decrypt(encrypted, "export passphrase")
+		require.NoError(t, err)
+		require.Equal(t, data, decrypted, "size %d", size)
+	}
+
+	encrypted := encrypt(t, bytes.Repeat([]byte("secret "), streamChunkSize))
+
+	_, err := decrypt(encrypted, "wrong passphrase")
+	require.ErrorIs(t, err, ErrDecrypt)
+
+	tampered := bytes.Clone(encrypted)
+	tampered[len(tampered)-100] ^= 1
+	_, err = decrypt(tampered, "export passphrase")
+	require.ErrorIs(t, err, ErrDecrypt)
+
+	// Cutting the data off after a full chunk must not pass for the end.
+	chunk := streamChunkSize + 16
+	_, err = decrypt(encrypted[:streamHeaderSize+chunk], "export passphrase")
+	require.ErrorIs(t, err, ErrDecrypt)
+	_, err = decrypt(encrypted[:len(encrypted)-1], "export passphrase")
+	require.ErrorIs(t, err, ErrDecrypt)
+
+	_, err = decrypt([]byte("plain text"), "export passphrase")
+	require.Error(t, err)
+}
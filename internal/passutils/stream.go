@@ -0,0 +1,247 @@
+package passutils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Encrypted streams start with a header holding the Argon2id parameters and
+// salt the key is derived with. The data follows in chunks sealed with
+// AES-256-GCM, each with its counter in the nonce and the header as
+// additional data; the last chunk is marked in the nonce as well, so that
+// dropping, reordering or cutting off chunks is detected.
+const (
+	streamMagic       = "HUSHENC\x01"
+	streamChunkSize   = 64 * 1024
+	streamNoncePrefix = 7
+	streamHeaderSize  = len(streamMagic) + 9 + saltSize + streamNoncePrefix
+	maxStreamKDFTime  = 64
+)
+
+// ErrDecrypt means that the passphrase is wrong or that the encrypted data
+// was damaged.
+var ErrDecrypt = errors.New("wrong passphrase, or the file is damaged")
+
+// IsEncryptedStream reports whether data starts like the output of
+// NewEncryptWriter.
+func IsEncryptedStream(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(streamMagic))
+}
+
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+	buf    []byte
+	chunk  uint32
+	err    error
+}
+
+// NewEncryptWriter encrypts everything written to it under passphrase.
+// Close must be called to write the last chunk; it does not close w.
+func NewEncryptWriter(w io.Writer, passphrase string, params KDFParams) (io.WriteCloser, error) {
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, streamHeaderSize)
+	header = append(header, streamMagic...)
+	header = binary.LittleEndian.AppendUint32(header, params.Time)
+	header = binary.LittleEndian.AppendUint32(header, params.Memory)
+	header = append(header, params.Threads)
+	random := make([]byte, saltSize+streamNoncePrefix)
+	if _, err := io.ReadFull(rand.Reader, random); err != nil {
+		return nil, err
+	}
+	header = append(header, random...)
+
+	aead, err := streamAEAD(passphrase, header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{
+		w:      w,
+		aead:   aead,
+		header: header,
+		nonce:  make([]byte, aead.NonceSize()),
+		buf:    make([]byte, 0, streamChunkSize),
+	}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+
+	n := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data arrives, because the
+		// last chunk is sealed differently.
+		if len(e.buf) == streamChunkSize {
+			if e.err = e.seal(false); e.err != nil {
+				return n, e.err
+			}
+		}
+		m := copy(e.buf[len(e.buf):streamChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+m]
+		p = p[m:]
+		n += m
+	}
+	return n, nil
+}
+
+func (e *encryptWriter) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	e.err = e.seal(true)
+	if e.err == nil {
+		e.err = errors.New("encrypted stream is closed")
+		return nil
+	}
+	return e.err
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	streamNonce(e.nonce, e.header, e.chunk, last)
+	e.chunk++
+	sealed := e.aead.Seal(nil, e.nonce, e.buf, e.header)
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+type decryptReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+	chunk  uint32
+	sealed []byte
+	plain  []byte
+	done   bool
+}
+
+// NewDecryptReader decrypts what NewEncryptWriter wrote. Every chunk is
+// authenticated before any of it is returned; reading fails with ErrDecrypt
+// when the passphrase is wrong or the data was tampered with or cut short.
+func NewDecryptReader(r io.Reader, passphrase string) (io.Reader, error) {
+	header := make([]byte, streamHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil || !IsEncryptedStream(header) {
+		return nil, fmt.Errorf("not an encrypted hush file")
+	}
+
+	aead, err := streamAEAD(passphrase, header)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &decryptReader{
+		r:      bufio.NewReader(r),
+		aead:   aead,
+		header: header,
+		nonce:  make([]byte, aead.NonceSize()),
+		sealed: make([]byte, streamChunkSize+aead.Overhead()),
+	}
+	// Open the first chunk right away, so that a wrong passphrase is
+	// reported before anything is done with the output.
+	if err := d.open(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) open() error {
+	n, err := io.ReadFull(d.r, d.sealed)
+	last := false
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		last = true
+	case errors.Is(err, io.EOF):
+		// The data ends before its last chunk.
+		return ErrDecrypt
+	case err != nil:
+		return err
+	default:
+		if _, err := d.r.Peek(1); errors.Is(err, io.EOF) {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	streamNonce(d.nonce, d.header, d.chunk, last)
+	d.chunk++
+	plain, err := d.aead.Open(d.sealed[:0], d.nonce, d.sealed[:n], d.header)
+	if err != nil {
+		return ErrDecrypt
+	}
+	d.plain = plain
+	d.done = last
+	return nil
+}
+
+func streamAEAD(passphrase string, header []byte) (cipher.AEAD, error) {
+	offset := len(streamMagic)
+	params := KDFParams{
+		Time:    binary.LittleEndian.Uint32(header[offset:]),
+		Memory:  binary.LittleEndian.Uint32(header[offset+4:]),
+		Threads: header[offset+8],
+		KeySize: keySize,
+	}
+	if err := params.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid encryption parameters: %w", err)
+	}
+	if params.Time > maxStreamKDFTime {
+		return nil, fmt.Errorf("encryption parameters are too costly")
+	}
+
+	salt := header[offset+9 : offset+9+saltSize]
+	key := argon2.IDKey([]byte(passphrase), salt, params.Time, params.Memory, params.Threads, params.KeySize)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// streamNonce is the nonce prefix from the header, the chunk counter and a
+// flag for the last chunk.
+func streamNonce(nonce, header []byte, chunk uint32, last bool) {
+	copy(nonce, header[streamHeaderSize-streamNoncePrefix:])
+	binary.BigEndian.PutUint32(nonce[streamNoncePrefix:], chunk)
+	nonce[len(nonce)-1] = 0
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+}